@@ -1,13 +1,30 @@
+// Package ast declares the types of the syntax tree of lily programs.
+//
+// # JSON
+//
+// Nodes marshal to JSON objects with a "type" member naming the node, such
+// as "binary_expression" or "let_statement", followed by the fields of the
+// node under lowercase names and its "position". Optional nodes and empty
+// lists may be null. A program additionally carries the [SchemaVersion] it
+// was written with as "version"; the version is increased whenever a name
+// changes or a field is added, and [Program.UnmarshalJSON] rejects other
+// versions.
+//
+// The format is described by the JSON Schema in schema.json, which is
+// generated from the node types by [JSONSchema].
 package ast
 
 import (
 	"bytes"
 	"encoding/json"
 	"reflect"
+
+	"github.com/tombuente/lily/token"
 )
 
 type Node interface {
 	node()
+	Pos() token.Pos // position of the first character of the node
 }
 
 type Expr interface {
@@ -20,81 +37,224 @@ type Stmt interface {
 	stmt()
 }
 
+// Pattern is the left-hand side of a [MatchArm].
+type Pattern interface {
+	Node
+	pattern()
+}
+
 type Program struct {
 	Stmts []Stmt `json:"statements"`
 }
 
 func (x *Program) node() {}
 
+func (x *Program) Pos() token.Pos {
+	return token.Pos{Line: 1, Column: 1}
+}
+
 type Ident struct {
-	Value string `json:"value"`
+	Value    string    `json:"value"`
+	Position token.Pos `json:"position"`
 }
 
 type Int struct {
-	Value int64 `json:"value"`
+	Value    int64     `json:"value"`
+	Position token.Pos `json:"position"`
 }
 
 type Bool struct {
-	Value bool `json:"value"`
+	Value    bool      `json:"value"`
+	Position token.Pos `json:"position"`
 }
 
 type String struct {
-	Value string `json:"value"`
+	Value    string    `json:"value"`
+	Position token.Pos `json:"position"`
 }
 
 type UnaryOp struct {
-	Op  string `json:"operator"`
-	Rhs Expr   `json:"value"`
+	Op       string    `json:"operator"`
+	Rhs      Expr      `json:"operand"`
+	Position token.Pos `json:"position"`
 }
 
 type BinaryOp struct {
-	Op    string `json:"operator"`
-	Left  Expr   `json:"left"`
-	Right Expr   `json:"right"`
+	Op       string    `json:"operator"`
+	Left     Expr      `json:"left"`
+	Right    Expr      `json:"right"`
+	Position token.Pos `json:"position"`
 }
 
 type If struct {
-	Condition   Expr
-	Consequence *BlockStmt
-	Alternative *BlockStmt
+	Condition   Expr       `json:"condition"`
+	Consequence *BlockStmt `json:"consequence"`
+	Alternative *BlockStmt `json:"alternative"` // nil if there is no else block
+	Position    token.Pos  `json:"position"`
 }
 
 type Function struct {
-	Params []*Ident   `json:"params"`
-	Body   *BlockStmt `json:"body"`
+	Params []Pattern `json:"parameters"` // *IdentPattern unless the parameter is destructured
+	// ParamTypes holds the annotations of the parameters by index, nil for
+	// parameters without one. It is nil if no parameter is annotated.
+	ParamTypes []TypeExpr `json:"parameter_types"`
+	Result     TypeExpr   `json:"result"` // nil if the result is not annotated
+	Body       *BlockStmt `json:"body"`
+	Position   token.Pos  `json:"position"`
 }
 
 type Call struct {
-	Lhs  Expr // Ident or Function
-	Args []Expr
+	Lhs      Expr      `json:"function"` // Ident or Function
+	Args     []Expr    `json:"arguments"`
+	Position token.Pos `json:"position"`
 }
 
 type Assignment struct {
-	Ident *Ident
-	Expr  Expr
-}
-
-func (x *Ident) expr()      {}
-func (x *Int) expr()        {}
-func (x *Bool) expr()       {}
-func (x *String) expr()     {}
-func (x *UnaryOp) expr()    {}
-func (x *BinaryOp) expr()   {}
-func (x *If) expr()         {}
-func (x *Function) expr()   {}
-func (x *Call) expr()       {}
-func (x *Assignment) expr() {}
-
-func (x *Ident) node()      {}
-func (x *Int) node()        {}
-func (x *Bool) node()       {}
-func (x *String) node()     {}
-func (x *UnaryOp) node()    {}
-func (x *BinaryOp) node()   {}
-func (x *If) node()         {}
-func (x *Function) node()   {}
-func (x *Call) node()       {}
-func (x *Assignment) node() {}
+	Ident    *Ident    `json:"identifier"`
+	Expr     Expr      `json:"value"`
+	Position token.Pos `json:"position"`
+}
+
+// [<expr>, <expr>]
+type ArrayLit struct {
+	Elems    []Expr    `json:"elements"`
+	Position token.Pos `json:"position"`
+}
+
+// <expr>[<index>]
+type Index struct {
+	Expr     Expr      `json:"expression"`
+	Index    Expr      `json:"index"`
+	Position token.Pos `json:"position"`
+}
+
+// <expr>.<field>
+type Selector struct {
+	Expr     Expr      `json:"expression"`
+	Field    *Ident    `json:"field"`
+	Position token.Pos `json:"position"`
+}
+
+// <target.expr>.<target.field> = <expr>
+type FieldAssignment struct {
+	Target   *Selector `json:"target"`
+	Expr     Expr      `json:"value"`
+	Position token.Pos `json:"position"`
+}
+
+// <target.expr>[<target.index>] = <expr>
+type IndexAssignment struct {
+	Target   *Index    `json:"target"`
+	Expr     Expr      `json:"value"`
+	Position token.Pos `json:"position"`
+}
+
+// <type>{<field>: <expr>, <field>: <expr>}
+type StructLit struct {
+	Type     *Ident        `json:"struct"`
+	Fields   []*FieldValue `json:"fields"`
+	Position token.Pos     `json:"position"`
+}
+
+// <name>: <expr> inside of a [StructLit]
+type FieldValue struct {
+	Name     *Ident    `json:"name"`
+	Value    Expr      `json:"value"`
+	Position token.Pos `json:"position"`
+}
+
+// match <subject> { <pattern> => <body>, <pattern> => <body> }
+type Match struct {
+	Subject  Expr        `json:"subject"`
+	Arms     []*MatchArm `json:"arms"`
+	Position token.Pos   `json:"position"`
+}
+
+// <pattern> => <body>
+type MatchArm struct {
+	Pattern  Pattern   `json:"pattern"`
+	Body     Stmt      `json:"body"` // *BlockStmt or *ExprStmt
+	Position token.Pos `json:"position"`
+}
+
+// <expr>?
+type Propagate struct {
+	Expr     Expr      `json:"expression"`
+	Position token.Pos `json:"position"`
+}
+
+// try { <body> } catch (<param>) { <catch> } finally { <finally> }
+type Try struct {
+	Body     *BlockStmt `json:"body"`
+	Param    *Ident     `json:"parameter"` // nil if there is no catch
+	Catch    *BlockStmt `json:"catch"`
+	Finally  *BlockStmt `json:"finally"`
+	Position token.Pos  `json:"position"`
+}
+
+func (x *Ident) expr()           {}
+func (x *Int) expr()             {}
+func (x *Bool) expr()            {}
+func (x *String) expr()          {}
+func (x *UnaryOp) expr()         {}
+func (x *BinaryOp) expr()        {}
+func (x *If) expr()              {}
+func (x *Function) expr()        {}
+func (x *Call) expr()            {}
+func (x *Assignment) expr()      {}
+func (x *Selector) expr()        {}
+func (x *Try) expr()             {}
+func (x *Propagate) expr()       {}
+func (x *FieldAssignment) expr() {}
+func (x *IndexAssignment) expr() {}
+func (x *StructLit) expr()       {}
+func (x *Match) expr()           {}
+func (x *ArrayLit) expr()        {}
+func (x *Index) expr()           {}
+
+func (x *Ident) node()           {}
+func (x *Int) node()             {}
+func (x *Bool) node()            {}
+func (x *String) node()          {}
+func (x *UnaryOp) node()         {}
+func (x *BinaryOp) node()        {}
+func (x *If) node()              {}
+func (x *Function) node()        {}
+func (x *Call) node()            {}
+func (x *Assignment) node()      {}
+func (x *Selector) node()        {}
+func (x *Try) node()             {}
+func (x *Propagate) node()       {}
+func (x *FieldAssignment) node() {}
+func (x *IndexAssignment) node() {}
+func (x *StructLit) node()       {}
+func (x *FieldValue) node()      {}
+func (x *Match) node()           {}
+func (x *MatchArm) node()        {}
+func (x *ArrayLit) node()        {}
+func (x *Index) node()           {}
+
+func (x *Ident) Pos() token.Pos           { return x.Position }
+func (x *Int) Pos() token.Pos             { return x.Position }
+func (x *Bool) Pos() token.Pos            { return x.Position }
+func (x *String) Pos() token.Pos          { return x.Position }
+func (x *UnaryOp) Pos() token.Pos         { return x.Position }
+func (x *BinaryOp) Pos() token.Pos        { return x.Position }
+func (x *If) Pos() token.Pos              { return x.Position }
+func (x *Function) Pos() token.Pos        { return x.Position }
+func (x *Call) Pos() token.Pos            { return x.Position }
+func (x *Assignment) Pos() token.Pos      { return x.Position }
+func (x *Selector) Pos() token.Pos        { return x.Position }
+func (x *Try) Pos() token.Pos             { return x.Position }
+func (x *Propagate) Pos() token.Pos       { return x.Position }
+func (x *FieldAssignment) Pos() token.Pos { return x.Position }
+func (x *IndexAssignment) Pos() token.Pos { return x.Position }
+func (x *StructLit) Pos() token.Pos       { return x.Position }
+func (x *FieldValue) Pos() token.Pos      { return x.Position }
+func (x *Match) Pos() token.Pos           { return x.Position }
+func (x *MatchArm) Pos() token.Pos        { return x.Position }
+func (x *ArrayLit) Pos() token.Pos        { return x.Position }
+func (x *Index) Pos() token.Pos           { return x.Position }
 
 func (x Ident) MarshalJSON() ([]byte, error) {
 	return addType(x, "identifier_expression")
@@ -136,33 +296,159 @@ func (x Assignment) MarshalJSON() ([]byte, error) {
 	return addType(x, "assignment_expression")
 }
 
+func (x Selector) MarshalJSON() ([]byte, error) {
+	return addType(x, "selector_expression")
+}
+
+func (x Try) MarshalJSON() ([]byte, error) {
+	return addType(x, "try_expression")
+}
+
+func (x Propagate) MarshalJSON() ([]byte, error) {
+	return addType(x, "propagate_expression")
+}
+
+func (x IndexAssignment) MarshalJSON() ([]byte, error) {
+	return addType(x, "index_assignment_expression")
+}
+
+func (x FieldAssignment) MarshalJSON() ([]byte, error) {
+	return addType(x, "field_assignment_expression")
+}
+
+func (x StructLit) MarshalJSON() ([]byte, error) {
+	return addType(x, "struct_literal_expression")
+}
+
+func (x FieldValue) MarshalJSON() ([]byte, error) {
+	return addType(x, "field_value")
+}
+
+func (x Match) MarshalJSON() ([]byte, error) {
+	return addType(x, "match_expression")
+}
+
+func (x MatchArm) MarshalJSON() ([]byte, error) {
+	return addType(x, "match_arm")
+}
+
+func (x ArrayLit) MarshalJSON() ([]byte, error) {
+	return addType(x, "array_literal_expression")
+}
+
+func (x Index) MarshalJSON() ([]byte, error) {
+	return addType(x, "index_expression")
+}
+
+// let <ident>: <type> = <expr>, or const <ident>: <type> = <expr> for
+// bindings that cannot be reassigned. The type is optional.
 type LetStmt struct {
-	Ident *Ident `json:"identifier"`
-	Expr  Expr   `json:"value"`
+	Const    bool      `json:"constant"`
+	Ident    *Ident    `json:"identifier"` // nil if Pattern is set
+	Pattern  Pattern   `json:"pattern"`    // set instead of Ident by destructuring lets
+	Type     TypeExpr  `json:"annotation"` // nil if the binding is not annotated
+	Expr     Expr      `json:"value"`
+	Position token.Pos `json:"position"`
 }
 
 type ReturnStmt struct {
-	Expr Expr `json:"value"`
+	Expr     Expr      `json:"value"`
+	Position token.Pos `json:"position"`
+}
+
+type ThrowStmt struct {
+	Expr     Expr      `json:"value"`
+	Position token.Pos `json:"position"`
+}
+
+// struct <name> { <field>, <field> }
+type StructStmt struct {
+	Name     *Ident    `json:"name"`
+	Fields   []*Ident  `json:"fields"`
+	Position token.Pos `json:"position"`
+}
+
+// fn (<receiver> <type>) <name>(<params>) { <body> }
+type MethodStmt struct {
+	Receiver *Ident    `json:"receiver"`
+	Type     *Ident    `json:"struct"`
+	Name     *Ident    `json:"name"`
+	Function *Function `json:"function"` // parameters and body, without the receiver
+	Position token.Pos `json:"position"`
+}
+
+// enum <name> { <variant>, <variant>(<field>, <field>) }
+type EnumStmt struct {
+	Name     *Ident     `json:"name"`
+	Variants []*Variant `json:"variants"`
+	Position token.Pos  `json:"position"`
+}
+
+// <name>(<field>, <field>) inside of an [EnumStmt]
+type Variant struct {
+	Name     *Ident    `json:"name"`
+	Fields   []*Ident  `json:"fields"` // nil for a variant without parentheses
+	Position token.Pos `json:"position"`
+}
+
+// import "<path>" as <name>
+type ImportStmt struct {
+	Path     *String   `json:"path"`
+	Name     *Ident    `json:"name"`
+	Position token.Pos `json:"position"`
+}
+
+// export <let, const, struct or enum statement>
+type ExportStmt struct {
+	Stmt     Stmt      `json:"statement"`
+	Position token.Pos `json:"position"`
 }
 
 type ExprStmt struct {
-	Expr Expr `json:"expression"`
+	Expr     Expr      `json:"expression"`
+	Position token.Pos `json:"position"`
 }
 
 type BlockStmt struct {
-	Stmts []Stmt `json:"statements"`
+	Stmts    []Stmt    `json:"statements"`
+	Position token.Pos `json:"position"`
 }
 
 func (x *LetStmt) stmt()    {}
 func (x *ReturnStmt) stmt() {}
+func (x *ThrowStmt) stmt()  {}
+func (x *StructStmt) stmt() {}
+func (x *MethodStmt) stmt() {}
+func (x *EnumStmt) stmt()   {}
+func (x *ImportStmt) stmt() {}
+func (x *ExportStmt) stmt() {}
 func (x *ExprStmt) stmt()   {}
 func (x *BlockStmt) stmt()  {}
 
 func (x *LetStmt) node()    {}
 func (x *ReturnStmt) node() {}
+func (x *ThrowStmt) node()  {}
+func (x *StructStmt) node() {}
+func (x *MethodStmt) node() {}
+func (x *EnumStmt) node()   {}
+func (x *Variant) node()    {}
+func (x *ImportStmt) node() {}
+func (x *ExportStmt) node() {}
 func (x *ExprStmt) node()   {}
 func (x *BlockStmt) node()  {}
 
+func (x *LetStmt) Pos() token.Pos    { return x.Position }
+func (x *ReturnStmt) Pos() token.Pos { return x.Position }
+func (x *ThrowStmt) Pos() token.Pos  { return x.Position }
+func (x *StructStmt) Pos() token.Pos { return x.Position }
+func (x *MethodStmt) Pos() token.Pos { return x.Position }
+func (x *EnumStmt) Pos() token.Pos   { return x.Position }
+func (x *Variant) Pos() token.Pos    { return x.Position }
+func (x *ImportStmt) Pos() token.Pos { return x.Position }
+func (x *ExportStmt) Pos() token.Pos { return x.Position }
+func (x *ExprStmt) Pos() token.Pos   { return x.Position }
+func (x *BlockStmt) Pos() token.Pos  { return x.Position }
+
 func (x LetStmt) MarshalJSON() ([]byte, error) {
 	return addType(x, "let_statement")
 }
@@ -171,6 +457,34 @@ func (x ReturnStmt) MarshalJSON() ([]byte, error) {
 	return addType(x, "return_statement")
 }
 
+func (x ThrowStmt) MarshalJSON() ([]byte, error) {
+	return addType(x, "throw_statement")
+}
+
+func (x StructStmt) MarshalJSON() ([]byte, error) {
+	return addType(x, "struct_statement")
+}
+
+func (x MethodStmt) MarshalJSON() ([]byte, error) {
+	return addType(x, "method_statement")
+}
+
+func (x EnumStmt) MarshalJSON() ([]byte, error) {
+	return addType(x, "enum_statement")
+}
+
+func (x Variant) MarshalJSON() ([]byte, error) {
+	return addType(x, "variant")
+}
+
+func (x ImportStmt) MarshalJSON() ([]byte, error) {
+	return addType(x, "import_statement")
+}
+
+func (x ExportStmt) MarshalJSON() ([]byte, error) {
+	return addType(x, "export_statement")
+}
+
 func (x ExprStmt) MarshalJSON() ([]byte, error) {
 	return addType(x, "expression_statement")
 }
@@ -179,17 +493,168 @@ func (x BlockStmt) MarshalJSON() ([]byte, error) {
 	return addType(x, "block_statement")
 }
 
+// _
+type WildcardPattern struct {
+	Position token.Pos `json:"position"`
+}
+
+// <ident> binds the matched value, unless ident names a variant without
+// fields, which it then matches.
+type IdentPattern struct {
+	Ident    *Ident    `json:"identifier"`
+	Position token.Pos `json:"position"`
+}
+
+// <int>, <string>, true or false
+type LiteralPattern struct {
+	Value    Expr      `json:"value"` // *Int, *String or *Bool
+	Position token.Pos `json:"position"`
+}
+
+// <variant>(<pattern>, <pattern>)
+type ConstructorPattern struct {
+	Name     *Ident    `json:"name"`
+	Args     []Pattern `json:"arguments"`
+	Position token.Pos `json:"position"`
+}
+
+// [<pattern>, <pattern>]
+type ArrayPattern struct {
+	Elems    []Pattern `json:"elements"`
+	Position token.Pos `json:"position"`
+}
+
+// {<field>, <field>: <pattern>}
+type ObjectPattern struct {
+	Fields   []*FieldPattern `json:"fields"`
+	Position token.Pos       `json:"position"`
+}
+
+// <name>: <pattern> inside of an [ObjectPattern]. The shorthand <name> is
+// parsed as <name>: <name>.
+type FieldPattern struct {
+	Name     *Ident    `json:"name"`
+	Pattern  Pattern   `json:"pattern"`
+	Position token.Pos `json:"position"`
+}
+
+func (x *WildcardPattern) pattern()    {}
+func (x *IdentPattern) pattern()       {}
+func (x *LiteralPattern) pattern()     {}
+func (x *ConstructorPattern) pattern() {}
+func (x *ArrayPattern) pattern()       {}
+func (x *ObjectPattern) pattern()      {}
+
+func (x *WildcardPattern) node()    {}
+func (x *IdentPattern) node()       {}
+func (x *LiteralPattern) node()     {}
+func (x *ConstructorPattern) node() {}
+func (x *ArrayPattern) node()       {}
+func (x *ObjectPattern) node()      {}
+func (x *FieldPattern) node()       {}
+
+func (x *WildcardPattern) Pos() token.Pos    { return x.Position }
+func (x *IdentPattern) Pos() token.Pos       { return x.Position }
+func (x *LiteralPattern) Pos() token.Pos     { return x.Position }
+func (x *ConstructorPattern) Pos() token.Pos { return x.Position }
+func (x *ArrayPattern) Pos() token.Pos       { return x.Position }
+func (x *ObjectPattern) Pos() token.Pos      { return x.Position }
+func (x *FieldPattern) Pos() token.Pos       { return x.Position }
+
+func (x WildcardPattern) MarshalJSON() ([]byte, error) {
+	return addType(x, "wildcard_pattern")
+}
+
+func (x IdentPattern) MarshalJSON() ([]byte, error) {
+	return addType(x, "identifier_pattern")
+}
+
+func (x LiteralPattern) MarshalJSON() ([]byte, error) {
+	return addType(x, "literal_pattern")
+}
+
+func (x ConstructorPattern) MarshalJSON() ([]byte, error) {
+	return addType(x, "constructor_pattern")
+}
+
+func (x ArrayPattern) MarshalJSON() ([]byte, error) {
+	return addType(x, "array_pattern")
+}
+
+func (x ObjectPattern) MarshalJSON() ([]byte, error) {
+	return addType(x, "object_pattern")
+}
+
+func (x FieldPattern) MarshalJSON() ([]byte, error) {
+	return addType(x, "field_pattern")
+}
+
+// TypeExpr is a type annotation, such as the type of a [LetStmt].
+type TypeExpr interface {
+	Node
+	typeExpr()
+}
+
+// <name>, such as int or the name of a struct
+type NamedType struct {
+	Name     *Ident    `json:"name"`
+	Position token.Pos `json:"position"`
+}
+
+// [<elem>]
+type ArrayType struct {
+	Elem     TypeExpr  `json:"element"`
+	Position token.Pos `json:"position"`
+}
+
+// fn(<param>, <param>): <result>
+type FuncType struct {
+	Params   []TypeExpr `json:"parameters"`
+	Result   TypeExpr   `json:"result"` // nil if the result is not annotated
+	Position token.Pos  `json:"position"`
+}
+
+func (x *NamedType) typeExpr() {}
+func (x *ArrayType) typeExpr() {}
+func (x *FuncType) typeExpr()  {}
+
+func (x *NamedType) node() {}
+func (x *ArrayType) node() {}
+func (x *FuncType) node()  {}
+
+func (x *NamedType) Pos() token.Pos { return x.Position }
+func (x *ArrayType) Pos() token.Pos { return x.Position }
+func (x *FuncType) Pos() token.Pos  { return x.Position }
+
+func (x NamedType) MarshalJSON() ([]byte, error) {
+	return addType(x, "named_type")
+}
+
+func (x ArrayType) MarshalJSON() ([]byte, error) {
+	return addType(x, "array_type")
+}
+
+func (x FuncType) MarshalJSON() ([]byte, error) {
+	return addType(x, "function_type")
+}
+
 func (x Program) MarshalJSON() ([]byte, error) {
-	return addType(x, "program")
+	return marshal(struct {
+		Type    string `json:"type"`
+		Version int    `json:"version"`
+		Stmts   []Stmt `json:"statements"`
+	}{"program", SchemaVersion, x.Stmts})
 }
 
 func addType(stmt any, typ string) ([]byte, error) {
 	value := reflect.ValueOf(stmt)
 	valueType := reflect.TypeOf(stmt)
 
+	// The field is not named Type, nodes such as StructLit have a field of
+	// that name.
 	fields := []reflect.StructField{
 		{
-			Name: "Type",
+			Name: "NodeType",
 			Type: reflect.TypeOf(""),
 			Tag:  reflect.StructTag(`json:"type"`),
 		},
@@ -200,7 +665,7 @@ func addType(stmt any, typ string) ([]byte, error) {
 	newType := reflect.StructOf(fields)
 
 	newValue := reflect.New(newType).Elem()
-	newValue.FieldByName("Type").SetString(typ)
+	newValue.Field(0).SetString(typ)
 	for i := range valueType.NumField() {
 		newValue.Field(i + 1).Set(value.Field(i))
 	}
@@ -0,0 +1,516 @@
+package ast_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+	"github.com/tombuente/lily/token"
+)
+
+func parse(t *testing.T, src string) *ast.Program {
+	t.Helper()
+	prog, err := parser.New(lexer.New(src)).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse program: %v", err)
+	}
+	return prog
+}
+
+// allNodes is a program using every node type.
+const allNodes = `
+	struct P { x, y };
+	fn (p P) sum() { p.x + p.y };
+	enum Opt { Some(v), None };
+	import "lib" as lib;
+	export const k = -1;
+	let [a, {b, c: d}] = [P{x: 1, y: 2}, lib.v];
+	let f = fn(n, [m]: [int]): fn(int): string { if n < 2 { return n } { throw "no" } };
+	let g: fn(P) = f;
+	a = b;
+	a.x = b[0] = f(1)?;
+	match a { Some(1) => true, [_] => { false }, {x} => x, q => q };
+	try { 1 } catch (e) { 2 } finally { 3 }
+`
+
+// TestWalkAll walks programs using every node type and checks that each
+// Visit of a node is matched by a Visit(nil).
+func TestWalkAll(t *testing.T) {
+	prog := parse(t, allNodes)
+
+	var stack []ast.Node
+	counts := make(map[string]int)
+	ast.Inspect(prog, func(node ast.Node) bool {
+		if node == nil {
+			stack = stack[:len(stack)-1]
+			return false
+		}
+		stack = append(stack, node)
+		counts[strings.TrimPrefix(fmt.Sprintf("%T", node), "*ast.")]++
+		return true
+	})
+	if len(stack) != 0 {
+		t.Fatalf("unbalanced Visit calls, remaining=%v", stack)
+	}
+
+	types := []string{
+		"Program", "Ident", "Int", "Bool", "String", "UnaryOp", "BinaryOp", "If", "Function",
+		"Call", "Assignment", "ArrayLit", "Index", "Selector", "FieldAssignment", "IndexAssignment",
+		"StructLit", "FieldValue", "Match", "MatchArm", "Propagate", "Try", "LetStmt", "ReturnStmt",
+		"ThrowStmt", "StructStmt", "MethodStmt", "EnumStmt", "Variant", "ImportStmt", "ExportStmt",
+		"ExprStmt", "BlockStmt", "WildcardPattern", "IdentPattern", "LiteralPattern",
+		"ConstructorPattern", "ArrayPattern", "ObjectPattern", "FieldPattern", "NamedType",
+		"ArrayType", "FuncType",
+	}
+	for _, typ := range types {
+		if counts[typ] == 0 {
+			t.Errorf("no %v visited", typ)
+		}
+	}
+}
+
+func TestInspect(t *testing.T) {
+	prog := parse(t, "let f = fn(x) { x + y }; f(a * b)")
+
+	var idents []string
+	ast.Inspect(prog, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.Function:
+			// Skip function bodies.
+			return false
+		case *ast.Ident:
+			idents = append(idents, node.Value)
+		}
+		return true
+	})
+
+	expected := []string{"f", "f", "a", "b"}
+	if !slices.Equal(idents, expected) {
+		t.Fatalf("want=%v, got=%v", expected, idents)
+	}
+}
+
+type depthVisitor struct {
+	depth  int
+	depths map[string]int
+}
+
+func (v depthVisitor) Visit(node ast.Node) ast.Visitor {
+	if ident, ok := node.(*ast.Ident); ok {
+		v.depths[ident.Value] = v.depth
+	}
+	return depthVisitor{depth: v.depth + 1, depths: v.depths}
+}
+
+func TestWalk(t *testing.T) {
+	prog := parse(t, "a; -b")
+
+	v := depthVisitor{depths: make(map[string]int)}
+	ast.Walk(v, prog)
+
+	// Program -> ExprStmt -> Ident and Program -> ExprStmt -> UnaryOp -> Ident
+	if v.depths["a"] != 2 || v.depths["b"] != 3 {
+		t.Fatalf("want depths a=2 and b=3, got=%v", v.depths)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		f        func(ast.Node) ast.Node
+		expected string
+	}{
+		{
+			name: "rename",
+			src:  "let x = 1; fn(y) { x + y }",
+			f: func(node ast.Node) ast.Node {
+				if ident, ok := node.(*ast.Ident); ok && ident.Value == "x" {
+					return &ast.Ident{Value: "z"}
+				}
+				return node
+			},
+			expected: "let z = 1; fn(y) { z + y }",
+		},
+		{
+			name: "fold bottom up",
+			src:  "1 + 2 * 3",
+			f: func(node ast.Node) ast.Node {
+				op, ok := node.(*ast.BinaryOp)
+				if !ok {
+					return node
+				}
+				left, lok := op.Left.(*ast.Int)
+				right, rok := op.Right.(*ast.Int)
+				if !lok || !rok {
+					return node
+				}
+				switch op.Op {
+				case "+":
+					return &ast.Int{Value: left.Value + right.Value}
+				case "*":
+					return &ast.Int{Value: left.Value * right.Value}
+				}
+				return node
+			},
+			expected: "7",
+		},
+		{
+			name: "remove statements",
+			src:  "let a = 1; a; fn() { 2; a; 3 }",
+			f: func(node ast.Node) ast.Node {
+				if stmt, ok := node.(*ast.ExprStmt); ok {
+					if ident, ok := stmt.Expr.(*ast.Ident); ok && ident.Value == "a" {
+						return nil
+					}
+				}
+				return node
+			},
+			expected: "let a = 1; fn() { 2; 3 }",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := ast.Rewrite(parse(t, tt.src), tt.f)
+			expected := parse(t, tt.expected)
+			if !ast.Equal(actual, expected) {
+				a, _ := ast.MarshalIndent(actual, "", "  ")
+				e, _ := ast.MarshalIndent(expected, "", "  ")
+				t.Fatalf("want=\n%s\ngot=\n%s", e, a)
+			}
+		})
+	}
+}
+
+func TestRewriteInvalidReplacement(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+
+	// A function body must stay a block.
+	ast.Rewrite(parse(t, "fn() { 1 }"), func(node ast.Node) ast.Node {
+		if _, ok := node.(*ast.BlockStmt); ok {
+			return &ast.ExprStmt{Expr: &ast.Int{Value: 1}}
+		}
+		return node
+	})
+}
+
+func TestUnmarshalRoundTrip(t *testing.T) {
+	tests := []string{
+		allNodes,
+		"let f = fn() {}; f()",
+		"enum E { A, B() }; match A { A => 1, B() => 2 }",
+		"try { 1 } finally {}; try { 2 } catch (e) {}",
+		"",
+	}
+
+	for _, src := range tests {
+		t.Run(src, func(t *testing.T) {
+			prog := parse(t, src)
+			data, err := json.Marshal(prog)
+			if err != nil {
+				t.Fatalf("Failed to marshal: %v", err)
+			}
+
+			var actual ast.Program
+			if err := json.Unmarshal(data, &actual); err != nil {
+				t.Fatalf("Failed to unmarshal: %v", err)
+			}
+			// Positions must survive as well.
+			if !reflect.DeepEqual(&actual, prog) {
+				a, _ := ast.MarshalIndent(actual, "", "  ")
+				e, _ := ast.MarshalIndent(prog, "", "  ")
+				t.Fatalf("want=\n%s\ngot=\n%s", e, a)
+			}
+
+			again, err := json.Marshal(actual)
+			if err != nil {
+				t.Fatalf("Failed to marshal: %v", err)
+			}
+			if string(again) != string(data) {
+				t.Fatalf("want=\n%s\ngot=\n%s", data, again)
+			}
+		})
+	}
+}
+
+func TestUnmarshalNode(t *testing.T) {
+	node, err := ast.UnmarshalNode([]byte(`{
+		"type": "binary_expression",
+		"operator": "+",
+		"left": {"type": "int_expression", "value": 1, "position": {"line": 1, "column": 1}},
+		"right": {"type": "identifier_expression", "value": "x", "position": {"line": 1, "column": 5}, "comment": "ignored"},
+		"position": {"line": 1, "column": 1}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+
+	expected := &ast.BinaryOp{
+		Op:       "+",
+		Left:     &ast.Int{Value: 1, Position: token.Pos{Line: 1, Column: 1}},
+		Right:    &ast.Ident{Value: "x", Position: token.Pos{Line: 1, Column: 5}},
+		Position: token.Pos{Line: 1, Column: 1},
+	}
+	if !reflect.DeepEqual(node, expected) {
+		t.Fatalf("want=%#v, got=%#v", expected, node)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		expected string
+	}{
+		{
+			name:     "missing type",
+			json:     `{"value": 1}`,
+			expected: "ast: node has no type",
+		},
+		{
+			name:     "unknown type",
+			json:     `{"type": "loop_statement"}`,
+			expected: `ast: unknown node type "loop_statement"`,
+		},
+		{
+			name:     "statement as expression",
+			json:     `{"type": "unary_expression", "operator": "-", "operand": {"type": "return_statement", "value": {"type": "int_expression", "value": 1, "position": {"line": 1, "column": 9}}, "position": {"line": 1, "column": 2}}, "position": {"line": 1, "column": 1}}`,
+			expected: "ast: unary_expression.operand: cannot use return_statement as ast.Expr",
+		},
+		{
+			name:     "nested",
+			json:     `{"type": "program", "version": 2, "statements": [{"type": "block_statement", "statements": [{"type": "int_expression", "value": 1, "position": {"line": 1, "column": 3}}], "position": {"line": 1, "column": 1}}]}`,
+			expected: "ast: program.statements: 0: block_statement.statements: 0: cannot use int_expression as ast.Stmt",
+		},
+		{
+			name:     "wrong node struct",
+			json:     `{"type": "call_expression", "function": {"type": "identifier_expression", "value": "f", "position": {"line": 1, "column": 1}}, "arguments": [{"type": "wildcard_pattern", "position": {"line": 1, "column": 3}}], "position": {"line": 1, "column": 1}}`,
+			expected: "ast: call_expression.arguments: 0: cannot use wildcard_pattern as ast.Expr",
+		},
+		{
+			name:     "program without version",
+			json:     `{"type": "program", "statements": []}`,
+			expected: "ast: program has no version",
+		},
+		{
+			name:     "unsupported version",
+			json:     `{"type": "program", "version": 99, "statements": []}`,
+			expected: "ast: unsupported schema version 99, want 2",
+		},
+		{
+			name:     "invalid value",
+			json:     `{"type": "int_expression", "value": "one"}`,
+			expected: "ast: int_expression.value: json: cannot unmarshal string into Go value of type int64",
+		},
+		{
+			name:     "missing value",
+			json:     `{"type": "int_expression", "position": {"line": 1, "column": 1}}`,
+			expected: "ast: int_expression: missing value",
+		},
+		{
+			name:     "null value",
+			json:     `{"type": "int_expression", "value": null, "position": {"line": 1, "column": 1}}`,
+			expected: "ast: int_expression.value: must not be null",
+		},
+		{
+			name:     "missing alternative",
+			json:     `{"type": "if_expression", "condition": {"type": "bool_expression", "value": true, "position": {"line": 1, "column": 4}}, "consequence": {"type": "block_statement", "statements": [], "position": {"line": 1, "column": 9}}, "position": {"line": 1, "column": 1}}`,
+			expected: "ast: if_expression: missing alternative",
+		},
+		{
+			name:     "missing column",
+			json:     `{"type": "int_expression", "value": 1, "position": {"line": 1}}`,
+			expected: "ast: int_expression.position: missing column",
+		},
+		{
+			name:     "null statement",
+			json:     `{"type": "program", "version": 2, "statements": [null]}`,
+			expected: "ast: program.statements: 0: must not be null",
+		},
+		{
+			name:     "null argument",
+			json:     `{"type": "call_expression", "function": {"type": "identifier_expression", "value": "f", "position": {"line": 1, "column": 1}}, "arguments": [null], "position": {"line": 1, "column": 1}}`,
+			expected: "ast: call_expression.arguments: 0: must not be null",
+		},
+		{
+			name:     "if without consequence",
+			json:     `{"type": "if_expression", "condition": {"type": "bool_expression", "value": true, "position": {"line": 1, "column": 4}}, "alternative": null, "position": {"line": 1, "column": 1}}`,
+			expected: "ast: if_expression: missing consequence",
+		},
+		{
+			name:     "function without body",
+			json:     `{"type": "function_expression", "parameters": [], "parameter_types": [], "result": null, "position": {"line": 1, "column": 1}}`,
+			expected: "ast: function_expression: missing body",
+		},
+		{
+			name:     "null body",
+			json:     `{"type": "function_expression", "parameters": [], "parameter_types": [], "result": null, "body": null, "position": {"line": 1, "column": 1}}`,
+			expected: "ast: function_expression.body: must not be null",
+		},
+		{
+			name:     "let without identifier or pattern",
+			json:     `{"type": "let_statement", "constant": false, "identifier": null, "pattern": null, "annotation": null, "value": {"type": "int_expression", "value": 1, "position": {"line": 1, "column": 9}}, "position": {"line": 1, "column": 1}}`,
+			expected: "ast: let_statement: needs either an identifier or a pattern",
+		},
+		{
+			name:     "catch without parameter",
+			json:     `{"type": "try_expression", "body": {"type": "block_statement", "statements": [], "position": {"line": 1, "column": 5}}, "parameter": null, "catch": {"type": "block_statement", "statements": [], "position": {"line": 1, "column": 18}}, "finally": null, "position": {"line": 1, "column": 1}}`,
+			expected: "ast: try_expression: needs both a parameter and a catch block or neither",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ast.UnmarshalNode([]byte(tt.json))
+			if err == nil {
+				t.Fatalf("expected error %q", tt.expected)
+			}
+			if err.Error() != tt.expected {
+				t.Fatalf("want=%q, got=%q", tt.expected, err.Error())
+			}
+		})
+	}
+}
+
+// TestUnmarshalRequired checks that every field the schema requires is
+// rejected when it is missing.
+func TestUnmarshalRequired(t *testing.T) {
+	schema, err := ast.JSONSchema()
+	if err != nil {
+		t.Fatalf("Failed to generate the schema: %v", err)
+	}
+	var s struct {
+		Defs map[string]struct {
+			Required []string `json:"required"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(schema, &s); err != nil {
+		t.Fatalf("Failed to unmarshal the schema: %v", err)
+	}
+
+	data, err := json.Marshal(parse(t, allNodes))
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	var prog any
+	if err := json.Unmarshal(data, &prog); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+
+	// Remove each required field of each object in turn, the rest of the
+	// program stays valid.
+	seen := make(map[string]bool)
+	var remove func(v any)
+	remove = func(v any) {
+		switch v := v.(type) {
+		case []any:
+			for _, elem := range v {
+				remove(elem)
+			}
+		case map[string]any:
+			def, ok := v["type"].(string)
+			if !ok {
+				def = "position"
+			}
+			seen[def] = true
+			for _, key := range s.Defs[def].Required {
+				value, ok := v[key]
+				if !ok {
+					t.Fatalf("%v has no %v", def, key)
+				}
+				delete(v, key)
+				data, err := json.Marshal(prog)
+				if err != nil {
+					t.Fatalf("Failed to marshal: %v", err)
+				}
+				if _, err := ast.UnmarshalNode(data); err == nil {
+					t.Errorf("%v without %v: expected an error", def, key)
+				}
+				v[key] = value
+				remove(value)
+			}
+		}
+	}
+	remove(prog)
+
+	for name, def := range s.Defs {
+		if def.Required != nil && !seen[name] {
+			t.Errorf("allNodes has no %v", name)
+		}
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	schema, err := ast.JSONSchema()
+	if err != nil {
+		t.Fatalf("Failed to generate the schema: %v", err)
+	}
+	stored, err := os.ReadFile("schema.json")
+	if err != nil {
+		t.Fatalf("Failed to read schema.json: %v", err)
+	}
+	if !bytes.Equal(schema, stored) {
+		t.Fatal("schema.json is out of date, run go generate")
+	}
+
+	var s struct {
+		Defs map[string]struct {
+			Properties map[string]any `json:"properties"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(schema, &s); err != nil {
+		t.Fatalf("Failed to unmarshal the schema: %v", err)
+	}
+
+	data, err := json.Marshal(parse(t, allNodes))
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	var prog any
+	if err := json.Unmarshal(data, &prog); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+
+	// Every node must have exactly the properties of its definition.
+	var check func(v any)
+	check = func(v any) {
+		switch v := v.(type) {
+		case []any:
+			for _, elem := range v {
+				check(elem)
+			}
+		case map[string]any:
+			typ, ok := v["type"].(string)
+			if !ok {
+				// A position.
+				return
+			}
+			def, ok := s.Defs[typ]
+			if !ok {
+				t.Errorf("no definition of %v", typ)
+				return
+			}
+			if actual, expected := slices.Sorted(maps.Keys(v)), slices.Sorted(maps.Keys(def.Properties)); !slices.Equal(actual, expected) {
+				t.Errorf("%v: want properties %v, got=%v", typ, expected, actual)
+			}
+			for _, field := range v {
+				check(field)
+			}
+		}
+	}
+	check(prog)
+}
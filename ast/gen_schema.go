@@ -0,0 +1,21 @@
+//go:build ignore
+
+// gen_schema writes the JSON Schema of the syntax tree to schema.json.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/tombuente/lily/ast"
+)
+
+func main() {
+	schema, err := ast.JSONSchema()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("schema.json", schema, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
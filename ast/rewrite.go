@@ -0,0 +1,194 @@
+package ast
+
+import "fmt"
+
+// Rewrite traverses an AST in depth-first order and replaces each node by
+// f(node), after the children of node have been rewritten. The tree is
+// modified in place; the rewritten root is returned.
+//
+// A replacement must fit where the node is used, for example an [Expr] for
+// an operand or a *[BlockStmt] for a function body, otherwise Rewrite
+// panics. If f returns nil for an element of a list, such as a statement of
+// a block, the element is removed; elsewhere the field is set to nil.
+func Rewrite(node Node, f func(Node) Node) Node {
+	switch n := node.(type) {
+	case *Program:
+		n.Stmts = rewriteList(n.Stmts, f)
+
+	// Expressions
+	case *Ident, *Int, *Bool, *String:
+		// nothing to do
+	case *UnaryOp:
+		n.Rhs = rewrite(n.Rhs, f)
+	case *BinaryOp:
+		n.Left = rewrite(n.Left, f)
+		n.Right = rewrite(n.Right, f)
+	case *If:
+		n.Condition = rewrite(n.Condition, f)
+		n.Consequence = rewrite(n.Consequence, f)
+		if n.Alternative != nil {
+			n.Alternative = rewrite(n.Alternative, f)
+		}
+	case *Function:
+		n.Params = rewriteList(n.Params, f)
+		for i, typ := range n.ParamTypes {
+			if typ != nil {
+				n.ParamTypes[i] = rewrite(typ, f)
+			}
+		}
+		if n.Result != nil {
+			n.Result = rewrite(n.Result, f)
+		}
+		n.Body = rewrite(n.Body, f)
+	case *Call:
+		n.Lhs = rewrite(n.Lhs, f)
+		n.Args = rewriteList(n.Args, f)
+	case *Assignment:
+		n.Ident = rewrite(n.Ident, f)
+		n.Expr = rewrite(n.Expr, f)
+	case *ArrayLit:
+		n.Elems = rewriteList(n.Elems, f)
+	case *Index:
+		n.Expr = rewrite(n.Expr, f)
+		n.Index = rewrite(n.Index, f)
+	case *Selector:
+		n.Expr = rewrite(n.Expr, f)
+		n.Field = rewrite(n.Field, f)
+	case *FieldAssignment:
+		n.Target = rewrite(n.Target, f)
+		n.Expr = rewrite(n.Expr, f)
+	case *IndexAssignment:
+		n.Target = rewrite(n.Target, f)
+		n.Expr = rewrite(n.Expr, f)
+	case *StructLit:
+		n.Type = rewrite(n.Type, f)
+		n.Fields = rewriteList(n.Fields, f)
+	case *FieldValue:
+		n.Name = rewrite(n.Name, f)
+		n.Value = rewrite(n.Value, f)
+	case *Match:
+		n.Subject = rewrite(n.Subject, f)
+		n.Arms = rewriteList(n.Arms, f)
+	case *MatchArm:
+		n.Pattern = rewrite(n.Pattern, f)
+		n.Body = rewrite(n.Body, f)
+	case *Propagate:
+		n.Expr = rewrite(n.Expr, f)
+	case *Try:
+		n.Body = rewrite(n.Body, f)
+		if n.Param != nil {
+			n.Param = rewrite(n.Param, f)
+		}
+		if n.Catch != nil {
+			n.Catch = rewrite(n.Catch, f)
+		}
+		if n.Finally != nil {
+			n.Finally = rewrite(n.Finally, f)
+		}
+
+	// Statements
+	case *LetStmt:
+		if n.Ident != nil {
+			n.Ident = rewrite(n.Ident, f)
+		}
+		if n.Pattern != nil {
+			n.Pattern = rewrite(n.Pattern, f)
+		}
+		if n.Type != nil {
+			n.Type = rewrite(n.Type, f)
+		}
+		n.Expr = rewrite(n.Expr, f)
+	case *ReturnStmt:
+		n.Expr = rewrite(n.Expr, f)
+	case *ThrowStmt:
+		n.Expr = rewrite(n.Expr, f)
+	case *StructStmt:
+		n.Name = rewrite(n.Name, f)
+		n.Fields = rewriteList(n.Fields, f)
+	case *MethodStmt:
+		n.Receiver = rewrite(n.Receiver, f)
+		n.Type = rewrite(n.Type, f)
+		n.Name = rewrite(n.Name, f)
+		n.Function = rewrite(n.Function, f)
+	case *EnumStmt:
+		n.Name = rewrite(n.Name, f)
+		n.Variants = rewriteList(n.Variants, f)
+	case *Variant:
+		n.Name = rewrite(n.Name, f)
+		if n.Fields != nil {
+			n.Fields = rewriteList(n.Fields, f)
+		}
+	case *ImportStmt:
+		n.Path = rewrite(n.Path, f)
+		n.Name = rewrite(n.Name, f)
+	case *ExportStmt:
+		n.Stmt = rewrite(n.Stmt, f)
+	case *ExprStmt:
+		n.Expr = rewrite(n.Expr, f)
+	case *BlockStmt:
+		n.Stmts = rewriteList(n.Stmts, f)
+
+	// Patterns
+	case *WildcardPattern:
+		// nothing to do
+	case *IdentPattern:
+		n.Ident = rewrite(n.Ident, f)
+	case *LiteralPattern:
+		n.Value = rewrite(n.Value, f)
+	case *ConstructorPattern:
+		n.Name = rewrite(n.Name, f)
+		n.Args = rewriteList(n.Args, f)
+	case *ArrayPattern:
+		n.Elems = rewriteList(n.Elems, f)
+	case *ObjectPattern:
+		n.Fields = rewriteList(n.Fields, f)
+	case *FieldPattern:
+		n.Name = rewrite(n.Name, f)
+		n.Pattern = rewrite(n.Pattern, f)
+
+	// Types
+	case *NamedType:
+		n.Name = rewrite(n.Name, f)
+	case *ArrayType:
+		n.Elem = rewrite(n.Elem, f)
+	case *FuncType:
+		n.Params = rewriteList(n.Params, f)
+		if n.Result != nil {
+			n.Result = rewrite(n.Result, f)
+		}
+
+	default:
+		panic(fmt.Sprintf("ast.Rewrite: unexpected node type %T", n))
+	}
+
+	return f(node)
+}
+
+// rewrite rewrites node, which is used as an N.
+func rewrite[N Node](node N, f func(Node) Node) N {
+	n, _ := replacement(node, Rewrite(node, f))
+	return n
+}
+
+func rewriteList[N Node](list []N, f func(Node) Node) []N {
+	res := list[:0]
+	for _, node := range list {
+		if n, ok := replacement(node, Rewrite(node, f)); ok {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+// replacement returns repl as the type N of node, or false if repl is nil.
+func replacement[N Node](node N, repl Node) (N, bool) {
+	if repl == nil {
+		var zero N
+		return zero, false
+	}
+	n, ok := repl.(N)
+	if !ok {
+		panic(fmt.Sprintf("ast.Rewrite: cannot replace %T with %T", node, repl))
+	}
+	return n, true
+}
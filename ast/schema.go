@@ -0,0 +1,162 @@
+package ast
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+
+	"github.com/tombuente/lily/token"
+)
+
+//go:generate go run gen_schema.go
+
+// SchemaVersion is the version of the JSON format of programs.
+//
+// Version 1 is the first versioned format, earlier dumps are not supported.
+// Version 2 adds type annotations.
+const SchemaVersion = 2
+
+// nullable lists the fields that are nil if the syntax they stand for is
+// left out. For lists, it is their elements that may be nil.
+var nullable = map[string]bool{
+	"If.Alternative":      true,
+	"Function.ParamTypes": true,
+	"Function.Result":     true,
+	"Try.Param":           true,
+	"Try.Catch":           true,
+	"Try.Finally":         true,
+	"LetStmt.Ident":       true,
+	"LetStmt.Pattern":     true,
+	"LetStmt.Type":        true,
+	"FuncType.Result":     true,
+}
+
+// categories are the interfaces used as field types, with the names of
+// their definitions in the JSON Schema.
+var categories = []struct {
+	typ  reflect.Type
+	name string
+}{
+	{reflect.TypeFor[Expr](), "expression"},
+	{reflect.TypeFor[Stmt](), "statement"},
+	{reflect.TypeFor[Pattern](), "pattern"},
+	{reflect.TypeFor[TypeExpr](), "type_expression"},
+}
+
+// JSONSchema returns the JSON Schema of the JSON of programs, see the
+// package documentation. The schema is stored in schema.json, run go
+// generate after changing a node.
+func JSONSchema() ([]byte, error) {
+	defs := map[string]any{
+		"position": map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"line":   map[string]any{"type": "integer"},
+				"column": map[string]any{"type": "integer"},
+			},
+			"required":             []string{"line", "column"},
+			"additionalProperties": false,
+		},
+	}
+
+	for _, c := range categories {
+		var names []string
+		for name, typ := range nodeTypes {
+			if typ.Implements(c.typ) {
+				names = append(names, name)
+			}
+		}
+		slices.Sort(names)
+
+		var refs []any
+		for _, name := range names {
+			refs = append(refs, ref(name))
+		}
+		defs[c.name] = map[string]any{"oneOf": refs}
+	}
+
+	for name, typ := range nodeTypes {
+		properties := map[string]any{
+			"type": map[string]any{"const": name},
+		}
+		required := []string{"type"}
+		if typ == programType {
+			properties["version"] = map[string]any{"const": SchemaVersion}
+			required = append(required, "version")
+		}
+
+		for i := range typ.Elem().NumField() {
+			field := typ.Elem().Field(i)
+			schema, err := fieldSchema(field.Type)
+			if err != nil {
+				return nil, fmt.Errorf("%v.%v: %w", typ.Elem().Name(), field.Name, err)
+			}
+			if nullable[typ.Elem().Name()+"."+field.Name] {
+				if field.Type.Kind() == reflect.Slice {
+					list := schema.(map[string]any)
+					list["items"] = orNull(list["items"])
+				} else {
+					schema = orNull(schema)
+				}
+			}
+			key := jsonName(field)
+			properties[key] = schema
+			required = append(required, key)
+		}
+
+		defs[name] = map[string]any{
+			"type":                 "object",
+			"properties":           properties,
+			"required":             required,
+			"additionalProperties": false,
+		}
+	}
+
+	return MarshalIndent(map[string]any{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "lily syntax tree",
+		"description": fmt.Sprintf("A lily program, version %v of the JSON format.", SchemaVersion),
+		"$ref":        "#/$defs/program",
+		"$defs":       defs,
+	}, "", "  ")
+}
+
+func fieldSchema(typ reflect.Type) (any, error) {
+	for _, c := range categories {
+		if typ == c.typ {
+			return ref(c.name), nil
+		}
+	}
+	if name, ok := typeNames[typ]; ok {
+		return ref(name), nil
+	}
+
+	switch typ.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}, nil
+	case reflect.Int64:
+		return map[string]any{"type": "integer"}, nil
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}, nil
+	case reflect.Slice:
+		items, err := fieldSchema(typ.Elem())
+		if err != nil {
+			return nil, err
+		}
+		// Empty lists may be nil.
+		return map[string]any{"type": []string{"array", "null"}, "items": items}, nil
+	case reflect.Struct:
+		if typ == reflect.TypeFor[token.Pos]() {
+			return ref("position"), nil
+		}
+	}
+	return nil, fmt.Errorf("no schema for type %v", typ)
+}
+
+func ref(name string) any {
+	return map[string]any{"$ref": "#/$defs/" + name}
+}
+
+func orNull(schema any) any {
+	return map[string]any{"oneOf": []any{schema, map[string]any{"type": "null"}}}
+}
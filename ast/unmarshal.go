@@ -0,0 +1,222 @@
+package ast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	nodeType    = reflect.TypeFor[Node]()
+	programType = reflect.TypeFor[*Program]()
+)
+
+// nodeTypes maps the "type" of the JSON of each node to its struct type, and
+// typeNames the other way around. The names are taken from the MarshalJSON
+// methods so that they cannot get out of sync.
+var nodeTypes, typeNames = func() (map[string]reflect.Type, map[reflect.Type]string) {
+	nodes := []Node{
+		&Program{},
+
+		&Ident{}, &Int{}, &Bool{}, &String{}, &UnaryOp{}, &BinaryOp{}, &If{}, &Function{},
+		&Call{}, &Assignment{}, &ArrayLit{}, &Index{}, &Selector{}, &FieldAssignment{},
+		&IndexAssignment{}, &StructLit{}, &FieldValue{}, &Match{}, &MatchArm{}, &Propagate{},
+		&Try{},
+
+		&LetStmt{}, &ReturnStmt{}, &ThrowStmt{}, &StructStmt{}, &MethodStmt{}, &EnumStmt{},
+		&Variant{}, &ImportStmt{}, &ExportStmt{}, &ExprStmt{}, &BlockStmt{},
+
+		&WildcardPattern{}, &IdentPattern{}, &LiteralPattern{}, &ConstructorPattern{},
+		&ArrayPattern{}, &ObjectPattern{}, &FieldPattern{},
+
+		&NamedType{}, &ArrayType{}, &FuncType{},
+	}
+
+	types := make(map[string]reflect.Type, len(nodes))
+	names := make(map[reflect.Type]string, len(nodes))
+	for _, node := range nodes {
+		data, err := json.Marshal(node)
+		if err != nil {
+			panic(err)
+		}
+		var v struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			panic(err)
+		}
+		typ := reflect.TypeOf(node)
+		types[v.Type] = typ
+		names[typ] = v.Type
+	}
+	return types, names
+}()
+
+// UnmarshalJSON reconstructs a program from the JSON produced by its
+// MarshalJSON method.
+func (x *Program) UnmarshalJSON(data []byte) error {
+	node, err := UnmarshalNode(data)
+	if err != nil {
+		return err
+	}
+	prog, ok := node.(*Program)
+	if !ok {
+		return fmt.Errorf("ast: cannot use %v as program", typeNames[reflect.TypeOf(node)])
+	}
+	*x = *prog
+	return nil
+}
+
+// UnmarshalNode reconstructs a node from its JSON, as produced by the
+// MarshalJSON methods of the nodes. The type of each node is taken from its
+// "type" field, fields that do not belong to the type are ignored. All
+// fields of the type must be given, as in [JSONSchema], and only those for
+// syntax that can be left out may be null, as may lists. It returns nil for
+// the JSON null.
+func UnmarshalNode(data []byte) (Node, error) {
+	node, err := unmarshalNode(data)
+	if err != nil {
+		return nil, fmt.Errorf("ast: %w", err)
+	}
+	return node, nil
+}
+
+func unmarshalNode(data []byte) (Node, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, nil
+	}
+
+	var name string
+	if raw, ok := fields["type"]; !ok {
+		return nil, errors.New("node has no type")
+	} else if err := json.Unmarshal(raw, &name); err != nil {
+		return nil, fmt.Errorf("type: %w", err)
+	}
+	typ, ok := nodeTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown node type %q", name)
+	}
+
+	if typ == programType {
+		var version int
+		if raw, ok := fields["version"]; !ok {
+			return nil, errors.New("program has no version")
+		} else if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, fmt.Errorf("version: %w", err)
+		}
+		if version != SchemaVersion {
+			return nil, fmt.Errorf("unsupported schema version %v, want %v", version, SchemaVersion)
+		}
+	}
+
+	node := reflect.New(typ.Elem())
+	for i := range typ.Elem().NumField() {
+		field := typ.Elem().Field(i)
+		key := jsonName(field)
+		raw, ok := fields[key]
+		if !ok {
+			return nil, fmt.Errorf("%v: missing %v", name, key)
+		}
+		optional := nullable[typ.Elem().Name()+"."+field.Name]
+		if err := unmarshalValue(raw, node.Elem().Field(i), optional); err != nil {
+			return nil, fmt.Errorf("%v.%v: %w", name, key, err)
+		}
+	}
+	if err := checkNode(node.Interface().(Node)); err != nil {
+		return nil, fmt.Errorf("%v: %w", name, err)
+	}
+	return node.Interface().(Node), nil
+}
+
+// checkNode checks the constraints between the nullable fields of node,
+// which the parser guarantees.
+func checkNode(node Node) error {
+	switch node := node.(type) {
+	case *LetStmt:
+		if (node.Ident == nil) == (node.Pattern == nil) {
+			return errors.New("needs either an identifier or a pattern")
+		}
+	case *Try:
+		if (node.Param == nil) != (node.Catch == nil) {
+			return errors.New("needs both a parameter and a catch block or neither")
+		}
+	}
+	return nil
+}
+
+// unmarshalValue decodes data into v, a field of a node or an element of
+// such a field. Nodes may only be null if nullable is set, lists are
+// always.
+func unmarshalValue(data json.RawMessage, v reflect.Value, nullable bool) error {
+	switch {
+	case v.Type().Implements(nodeType):
+		node, err := unmarshalNode(data)
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			if !nullable {
+				return errNull
+			}
+			v.SetZero()
+			return nil
+		}
+		nv := reflect.ValueOf(node)
+		if !nv.Type().AssignableTo(v.Type()) {
+			return fmt.Errorf("cannot use %v as %v", typeNames[nv.Type()], v.Type())
+		}
+		v.Set(nv)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Implements(nodeType):
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return err
+		}
+		if elems == nil {
+			v.SetZero()
+			return nil
+		}
+		v.Set(reflect.MakeSlice(v.Type(), len(elems), len(elems)))
+		for i, elem := range elems {
+			if err := unmarshalValue(elem, v.Index(i), nullable); err != nil {
+				return fmt.Errorf("%v: %w", i, err)
+			}
+		}
+	case string(data) == "null" && v.Kind() != reflect.Slice:
+		return errNull
+	case v.Kind() == reflect.Struct:
+		// Positions, which need all their fields as well.
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		for i := range v.NumField() {
+			key := jsonName(v.Type().Field(i))
+			if raw, ok := fields[key]; !ok {
+				return fmt.Errorf("missing %v", key)
+			} else if string(raw) == "null" {
+				return fmt.Errorf("%v: %w", key, errNull)
+			}
+		}
+		return json.Unmarshal(data, v.Addr().Interface())
+	default:
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+	return nil
+}
+
+var errNull = errors.New("must not be null")
+
+// jsonName returns the key of field in the JSON of its node.
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
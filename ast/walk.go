@@ -0,0 +1,194 @@
+package ast
+
+import "fmt"
+
+// A Visitor's Visit method is invoked for each node encountered by [Walk].
+// If the result visitor w is not nil, Walk visits each of the children of
+// node with the visitor w, followed by a call of w.Visit(nil).
+type Visitor interface {
+	Visit(node Node) (w Visitor)
+}
+
+// Walk traverses an AST in depth-first order: It starts by calling
+// v.Visit(node); node must not be nil. If the visitor w returned by
+// v.Visit(node) is not nil, Walk is invoked recursively with visitor w for
+// each of the non-nil children of node, followed by a call of w.Visit(nil).
+// Children are visited in source order.
+func Walk(v Visitor, node Node) {
+	if v = v.Visit(node); v == nil {
+		return
+	}
+
+	switch n := node.(type) {
+	case *Program:
+		walkList(v, n.Stmts)
+
+	// Expressions
+	case *Ident, *Int, *Bool, *String:
+		// nothing to do
+	case *UnaryOp:
+		Walk(v, n.Rhs)
+	case *BinaryOp:
+		Walk(v, n.Left)
+		Walk(v, n.Right)
+	case *If:
+		Walk(v, n.Condition)
+		Walk(v, n.Consequence)
+		if n.Alternative != nil {
+			Walk(v, n.Alternative)
+		}
+	case *Function:
+		for i, param := range n.Params {
+			Walk(v, param)
+			if i < len(n.ParamTypes) && n.ParamTypes[i] != nil {
+				Walk(v, n.ParamTypes[i])
+			}
+		}
+		if n.Result != nil {
+			Walk(v, n.Result)
+		}
+		Walk(v, n.Body)
+	case *Call:
+		Walk(v, n.Lhs)
+		walkList(v, n.Args)
+	case *Assignment:
+		Walk(v, n.Ident)
+		Walk(v, n.Expr)
+	case *ArrayLit:
+		walkList(v, n.Elems)
+	case *Index:
+		Walk(v, n.Expr)
+		Walk(v, n.Index)
+	case *Selector:
+		Walk(v, n.Expr)
+		Walk(v, n.Field)
+	case *FieldAssignment:
+		Walk(v, n.Target)
+		Walk(v, n.Expr)
+	case *IndexAssignment:
+		Walk(v, n.Target)
+		Walk(v, n.Expr)
+	case *StructLit:
+		Walk(v, n.Type)
+		walkList(v, n.Fields)
+	case *FieldValue:
+		Walk(v, n.Name)
+		Walk(v, n.Value)
+	case *Match:
+		Walk(v, n.Subject)
+		walkList(v, n.Arms)
+	case *MatchArm:
+		Walk(v, n.Pattern)
+		Walk(v, n.Body)
+	case *Propagate:
+		Walk(v, n.Expr)
+	case *Try:
+		Walk(v, n.Body)
+		if n.Param != nil {
+			Walk(v, n.Param)
+		}
+		if n.Catch != nil {
+			Walk(v, n.Catch)
+		}
+		if n.Finally != nil {
+			Walk(v, n.Finally)
+		}
+
+	// Statements
+	case *LetStmt:
+		if n.Ident != nil {
+			Walk(v, n.Ident)
+		}
+		if n.Pattern != nil {
+			Walk(v, n.Pattern)
+		}
+		if n.Type != nil {
+			Walk(v, n.Type)
+		}
+		Walk(v, n.Expr)
+	case *ReturnStmt:
+		Walk(v, n.Expr)
+	case *ThrowStmt:
+		Walk(v, n.Expr)
+	case *StructStmt:
+		Walk(v, n.Name)
+		walkList(v, n.Fields)
+	case *MethodStmt:
+		Walk(v, n.Receiver)
+		Walk(v, n.Type)
+		Walk(v, n.Name)
+		Walk(v, n.Function)
+	case *EnumStmt:
+		Walk(v, n.Name)
+		walkList(v, n.Variants)
+	case *Variant:
+		Walk(v, n.Name)
+		walkList(v, n.Fields)
+	case *ImportStmt:
+		Walk(v, n.Path)
+		Walk(v, n.Name)
+	case *ExportStmt:
+		Walk(v, n.Stmt)
+	case *ExprStmt:
+		Walk(v, n.Expr)
+	case *BlockStmt:
+		walkList(v, n.Stmts)
+
+	// Patterns
+	case *WildcardPattern:
+		// nothing to do
+	case *IdentPattern:
+		Walk(v, n.Ident)
+	case *LiteralPattern:
+		Walk(v, n.Value)
+	case *ConstructorPattern:
+		Walk(v, n.Name)
+		walkList(v, n.Args)
+	case *ArrayPattern:
+		walkList(v, n.Elems)
+	case *ObjectPattern:
+		walkList(v, n.Fields)
+	case *FieldPattern:
+		Walk(v, n.Name)
+		Walk(v, n.Pattern)
+
+	// Types
+	case *NamedType:
+		Walk(v, n.Name)
+	case *ArrayType:
+		Walk(v, n.Elem)
+	case *FuncType:
+		walkList(v, n.Params)
+		if n.Result != nil {
+			Walk(v, n.Result)
+		}
+
+	default:
+		panic(fmt.Sprintf("ast.Walk: unexpected node type %T", n))
+	}
+
+	v.Visit(nil)
+}
+
+func walkList[N Node](v Visitor, list []N) {
+	for _, node := range list {
+		Walk(v, node)
+	}
+}
+
+type inspector func(Node) bool
+
+func (f inspector) Visit(node Node) Visitor {
+	if f(node) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses an AST in depth-first order: It starts by calling
+// f(node); node must not be nil. If f returns true, Inspect invokes f
+// recursively for each of the non-nil children of node, followed by a call
+// of f(nil).
+func Inspect(node Node, f func(Node) bool) {
+	Walk(inspector(f), node)
+}
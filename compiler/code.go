@@ -0,0 +1,213 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+type Instructions []byte
+
+type Opcode byte
+
+const (
+	OpConstant Opcode = iota
+	OpNil
+	OpTrue
+	OpFalse
+	OpPop
+
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpEQ
+	OpNotEQ
+	OpLess
+	OpGreater
+	OpMinus
+	OpBang
+
+	// Binary operations whose right operand is a constant, which they
+	// take instead of popping it.
+	OpAddConstant
+	OpSubConstant
+	OpLessConstant
+
+	OpJump
+	OpJumpIfFalse
+
+	OpGetGlobal
+	OpSetGlobal
+	OpDefineGlobal
+	OpGetLocal
+	OpSetLocal
+	OpDefineLocal
+	OpGetUpvalue
+	OpSetUpvalue
+	OpGetBuiltin
+
+	OpClosure
+	OpCall
+	OpTailCall
+	OpReturn
+)
+
+type definition struct {
+	name   string
+	widths []int // operand widths in bytes
+}
+
+var definitions = map[Opcode]*definition{
+	OpConstant: {"OpConstant", []int{2}},
+	OpNil:      {"OpNil", nil},
+	OpTrue:     {"OpTrue", nil},
+	OpFalse:    {"OpFalse", nil},
+	OpPop:      {"OpPop", nil},
+
+	OpAdd:     {"OpAdd", nil},
+	OpSub:     {"OpSub", nil},
+	OpMul:     {"OpMul", nil},
+	OpDiv:     {"OpDiv", nil},
+	OpEQ:      {"OpEQ", nil},
+	OpNotEQ:   {"OpNotEQ", nil},
+	OpLess:    {"OpLess", nil},
+	OpGreater: {"OpGreater", nil},
+	OpMinus:   {"OpMinus", nil},
+	OpBang:    {"OpBang", nil},
+
+	OpAddConstant:  {"OpAddConstant", []int{2}},
+	OpSubConstant:  {"OpSubConstant", []int{2}},
+	OpLessConstant: {"OpLessConstant", []int{2}},
+
+	OpJump:        {"OpJump", []int{2}},
+	OpJumpIfFalse: {"OpJumpIfFalse", []int{2}},
+
+	OpGetGlobal:    {"OpGetGlobal", []int{2}},
+	OpSetGlobal:    {"OpSetGlobal", []int{2}},
+	OpDefineGlobal: {"OpDefineGlobal", []int{2}},
+	OpGetLocal:     {"OpGetLocal", []int{1}},
+	OpSetLocal:     {"OpSetLocal", []int{1}},
+	OpDefineLocal:  {"OpDefineLocal", []int{1}},
+	OpGetUpvalue:   {"OpGetUpvalue", []int{1}},
+	OpSetUpvalue:   {"OpSetUpvalue", []int{1}},
+	OpGetBuiltin:   {"OpGetBuiltin", []int{1}},
+
+	// OpClosure is followed by one (is local, index) byte pair per upvalue.
+	OpClosure:  {"OpClosure", []int{2, 1}},
+	OpCall:     {"OpCall", []int{1}},
+	OpTailCall: {"OpTailCall", []int{1}},
+	OpReturn:   {"OpReturn", nil},
+}
+
+var binaryOps = map[string]Opcode{
+	"+":  OpAdd,
+	"-":  OpSub,
+	"*":  OpMul,
+	"/":  OpDiv,
+	"==": OpEQ,
+	"!=": OpNotEQ,
+	"<":  OpLess,
+	">":  OpGreater,
+}
+
+// constantOps maps binary operations to their variants with a constant
+// right operand.
+var constantOps = map[Opcode]Opcode{
+	OpAdd:  OpAddConstant,
+	OpSub:  OpSubConstant,
+	OpLess: OpLessConstant,
+}
+
+// BinaryOperator returns the source operator of a binary opcode.
+func BinaryOperator(op Opcode) string {
+	for s, o := range binaryOps {
+		if o == op {
+			return s
+		}
+	}
+	return ""
+}
+
+func (op Opcode) String() string {
+	if def, ok := definitions[op]; ok {
+		return def.name
+	}
+	return fmt.Sprintf("Opcode(%d)", byte(op))
+}
+
+// Make encodes a single instruction.
+func Make(op Opcode, operands ...int) []byte {
+	def, ok := definitions[op]
+	if !ok {
+		return []byte{}
+	}
+
+	length := 1
+	for _, w := range def.widths {
+		length += w
+	}
+
+	ins := make([]byte, length)
+	ins[0] = byte(op)
+	offset := 1
+	for i, operand := range operands {
+		switch def.widths[i] {
+		case 2:
+			binary.BigEndian.PutUint16(ins[offset:], uint16(operand))
+		case 1:
+			ins[offset] = byte(operand)
+		}
+		offset += def.widths[i]
+	}
+	return ins
+}
+
+// ReadOperands decodes the operands of op from ins and returns them together
+// with the number of bytes read.
+func ReadOperands(op Opcode, ins Instructions) ([]int, int) {
+	def, ok := definitions[op]
+	if !ok {
+		return nil, 0
+	}
+
+	operands := make([]int, len(def.widths))
+	offset := 0
+	for i, w := range def.widths {
+		switch w {
+		case 2:
+			operands[i] = int(ReadUint16(ins[offset:]))
+		case 1:
+			operands[i] = int(ins[offset])
+		}
+		offset += w
+	}
+	return operands, offset
+}
+
+func ReadUint16(ins Instructions) uint16 {
+	return binary.BigEndian.Uint16(ins)
+}
+
+func (ins Instructions) String() string {
+	var out strings.Builder
+	i := 0
+	for i < len(ins) {
+		op := Opcode(ins[i])
+		operands, read := ReadOperands(op, ins[i+1:])
+		fmt.Fprintf(&out, "%04d %v", i, op)
+		for _, operand := range operands {
+			fmt.Fprintf(&out, " %d", operand)
+		}
+		i += 1 + read
+
+		if op == OpClosure {
+			for range operands[1] {
+				fmt.Fprintf(&out, " [%d %d]", ins[i], ins[i+1])
+				i += 2
+			}
+		}
+		out.WriteString("\n")
+	}
+	return out.String()
+}
@@ -0,0 +1,423 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/resolver"
+)
+
+// Constant is a value stored in the constant pool of a [Bytecode].
+type Constant interface {
+	constant()
+}
+
+type Int int64
+
+type String string
+
+// Function is a compiled function body. The top level of a program is
+// compiled into a parameterless Function as well.
+type Function struct {
+	Name         string
+	Instructions Instructions
+	NumParams    int
+	Locals       []string // local names indexed by slot, starting with the parameters
+}
+
+func (Int) constant()       {}
+func (String) constant()    {}
+func (*Function) constant() {}
+
+type Bytecode struct {
+	Main      *Function
+	Constants []Constant
+	Globals   []string // global names indexed by slot
+	Builtins  []string // names of the builtins used by the program
+}
+
+type Error struct {
+	msg string
+}
+
+func (x *Error) Error() string {
+	return x.msg
+}
+
+type Compiler struct {
+	info      *resolver.Info
+	constants []Constant
+	builtins  map[string]int
+	names     []string // builtin names indexed by operand
+
+	scope *scope
+}
+
+// scope holds the compilation state of a single function.
+type scope struct {
+	parent *scope
+	fn     *Function
+}
+
+func New() *Compiler {
+	return &Compiler{builtins: make(map[string]int)}
+}
+
+// Compile compiles prog. Names that prog does not declare are resolved
+// against builtins.
+func Compile(prog *ast.Program, builtins []string) (*Bytecode, error) {
+	return New().Compile(prog, builtins)
+}
+
+func (c *Compiler) Compile(prog *ast.Program, builtins []string) (*Bytecode, error) {
+	info, err := resolver.Resolve(prog, builtins)
+	if err != nil {
+		return nil, err
+	}
+	c.info = info
+
+	c.scope = &scope{fn: &Function{Name: "main"}}
+	if err := c.compileStmts(prog.Stmts); err != nil {
+		return nil, err
+	}
+	c.emit(OpReturn)
+
+	return &Bytecode{
+		Main:      c.scope.fn,
+		Constants: c.constants,
+		Globals:   info.Globals,
+		Builtins:  c.names,
+	}, nil
+}
+
+func (c *Compiler) compile(node ast.Node) error {
+	switch node := node.(type) {
+	case *ast.Int:
+		return c.emitConstant(Int(node.Value))
+	case *ast.Bool:
+		if node.Value {
+			c.emit(OpTrue)
+		} else {
+			c.emit(OpFalse)
+		}
+	case *ast.String:
+		return c.emitConstant(String(node.Value))
+	case *ast.UnaryOp:
+		return c.compileUnaryOp(node)
+	case *ast.BinaryOp:
+		return c.compileBinaryOp(node)
+	case *ast.If:
+		return c.compileIf(node, true)
+	case *ast.Ident:
+		return c.compileIdent(node)
+	case *ast.Function:
+		return c.compileFunction(node, "")
+	case *ast.Call:
+		return c.compileCall(node)
+	case *ast.Assignment:
+		return c.compileAssignment(node)
+	case *ast.BlockStmt:
+		return c.compileStmts(node.Stmts)
+	default:
+		return &Error{msg: fmt.Sprintf("node not supported: %T", node)}
+	}
+	return nil
+}
+
+// compileStmts compiles stmts so that exactly one value, the value of the
+// last statement, is left on the stack.
+func (c *Compiler) compileStmts(stmts []ast.Stmt) error {
+	if len(stmts) == 0 {
+		c.emit(OpNil)
+		return nil
+	}
+
+	for i, stmt := range stmts {
+		last := i == len(stmts)-1
+		if err := c.compileStmt(stmt, last); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Compiler) compileStmt(stmt ast.Stmt, last bool) error {
+	switch stmt := stmt.(type) {
+	case *ast.ExprStmt:
+		// An if statement whose value is discarded leaves none behind,
+		// which saves pushing and popping nil when it has no else branch.
+		if node, ok := stmt.Expr.(*ast.If); ok && !last {
+			return c.compileIf(node, false)
+		}
+		if err := c.compile(stmt.Expr); err != nil {
+			return err
+		}
+		if !last {
+			c.emit(OpPop)
+		}
+	case *ast.LetStmt:
+		if err := c.compileLet(stmt); err != nil {
+			return err
+		}
+		if last {
+			c.emit(OpNil)
+		}
+	case *ast.ReturnStmt:
+		if err := c.compile(stmt.Expr); err != nil {
+			return err
+		}
+		c.emit(OpReturn)
+	case *ast.BlockStmt:
+		if err := c.compileStmts(stmt.Stmts); err != nil {
+			return err
+		}
+		if !last {
+			c.emit(OpPop)
+		}
+	default:
+		return &Error{msg: fmt.Sprintf("statement not supported: %T", stmt)}
+	}
+	return nil
+}
+
+func (c *Compiler) compileUnaryOp(node *ast.UnaryOp) error {
+	if err := c.compile(node.Rhs); err != nil {
+		return err
+	}
+
+	switch node.Op {
+	case "-":
+		c.emit(OpMinus)
+	case "!":
+		c.emit(OpBang)
+	default:
+		return &Error{msg: fmt.Sprintf("operator '%v' not implemented for unary expression", node.Op)}
+	}
+	return nil
+}
+
+func (c *Compiler) compileBinaryOp(node *ast.BinaryOp) error {
+	op, ok := binaryOps[node.Op]
+	if !ok {
+		return &Error{msg: fmt.Sprintf("operator '%v' not implemented for binary expression", node.Op)}
+	}
+
+	if err := c.compile(node.Left); err != nil {
+		return err
+	}
+	if constantOp, ok := constantOps[op]; ok {
+		if right, ok := node.Right.(*ast.Int); ok {
+			idx, err := c.addConstant(Int(right.Value))
+			if err != nil {
+				return err
+			}
+			c.emit(constantOp, idx)
+			return nil
+		}
+	}
+	if err := c.compile(node.Right); err != nil {
+		return err
+	}
+	c.emit(op)
+	return nil
+}
+
+// compileIf compiles node. Unless value is set, the value of the branch
+// taken is popped.
+func (c *Compiler) compileIf(node *ast.If, value bool) error {
+	if err := c.compile(node.Condition); err != nil {
+		return err
+	}
+	jumpIfFalse := c.emit(OpJumpIfFalse, 0xffff)
+
+	if err := c.compile(node.Consequence); err != nil {
+		return err
+	}
+	if !value {
+		c.emit(OpPop)
+	}
+	if node.Alternative == nil && !value {
+		return c.patchJump(jumpIfFalse)
+	}
+	jump := c.emit(OpJump, 0xffff)
+
+	if err := c.patchJump(jumpIfFalse); err != nil {
+		return err
+	}
+	if node.Alternative != nil {
+		if err := c.compile(node.Alternative); err != nil {
+			return err
+		}
+		if !value {
+			c.emit(OpPop)
+		}
+	} else {
+		c.emit(OpNil)
+	}
+	return c.patchJump(jump)
+}
+
+func (c *Compiler) compileFunction(node *ast.Function, name string) error {
+	if name == "" {
+		name = "<anonymous>"
+	}
+	info := c.info.Functions[node]
+	if len(info.Locals) > 0x100 {
+		return &Error{msg: fmt.Sprintf("too many local variables in function '%v'", name)}
+	}
+	if len(info.Upvalues) > 0x100 {
+		return &Error{msg: fmt.Sprintf("function '%v' captures too many variables", name)}
+	}
+
+	for _, param := range node.Params {
+		if _, ok := param.(*ast.IdentPattern); !ok {
+			return &Error{msg: fmt.Sprintf("destructured parameters not supported in function '%v'", name)}
+		}
+	}
+
+	fn := &Function{Name: name, NumParams: len(node.Params), Locals: info.Locals}
+	c.scope = &scope{parent: c.scope, fn: fn}
+	if err := c.compileStmts(node.Body.Stmts); err != nil {
+		return err
+	}
+	c.emit(OpReturn)
+	c.scope = c.scope.parent
+
+	idx, err := c.addConstant(fn)
+	if err != nil {
+		return err
+	}
+	c.emit(OpClosure, idx, len(info.Upvalues))
+	for _, up := range info.Upvalues {
+		local := 0
+		if up.Local {
+			local = 1
+		}
+		c.scope.fn.Instructions = append(c.scope.fn.Instructions, byte(local), byte(up.Index))
+	}
+	return nil
+}
+
+func (c *Compiler) compileCall(node *ast.Call) error {
+	if len(node.Args) > 0xff {
+		return &Error{msg: "too many call arguments"}
+	}
+
+	if err := c.compile(node.Lhs); err != nil {
+		return err
+	}
+	for _, arg := range node.Args {
+		if err := c.compile(arg); err != nil {
+			return err
+		}
+	}
+	if c.info.TailCalls[node] {
+		c.emit(OpTailCall, len(node.Args))
+	} else {
+		c.emit(OpCall, len(node.Args))
+	}
+	return nil
+}
+
+func (c *Compiler) compileAssignment(node *ast.Assignment) error {
+	if err := c.compile(node.Expr); err != nil {
+		return err
+	}
+
+	switch binding := c.info.Idents[node.Ident]; binding.Kind {
+	case resolver.Global:
+		c.emit(OpSetGlobal, binding.Index)
+	case resolver.Local:
+		c.emit(OpSetLocal, binding.Index)
+	case resolver.Upvalue:
+		c.emit(OpSetUpvalue, binding.Index)
+	default:
+		return &Error{msg: fmt.Sprintf("cannot assign to '%v'", node.Ident.Value)}
+	}
+	c.emit(OpNil)
+	return nil
+}
+
+func (c *Compiler) compileLet(node *ast.LetStmt) error {
+	if node.Pattern != nil {
+		return &Error{msg: "destructuring not supported"}
+	}
+
+	var err error
+	if fn, ok := node.Expr.(*ast.Function); ok {
+		err = c.compileFunction(fn, node.Ident.Value)
+	} else {
+		err = c.compile(node.Expr)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch binding := c.info.Idents[node.Ident]; binding.Kind {
+	case resolver.Global:
+		c.emit(OpDefineGlobal, binding.Index)
+	case resolver.Local:
+		c.emit(OpDefineLocal, binding.Index)
+	default:
+		return &Error{msg: fmt.Sprintf("cannot define '%v'", node.Ident.Value)}
+	}
+	return nil
+}
+
+func (c *Compiler) compileIdent(node *ast.Ident) error {
+	switch binding := c.info.Idents[node]; binding.Kind {
+	case resolver.Global:
+		c.emit(OpGetGlobal, binding.Index)
+	case resolver.Local:
+		c.emit(OpGetLocal, binding.Index)
+	case resolver.Upvalue:
+		c.emit(OpGetUpvalue, binding.Index)
+	case resolver.Builtin:
+		c.emit(OpGetBuiltin, c.builtin(node.Value))
+	}
+	return nil
+}
+
+func (c *Compiler) builtin(name string) int {
+	if idx, ok := c.builtins[name]; ok {
+		return idx
+	}
+	c.names = append(c.names, name)
+	c.builtins[name] = len(c.names) - 1
+	return len(c.names) - 1
+}
+
+// addConstant adds constant to the constant pool and returns its index.
+func (c *Compiler) addConstant(constant Constant) (int, error) {
+	if len(c.constants) > 0xffff {
+		return 0, &Error{msg: "too many constants"}
+	}
+	c.constants = append(c.constants, constant)
+	return len(c.constants) - 1, nil
+}
+
+func (c *Compiler) emitConstant(constant Constant) error {
+	idx, err := c.addConstant(constant)
+	if err != nil {
+		return err
+	}
+	c.emit(OpConstant, idx)
+	return nil
+}
+
+// emit appends an instruction to the current function and returns its position.
+func (c *Compiler) emit(op Opcode, operands ...int) int {
+	pos := len(c.scope.fn.Instructions)
+	c.scope.fn.Instructions = append(c.scope.fn.Instructions, Make(op, operands...)...)
+	return pos
+}
+
+// patchJump points the jump instruction at pos to the current position.
+func (c *Compiler) patchJump(pos int) error {
+	target := len(c.scope.fn.Instructions)
+	if target > 0xffff {
+		return &Error{msg: fmt.Sprintf("function '%v' is too long", c.scope.fn.Name)}
+	}
+	copy(c.scope.fn.Instructions[pos:], Make(Opcode(c.scope.fn.Instructions[pos]), target))
+	return nil
+}
@@ -0,0 +1,359 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+)
+
+type compilerTest struct {
+	name         string
+	src          string
+	constants    []Constant
+	instructions []Instructions
+}
+
+func TestMake(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected []byte
+	}{
+		{OpConstant, []int{65534}, []byte{byte(OpConstant), 255, 254}},
+		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
+		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpAdd, []int{}, []byte{byte(OpAdd)}},
+	}
+
+	for _, tt := range tests {
+		ins := Make(tt.op, tt.operands...)
+		if !reflect.DeepEqual(ins, tt.expected) {
+			t.Fatalf("want=%v, got=%v", tt.expected, ins)
+		}
+
+		operands, read := ReadOperands(tt.op, ins[1:])
+		if read != len(tt.expected)-1 {
+			t.Fatalf("want=%v bytes read, got=%v", len(tt.expected)-1, read)
+		}
+		if !reflect.DeepEqual(operands, tt.operands) {
+			t.Fatalf("want=%v, got=%v", tt.operands, operands)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []compilerTest{
+		{
+			src:       "1 + 2",
+			constants: []Constant{Int(1), Int(2)},
+			instructions: []Instructions{
+				Make(OpConstant, 0),
+				Make(OpAddConstant, 1),
+				Make(OpReturn),
+			},
+		},
+		{
+			src:       "2 * 3",
+			constants: []Constant{Int(2), Int(3)},
+			instructions: []Instructions{
+				Make(OpConstant, 0),
+				Make(OpConstant, 1),
+				Make(OpMul),
+				Make(OpReturn),
+			},
+		},
+		{
+			src:       "let x = 1; x - 2 < x",
+			constants: []Constant{Int(1), Int(2)},
+			instructions: []Instructions{
+				Make(OpConstant, 0),
+				Make(OpDefineGlobal, 0),
+				Make(OpGetGlobal, 0),
+				Make(OpSubConstant, 1),
+				Make(OpGetGlobal, 0),
+				Make(OpLess),
+				Make(OpReturn),
+			},
+		},
+		{
+			src:       "1; 2",
+			constants: []Constant{Int(1), Int(2)},
+			instructions: []Instructions{
+				Make(OpConstant, 0),
+				Make(OpPop),
+				Make(OpConstant, 1),
+				Make(OpReturn),
+			},
+		},
+		{
+			src:       "if (true) { 10 }",
+			constants: []Constant{Int(10)},
+			instructions: []Instructions{
+				Make(OpTrue),
+				Make(OpJumpIfFalse, 10),
+				Make(OpConstant, 0),
+				Make(OpJump, 11),
+				Make(OpNil),
+				Make(OpReturn),
+			},
+		},
+		{
+			src:       "if (true) { 10 }; 20",
+			constants: []Constant{Int(10), Int(20)},
+			instructions: []Instructions{
+				Make(OpTrue),
+				Make(OpJumpIfFalse, 8),
+				Make(OpConstant, 0),
+				Make(OpPop),
+				Make(OpConstant, 1),
+				Make(OpReturn),
+			},
+		},
+		{
+			src:       "if (true) { 10 } { 20 }; 30",
+			constants: []Constant{Int(10), Int(20), Int(30)},
+			instructions: []Instructions{
+				Make(OpTrue),
+				Make(OpJumpIfFalse, 11),
+				Make(OpConstant, 0),
+				Make(OpPop),
+				Make(OpJump, 15),
+				Make(OpConstant, 1),
+				Make(OpPop),
+				Make(OpConstant, 2),
+				Make(OpReturn),
+			},
+		},
+		{
+			src:       `let x = "a"; x = "b"`,
+			constants: []Constant{String("a"), String("b")},
+			instructions: []Instructions{
+				Make(OpConstant, 0),
+				Make(OpDefineGlobal, 0),
+				Make(OpConstant, 1),
+				Make(OpSetGlobal, 0),
+				Make(OpNil),
+				Make(OpReturn),
+			},
+		},
+		{
+			name: "closure",
+			src:  "fn(x) { fn() { x } }",
+			constants: []Constant{
+				&Function{
+					Name: "<anonymous>",
+					Instructions: concat(
+						Make(OpGetUpvalue, 0),
+						Make(OpReturn),
+					),
+				},
+				&Function{
+					Name:      "<anonymous>",
+					NumParams: 1,
+					Locals:    []string{"x"},
+					Instructions: concat(
+						Make(OpClosure, 0, 1), []byte{1, 0},
+						Make(OpReturn),
+					),
+				},
+			},
+			instructions: []Instructions{
+				Make(OpClosure, 1, 0),
+				Make(OpReturn),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		if name == "" {
+			name = tt.src
+		}
+		t.Run(name, func(t *testing.T) {
+			prog, err := parser.New(lexer.New(tt.src)).Parse()
+			if err != nil {
+				t.Fatalf("Failed to parse program: %v", err)
+			}
+			bc, err := Compile(prog, nil)
+			if err != nil {
+				t.Fatalf("Failed to compile program: %v", err)
+			}
+
+			expected := concat(tt.instructions...)
+			if !reflect.DeepEqual(bc.Main.Instructions, expected) {
+				t.Fatalf("want=\n%v, got=\n%v", expected, bc.Main.Instructions)
+			}
+			if !reflect.DeepEqual(bc.Constants, tt.constants) {
+				t.Fatalf("want=%#v, got=%#v", tt.constants, bc.Constants)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		expected string
+	}{
+		{
+			// Each statement compiles to 4 bytes, so the jump over the
+			// branch would need a target beyond the 2-byte operand.
+			name:     "long function",
+			src:      "if (true) { " + strings.Repeat("1; ", 0x4000) + "}",
+			expected: "function 'main' is too long",
+		},
+		{
+			// The index of the last constant does not fit the 2-byte
+			// operand.
+			name:     "many constants",
+			src:      strings.Repeat("1; ", 0x10000) + "1234567",
+			expected: "too many constants",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := parser.New(lexer.New(tt.src)).Parse()
+			if err != nil {
+				t.Fatalf("Failed to parse program: %v", err)
+			}
+			_, err = Compile(prog, nil)
+			var compileErr *Error
+			if !errors.As(err, &compileErr) || err.Error() != tt.expected {
+				t.Fatalf("want=%q, got=%v", tt.expected, err)
+			}
+		})
+	}
+}
+
+func concat[T ~[]byte](ins ...T) Instructions {
+	out := Instructions{}
+	for _, i := range ins {
+		out = append(out, i...)
+	}
+	return out
+}
+
+func TestEncode(t *testing.T) {
+	src := `
+		let greeting = "hello";
+		let make = fn(x) { fn(y) { if (x > y) { -x } { len(greeting) } } };
+		make(1)(2);`
+	prog, err := parser.New(lexer.New(src)).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse program: %v", err)
+	}
+	bc, err := Compile(prog, []string{"len"})
+	if err != nil {
+		t.Fatalf("Failed to compile program: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, bc); err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	data := buf.Bytes()
+
+	decoded, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, bc) {
+		t.Fatalf("want=%#v, got=%#v", bc, decoded)
+	}
+
+	t.Run("version", func(t *testing.T) {
+		data := bytes.Clone(data)
+		binary.BigEndian.PutUint16(data[4:], FormatVersion+1)
+		_, err := Decode(bytes.NewReader(data))
+		var versionErr *VersionError
+		if !errors.As(err, &versionErr) || versionErr.Version != FormatVersion+1 {
+			t.Fatalf("want VersionError, got=%v", err)
+		}
+	})
+
+	t.Run("magic", func(t *testing.T) {
+		_, err := Decode(strings.NewReader("let x = 1;"))
+		if !errors.Is(err, ErrMagic) {
+			t.Fatalf("want=%v, got=%v", ErrMagic, err)
+		}
+	})
+
+	t.Run("checksum", func(t *testing.T) {
+		data := bytes.Clone(data)
+		data[len(data)-1] ^= 0xff
+		_, err := Decode(bytes.NewReader(data))
+		if !errors.Is(err, ErrChecksum) {
+			t.Fatalf("want=%v, got=%v", ErrChecksum, err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		_, err := Decode(bytes.NewReader(data[:len(data)-3]))
+		if err == nil {
+			t.Fatalf("Expected error")
+		}
+	})
+}
+
+// TestDecodeInvalid checks that Decode rejects bytecode with a valid
+// checksum that the VM cannot run.
+func TestDecodeInvalid(t *testing.T) {
+	fn := &Function{Name: "f", NumParams: 1, Locals: []string{"x"}, Instructions: concat(
+		Make(OpGetLocal, 0),
+		Make(OpReturn),
+	)}
+	tests := []struct {
+		name      string
+		ins       Instructions
+		constants []Constant
+		expected  string
+	}{
+		{"unknown opcode", Instructions{0xff}, nil, "unknown opcode 255"},
+		{"truncated operand", Instructions{byte(OpConstant), 0}, nil, "OpConstant is truncated"},
+		{"constant", concat(Make(OpConstant, 1), Make(OpReturn)), []Constant{Int(1)}, "constant 1 out of range"},
+		{"function constant", concat(Make(OpConstant, 0), Make(OpReturn)), []Constant{fn}, "constant 0 is a function"},
+		{"closure of int", concat(Make(OpClosure, 0, 0), Make(OpReturn)), []Constant{Int(1)}, "constant 0 is not a function"},
+		{"captured local", concat(Make(OpClosure, 0, 1), []byte{1, 0}, Make(OpReturn)), []Constant{fn}, "local 0 out of range"},
+		{"constant operand", concat(Make(OpNil), Make(OpAddConstant, 1), Make(OpReturn)), []Constant{Int(1)}, "constant 1 out of range"},
+		{"function operand", concat(Make(OpNil), Make(OpLessConstant, 0), Make(OpReturn)), []Constant{fn}, "constant 0 is a function"},
+		{"global", concat(Make(OpGetGlobal, 1), Make(OpReturn)), nil, "global 1 out of range"},
+		{"local", concat(Make(OpGetLocal, 0), Make(OpReturn)), nil, "local 0 out of range"},
+		{"local of function", concat(Make(OpClosure, 1, 0), Make(OpReturn)), []Constant{Int(1), &Function{
+			Name: "g", Instructions: concat(Make(OpGetLocal, 0), Make(OpReturn)),
+		}}, "function 'g': 0000: local 0 out of range"},
+		{"upvalue", concat(Make(OpGetUpvalue, 0), Make(OpReturn)), nil, "upvalue 0 out of range"},
+		{"builtin", concat(Make(OpGetBuiltin, 0), Make(OpReturn)), nil, "builtin 0 out of range"},
+		{"backward jump", concat(Make(OpNil), Make(OpJump, 0)), nil, "jump target 0 out of range"},
+		{"jump past the end", concat(Make(OpJump, 100), Make(OpNil), Make(OpReturn)), nil, "jump target 100 out of range"},
+		{"jump into instruction", concat(Make(OpJump, 4), Make(OpConstant, 0), Make(OpReturn)), []Constant{Int(1)}, "jump target 4 is inside an instruction"},
+		{"empty stack", concat(Make(OpPop), Make(OpNil), Make(OpReturn)), nil, "OpPop pops 1 values of 0"},
+		{"empty operand", concat(Make(OpSubConstant, 0), Make(OpReturn)), []Constant{Int(1)}, "OpSubConstant pops 1 values of 0"},
+		{"call", concat(Make(OpNil), Make(OpCall, 1), Make(OpReturn)), nil, "OpCall pops 2 values of 1"},
+		{"tail call", concat(Make(OpNil), Make(OpTailCall, 0), Make(OpReturn)), nil, "OpTailCall outside of a function"},
+		{"stack depths", concat(Make(OpTrue), Make(OpJumpIfFalse, 6), Make(OpNil), Make(OpNil), Make(OpReturn)), nil, "0006: reached with 0 and 2 values"},
+		{"no return", Make(OpNil), nil, "OpNil runs past the end"},
+		{"no instructions", nil, nil, "no instructions"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := &Bytecode{Main: &Function{Name: "main", Instructions: tt.ins}, Constants: tt.constants}
+			var buf bytes.Buffer
+			if err := Encode(&buf, bc); err != nil {
+				t.Fatalf("Failed to encode: %v", err)
+			}
+			_, err := Decode(&buf)
+			if err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Fatalf("want error containing %q, got=%v", tt.expected, err)
+			}
+		})
+	}
+}
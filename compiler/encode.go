@@ -0,0 +1,262 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// FormatVersion is the version of the binary format written by [Encode]. It
+// has to be incremented whenever the format or the instruction set changes.
+const FormatVersion = 3
+
+// magic identifies compiled lily scripts.
+var magic = [4]byte{'L', 'I', 'L', 'Y'}
+
+// The header consists of the magic, the format version, the payload length
+// and the CRC-32 (IEEE) checksum of the payload.
+const headerSize = 4 + 2 + 4 + 4
+
+const (
+	tagInt byte = iota
+	tagString
+	tagFunction
+)
+
+var (
+	ErrMagic    = errors.New("not a compiled lily script")
+	ErrChecksum = errors.New("compiled lily script is corrupted: checksum mismatch")
+)
+
+// VersionError is returned by [Decode] for scripts written in a format
+// version this build cannot read.
+type VersionError struct {
+	Version int
+}
+
+func (x *VersionError) Error() string {
+	return fmt.Sprintf("compiled lily script has format version %v, expected version %v: recompile the script", x.Version, FormatVersion)
+}
+
+// Encode writes bc to w in the versioned binary format read by [Decode].
+func Encode(w io.Writer, bc *Bytecode) error {
+	data, err := bc.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Decode reads bytecode written by [Encode]. It returns an error for
+// bytecode the VM cannot run safely, such as instructions referring to
+// constants that do not exist.
+func Decode(r io.Reader) (*Bytecode, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	bc := &Bytecode{}
+	if err := bc.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return bc, nil
+}
+
+func (bc *Bytecode) MarshalBinary() ([]byte, error) {
+	var payload []byte
+	payload = appendStrings(payload, bc.Globals)
+	payload = appendStrings(payload, bc.Builtins)
+
+	payload = binary.AppendUvarint(payload, uint64(len(bc.Constants)))
+	for _, c := range bc.Constants {
+		switch c := c.(type) {
+		case Int:
+			payload = append(payload, tagInt)
+			payload = binary.AppendVarint(payload, int64(c))
+		case String:
+			payload = append(payload, tagString)
+			payload = appendString(payload, string(c))
+		case *Function:
+			payload = append(payload, tagFunction)
+			payload = appendFunction(payload, c)
+		default:
+			return nil, fmt.Errorf("cannot encode constant of type %T", c)
+		}
+	}
+	payload = appendFunction(payload, bc.Main)
+
+	data := make([]byte, 0, headerSize+len(payload))
+	data = append(data, magic[:]...)
+	data = binary.BigEndian.AppendUint16(data, FormatVersion)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(payload)))
+	data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(payload))
+	return append(data, payload...), nil
+}
+
+func (bc *Bytecode) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 || !bytes.Equal(data[:4], magic[:]) {
+		return ErrMagic
+	}
+	if len(data) < headerSize {
+		return fmt.Errorf("compiled lily script is truncated")
+	}
+	if version := int(binary.BigEndian.Uint16(data[4:])); version != FormatVersion {
+		return &VersionError{Version: version}
+	}
+	length := binary.BigEndian.Uint32(data[6:])
+	checksum := binary.BigEndian.Uint32(data[10:])
+
+	payload := data[headerSize:]
+	if uint32(len(payload)) != length {
+		return fmt.Errorf("compiled lily script is truncated: want %v bytes, got %v", length, len(payload))
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return ErrChecksum
+	}
+
+	d := &decoder{data: payload}
+	bc.Globals = d.strings()
+	bc.Builtins = d.strings()
+
+	bc.Constants = make([]Constant, d.length())
+	for i := range bc.Constants {
+		switch tag := d.byte(); tag {
+		case tagInt:
+			bc.Constants[i] = Int(d.varint())
+		case tagString:
+			bc.Constants[i] = String(d.string())
+		case tagFunction:
+			bc.Constants[i] = d.function()
+		default:
+			d.fail(fmt.Errorf("unknown constant tag %v", tag))
+		}
+		if d.err != nil {
+			break
+		}
+	}
+	bc.Main = d.function()
+
+	if d.err == nil && len(d.data) > 0 {
+		d.fail(fmt.Errorf("%v trailing bytes", len(d.data)))
+	}
+	if d.err == nil {
+		d.err = bc.verify()
+	}
+	if d.err != nil {
+		return fmt.Errorf("invalid compiled lily script: %w", d.err)
+	}
+	return nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendStrings(b []byte, strs []string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(strs)))
+	for _, s := range strs {
+		b = appendString(b, s)
+	}
+	return b
+}
+
+func appendFunction(b []byte, fn *Function) []byte {
+	b = appendString(b, fn.Name)
+	b = binary.AppendUvarint(b, uint64(fn.NumParams))
+	b = appendStrings(b, fn.Locals)
+	b = binary.AppendUvarint(b, uint64(len(fn.Instructions)))
+	return append(b, fn.Instructions...)
+}
+
+// decoder reads the payload. After the first error all reads return zero
+// values, so the error only needs to be checked at the end.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.data = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) < 1 {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// length reads a length and makes sure it does not exceed the remaining
+// data, so that corrupted input cannot cause huge allocations.
+func (d *decoder) length() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.length()
+	b := d.data[:n:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) strings() []string {
+	n := d.length()
+	if n == 0 {
+		return nil
+	}
+	strs := make([]string, n)
+	for i := range strs {
+		strs[i] = d.string()
+	}
+	return strs
+}
+
+func (d *decoder) function() *Function {
+	fn := &Function{}
+	fn.Name = d.string()
+	fn.NumParams = int(d.uvarint())
+	fn.Locals = d.strings()
+	fn.Instructions = Instructions(bytes.Clone(d.bytes()))
+	return fn
+}
@@ -0,0 +1,221 @@
+package compiler
+
+import "fmt"
+
+// verify checks that the functions of bc only hold instructions the VM can
+// run: known opcodes with all their operands, indexes within the constant
+// pool, the globals, the builtins, the locals and the captured variables,
+// and forward jumps to instructions. It also checks that no instruction
+// pops more values than there are on the stack and that no function runs
+// past its end. Bytecode written by [Compile] passes.
+func (bc *Bytecode) verify() error {
+	// The number of variables a function captures is the one of the
+	// closures made of it.
+	upvalues := make(map[*Function]int)
+	fns := []*Function{bc.Main}
+	for _, c := range bc.Constants {
+		if fn, ok := c.(*Function); ok {
+			fns = append(fns, fn)
+		}
+	}
+	for _, fn := range fns {
+		if err := bc.closures(fn, upvalues); err != nil {
+			return fmt.Errorf("function '%v': %w", fn.Name, err)
+		}
+	}
+
+	for _, fn := range fns {
+		if err := bc.verifyFunction(fn, upvalues); err != nil {
+			return fmt.Errorf("function '%v': %w", fn.Name, err)
+		}
+	}
+	return nil
+}
+
+// closures records the number of upvalues of the closures made by fn.
+func (bc *Bytecode) closures(fn *Function, upvalues map[*Function]int) error {
+	ins := fn.Instructions
+	for i := 0; i < len(ins); {
+		op := Opcode(ins[i])
+		def, ok := definitions[op]
+		if !ok {
+			return fmt.Errorf("%04d: unknown opcode %v", i, ins[i])
+		}
+		size := 1
+		for _, w := range def.widths {
+			size += w
+		}
+		if i+size > len(ins) {
+			return fmt.Errorf("%04d: %v is truncated", i, op)
+		}
+		operands, _ := ReadOperands(op, ins[i+1:])
+
+		if op == OpClosure {
+			size += 2 * operands[1]
+			if i+size > len(ins) {
+				return fmt.Errorf("%04d: %v is truncated", i, op)
+			}
+			if operands[0] >= len(bc.Constants) {
+				return fmt.Errorf("%04d: constant %v out of range", i, operands[0])
+			}
+			closure, ok := bc.Constants[operands[0]].(*Function)
+			if !ok {
+				return fmt.Errorf("%04d: constant %v is not a function", i, operands[0])
+			}
+			if n, ok := upvalues[closure]; ok && n != operands[1] {
+				return fmt.Errorf("%04d: closures of '%v' capture %v and %v variables", i, closure.Name, n, operands[1])
+			}
+			upvalues[closure] = operands[1]
+		}
+		i += size
+	}
+	return nil
+}
+
+func (bc *Bytecode) verifyFunction(fn *Function, upvalues map[*Function]int) error {
+	if fn.NumParams > len(fn.Locals) {
+		return fmt.Errorf("%v parameters but %v locals", fn.NumParams, len(fn.Locals))
+	}
+	if fn == bc.Main && len(fn.Locals) > 0 {
+		// The top level has globals only.
+		return fmt.Errorf("%v locals at the top level", len(fn.Locals))
+	}
+	if len(fn.Instructions) == 0 {
+		return fmt.Errorf("no instructions")
+	}
+
+	// depths holds the number of values on the stack before the
+	// instructions that can be reached, by position.
+	ins := fn.Instructions
+	depths := map[int]int{0: 0}
+	starts := make(map[int]bool) // positions of the instructions
+	reach := func(pos, depth int) error {
+		if d, ok := depths[pos]; ok && d != depth {
+			return fmt.Errorf("%04d: reached with %v and %v values on the stack", pos, d, depth)
+		}
+		depths[pos] = depth
+		return nil
+	}
+
+	for i := 0; i < len(ins); {
+		starts[i] = true
+		op := Opcode(ins[i])
+		operands, read := ReadOperands(op, ins[i+1:])
+		next := i + 1 + read
+		if op == OpClosure {
+			next += 2 * operands[1]
+		}
+		if op == OpTailCall && fn == bc.Main {
+			return fmt.Errorf("%04d: %v outside of a function", i, op)
+		}
+
+		if err := bc.verifyOperands(fn, upvalues, ins[i:next], operands); err != nil {
+			return fmt.Errorf("%04d: %w", i, err)
+		}
+
+		depth, reachable := depths[i]
+		if !reachable {
+			// Code after a return or a jump, which the compiler emits
+			// for the unused parts of branches.
+			i = next
+			continue
+		}
+		pop, push := stackEffect(op, operands)
+		if pop > depth {
+			return fmt.Errorf("%04d: %v pops %v values of %v", i, op, pop, depth)
+		}
+		depth += push - pop
+
+		switch op {
+		case OpJump, OpJumpIfFalse:
+			target := operands[0]
+			if target <= i || target >= len(ins) {
+				return fmt.Errorf("%04d: jump target %v out of range", i, target)
+			}
+			if err := reach(target, depth); err != nil {
+				return err
+			}
+		}
+		switch op {
+		case OpReturn, OpJump:
+		default:
+			if next == len(ins) {
+				return fmt.Errorf("%04d: %v runs past the end", i, op)
+			}
+			if err := reach(next, depth); err != nil {
+				return err
+			}
+		}
+		i = next
+	}
+
+	for pos := range depths {
+		if !starts[pos] {
+			return fmt.Errorf("jump target %v is inside an instruction", pos)
+		}
+	}
+	return nil
+}
+
+// verifyOperands checks the operands of the instruction ins of fn.
+func (bc *Bytecode) verifyOperands(fn *Function, upvalues map[*Function]int, ins Instructions, operands []int) error {
+	check := func(what string, idx, n int) error {
+		if idx >= n {
+			return fmt.Errorf("%v %v out of range", what, idx)
+		}
+		return nil
+	}
+
+	switch op := Opcode(ins[0]); op {
+	case OpConstant, OpAddConstant, OpSubConstant, OpLessConstant:
+		if err := check("constant", operands[0], len(bc.Constants)); err != nil {
+			return err
+		}
+		if _, ok := bc.Constants[operands[0]].(*Function); ok {
+			return fmt.Errorf("constant %v is a function", operands[0])
+		}
+	case OpGetGlobal, OpSetGlobal, OpDefineGlobal:
+		return check("global", operands[0], len(bc.Globals))
+	case OpGetLocal, OpSetLocal, OpDefineLocal:
+		return check("local", operands[0], len(fn.Locals))
+	case OpGetUpvalue, OpSetUpvalue:
+		return check("upvalue", operands[0], upvalues[fn])
+	case OpGetBuiltin:
+		return check("builtin", operands[0], len(bc.Builtins))
+	case OpClosure:
+		for i := range operands[1] {
+			local, index := ins[4+2*i], int(ins[5+2*i])
+			var err error
+			switch local {
+			case 0:
+				err = check("upvalue", index, upvalues[fn])
+			case 1:
+				err = check("local", index, len(fn.Locals))
+			default:
+				err = fmt.Errorf("invalid upvalue kind %v", local)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stackEffect returns the number of values op pops off the stack and the
+// number it pushes.
+func stackEffect(op Opcode, operands []int) (pop, push int) {
+	switch op {
+	case OpConstant, OpNil, OpTrue, OpFalse, OpGetGlobal, OpGetLocal, OpGetUpvalue, OpGetBuiltin, OpClosure:
+		return 0, 1
+	case OpPop, OpJumpIfFalse, OpSetGlobal, OpDefineGlobal, OpSetLocal, OpDefineLocal, OpSetUpvalue, OpReturn:
+		return 1, 0
+	case OpAdd, OpSub, OpMul, OpDiv, OpEQ, OpNotEQ, OpLess, OpGreater:
+		return 2, 1
+	case OpMinus, OpBang, OpAddConstant, OpSubConstant, OpLessConstant:
+		return 1, 1
+	case OpCall, OpTailCall:
+		return operands[0] + 1, 1
+	}
+	return 0, 0
+}
@@ -0,0 +1,382 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tombuente/lily/internal/frame"
+)
+
+const (
+	script = `import "lib/m" as m;
+let sq = fn(x) {
+	let y = x * x;
+	m.inc(y)
+};
+
+sq(2) + sq(3)`
+
+	module = `export let inc = fn(n) {
+	n + 1
+};`
+)
+
+func TestSession(t *testing.T) {
+	c := newClient(t)
+	program, lib := c.launch(t, map[string]string{"main.lily": script, "lib/m.lily": module}, false)
+
+	var bps BreakpointsResponse
+	c.request("setBreakpoints", SetBreakpointsArguments{
+		Source:      Source{Path: program},
+		Breakpoints: []SourceBreakpoint{{Line: 3}, {Line: 6}},
+	}, &bps)
+	if len(bps.Breakpoints) != 2 || !bps.Breakpoints[0].Verified || bps.Breakpoints[1].Verified {
+		t.Fatalf("want the breakpoint at line 3 verified only, got=%+v", bps.Breakpoints)
+	}
+	c.request("configurationDone", nil, nil)
+
+	c.expectStop("breakpoint", "sq", 3, "<main>", 7)
+	var stack StackTraceResponse
+	c.request("stackTrace", StackTraceArguments{ThreadID: threadID}, &stack)
+	if stack.StackFrames[0].Source.Path != program || stack.StackFrames[0].Column != 2 {
+		t.Fatalf("unexpected frame: %+v", stack.StackFrames[0])
+	}
+
+	var scopes ScopesResponse
+	c.request("scopes", ScopesArguments{FrameID: 0}, &scopes)
+	var names []string
+	for _, scope := range scopes.Scopes {
+		names = append(names, scope.Name)
+	}
+	if expected := []string{"Locals", "Captured", "Globals"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("want=%v, got=%v", expected, names)
+	}
+	c.expectVariables(scopes.Scopes[0].VariablesReference, []Variable{{Name: "x", Value: "2", Type: "int"}})
+	c.expectVariables(scopes.Scopes[2].VariablesReference, []Variable{
+		{Name: "m", Value: `module "lib/m"`, Type: "module", VariablesReference: 3},
+		{Name: "sq", Value: "fn sq", Type: "function"},
+	})
+	c.expectVariables(3, []Variable{{Name: "inc", Value: "fn inc", Type: "function"}})
+
+	var res EvaluateResponse
+	c.request("evaluate", EvaluateArguments{Expression: "[x, x * 10]", Context: "watch"}, &res)
+	if res.Result != "[2, 20]" || res.Type != "array" {
+		t.Fatalf("want=[2, 20], got=%+v", res)
+	}
+	c.expectVariables(res.VariablesReference, []Variable{{Name: "[0]", Value: "2", Type: "int"}, {Name: "[1]", Value: "20", Type: "int"}})
+	c.request("evaluate", EvaluateArguments{Expression: "x", FrameID: 1}, &res)
+	if c.lastError == "" {
+		t.Fatalf("want an error evaluating x in the top level frame, got=%+v", res)
+	}
+
+	c.request("next", map[string]any{"threadId": threadID}, nil)
+	c.expectStop("step", "sq", 4, "<main>", 7)
+	c.request("stepIn", map[string]any{"threadId": threadID}, nil)
+	// The call of inc is in tail position and replaces the frame of sq.
+	c.expectStop("step", "inc", 2, "<main>", 7)
+	c.request("stackTrace", StackTraceArguments{ThreadID: threadID, Levels: 1}, &stack)
+	if len(stack.StackFrames) != 1 || stack.TotalFrames != 2 || stack.StackFrames[0].Source.Path != lib {
+		t.Fatalf("unexpected stack trace: %+v", stack)
+	}
+
+	c.request("stepOut", map[string]any{"threadId": threadID}, nil)
+	c.expectStop("breakpoint", "sq", 3, "<main>", 7)
+	c.request("evaluate", EvaluateArguments{Expression: "x"}, &res)
+	if res.Result != "3" {
+		t.Fatalf("want=3, got=%+v", res)
+	}
+
+	c.request("setBreakpoints", SetBreakpointsArguments{Source: Source{Path: program}}, &bps)
+	c.request("continue", map[string]any{"threadId": threadID}, nil)
+	c.expectOutput("stdout", "15\n")
+	c.expectExit(0)
+}
+
+func TestFunctionBreakpoints(t *testing.T) {
+	c := newClient(t)
+	c.launch(t, map[string]string{"main.lily": script, "lib/m.lily": module}, false)
+
+	var bps BreakpointsResponse
+	c.request("setFunctionBreakpoints", SetFunctionBreakpointsArguments{Breakpoints: []FunctionBreakpoint{{Name: "inc"}}}, &bps)
+	if len(bps.Breakpoints) != 1 || !bps.Breakpoints[0].Verified {
+		t.Fatalf("want a verified breakpoint, got=%+v", bps.Breakpoints)
+	}
+	c.request("configurationDone", nil, nil)
+	c.expectStop("function breakpoint", "inc", 2, "<main>", 7)
+	c.request("evaluate", EvaluateArguments{Expression: "n"}, new(EvaluateResponse))
+	c.request("disconnect", nil, nil)
+	c.expectExit(0)
+}
+
+func TestStopOnEntry(t *testing.T) {
+	c := newClient(t)
+	c.launch(t, map[string]string{"main.lily": script, "lib/m.lily": module}, true)
+	c.request("configurationDone", nil, nil)
+	c.expectStop("entry", "<main>", 1)
+
+	c.request("terminate", nil, nil)
+	c.expectExit(0)
+}
+
+func TestRuntimeError(t *testing.T) {
+	c := newClient(t)
+	c.launch(t, map[string]string{"main.lily": "let f = fn() { 1 / 0 };\nf()"}, false)
+	c.request("configurationDone", nil, nil)
+	c.expectOutput("stderr", "Traceback (most recent call last):\n  line 2, column 1, in f()\nZeroDivisionError: division by zero\n")
+	c.expectExit(1)
+}
+
+func TestErrors(t *testing.T) {
+	c := newClient(t)
+	tests := []struct {
+		command string
+		args    any
+	}{
+		{"launch", LaunchArguments{Program: filepath.Join(t.TempDir(), "missing.lily")}},
+		{"configurationDone", nil},
+		{"evaluate", EvaluateArguments{Expression: "1"}},
+		{"stepBack", nil},
+	}
+	for _, tt := range tests {
+		c.request(tt.command, tt.args, nil)
+		if c.lastError == "" {
+			t.Errorf("%v: want an error", tt.command)
+		}
+	}
+}
+
+func TestInvalidLength(t *testing.T) {
+	err := NewServer().Serve(strings.NewReader("Content-Length: -1\r\n\r\n"), io.Discard)
+	if !errors.Is(err, frame.ErrLength) {
+		t.Fatalf("want=%v, got=%v", frame.ErrLength, err)
+	}
+}
+
+// client talks to a server running in the same process.
+type client struct {
+	t      *testing.T
+	w      io.WriteCloser
+	msgs   chan map[string]json.RawMessage
+	done   chan error
+	seq    int
+	events []map[string]json.RawMessage // events not yet expected
+
+	lastError string // message of the last failed request
+}
+
+func newClient(t *testing.T) *client {
+	t.Helper()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+
+	c := &client{
+		t:    t,
+		w:    inW,
+		msgs: make(chan map[string]json.RawMessage, 16),
+		done: make(chan error, 1),
+	}
+	go func() {
+		c.done <- NewServer().Serve(inR, outW)
+		outW.Close()
+	}()
+	go func() {
+		defer close(c.msgs)
+		r := bufio.NewReader(outR)
+		for {
+			body, err := frame.Read(r)
+			if err != nil {
+				return
+			}
+			var msg map[string]json.RawMessage
+			if err := json.Unmarshal(body, &msg); err != nil {
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+	t.Cleanup(func() {
+		inW.Close()
+		select {
+		case err := <-c.done:
+			if err != nil {
+				t.Errorf("Serve failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("server did not exit")
+		}
+	})
+
+	var caps Capabilities
+	c.request("initialize", map[string]any{"adapterID": "lily"}, &caps)
+	if !caps.SupportsConfigurationDoneRequest || !caps.SupportsFunctionBreakpoints {
+		t.Fatalf("unexpected capabilities: %+v", caps)
+	}
+	return c
+}
+
+// launch writes files to a temporary directory and launches main.lily. It
+// returns the paths of main.lily and lib/m.lily.
+func (c *client) launch(t *testing.T, files map[string]string, stopOnEntry bool) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, src := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	program := filepath.Join(dir, "main.lily")
+	c.request("launch", LaunchArguments{Program: program, StopOnEntry: stopOnEntry}, nil)
+	if c.lastError != "" {
+		t.Fatalf("launch failed: %v", c.lastError)
+	}
+	c.event("initialized")
+	return program, filepath.Join(dir, "lib", "m.lily")
+}
+
+// next returns the next message of the server.
+func (c *client) next() map[string]json.RawMessage {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatalf("server closed the connection")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("timed out waiting for the server")
+	}
+	return nil
+}
+
+// request sends a request and decodes the body of its response into
+// result, unless it is nil. Events received meanwhile are kept.
+func (c *client) request(command string, args any, result any) {
+	c.t.Helper()
+	c.seq++
+	msg := map[string]any{"seq": c.seq, "type": "request", "command": command}
+	if args != nil {
+		msg["arguments"] = args
+	}
+	if err := frame.Write(c.w, msg); err != nil {
+		c.t.Fatalf("Failed to send: %v", err)
+	}
+
+	for {
+		msg := c.next()
+		if decodeField[string](c.t, msg, "type") == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if seq := decodeField[int](c.t, msg, "request_seq"); seq != c.seq {
+			c.t.Fatalf("want response to %v, got %v", c.seq, seq)
+		}
+
+		c.lastError = ""
+		if !decodeField[bool](c.t, msg, "success") {
+			c.lastError = decodeField[string](c.t, msg, "message")
+			return
+		}
+		if result != nil {
+			if err := json.Unmarshal(msg["body"], result); err != nil {
+				c.t.Fatalf("Failed to decode the response to %v: %v", command, err)
+			}
+		}
+		return
+	}
+}
+
+// event waits for the event name and returns its body. Other events
+// received before are dropped.
+func (c *client) event(name string) json.RawMessage {
+	c.t.Helper()
+	for {
+		var msg map[string]json.RawMessage
+		if len(c.events) > 0 {
+			msg, c.events = c.events[0], c.events[1:]
+		} else {
+			msg = c.next()
+		}
+		if decodeField[string](c.t, msg, "type") == "event" && decodeField[string](c.t, msg, "event") == name {
+			return msg["body"]
+		}
+	}
+}
+
+// expectStop waits for the script to stop and compares the reason and the
+// names and lines of the frames, given innermost first.
+func (c *client) expectStop(reason string, frames ...any) {
+	c.t.Helper()
+	var stopped StoppedEvent
+	if err := json.Unmarshal(c.event("stopped"), &stopped); err != nil {
+		c.t.Fatal(err)
+	}
+	if stopped.Reason != reason || stopped.ThreadID != threadID {
+		c.t.Fatalf("want stop for %v, got=%+v", reason, stopped)
+	}
+
+	var stack StackTraceResponse
+	c.request("stackTrace", StackTraceArguments{ThreadID: threadID}, &stack)
+	var got []any
+	for _, frame := range stack.StackFrames {
+		got = append(got, frame.Name, frame.Line)
+	}
+	if !reflect.DeepEqual(got, frames) {
+		c.t.Fatalf("want frames=%v, got=%v", frames, got)
+	}
+}
+
+func (c *client) expectVariables(ref int, expected []Variable) {
+	c.t.Helper()
+	var vars VariablesResponse
+	c.request("variables", VariablesArguments{VariablesReference: ref}, &vars)
+	if !reflect.DeepEqual(vars.Variables, expected) {
+		c.t.Fatalf("want=%+v, got=%+v", expected, vars.Variables)
+	}
+}
+
+func (c *client) expectOutput(category, output string) {
+	c.t.Helper()
+	var ev OutputEvent
+	if err := json.Unmarshal(c.event("output"), &ev); err != nil {
+		c.t.Fatal(err)
+	}
+	if ev.Category != category || ev.Output != output {
+		c.t.Fatalf("want %v output %q, got=%+v", category, output, ev)
+	}
+}
+
+func (c *client) expectExit(code int) {
+	c.t.Helper()
+	var ev ExitedEvent
+	if err := json.Unmarshal(c.event("exited"), &ev); err != nil {
+		c.t.Fatal(err)
+	}
+	if ev.ExitCode != code {
+		c.t.Fatalf("want exit code %v, got=%v", code, ev.ExitCode)
+	}
+	c.event("terminated")
+}
+
+func decodeField[T any](t *testing.T, msg map[string]json.RawMessage, key string) T {
+	t.Helper()
+	var v T
+	if raw, ok := msg[key]; ok {
+		if err := json.Unmarshal(raw, &v); err != nil {
+			t.Fatalf("Failed to decode %v: %v", key, err)
+		}
+	}
+	return v
+}
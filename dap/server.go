@@ -0,0 +1,509 @@
+// Package dap implements a Debug Adapter Protocol server for lily.
+//
+// The adapter speaks the protocol over a reader and a writer, usually
+// standard input and output, and debugs the script given by the launch
+// request. It supports line and function breakpoints, stepping, pausing,
+// stack traces, the inspection of variables and the evaluation of watch
+// expressions in a stopped frame. Scripts have a single thread, with the
+// ID 1. Modules are imported from the directory of the script.
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/debug"
+	"github.com/tombuente/lily/eval"
+	"github.com/tombuente/lily/internal/frame"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+)
+
+const threadID = 1
+
+type handler func(args json.RawMessage) (any, error)
+
+// Server is a debug adapter. Its zero value is not usable, use
+// [NewServer].
+type Server struct {
+	wmu sync.Mutex // guards w and seq, events are sent by the script too
+	w   io.Writer
+	seq int
+
+	handlers map[string]handler
+	// then is run after the response to the current request has been
+	// written, so that the events caused by the request follow it.
+	then func()
+
+	interp   *eval.Interpreter
+	debugger *debug.Debugger
+	program  string // absolute path of the script, set by launch
+	prog     *ast.Program
+	done     chan struct{} // closed when the script has ended, set once it runs
+
+	mu sync.Mutex // guards the fields below, which are set by the script
+	// frames holds the frames of the stopped script, innermost first. It
+	// is nil while the script runs.
+	frames []*eval.StackFrame
+	// refs holds the variables shown by the client, by their reference
+	// minus 1, until the script is resumed.
+	refs [][]eval.Variable
+}
+
+// NewServer returns a debug adapter.
+func NewServer() *Server {
+	s := &Server{interp: eval.New()}
+	s.debugger = debug.New(s.interp, s.stopped)
+
+	s.handlers = map[string]handler{
+		"initialize":              s.initialize,
+		"launch":                  s.launch,
+		"setBreakpoints":          s.setBreakpoints,
+		"setFunctionBreakpoints":  s.setFunctionBreakpoints,
+		"setExceptionBreakpoints": s.setExceptionBreakpoints,
+		"configurationDone":       s.configurationDone,
+		"threads":                 s.threads,
+		"stackTrace":              s.stackTrace,
+		"scopes":                  s.scopes,
+		"variables":               s.variables,
+		"evaluate":                s.evaluate,
+		"continue":                s.resume(s.debugger.Continue),
+		"next":                    s.resume(s.debugger.StepOver),
+		"stepIn":                  s.resume(s.debugger.StepIn),
+		"stepOut":                 s.resume(s.debugger.StepOut),
+		"pause":                   s.pause,
+		"terminate":               s.terminate,
+		"disconnect":              s.terminate,
+	}
+	return s
+}
+
+// Serve reads requests from r and writes responses and events to w until
+// the client disconnects or closes r. The script is terminated then.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.w = w
+	defer s.shutdown()
+
+	br := bufio.NewReader(r)
+	for {
+		msg, err := readMessage(br)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+		if msg.Command == "disconnect" {
+			return nil
+		}
+	}
+}
+
+// handle handles the request msg and responds to it.
+func (s *Server) handle(msg *message) error {
+	if msg.Type != "request" {
+		return nil
+	}
+	res := response{Type: "response", RequestSeq: msg.Seq, Command: msg.Command, Success: true}
+
+	h, ok := s.handlers[msg.Command]
+	if !ok {
+		res.Success, res.Message = false, "unsupported request: "+msg.Command
+		return s.write(&res.Seq, res)
+	}
+	body, err := h(msg.Arguments)
+	if err != nil {
+		res.Success, res.Message = false, err.Error()
+	} else {
+		res.Body = body
+	}
+	if err := s.write(&res.Seq, res); err != nil {
+		return err
+	}
+
+	if then := s.then; then != nil {
+		s.then = nil
+		then()
+	}
+	return nil
+}
+
+// write writes the response or event v after setting its sequence number
+// seq.
+func (s *Server) write(seq *int, v any) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	*seq = s.seq
+	return frame.Write(s.w, v)
+}
+
+func (s *Server) send(name string, body any) error {
+	ev := event{Type: "event", Event: name, Body: body}
+	return s.write(&ev.Seq, &ev)
+}
+
+// decode unmarshals the arguments of a request into v.
+func decode[T any](args json.RawMessage) (T, error) {
+	var v T
+	if len(args) == 0 {
+		return v, nil
+	}
+	if err := json.Unmarshal(args, &v); err != nil {
+		return v, fmt.Errorf("invalid arguments: %w", err)
+	}
+	return v, nil
+}
+
+func (s *Server) initialize(json.RawMessage) (any, error) {
+	return Capabilities{
+		SupportsConfigurationDoneRequest: true,
+		SupportsFunctionBreakpoints:      true,
+		SupportsEvaluateForHovers:        true,
+		SupportsTerminateRequest:         true,
+	}, nil
+}
+
+// launch loads the script. The client is asked for the breakpoints once
+// the script is known since they are set by module.
+func (s *Server) launch(args json.RawMessage) (any, error) {
+	a, err := decode[LaunchArguments](args)
+	if err != nil {
+		return nil, err
+	}
+	if s.prog != nil {
+		return nil, errors.New("a script is already launched")
+	}
+	program, err := filepath.Abs(a.Program)
+	if err != nil {
+		return nil, err
+	}
+	src, err := os.ReadFile(program)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := parser.New(lexer.New(string(src))).Parse()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", a.Program, err)
+	}
+
+	s.program, s.prog = program, prog
+	s.interp.SetLoader(eval.FSLoader{FS: os.DirFS(filepath.Dir(program))})
+	if a.StopOnEntry {
+		s.debugger.StopOnEntry()
+	}
+	s.then = func() { s.send("initialized", nil) }
+	return nil, nil
+}
+
+func (s *Server) setBreakpoints(args json.RawMessage) (any, error) {
+	a, err := decode[SetBreakpointsArguments](args)
+	if err != nil {
+		return nil, err
+	}
+	if s.prog == nil {
+		return nil, errors.New("no script launched")
+	}
+
+	breakpoints := make([]Breakpoint, len(a.Breakpoints))
+	module, ok := s.module(a.Source.Path)
+	if !ok {
+		for i, bp := range a.Breakpoints {
+			breakpoints[i] = Breakpoint{Line: bp.Line, Message: "not part of the script or its modules"}
+		}
+		return BreakpointsResponse{Breakpoints: breakpoints}, nil
+	}
+
+	lines, err := stmtLines(a.Source.Path)
+	var set []int
+	for i, bp := range a.Breakpoints {
+		breakpoints[i] = Breakpoint{Line: bp.Line}
+		switch {
+		case err != nil:
+			breakpoints[i].Message = err.Error()
+		case !lines[bp.Line]:
+			breakpoints[i].Message = "no statement on this line"
+		default:
+			breakpoints[i].Verified = true
+			set = append(set, bp.Line)
+		}
+	}
+	s.debugger.SetBreakpoints(module, set)
+	return BreakpointsResponse{Breakpoints: breakpoints}, nil
+}
+
+// stmtLines returns the lines of the file path on which statements start.
+func stmtLines(path string) (map[int]bool, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := parser.New(lexer.New(string(src))).Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make(map[int]bool)
+	add := func(stmts []ast.Stmt) {
+		for _, stmt := range stmts {
+			lines[stmt.Pos().Line] = true
+		}
+	}
+	ast.Inspect(prog, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.Program:
+			add(node.Stmts)
+		case *ast.BlockStmt:
+			add(node.Stmts)
+		}
+		return true
+	})
+	return lines, nil
+}
+
+// module returns the path the file path is imported as, "" for the
+// script, or false if it cannot be imported.
+func (s *Server) module(path string) (string, bool) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	if path == s.program {
+		return "", true
+	}
+	rel, err := filepath.Rel(filepath.Dir(s.program), path)
+	if err != nil || !filepath.IsLocal(rel) || filepath.Ext(rel) != ".lily" {
+		return "", false
+	}
+	return filepath.ToSlash(strings.TrimSuffix(rel, ".lily")), true
+}
+
+// source returns the file of the module path, "" for the script.
+func (s *Server) source(module string) Source {
+	path := s.program
+	if module != "" {
+		path = filepath.Join(filepath.Dir(s.program), filepath.FromSlash(module)+".lily")
+	}
+	return Source{Name: filepath.Base(path), Path: path}
+}
+
+func (s *Server) setFunctionBreakpoints(args json.RawMessage) (any, error) {
+	a, err := decode[SetFunctionBreakpointsArguments](args)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(a.Breakpoints))
+	breakpoints := make([]Breakpoint, len(a.Breakpoints))
+	for i, bp := range a.Breakpoints {
+		names[i] = bp.Name
+		breakpoints[i] = Breakpoint{Verified: true}
+	}
+	s.debugger.SetFunctionBreakpoints(names)
+	return BreakpointsResponse{Breakpoints: breakpoints}, nil
+}
+
+// setExceptionBreakpoints accepts no filters, errors always end the script.
+func (s *Server) setExceptionBreakpoints(json.RawMessage) (any, error) {
+	return BreakpointsResponse{Breakpoints: []Breakpoint{}}, nil
+}
+
+// configurationDone starts the script.
+func (s *Server) configurationDone(json.RawMessage) (any, error) {
+	if s.prog == nil {
+		return nil, errors.New("no script launched")
+	}
+	if s.done != nil {
+		return nil, nil
+	}
+	s.done = make(chan struct{})
+	s.then = func() { go s.run() }
+	return nil, nil
+}
+
+// run runs the script and reports its result.
+func (s *Server) run() {
+	defer close(s.done)
+
+	val, err := s.interp.Eval(s.prog)
+	code := 0
+	switch {
+	case errors.Is(err, debug.ErrTerminated):
+	case err != nil:
+		s.send("output", OutputEvent{Category: "stderr", Output: err.Error() + "\n"})
+		code = 1
+	case val != nil:
+		s.send("output", OutputEvent{Category: "stdout", Output: eval.Format(val) + "\n"})
+	}
+	s.send("exited", ExitedEvent{ExitCode: code})
+	s.send("terminated", nil)
+}
+
+// stopped is called by the script when it stops.
+func (s *Server) stopped(stop debug.Stop) {
+	s.mu.Lock()
+	s.frames = stop.Frames
+	s.mu.Unlock()
+	s.send("stopped", StoppedEvent{Reason: string(stop.Reason), ThreadID: threadID, AllThreadsStopped: true})
+}
+
+// resume returns the handler of a request resuming the script with f.
+func (s *Server) resume(f func()) handler {
+	return func(json.RawMessage) (any, error) {
+		s.then = func() {
+			s.mu.Lock()
+			s.frames, s.refs = nil, nil
+			s.mu.Unlock()
+			f()
+		}
+		return ContinueResponse{AllThreadsContinued: true}, nil
+	}
+}
+
+func (s *Server) pause(json.RawMessage) (any, error) {
+	s.then = s.debugger.Pause
+	return nil, nil
+}
+
+func (s *Server) terminate(json.RawMessage) (any, error) {
+	s.shutdown()
+	return nil, nil
+}
+
+// shutdown terminates the script and waits for it to end.
+func (s *Server) shutdown() {
+	s.debugger.Terminate()
+	if s.done != nil {
+		<-s.done
+	}
+}
+
+func (s *Server) threads(json.RawMessage) (any, error) {
+	return ThreadsResponse{Threads: []Thread{{ID: threadID, Name: "main"}}}, nil
+}
+
+func (s *Server) stackTrace(args json.RawMessage) (any, error) {
+	a, err := decode[StackTraceArguments](args)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	frames := s.frames[min(a.StartFrame, len(s.frames)):]
+	if a.Levels > 0 {
+		frames = frames[:min(a.Levels, len(frames))]
+	}
+	stack := []StackFrame{}
+	for i, frame := range frames {
+		stack = append(stack, StackFrame{
+			ID:     a.StartFrame + i,
+			Name:   frame.Function,
+			Source: s.source(frame.Module),
+			Line:   frame.Pos.Line,
+			Column: frame.Pos.Column,
+		})
+	}
+	return StackTraceResponse{StackFrames: stack, TotalFrames: len(s.frames)}, nil
+}
+
+// frame returns the stopped frame with the ID id, s.mu must be held.
+func (s *Server) frame(id int) (*eval.StackFrame, error) {
+	if s.frames == nil {
+		return nil, errors.New("the script is not stopped")
+	}
+	if id < 0 || id >= len(s.frames) {
+		return nil, fmt.Errorf("unknown frame %v", id)
+	}
+	return s.frames[id], nil
+}
+
+// ref returns a reference to vars, or 0 if it is empty. s.mu must be held.
+func (s *Server) ref(vars []eval.Variable) int {
+	if len(vars) == 0 {
+		return 0
+	}
+	s.refs = append(s.refs, vars)
+	return len(s.refs)
+}
+
+func (s *Server) scopes(args json.RawMessage) (any, error) {
+	a, err := decode[ScopesArguments](args)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frame, err := s.frame(a.FrameID)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := []Scope{}
+	for _, scope := range frame.Scopes() {
+		scopes = append(scopes, Scope{Name: scope.Name, VariablesReference: s.ref(scope.Vars)})
+	}
+	return ScopesResponse{Scopes: scopes}, nil
+}
+
+func (s *Server) variables(args json.RawMessage) (any, error) {
+	a, err := decode[VariablesArguments](args)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a.VariablesReference < 1 || a.VariablesReference > len(s.refs) {
+		return nil, fmt.Errorf("unknown variables reference %v", a.VariablesReference)
+	}
+
+	vars := []Variable{}
+	for _, v := range s.refs[a.VariablesReference-1] {
+		vars = append(vars, Variable{
+			Name:               v.Name,
+			Value:              eval.Format(v.Value),
+			Type:               v.Value.Info(),
+			VariablesReference: s.ref(eval.Fields(v.Value)),
+		})
+	}
+	return VariablesResponse{Variables: vars}, nil
+}
+
+// evaluate evaluates an expression in a stopped frame.
+func (s *Server) evaluate(args json.RawMessage) (any, error) {
+	a, err := decode[EvaluateArguments](args)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frame, err := s.frame(a.FrameID)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := frame.Eval(a.Expression)
+	if err != nil {
+		return nil, err
+	}
+	if val == nil {
+		val = eval.Nil()
+	}
+	return EvaluateResponse{
+		Result:             eval.Format(val),
+		Type:               val.Info(),
+		VariablesReference: s.ref(eval.Fields(val)),
+	}, nil
+}
@@ -0,0 +1,22 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tombuente/lily/internal/frame"
+)
+
+// readMessage reads a message framed by a Content-Length header.
+func readMessage(r *bufio.Reader) (*message, error) {
+	body, err := frame.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	var msg message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, fmt.Errorf("invalid message: %w", err)
+	}
+	return &msg, nil
+}
@@ -0,0 +1,251 @@
+// Package debug implements a step debugger for lily programs on top of the
+// hooks of the interpreter.
+//
+// The program runs on a goroutine of its own. When it stops, at a
+// breakpoint, after a step or when it is paused, the debugger reports the
+// stop and blocks the program until it is resumed by [Debugger.Continue] or
+// one of the step methods. The frames of a stop may be inspected until then.
+package debug
+
+import (
+	"errors"
+	"slices"
+	"sync"
+
+	"github.com/tombuente/lily/eval"
+)
+
+// ErrTerminated is the error the evaluation of a program fails with when it
+// is ended by [Debugger.Terminate].
+var ErrTerminated = errors.New("terminated by the debugger")
+
+type Reason string
+
+const (
+	ReasonEntry              Reason = "entry"
+	ReasonBreakpoint         Reason = "breakpoint"
+	ReasonFunctionBreakpoint Reason = "function breakpoint"
+	ReasonStep               Reason = "step"
+	ReasonPause              Reason = "pause"
+)
+
+// Stop describes where the program stopped.
+type Stop struct {
+	Reason Reason
+	// Frames holds the active frames, innermost first. They are valid
+	// until the program is resumed.
+	Frames []*eval.StackFrame
+}
+
+type mode int
+
+const (
+	running mode = iota
+	stepIn
+	stepOver
+	stepOut
+	pausing
+)
+
+// position is the line a frame was last seen at.
+type position struct {
+	frame *eval.StackFrame
+	line  int
+}
+
+// Debugger controls the evaluation of programs by an interpreter. Its
+// methods may be called from any goroutine.
+type Debugger struct {
+	stopped func(Stop)
+	resume  chan struct{}
+
+	mu          sync.Mutex
+	breakpoints map[string]map[int]bool // lines by module path, "" is the program
+	functions   map[string]bool
+	mode        mode
+	stack       []*eval.StackFrame // the active frames at the last stop
+	entry       bool               // stop at the first statement
+	paused      bool               // the program is blocked in the hook
+	terminated  bool
+
+	// last holds the position of each active frame, outermost first, as of
+	// their last statement. A statement starts a new line if its frame has
+	// left the line since.
+	last []position
+}
+
+// New returns a debugger controlling the evaluations of interp, which calls
+// stopped on the goroutine of the program whenever it stops.
+func New(interp *eval.Interpreter, stopped func(Stop)) *Debugger {
+	d := &Debugger{
+		stopped:     stopped,
+		resume:      make(chan struct{}),
+		breakpoints: make(map[string]map[int]bool),
+		functions:   make(map[string]bool),
+	}
+	interp.SetHook(d.hook)
+	return d
+}
+
+// StopOnEntry makes the program stop before its first statement.
+func (d *Debugger) StopOnEntry() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entry = true
+}
+
+// SetBreakpoints replaces the breakpoints of the module path, "" for the
+// program, with the given lines.
+func (d *Debugger) SetBreakpoints(path string, lines []int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.breakpoints[path] = make(map[int]bool)
+	for _, line := range lines {
+		d.breakpoints[path][line] = true
+	}
+}
+
+// SetFunctionBreakpoints replaces the function breakpoints, which stop the
+// program at the first statement of the calls of the named functions.
+// Methods are named like P.method.
+func (d *Debugger) SetFunctionBreakpoints(names []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.functions = make(map[string]bool)
+	for _, name := range names {
+		d.functions[name] = true
+	}
+}
+
+// Continue resumes the program until the next breakpoint.
+func (d *Debugger) Continue() {
+	d.resumeWith(running)
+}
+
+// StepIn resumes the program until the next line, entering calls.
+func (d *Debugger) StepIn() {
+	d.resumeWith(stepIn)
+}
+
+// StepOver resumes the program until the next line of the current function
+// or the ones it returns to.
+func (d *Debugger) StepOver() {
+	d.resumeWith(stepOver)
+}
+
+// StepOut resumes the program until it returns from the current function.
+func (d *Debugger) StepOut() {
+	d.resumeWith(stepOut)
+}
+
+// Pause stops the program at the next statement.
+func (d *Debugger) Pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.paused {
+		d.mode = pausing
+	}
+}
+
+// Terminate ends the program, whose evaluation fails with [ErrTerminated].
+func (d *Debugger) Terminate() {
+	d.mu.Lock()
+	d.terminated = true
+	d.mu.Unlock()
+	d.resumeWith(running)
+}
+
+// resumeWith sets the mode of the debugger and resumes the program if it is
+// stopped. Steps of a running program are ignored.
+func (d *Debugger) resumeWith(m mode) {
+	d.mu.Lock()
+	if !d.paused {
+		d.mu.Unlock()
+		return
+	}
+	d.mode = m
+	d.paused = false
+	d.mu.Unlock()
+	d.resume <- struct{}{}
+}
+
+func (d *Debugger) hook(ev eval.Event) error {
+	if ev.Kind != eval.StmtEvent {
+		return nil
+	}
+
+	d.mu.Lock()
+	if d.terminated {
+		d.mu.Unlock()
+		return ErrTerminated
+	}
+	reason, ok := d.stop(ev)
+	if !ok {
+		d.mu.Unlock()
+		return nil
+	}
+	d.paused = true
+	d.stack = slices.Clone(ev.Stack)
+	d.mu.Unlock()
+
+	frames := make([]*eval.StackFrame, len(ev.Stack))
+	for i, frame := range ev.Stack {
+		frames[len(frames)-1-i] = frame
+	}
+	d.stopped(Stop{Reason: reason, Frames: frames})
+	<-d.resume
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.terminated {
+		return ErrTerminated
+	}
+	return nil
+}
+
+// stop reports whether the program stops at the statement of ev and why.
+func (d *Debugger) stop(ev eval.Event) (Reason, bool) {
+	depth := len(ev.Stack)
+	frame := ev.Stack[depth-1]
+	line := ev.Pos.Line
+
+	// Statements on the line a frame is already at do not stop it again.
+	d.last = d.last[:min(len(d.last), depth)]
+	for i, pos := range d.last {
+		if pos.frame != ev.Stack[i] {
+			d.last = d.last[:i]
+			break
+		}
+	}
+	entered := len(d.last) < depth
+	newLine := entered || d.last[depth-1].line != line
+	if entered {
+		d.last = append(d.last, make([]position, depth-len(d.last))...)
+		for i := range d.last {
+			d.last[i].frame = ev.Stack[i]
+		}
+	}
+	d.last[depth-1].line = line
+
+	// Steps over and out stay in the frames active at the last stop.
+	active := depth <= len(d.stack) && d.stack[depth-1] == frame
+
+	switch {
+	case d.entry:
+		d.entry = false
+		return ReasonEntry, true
+	case d.mode == pausing:
+		return ReasonPause, true
+	case !newLine:
+		return "", false
+	case d.breakpoints[frame.Module][line]:
+		return ReasonBreakpoint, true
+	case entered && d.functions[frame.Function]:
+		return ReasonFunctionBreakpoint, true
+	case d.mode == stepIn,
+		d.mode == stepOver && active,
+		d.mode == stepOut && active && depth < len(d.stack):
+		return ReasonStep, true
+	}
+	return "", false
+}
@@ -0,0 +1,187 @@
+package debug
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tombuente/lily/eval"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+)
+
+const src = `let sq = fn(x) {
+	let y = x * x;
+	y
+};
+let a = sq(2); let b = sq(3);
+a + b`
+
+func TestBreakpoint(t *testing.T) {
+	s := start(t, src, nil, func(d *Debugger) {
+		d.SetBreakpoints("", []int{2})
+	})
+
+	s.expect(t, "breakpoint sq@2 <main>@5")
+	if val, err := s.stop.Frames[0].Eval("x"); err != nil || eval.Format(val) != "2" {
+		t.Fatalf("want=2, got=%v, %v", val, err)
+	}
+	s.d.Continue()
+	// The statements of a line stop at it once, but every call does.
+	s.expect(t, "breakpoint sq@2 <main>@5")
+	if val, err := s.stop.Frames[0].Eval("x"); err != nil || eval.Format(val) != "3" {
+		t.Fatalf("want=3, got=%v, %v", val, err)
+	}
+	s.d.Continue()
+	s.result(t, "13")
+}
+
+func TestStep(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []func(d *Debugger)
+		stops []string
+	}{
+		{
+			name:  "over",
+			steps: []func(d *Debugger){(*Debugger).StepOver, (*Debugger).StepOver},
+			stops: []string{"step <main>@5", "step <main>@6"},
+		},
+		{
+			name:  "in and over",
+			steps: []func(d *Debugger){(*Debugger).StepOver, (*Debugger).StepIn, (*Debugger).StepOver, (*Debugger).StepOver},
+			stops: []string{"step <main>@5", "step sq@2 <main>@5", "step sq@3 <main>@5", "step <main>@6"},
+		},
+		{
+			name:  "in and out",
+			steps: []func(d *Debugger){(*Debugger).StepIn, (*Debugger).StepIn, (*Debugger).StepOut},
+			stops: []string{"step <main>@5", "step sq@2 <main>@5", "step <main>@6"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := start(t, src, nil, (*Debugger).StopOnEntry)
+			s.expect(t, "entry <main>@1")
+			for i, step := range tt.steps {
+				step(s.d)
+				s.expect(t, tt.stops[i])
+			}
+			s.d.Continue()
+			s.result(t, "13")
+		})
+	}
+}
+
+func TestFunctionBreakpoint(t *testing.T) {
+	s := start(t, src, nil, func(d *Debugger) {
+		d.SetFunctionBreakpoints([]string{"sq"})
+	})
+	s.expect(t, "function breakpoint sq@2 <main>@5")
+	s.d.Continue()
+	s.expect(t, "function breakpoint sq@2 <main>@5")
+	s.d.Continue()
+	s.result(t, "13")
+}
+
+func TestModuleBreakpoint(t *testing.T) {
+	loader := eval.MapLoader{"lib/m": "export let f = fn(n) {\n\tn + 1\n};"}
+	s := start(t, "import \"lib/m\" as m;\nm.f(1)", loader, func(d *Debugger) {
+		d.SetBreakpoints("lib/m", []int{2})
+	})
+	s.expect(t, "breakpoint f@2 <main>@2")
+	if module := s.stop.Frames[0].Module; module != "lib/m" {
+		t.Fatalf("want=lib/m, got=%v", module)
+	}
+	s.d.Continue()
+	s.result(t, "2")
+}
+
+func TestPauseAndTerminate(t *testing.T) {
+	s := start(t, "let loop = fn(n) {\n\tloop(n + 1)\n};\nloop(0)", nil, nil)
+	s.d.Pause()
+	select {
+	case stop := <-s.stops:
+		if stop.Reason != ReasonPause {
+			t.Fatalf("want=%v, got=%v", ReasonPause, stop.Reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("want=%v, timed out", ReasonPause)
+	}
+	s.d.Terminate()
+	if err := <-s.done; !errors.Is(err, ErrTerminated) {
+		t.Fatalf("want=%v, got=%v", ErrTerminated, err)
+	}
+}
+
+type session struct {
+	d     *Debugger
+	stops chan Stop
+	done  chan error
+	val   eval.Value
+
+	stop Stop // the last stop
+}
+
+// start runs src with a debugger set up by setup.
+func start(t *testing.T, src string, loader eval.ModuleLoader, setup func(d *Debugger)) *session {
+	t.Helper()
+	prog, err := parser.New(lexer.New(src)).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse program: %v", err)
+	}
+
+	interp := eval.New()
+	interp.SetLoader(loader)
+	s := &session{stops: make(chan Stop), done: make(chan error, 1)}
+	s.d = New(interp, func(stop Stop) { s.stops <- stop })
+	if setup != nil {
+		setup(s.d)
+	}
+	go func() {
+		var err error
+		s.val, err = interp.Eval(prog)
+		s.done <- err
+	}()
+	t.Cleanup(s.d.Terminate)
+	return s
+}
+
+// expect waits for the program to stop and compares the reason and the
+// frames of the stop, written like "step f@2 <main>@5".
+func (s *session) expect(t *testing.T, expected string) {
+	t.Helper()
+	select {
+	case s.stop = <-s.stops:
+	case err := <-s.done:
+		t.Fatalf("want=%v, program ended with %v", expected, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("want=%v, timed out", expected)
+	}
+
+	got := string(s.stop.Reason)
+	for _, frame := range s.stop.Frames {
+		got += fmt.Sprintf(" %v@%v", frame.Function, frame.Pos.Line)
+	}
+	if got != expected {
+		t.Fatalf("want=%v, got=%v", expected, got)
+	}
+}
+
+// result waits for the program to end and compares its value.
+func (s *session) result(t *testing.T, expected string) {
+	t.Helper()
+	select {
+	case stop := <-s.stops:
+		t.Fatalf("want=%v, program stopped: %v", expected, stop.Reason)
+	case err := <-s.done:
+		if err != nil {
+			t.Fatalf("Failed with error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("want=%v, timed out", expected)
+	}
+	if got := eval.Format(s.val); got != expected {
+		t.Fatalf("want=%v, got=%v", expected, got)
+	}
+}
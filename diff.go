@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines around the changes of a hunk.
+const diffContext = 3
+
+// edit is a line of a diff. op is ' ' for an unchanged line, '-' for a
+// removed and '+' for an added one.
+type edit struct {
+	op   byte
+	line string
+}
+
+// unifiedDiff returns the unified diff from a to b, the contents of the file
+// name, or "" if they are equal.
+func unifiedDiff(name, a, b string) string {
+	if a == b {
+		return ""
+	}
+	edits := lineDiff(splitLines(a), splitLines(b))
+
+	// before[i] and after[i] are the numbers of lines of a and b before edits[i].
+	before := make([]int, len(edits)+1)
+	after := make([]int, len(edits)+1)
+	for i, e := range edits {
+		before[i+1], after[i+1] = before[i], after[i]
+		if e.op != '+' {
+			before[i+1]++
+		}
+		if e.op != '-' {
+			after[i+1]++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %v.orig\n+++ %v\n", name, name)
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+
+		// A hunk ends at the first run of unchanged lines that is too long
+		// to join it with the next change.
+		start, end := max(i-diffContext, 0), i
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(edits) && edits[next].op == ' ' {
+				next++
+			}
+			if next == len(edits) || next-end > 2*diffContext {
+				end = min(end+diffContext, len(edits))
+				break
+			}
+			end = next
+		}
+
+		fmt.Fprintf(&out, "@@ -%v +%v @@\n", hunkRange(before[start], before[end]), hunkRange(after[start], after[end]))
+		for _, e := range edits[start:end] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// hunkRange returns the range of the lines from, exclusive, to to,
+// inclusive, in the format of a hunk header.
+func hunkRange(from, to int) string {
+	switch to - from {
+	case 0:
+		return fmt.Sprintf("%v,0", from)
+	case 1:
+		return fmt.Sprint(to)
+	default:
+		return fmt.Sprintf("%v,%v", from+1, to-from)
+	}
+}
+
+// lineDiff returns the edits from a to b, based on their longest common
+// subsequence of lines.
+func lineDiff(a, b []string) []edit {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			edits = append(edits, edit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		edits = append(edits, edit{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		edits = append(edits, edit{'+', b[j]})
+	}
+	return edits
+}
+
+// splitLines splits s after each newline.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tombuente/lily/doc"
+	"github.com/tombuente/lily/eval"
+)
+
+// runDoc prints the API reference of the files and directories in args, or
+// standard input if there are none, followed by the one of the builtins.
+// Directories are walked for .lily files.
+func runDoc(args []string) error {
+	flags := flag.NewFlagSet("doc", flag.ExitOnError)
+	html := flags.Bool("html", false, "print HTML instead of Markdown")
+	title := flags.String("title", "API reference", "title of the reference")
+	builtins := flags.Bool("builtins", true, "document the builtins")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: lily doc [-html] [-title title] [-builtins=false] [path ...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var mods []*doc.Module
+	if flags.NArg() == 0 {
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		mod, err := doc.Source("<standard input>", string(src))
+		if err != nil {
+			return fmt.Errorf("<standard input>: %w", err)
+		}
+		mods = append(mods, mod)
+	}
+	for _, path := range flags.Args() {
+		m, err := modules(path)
+		if err != nil {
+			return err
+		}
+		mods = append(mods, m...)
+	}
+	if *builtins {
+		mod, err := doc.Source("builtins", eval.BuiltinDocs())
+		if err != nil {
+			return err
+		}
+		mods = append(mods, mod)
+	}
+
+	if *html {
+		return doc.HTML(os.Stdout, *title, mods)
+	}
+	return doc.Markdown(os.Stdout, *title, mods)
+}
+
+// modules returns the documentation of the file path, or of the .lily files
+// in the directory path. Modules are named by their path without the
+// extension, relative to the directory.
+func modules(path string) ([]*doc.Module, error) {
+	var mods []*doc.Module
+	err := walkFiles(path, func(file string) error {
+		name, err := filepath.Rel(path, file)
+		if err != nil || name == "." {
+			name = filepath.Base(file)
+		}
+		mod, err := module(file, filepath.ToSlash(strings.TrimSuffix(name, ".lily")))
+		if err != nil {
+			return err
+		}
+		mods = append(mods, mod)
+		return nil
+	})
+	return mods, err
+}
+
+func module(path, name string) (*doc.Module, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mod, err := doc.Source(name, string(src))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return mod, nil
+}
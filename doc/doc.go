@@ -0,0 +1,181 @@
+// Package doc extracts API references from lily source code.
+//
+// A function bound by a top-level let or const is documented by the lines
+// of // comments starting with /// directly above its declaration:
+//
+//	/// greet returns a greeting for name.
+//	///
+//	/// The greeting is in English.
+//	let greet = fn(name) { "hello " + name };
+//
+// The text of a doc comment is the one of its lines without /// and the
+// space following it. Blank lines separate paragraphs and indented lines
+// are preformatted, as in Markdown. The reference lists the functions that
+// have a doc comment or are exported, and renders as Markdown or HTML.
+package doc
+
+import (
+	"strings"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+	"github.com/tombuente/lily/token"
+)
+
+// Module is the documentation of a source file.
+type Module struct {
+	Name  string // such as the path of the module
+	Funcs []*Func
+}
+
+// Func is the documentation of a function.
+type Func struct {
+	Name string
+	// Params holds the parameters as written in the declaration, with
+	// their annotations: "n: int", "[a, b]".
+	Params   []string
+	Result   string // annotated result type, "" if there is none
+	Doc      string // text of the doc comment, "" if there is none
+	Const    bool   // bound by const instead of let
+	Exported bool
+	Pos      token.Pos
+}
+
+// Signature returns the declaration of f without its body.
+func (x *Func) Signature() string {
+	keyword := "let "
+	if x.Const {
+		keyword = "const "
+	}
+	sig := keyword + x.Name + " = fn(" + strings.Join(x.Params, ", ") + ")"
+	if x.Result != "" {
+		sig += ": " + x.Result
+	}
+	return sig
+}
+
+// Source returns the documentation of src, the source of the module name.
+func Source(name, src string) (*Module, error) {
+	l := lexer.New(src)
+	prog, err := parser.New(l).Parse()
+	if err != nil {
+		return nil, err
+	}
+	docs := comments(src, l.Comments())
+
+	mod := &Module{Name: name}
+	for _, stmt := range prog.Stmts {
+		pos, exported := stmt.Pos(), false
+		if export, ok := stmt.(*ast.ExportStmt); ok {
+			stmt, exported = export.Stmt, true
+		}
+		let, ok := stmt.(*ast.LetStmt)
+		if !ok || let.Ident == nil {
+			continue
+		}
+		fn, ok := let.Expr.(*ast.Function)
+		if !ok {
+			continue
+		}
+
+		f := &Func{Name: let.Ident.Value, Doc: docs[pos.Line], Const: let.Const, Exported: exported, Pos: let.Ident.Pos()}
+		if f.Doc == "" && !exported {
+			continue
+		}
+		for i, param := range fn.Params {
+			p := pattern(param)
+			if i < len(fn.ParamTypes) && fn.ParamTypes[i] != nil {
+				p += ": " + typeExpr(fn.ParamTypes[i])
+			}
+			f.Params = append(f.Params, p)
+		}
+		if fn.Result != nil {
+			f.Result = typeExpr(fn.Result)
+		}
+		mod.Funcs = append(mod.Funcs, f)
+	}
+	return mod, nil
+}
+
+// comments returns the text of the doc comments of src by the line
+// following them.
+func comments(src string, comments []token.Token) map[int]string {
+	lines := strings.Split(src, "\n")
+	text := make(map[int]string) // of the doc comment lines, by line
+	for _, c := range comments {
+		own := strings.TrimSpace(lines[c.Pos.Line-1][:c.Pos.Column-1]) == ""
+		if line, ok := strings.CutPrefix(c.Literal, "///"); ok && own && !strings.HasPrefix(line, "/") {
+			text[c.Pos.Line] = strings.TrimPrefix(line, " ")
+		}
+	}
+
+	docs := make(map[int]string)
+	for line := range text {
+		if _, ok := text[line+1]; ok {
+			continue
+		}
+		// line ends a doc comment.
+		start := line
+		for {
+			if _, ok := text[start-1]; !ok {
+				break
+			}
+			start--
+		}
+		var b strings.Builder
+		for l := start; l <= line; l++ {
+			b.WriteString(strings.TrimRight(text[l], " \t"))
+			b.WriteString("\n")
+		}
+		docs[line+1] = strings.Trim(b.String(), "\n")
+	}
+	return docs
+}
+
+// pattern returns the source of a parameter.
+func pattern(p ast.Pattern) string {
+	switch p := p.(type) {
+	case *ast.IdentPattern:
+		return p.Ident.Value
+	case *ast.WildcardPattern:
+		return "_"
+	case *ast.ArrayPattern:
+		elems := make([]string, len(p.Elems))
+		for i, e := range p.Elems {
+			elems[i] = pattern(e)
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	case *ast.ObjectPattern:
+		fields := make([]string, len(p.Fields))
+		for i, f := range p.Fields {
+			fields[i] = f.Name.Value
+			if ident, ok := f.Pattern.(*ast.IdentPattern); !ok || ident.Ident.Value != f.Name.Value {
+				fields[i] += ": " + pattern(f.Pattern)
+			}
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+	return "?"
+}
+
+// typeExpr returns the source of an annotation.
+func typeExpr(typ ast.TypeExpr) string {
+	switch t := typ.(type) {
+	case *ast.NamedType:
+		return t.Name.Value
+	case *ast.ArrayType:
+		return "[" + typeExpr(t.Elem) + "]"
+	case *ast.FuncType:
+		params := make([]string, len(t.Params))
+		for i, param := range t.Params {
+			params[i] = typeExpr(param)
+		}
+		s := "fn(" + strings.Join(params, ", ") + ")"
+		if t.Result != nil {
+			s += ": " + typeExpr(t.Result)
+		}
+		return s
+	}
+	return "?"
+}
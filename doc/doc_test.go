@@ -0,0 +1,125 @@
+package doc
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/tombuente/lily/eval"
+	"github.com/tombuente/lily/token"
+)
+
+func TestSource(t *testing.T) {
+	src := `/// add returns the sum of a and b.
+///
+/// It works for strings, too.
+let add = fn(a: int, b): int { a + b };
+
+/// not a doc comment, the line below is blank
+
+let undocumented = fn() { 1 };
+export let pair = fn([x, y], {k, v: w}, _) { x };
+let n = 1; /// not a doc comment either
+/// doc comments of values are ignored
+let value = 2;
+//// not a doc comment
+let quadruple = fn() { 4 };
+if true {
+	/// only the top level is documented
+	let nested = fn() { 1 };
+}
+/// docs
+/// of const
+const c = fn(f: fn(int): [int]) {}`
+	mod, err := Source("m", src)
+	if err != nil {
+		t.Fatalf("Failed to extract: %v", err)
+	}
+
+	expected := &Module{Name: "m", Funcs: []*Func{
+		{
+			Name:   "add",
+			Params: []string{"a: int", "b"},
+			Result: "int",
+			Doc:    "add returns the sum of a and b.\n\nIt works for strings, too.",
+			Pos:    token.Pos{Line: 4, Column: 5},
+		},
+		{Name: "pair", Params: []string{"[x, y]", "{k, v: w}", "_"}, Exported: true, Pos: token.Pos{Line: 9, Column: 12}},
+		{Name: "c", Params: []string{"f: fn(int): [int]"}, Doc: "docs\nof const", Const: true, Pos: token.Pos{Line: 21, Column: 7}},
+	}}
+	if !reflect.DeepEqual(mod, expected) {
+		for i, f := range mod.Funcs {
+			t.Logf("got[%d]=%+v", i, *f)
+		}
+		t.Fatalf("want=%+v", expected.Funcs)
+	}
+	if sig, expected := mod.Funcs[0].Signature(), "let add = fn(a: int, b): int"; sig != expected {
+		t.Fatalf("want=%v, got=%v", expected, sig)
+	}
+	if sig, expected := mod.Funcs[2].Signature(), "const c = fn(f: fn(int): [int])"; sig != expected {
+		t.Fatalf("want=%v, got=%v", expected, sig)
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	mods := []*Module{
+		{Name: "empty"},
+		{Name: "m", Funcs: []*Func{
+			{Name: "f", Params: []string{"a"}, Doc: "f does it.\n\n\tf(1)"},
+			{Name: "g", Exported: true},
+		}},
+	}
+	var b strings.Builder
+	if err := Markdown(&b, "Ref", mods); err != nil {
+		t.Fatalf("Failed to render: %v", err)
+	}
+
+	expected := "# Ref\n\n## m\n\n" +
+		"### f\n\n```lily\nlet f = fn(a)\n```\n\nf does it.\n\n\tf(1)\n\n" +
+		"### g\n\n```lily\nlet g = fn()\n```\n"
+	if b.String() != expected {
+		t.Fatalf("want=\n%v\ngot=\n%v", expected, b.String())
+	}
+}
+
+func TestHTML(t *testing.T) {
+	mods := []*Module{{Name: "m", Funcs: []*Func{
+		{Name: "f", Params: []string{"a"}, Doc: "f compares a < b\nand more.\n\n\tf(1)\n\tf(2)\nDone."},
+	}}}
+	var b strings.Builder
+	if err := HTML(&b, "Ref <1>", mods); err != nil {
+		t.Fatalf("Failed to render: %v", err)
+	}
+
+	for _, expected := range []string{
+		"<title>Ref &lt;1&gt;</title>",
+		`<li><a href="#m.f">f</a></li>`,
+		`<h3 id="m.f">f</h3>`,
+		"<pre><code>let f = fn(a)</code></pre>",
+		"<p>f compares a &lt; b\nand more.</p>\n<pre>\tf(1)\n\tf(2)</pre>\n<p>Done.</p>",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("want %q in\n%v", expected, b.String())
+		}
+	}
+}
+
+// TestBuiltins checks that every default builtin is documented.
+func TestBuiltins(t *testing.T) {
+	mod, err := Source("builtins", eval.BuiltinDocs())
+	if err != nil {
+		t.Fatalf("Failed to extract: %v", err)
+	}
+	var names []string
+	for _, f := range mod.Funcs {
+		if f.Doc == "" {
+			t.Errorf("%v is not documented", f.Name)
+		}
+		names = append(names, f.Name)
+	}
+	slices.Sort(names)
+	if expected := eval.New().Builtins(); !slices.Equal(names, expected) {
+		t.Fatalf("want=%v, got=%v", expected, names)
+	}
+}
@@ -0,0 +1,125 @@
+package doc
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+)
+
+// Markdown writes the reference of mods, titled title, to w as Markdown.
+// Modules without functions are left out.
+func Markdown(w io.Writer, title string, mods []*Module) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "# %v\n", title)
+	for _, mod := range mods {
+		if len(mod.Funcs) == 0 {
+			continue
+		}
+		fmt.Fprintf(b, "\n## %v\n", mod.Name)
+		for _, f := range mod.Funcs {
+			fmt.Fprintf(b, "\n### %v\n\n```lily\n%v\n```\n", f.Name, f.Signature())
+			if f.Doc != "" {
+				fmt.Fprintf(b, "\n%v\n", f.Doc)
+			}
+		}
+	}
+	return b.Flush()
+}
+
+// HTML writes the reference of mods, titled title, to w as an HTML page
+// with a table of contents. Modules without functions are left out.
+func HTML(w io.Writer, title string, mods []*Module) error {
+	var shown []*Module
+	for _, mod := range mods {
+		if len(mod.Funcs) > 0 {
+			shown = append(shown, mod)
+		}
+	}
+	return page.Execute(w, struct {
+		Title   string
+		Modules []*Module
+	}{title, shown})
+}
+
+// block is a paragraph or a preformatted block of a doc comment.
+type block struct {
+	Pre  bool
+	Text string
+}
+
+// blocks splits the text of a doc comment into blocks. Blank lines end
+// paragraphs, and indented lines are preformatted.
+func blocks(text string) []block {
+	var blocks []block
+	var lines []string
+	pre := false
+	flush := func() {
+		if len(lines) > 0 {
+			blocks = append(blocks, block{Pre: pre, Text: strings.Join(lines, "\n")})
+		}
+		lines = nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		indented := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		switch {
+		case line == "":
+			flush()
+		case indented != pre:
+			flush()
+			pre = indented
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	flush()
+	return blocks
+}
+
+var page = template.Must(template.New("page").Funcs(template.FuncMap{"blocks": blocks}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; padding: 0 1em; line-height: 1.5; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+h3 { margin-top: 2em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<nav>
+<ul>
+{{- range .Modules}}
+<li><a href="#{{.Name}}">{{.Name}}</a>
+<ul>
+{{- $mod := .Name}}
+{{- range .Funcs}}
+<li><a href="#{{$mod}}.{{.Name}}">{{.Name}}</a></li>
+{{- end}}
+</ul>
+</li>
+{{- end}}
+</ul>
+</nav>
+{{- range .Modules}}
+{{- $mod := .Name}}
+<h2 id="{{.Name}}">{{.Name}}</h2>
+{{- range .Funcs}}
+<h3 id="{{$mod}}.{{.Name}}">{{.Name}}</h3>
+<pre><code>{{.Signature}}</code></pre>
+{{- range blocks .Doc}}
+{{- if .Pre}}
+<pre>{{.Text}}</pre>
+{{- else}}
+<p>{{.Text}}</p>
+{{- end}}
+{{- end}}
+{{- end}}
+{{- end}}
+</body>
+</html>
+`))
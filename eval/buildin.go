@@ -1,19 +1,85 @@
 package eval
 
-import "fmt"
+import (
+	_ "embed"
+	"fmt"
+)
+
+//go:embed buildin.lily
+var builtinDocs string
+
+// BuiltinDocs returns lily source declaring the default builtins as
+// functions with doc comments, from which tools such as lily doc generate
+// their documentation.
+func BuiltinDocs() string {
+	return builtinDocs
+}
 
 var builtin = map[string]*builtinFunctionObject{
-	"len": {fn: lenBuildin},
+	"len": {name: "len", fn: lenBuildin},
+	"ok":  {name: "ok", fn: okBuildin},
+	"err": {name: "err", fn: errBuildin},
+
+	"freeze": {name: "freeze", fn: freezeBuildin},
 }
 
 func lenBuildin(args ...object) (object, error) {
 	if len(args) != 1 {
-		return nil, &internalError{msg: fmt.Sprintf("len accepts 1 argument, got=%v", len(args))}
+		return nil, &typeError{msg: fmt.Sprintf("len accepts 1 argument, got=%v", len(args))}
 	}
 
 	switch arg := args[0].(type) {
 	case *stringObject:
 		return &intObject{value: int64(len(arg.value))}, nil
+	case *arrayObject:
+		return &intObject{value: int64(len(arg.elems))}, nil
+	}
+	return nil, &typeError{msg: fmt.Sprintf("arg not supported for len, got=%v", args[0].Info())}
+}
+
+func okBuildin(args ...object) (object, error) {
+	if len(args) != 1 {
+		return nil, &typeError{msg: fmt.Sprintf("ok accepts 1 argument, got=%v", len(args))}
+	}
+	return &resultObject{ok: true, value: args[0]}, nil
+}
+
+func errBuildin(args ...object) (object, error) {
+	if len(args) != 1 {
+		return nil, &typeError{msg: fmt.Sprintf("err accepts 1 argument, got=%v", len(args))}
+	}
+	return &resultObject{value: args[0]}, nil
+}
+
+// freezeBuildin makes its argument and all arrays and structs reachable
+// from it immutable and returns it.
+func freezeBuildin(args ...object) (object, error) {
+	if len(args) != 1 {
+		return nil, &typeError{msg: fmt.Sprintf("freeze accepts 1 argument, got=%v", len(args))}
+	}
+	freeze(args[0])
+	return args[0], nil
+}
+
+func freeze(obj object) {
+	var elems []object
+	switch obj := obj.(type) {
+	case *arrayObject:
+		if obj.frozen {
+			return
+		}
+		obj.frozen, elems = true, obj.elems
+	case *structObject:
+		if obj.frozen {
+			return
+		}
+		obj.frozen, elems = true, obj.fields
+	case *variantObject:
+		elems = obj.fields
+	case *resultObject:
+		elems = []object{obj.value}
+	}
+	for _, elem := range elems {
+		freeze(elem)
 	}
-	return nil, &internalError{msg: fmt.Sprintf("arg not supported for len, got=%v", args[0].Info())}
 }
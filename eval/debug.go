@@ -0,0 +1,288 @@
+package eval
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+	"github.com/tombuente/lily/resolver"
+	"github.com/tombuente/lily/token"
+)
+
+// Hook is called by the interpreter before it runs a statement and before
+// it calls a function, see [Interpreter.SetHook]. Returning an error aborts
+// the evaluation with that error, which scripts cannot catch.
+type Hook func(ev Event) error
+
+type EventKind int
+
+const (
+	StmtEvent EventKind = iota // a statement is about to run
+	CallEvent                  // a function or builtin is about to be called
+)
+
+// Event describes the point of the evaluation a hook is called at.
+type Event struct {
+	Kind EventKind
+	Pos  token.Pos // position of the statement or call
+	// Function is the name of the called function for a CallEvent.
+	Function string
+	// Stack holds the active frames, outermost first. The event occurs in
+	// the last one, a CallEvent before the frame of the call is pushed.
+	// The slice and its frames are only valid during the call of the hook.
+	Stack []*StackFrame
+}
+
+// SetHook sets the hook called during evaluation, nil removes it. It must
+// not be called while a program is evaluated, except by the hook itself to
+// remove it.
+func (x *Interpreter) SetHook(hook Hook) {
+	x.hook = hook
+}
+
+// StackFrame is a running function or the top level of the program or of
+// an imported module.
+type StackFrame struct {
+	// Function is the name of the function, "<main>" for the top level of
+	// the program and "<module>" for the one of a module.
+	Function string
+	Module   string    // path of the module the code is from, "" for the program
+	Pos      token.Pos // position of the statement being run
+
+	in  *evaluator
+	env *environment
+	fn  *resolver.Function // nil at the top level
+}
+
+// Scope is a set of variables of a frame.
+type Scope struct {
+	Name string
+	Vars []Variable
+}
+
+type Variable struct {
+	Name  string
+	Value Value
+}
+
+// Scopes returns the variables visible in the frame, innermost first: the
+// locals of the function, the variables it captured and the globals of its
+// program or module. Variables not yet defined are left out. A name
+// declared by several blocks of a function is taken from the latest
+// declaration that has a value.
+func (x *StackFrame) Scopes() []Scope {
+	var scopes []Scope
+	if x.fn != nil {
+		locals := Scope{Name: "Locals"}
+		for i, name := range x.fn.Locals {
+			// Destructured parameters are held by hidden locals.
+			if x.env.slots[i] == nil || strings.HasPrefix(name, "[") {
+				continue
+			}
+			locals.Vars = slices.DeleteFunc(locals.Vars, func(v Variable) bool { return v.Name == name })
+			locals.Vars = append(locals.Vars, Variable{name, x.env.slots[i]})
+		}
+
+		captured := Scope{Name: "Captured"}
+		for i, c := range x.fn.Upvalues {
+			if val := *x.env.upvalues[i]; val != nil {
+				captured.Vars = append(captured.Vars, Variable{c.Name, val})
+			}
+		}
+		scopes = append(scopes, locals, captured)
+	}
+
+	globals := Scope{Name: "Globals"}
+	for i, name := range x.in.info.Globals {
+		if val := x.in.globals[i]; val != nil {
+			globals.Vars = append(globals.Vars, Variable{name, val})
+		}
+	}
+	return append(scopes, globals)
+}
+
+// Eval evaluates the expression or statements src in the frame, which see
+// the variables returned by [StackFrame.Scopes] but cannot assign them.
+// Hooks are not called while src runs.
+func (x *StackFrame) Eval(src string) (Value, error) {
+	prog, err := parser.New(lexer.New(src)).Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]object)
+	for _, scope := range slices.Backward(x.Scopes()) {
+		for _, v := range scope.Vars {
+			names[v.Name] = v.Value
+		}
+	}
+	interp := x.in.interp
+	info, err := resolver.Resolve(prog, slices.Concat(slices.Collect(maps.Keys(interp.builtins)), slices.Collect(maps.Keys(names))))
+	if err != nil {
+		return nil, &nameError{msg: err.Error()}
+	}
+
+	hook := interp.hook
+	interp.hook = nil
+	defer func() { interp.hook = hook }()
+
+	in := &evaluator{
+		interp:   interp,
+		info:     info,
+		builtins: interp.builtins,
+		globals:  make([]object, len(info.Globals)),
+		module:   x.Module,
+		names:    names,
+	}
+	return in.run(&StackFrame{Function: "<eval>", Module: x.Module}, prog)
+}
+
+// run evaluates the top level node in a frame of its own.
+func (in *evaluator) run(frame *StackFrame, node ast.Node) (object, error) {
+	frame.in, frame.env = in, &environment{}
+	in.interp.stack = append(in.interp.stack, frame)
+	defer in.interp.pop()
+	return in.eval(node, frame.env)
+}
+
+func (x *Interpreter) pop() {
+	x.stack = x.stack[:len(x.stack)-1]
+}
+
+// step records that the innermost frame runs the statement at pos next.
+func (x *Interpreter) step(pos token.Pos) error {
+	if x.hook == nil {
+		return nil
+	}
+	x.stack[len(x.stack)-1].Pos = pos
+	return x.hook(Event{Kind: StmtEvent, Pos: pos, Stack: x.stack})
+}
+
+func (x *Interpreter) call(pos token.Pos, name string) error {
+	if x.hook == nil {
+		return nil
+	}
+	return x.hook(Event{Kind: CallEvent, Pos: pos, Function: name, Stack: x.stack})
+}
+
+// Format returns v the way it is written in lily source where possible,
+// such as 1, "a", [1, 2] or P { x: 1 }.
+func Format(v Value) string {
+	var b strings.Builder
+	format(&b, v, 0)
+	return b.String()
+}
+
+// format writes v to b, nested values beyond a depth of 4 are elided since
+// arrays and structs may contain themselves.
+func format(b *strings.Builder, v Value, depth int) {
+	if depth > 4 {
+		b.WriteString("...")
+		return
+	}
+	list := func(vals []object) {
+		for i, val := range vals {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			format(b, val, depth+1)
+		}
+	}
+
+	switch v := v.(type) {
+	case *intObject:
+		b.WriteString(strconv.FormatInt(v.value, 10))
+	case *stringObject:
+		b.WriteString(strconv.Quote(v.value))
+	case *boolObject:
+		b.WriteString(strconv.FormatBool(v.value))
+	case *nilObject:
+		b.WriteString("nil")
+	case *arrayObject:
+		b.WriteString("[")
+		list(v.elems)
+		b.WriteString("]")
+	case *structObject:
+		fmt.Fprintf(b, "%v {", v.typ.name)
+		for i, val := range v.fields {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(b, " %v: ", v.typ.fields[i])
+			format(b, val, depth+1)
+		}
+		b.WriteString(" }")
+	case *variantObject:
+		fmt.Fprintf(b, "%v.%v", v.typ.enum.name, v.typ.name)
+		if v.fields != nil {
+			b.WriteString("(")
+			list(v.fields)
+			b.WriteString(")")
+		}
+	case *resultObject:
+		if v.ok {
+			b.WriteString("ok(")
+		} else {
+			b.WriteString("err(")
+		}
+		format(b, v.value, depth+1)
+		b.WriteString(")")
+	case *errorObject:
+		fmt.Fprintf(b, "error(%v: %v)", v.kind, v.message)
+	case *functionObject:
+		fmt.Fprintf(b, "fn %v", cmp.Or(v.name, "<anonymous>"))
+	case *boundMethod:
+		fmt.Fprintf(b, "method %v", cmp.Or(v.fn.name, "<anonymous>"))
+	case *builtinFunctionObject:
+		fmt.Fprintf(b, "builtin %v", v.name)
+	case *structType:
+		fmt.Fprintf(b, "struct %v", v.name)
+	case *enumType:
+		fmt.Fprintf(b, "enum %v", v.name)
+	case *variantType:
+		fmt.Fprintf(b, "%v.%v", v.enum.name, v.name)
+	case *moduleObject:
+		fmt.Fprintf(b, "module %q", v.path)
+	default:
+		b.WriteString(v.Info())
+	}
+}
+
+// Fields returns the components of arrays, structs, variants, results,
+// errors and modules, and nil for other values.
+func Fields(v Value) []Variable {
+	var vars []Variable
+	switch v := v.(type) {
+	case *arrayObject:
+		for i, elem := range v.elems {
+			vars = append(vars, Variable{fmt.Sprintf("[%v]", i), elem})
+		}
+	case *structObject:
+		for i, val := range v.fields {
+			vars = append(vars, Variable{v.typ.fields[i], val})
+		}
+	case *variantObject:
+		for i, val := range v.fields {
+			vars = append(vars, Variable{v.typ.fields[i], val})
+		}
+	case *resultObject:
+		name := "value"
+		if !v.ok {
+			name = "error"
+		}
+		vars = append(vars, Variable{name, v.value})
+	case *errorObject:
+		vars = append(vars, Variable{"kind", String(v.kind)}, Variable{"message", String(v.message)})
+	case *moduleObject:
+		for _, name := range slices.Sorted(maps.Keys(v.exports)) {
+			vars = append(vars, Variable{name, v.exports[name]})
+		}
+	}
+	return vars
+}
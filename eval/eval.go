@@ -1,9 +1,14 @@
 package eval
 
 import (
+	"cmp"
 	"fmt"
+	"maps"
+	"slices"
 
 	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/resolver"
+	"github.com/tombuente/lily/typecheck"
 )
 
 var (
@@ -12,11 +17,95 @@ var (
 	falseInstance = &boolObject{value: false}
 )
 
+// Interpreter evaluates programs with the default builtins and the ones
+// registered by the host.
+type Interpreter struct {
+	builtins map[string]*builtinFunctionObject
+
+	loader  ModuleLoader
+	modules map[string]*moduleObject // evaluated modules by path
+	loading []string                 // paths of the modules being evaluated
+
+	hook  Hook
+	stack []*StackFrame // active frames, outermost first
+
+	typecheck bool // check programs and modules before evaluating them
+}
+
+func New() *Interpreter {
+	return &Interpreter{
+		builtins: maps.Clone(builtin),
+		modules:  make(map[string]*moduleObject),
+	}
+}
+
+// Register makes fn available to scripts as the builtin name, replacing any
+// builtin of the same name. Calls return an ok result holding the value
+// returned by fn, or an err result holding an error of kind "host" if fn
+// fails, so scripts can handle the failure instead of aborting.
+func (x *Interpreter) Register(name string, fn HostFunc) {
+	x.builtins[name] = &builtinFunctionObject{name: name, fn: func(args ...object) (object, error) {
+		val, err := fn(args...)
+		if err != nil {
+			return &resultObject{value: &errorObject{kind: hostErrorKind, message: err.Error()}}, nil
+		}
+		if val == nil {
+			val = nilInstance
+		}
+		return &resultObject{ok: true, value: val}, nil
+	}}
+}
+
+// Builtins returns the sorted names of the builtins available to scripts.
+func (x *Interpreter) Builtins() []string {
+	return slices.Sorted(maps.Keys(x.builtins))
+}
+
+// SetTypeCheck sets whether programs and the modules they import are
+// checked by [typecheck.Check] before they are evaluated. A program with
+// type errors is not run, Eval returns a type error instead.
+func (x *Interpreter) SetTypeCheck(on bool) {
+	x.typecheck = on
+}
+
+func (x *Interpreter) Eval(node ast.Node) (Value, error) {
+	info, err := resolver.Resolve(node, slices.Collect(maps.Keys(x.builtins)))
+	if err != nil {
+		return nil, &nameError{msg: err.Error()}
+	}
+	if prog, ok := node.(*ast.Program); ok && x.typecheck {
+		if _, err := typecheck.Check(prog, info); err != nil {
+			return nil, &typeError{msg: err.Error()}
+		}
+	}
+
+	in := &evaluator{
+		interp:   x,
+		info:     info,
+		builtins: x.builtins,
+		globals:  make([]object, len(info.Globals)),
+	}
+	return in.run(&StackFrame{Function: "<main>"}, node)
+}
+
+// Eval evaluates node with the default builtins.
 func Eval(node ast.Node) (object, error) {
-	return eval(node, NewEnvironment())
+	return New().Eval(node)
+}
+
+type evaluator struct {
+	interp   *Interpreter
+	info     *resolver.Info
+	builtins map[string]*builtinFunctionObject
+	globals  []object
+	module   string // path of the module, "" for the program
+
+	// names holds the variables of the frame a watch expression is
+	// evaluated in, which it refers to as builtins, see [StackFrame.Eval].
+	names map[string]object
 }
 
-func eval(node ast.Node, env *environment) (object, error) {
+func (in *evaluator) eval(node ast.Node, env *environment) (object, error) {
 	switch node := node.(type) {
 	case *ast.Int:
 		return evalIntExpr(node)
@@ -25,29 +114,59 @@ func eval(node ast.Node, env *environment) (object, error) {
 	case *ast.String:
 		return evalString(node)
 	case *ast.UnaryOp:
-		return evalUnaryExpr(node, env)
+		return in.evalUnaryExpr(node, env)
 	case *ast.If:
-		return evalIfExpr(node, env)
+		return in.evalIfExpr(node, env)
 	case *ast.BinaryOp:
-		return evalBinaryExpr(node, env)
+		return in.evalBinaryExpr(node, env)
 	case *ast.Ident:
-		return evalIdentExpr(node, env)
+		return in.evalIdentExpr(node, env)
 	case *ast.Function:
-		return evalFunctionExpr(node, env)
+		return in.evalFunctionExpr(node, env)
 	case *ast.Call:
-		return evalCallExpr(node, env)
+		return in.evalCallExpr(node, env)
 	case *ast.Assignment:
-		return evalAssignmentExpr(node, env)
+		return in.evalAssignmentExpr(node, env)
+	case *ast.Selector:
+		return in.evalSelectorExpr(node, env)
+	case *ast.Try:
+		return in.evalTryExpr(node, env)
+	case *ast.Propagate:
+		return in.evalPropagateExpr(node, env)
+	case *ast.StructLit:
+		return in.evalStructLit(node, env)
+	case *ast.FieldAssignment:
+		return in.evalFieldAssignmentExpr(node, env)
+	case *ast.IndexAssignment:
+		return in.evalIndexAssignmentExpr(node, env)
+	case *ast.Match:
+		return in.evalMatchExpr(node, env)
+	case *ast.ArrayLit:
+		return in.evalArrayLit(node, env)
+	case *ast.Index:
+		return in.evalIndexExpr(node, env)
 	case *ast.ExprStmt:
-		return evalExprStmt(node, env)
+		return in.evalExprStmt(node, env)
 	case *ast.ReturnStmt:
-		return evalReturnStmt(node, env)
+		return in.evalReturnStmt(node, env)
+	case *ast.ThrowStmt:
+		return in.evalThrowStmt(node, env)
+	case *ast.StructStmt:
+		return in.evalStructStmt(node, env)
+	case *ast.MethodStmt:
+		return in.evalMethodStmt(node, env)
+	case *ast.EnumStmt:
+		return in.evalEnumStmt(node, env)
+	case *ast.ImportStmt:
+		return in.evalImportStmt(node, env)
+	case *ast.ExportStmt:
+		return in.eval(node.Stmt, env)
 	case *ast.LetStmt:
-		return evalLetStmt(node, env)
+		return in.evalLetStmt(node, env)
 	case *ast.BlockStmt:
-		return evalBlockStmt(node, env)
+		return in.evalBlockStmt(node, env)
 	case *ast.Program:
-		return evalProgram(node, env)
+		return in.evalProgram(node, env)
 	}
 	return nil, &internalError{msg: "node not supported"}
 }
@@ -64,8 +183,8 @@ func evalString(node *ast.String) (object, error) {
 	return &stringObject{value: node.Value}, nil
 }
 
-func evalUnaryExpr(expr *ast.UnaryOp, env *environment) (object, error) {
-	obj, err := eval(expr.Rhs, env)
+func (in *evaluator) evalUnaryExpr(expr *ast.UnaryOp, env *environment) (object, error) {
+	obj, err := in.eval(expr.Rhs, env)
 	if err != nil {
 		return nil, err
 	}
@@ -100,8 +219,8 @@ func evalUnaryBangExpr(obj object) (object, error) {
 	return nil, &typeError{msg: fmt.Sprintf("bad operand type for unary !: '%v'", obj.Info())}
 }
 
-func evalIfExpr(expr *ast.If, env *environment) (object, error) {
-	conditionRes, err := eval(expr.Condition, env)
+func (in *evaluator) evalIfExpr(expr *ast.If, env *environment) (object, error) {
+	conditionRes, err := in.eval(expr.Condition, env)
 	if err != nil {
 		return nil, err
 	}
@@ -112,79 +231,170 @@ func evalIfExpr(expr *ast.If, env *environment) (object, error) {
 	}
 
 	if condition.value {
-		return eval(expr.Consequence, env)
+		return in.eval(expr.Consequence, env)
 	} else if expr.Alternative != nil {
-		return eval(expr.Alternative, env)
+		return in.eval(expr.Alternative, env)
 	}
 	return nilInstance, nil
 }
 
-func evalIdentExpr(node *ast.Ident, env *environment) (object, error) {
-	obj, ok := env.get(node.Value)
-	if ok {
-		return obj, nil
+func (in *evaluator) evalIdentExpr(node *ast.Ident, env *environment) (object, error) {
+	binding := in.info.Idents[node]
+	if binding.Kind == resolver.Builtin {
+		if obj, ok := in.names[node.Value]; ok {
+			return obj, nil
+		}
+		return in.builtins[node.Value], nil
 	}
 
-	if buildin, ok := builtin[node.Value]; ok {
-		return buildin, nil
+	obj := *in.variable(binding, env)
+	if obj == nil {
+		return nil, &nameError{msg: fmt.Sprintf("name '%v' not defined", node.Value)}
 	}
-
-	return nil, &nameError{msg: fmt.Sprintf("name '%v' not defined", node.Value)}
+	return obj, nil
 }
 
-func evalFunctionExpr(node *ast.Function, env *environment) (object, error) {
+func (in *evaluator) evalFunctionExpr(node *ast.Function, env *environment) (object, error) {
+	info := in.info.Functions[node]
+
+	upvalues := make([]*object, len(info.Upvalues))
+	for i, c := range info.Upvalues {
+		if c.Local {
+			upvalues[i] = &env.slots[c.Index]
+		} else {
+			upvalues[i] = env.upvalues[c.Index]
+		}
+	}
+
 	return &functionObject{
 		params:   node.Params,
 		body:     node.Body,
-		captured: env,
+		info:     info,
+		upvalues: upvalues,
+		in:       in,
 	}, nil
 }
 
-func evalCallExpr(node *ast.Call, env *environment) (object, error) {
-	fn, err := eval(node.Lhs, env)
+func (in *evaluator) evalCallExpr(node *ast.Call, env *environment) (object, error) {
+	fn, err := in.eval(node.Lhs, env)
 	if err != nil {
 		return nil, err
 	}
 
-	args, err := evalExpressions(node.Args, env)
+	args, err := in.evalExpressions(node.Args, env)
 	if err != nil {
 		return nil, err
 	}
 
-	return applyFunction(fn, args)
+	if in.info.TailCalls[node] {
+		return &tailCallObject{fn: fn, args: args, call: node}, nil
+	}
+	return in.applyFunction(fn, args, node)
 }
 
-func applyFunction(fn object, args []object) (object, error) {
-	switch fn := fn.(type) {
-	case *functionObject:
-		localEnv := NewEnvironment()
-		for i, param := range fn.params {
-			localEnv.set(param.Value, args[i])
-		}
-		localEnv.captured = fn.captured
+// applyFunction calls fn. Tail calls made by fn are run in a loop here
+// rather than recursively.
+func (in *evaluator) applyFunction(fn object, args []object, call *ast.Call) (object, error) {
+	for {
+		switch f := fn.(type) {
+		case *boundMethod:
+			if len(args) != len(f.fn.params) {
+				return nil, &typeError{msg: fmt.Sprintf("method takes %v argument(s), got %v", len(f.fn.params), len(args))}
+			}
+			fn, args = f.fn, append([]object{f.recv}, args...)
+			continue
+		case *functionObject:
+			if !f.method && len(args) != len(f.params) {
+				return nil, &typeError{msg: fmt.Sprintf("function takes %v argument(s), got %v", len(f.params), len(args))}
+			}
 
-		obj, err := eval(fn.body, localEnv)
-		if err != nil {
-			return nil, err
+			if err := in.interp.call(call.Pos(), f.name); err != nil {
+				return nil, err
+			}
+
+			localEnv := &environment{
+				slots:    make([]object, len(f.info.Locals)),
+				upvalues: f.upvalues,
+			}
+			copy(localEnv.slots, args)
+
+			// Frames are only kept for hooks, they slow down calls.
+			traced := in.interp.hook != nil
+			if traced {
+				in.interp.stack = append(in.interp.stack, &StackFrame{
+					Function: cmp.Or(f.name, "<anonymous>"),
+					Module:   f.in.module,
+					Pos:      f.body.Pos(),
+					in:       f.in,
+					env:      localEnv,
+					fn:       f.info,
+				})
+			}
+			obj, err := f.in.callBody(f, args, localEnv)
+			if traced {
+				in.interp.pop()
+			}
+			if err != nil {
+				return nil, withFrame(err, f.name, call.Pos(), args)
+			}
+
+			if retObj, ok := obj.(*returnObject); ok {
+				obj = retObj.value
+			}
+			if tailCall, ok := obj.(*tailCallObject); ok {
+				fn, args, call = tailCall.fn, tailCall.args, tailCall.call
+				continue
+			}
+			return obj, nil
+		case *variantType:
+			if len(args) != len(f.fields) {
+				return nil, &typeError{msg: fmt.Sprintf("'%v' takes %v argument(s), got %v", f.name, len(f.fields), len(args))}
+			}
+			return &variantObject{typ: f, fields: args}, nil
+		case *builtinFunctionObject:
+			if err := in.interp.call(call.Pos(), f.name); err != nil {
+				return nil, err
+			}
+			obj, err := f.fn(args...)
+			if err != nil {
+				return nil, withFrame(err, f.name, call.Pos(), args)
+			}
+			return obj, nil
 		}
+		return nil, &typeError{msg: fmt.Sprintf("'%v' is not callable", fn.Info())}
+	}
+}
 
-		if retObj, ok := obj.(*returnObject); ok {
-			return retObj.value, nil
+// callBody binds the arguments of fn and runs its body in env.
+func (in *evaluator) callBody(fn *functionObject, args []object, env *environment) (object, error) {
+	if err := in.bindParams(fn, args, env); err != nil {
+		return nil, err
+	}
+	return in.eval(fn.body, env)
+}
+
+// bindParams destructures the arguments of fn passed for destructured
+// parameters, which are held by hidden locals at the parameter's slot.
+func (in *evaluator) bindParams(fn *functionObject, args []object, env *environment) error {
+	offset := len(args) - len(fn.params) // the receiver of a method
+	for i, param := range fn.params {
+		if _, ok := param.(*ast.IdentPattern); ok {
+			continue
+		}
+		if err := in.destructure(param, args[offset+i], env); err != nil {
+			return err
 		}
-		return obj, nil
-	case *builtinFunctionObject:
-		return fn.fn(args...)
 	}
-	return nil, &internalError{msg: "function cannot be applied"}
+	return nil
 }
 
-func evalBinaryExpr(expr *ast.BinaryOp, env *environment) (object, error) {
-	left, err := eval(expr.Left, env)
+func (in *evaluator) evalBinaryExpr(expr *ast.BinaryOp, env *environment) (object, error) {
+	left, err := in.eval(expr.Left, env)
 	if err != nil {
 		return nil, err
 	}
 
-	right, err := eval(expr.Right, env)
+	right, err := in.eval(expr.Right, env)
 	if err != nil {
 		return nil, err
 	}
@@ -219,6 +429,9 @@ func evalBinaryIntExpr(op string, left, right *intObject) (object, error) {
 	case "*":
 		return &intObject{value: left.value * right.value}, nil
 	case "/":
+		if right.value == 0 {
+			return nil, &zeroDivisionError{msg: "division by zero"}
+		}
 		return &intObject{value: left.value / right.value}, nil
 	case "<":
 		return boolInstance(left.value < right.value), nil
@@ -245,61 +458,503 @@ func evalBinaryBoolExpr(op string, left, right *boolObject) (object, error) {
 func evalBinaryStringExpr(op string, left *stringObject, right *stringObject) (object, error) {
 	switch op {
 	case "+":
-		fmt.Println(left.value, right.value)
 		return &stringObject{value: left.value + right.value}, nil
 	}
 	return nil, &typeError{msg: fmt.Sprintf("unsupported operand type(s) for '%v': '%v' '%v'", op, left.Info(), right.Info())}
 }
 
-func evalAssignmentExpr(node *ast.Assignment, env *environment) (object, error) {
-	val, err := eval(node.Expr, env)
+func (in *evaluator) evalAssignmentExpr(node *ast.Assignment, env *environment) (object, error) {
+	val, err := in.eval(node.Expr, env)
+	if err != nil {
+		return nil, err
+	}
+
+	variable := in.variable(in.info.Idents[node.Ident], env)
+	if *variable == nil {
+		return nil, &nameError{msg: fmt.Sprintf("'%v' is not defined", node.Ident.Value)}
+	}
+	*variable = val
+	return nilInstance, nil
+}
+
+func (in *evaluator) evalSelectorExpr(node *ast.Selector, env *environment) (object, error) {
+	obj, err := in.eval(node.Expr, env)
+	if err != nil {
+		return nil, err
+	}
+
+	if val, ok := field(obj, node.Field.Value); ok {
+		return val, nil
+	}
+	switch obj := obj.(type) {
+	case *structObject:
+		if method, ok := obj.typ.methods[node.Field.Value]; ok {
+			return &boundMethod{recv: obj, fn: method}, nil
+		}
+	case *resultObject:
+		switch node.Field.Value {
+		case "ok":
+			return boolInstance(obj.ok), nil
+		case "value":
+			if !obj.ok {
+				return nil, &typeError{msg: "err result has no value"}
+			}
+			return obj.value, nil
+		case "error":
+			if obj.ok {
+				return nil, &typeError{msg: "ok result has no error"}
+			}
+			return obj.value, nil
+		}
+	}
+	return nil, &typeError{msg: fmt.Sprintf("'%v' has no field '%v'", obj.Info(), node.Field.Value)}
+}
+
+// field returns the field name of a struct, variant or error value, or the
+// export name of a module.
+func field(obj object, name string) (object, bool) {
+	switch obj := obj.(type) {
+	case *structObject:
+		if i := obj.typ.field(name); i >= 0 {
+			return obj.fields[i], true
+		}
+	case *variantObject:
+		if i := slices.Index(obj.typ.fields, name); i >= 0 {
+			return obj.fields[i], true
+		}
+	case *errorObject:
+		switch name {
+		case "kind":
+			return &stringObject{value: obj.kind}, true
+		case "message":
+			return &stringObject{value: obj.message}, true
+		}
+	case *moduleObject:
+		val, ok := obj.exports[name]
+		return val, ok
+	}
+	return nil, false
+}
+
+func (in *evaluator) evalArrayLit(node *ast.ArrayLit, env *environment) (object, error) {
+	elems, err := in.evalExpressions(node.Elems, env)
+	if err != nil {
+		return nil, err
+	}
+	return &arrayObject{elems: elems}, nil
+}
+
+func (in *evaluator) evalIndexExpr(node *ast.Index, env *environment) (object, error) {
+	array, i, err := in.index(node, env)
 	if err != nil {
-		return nil, fmt.Errorf("cannot eval rhs: %w", err)
+		return nil, err
+	}
+	return array.elems[i], nil
+}
+
+// index evaluates the array and the index of node, which is in range.
+func (in *evaluator) index(node *ast.Index, env *environment) (*arrayObject, int, error) {
+	obj, err := in.eval(node.Expr, env)
+	if err != nil {
+		return nil, 0, err
+	}
+	idx, err := in.eval(node.Index, env)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	array, ok := obj.(*arrayObject)
+	if !ok {
+		return nil, 0, &typeError{msg: fmt.Sprintf("'%v' is not indexable", obj.Info())}
+	}
+	i, ok := idx.(*intObject)
+	if !ok {
+		return nil, 0, &typeError{msg: fmt.Sprintf("array index must be int, got '%v'", idx.Info())}
+	}
+	if i.value < 0 || i.value >= int64(len(array.elems)) {
+		return nil, 0, &indexError{msg: fmt.Sprintf("index %v out of range for array of length %v", i.value, len(array.elems))}
+	}
+	return array, int(i.value), nil
+}
+
+func (in *evaluator) evalFieldAssignmentExpr(node *ast.FieldAssignment, env *environment) (object, error) {
+	val, err := in.eval(node.Expr, env)
+	if err != nil {
+		return nil, err
+	}
+
+	obj, err := in.eval(node.Target.Expr, env)
+	if err != nil {
+		return nil, err
+	}
+
+	structObj, ok := obj.(*structObject)
+	if !ok {
+		return nil, &typeError{msg: fmt.Sprintf("cannot assign to field '%v' of '%v'", node.Target.Field.Value, obj.Info())}
+	}
+	i := structObj.typ.field(node.Target.Field.Value)
+	if i < 0 {
+		return nil, &typeError{msg: fmt.Sprintf("'%v' has no field '%v'", obj.Info(), node.Target.Field.Value)}
+	}
+	if structObj.frozen {
+		return nil, &typeError{msg: fmt.Sprintf("cannot assign to field '%v' of frozen '%v'", node.Target.Field.Value, obj.Info())}
+	}
+	structObj.fields[i] = val
+	return nilInstance, nil
+}
+
+func (in *evaluator) evalIndexAssignmentExpr(node *ast.IndexAssignment, env *environment) (object, error) {
+	val, err := in.eval(node.Expr, env)
+	if err != nil {
+		return nil, err
 	}
-	if err := env.update(node.Ident.Value, val); err != nil {
+
+	array, i, err := in.index(node.Target, env)
+	if err != nil {
 		return nil, err
 	}
+	if array.frozen {
+		return nil, &typeError{msg: "cannot assign to element of frozen array"}
+	}
+	array.elems[i] = val
 	return nilInstance, nil
 }
 
-func evalExprStmt(stmt *ast.ExprStmt, env *environment) (object, error) {
-	return eval(stmt.Expr, env)
+func (in *evaluator) evalStructLit(node *ast.StructLit, env *environment) (object, error) {
+	obj, err := in.eval(node.Type, env)
+	if err != nil {
+		return nil, err
+	}
+	typ, ok := obj.(*structType)
+	if !ok {
+		return nil, &typeError{msg: fmt.Sprintf("'%v' is not a struct", node.Type.Value)}
+	}
+
+	fields := make([]object, len(typ.fields))
+	for _, field := range node.Fields {
+		i := typ.field(field.Name.Value)
+		if i < 0 {
+			return nil, &typeError{msg: fmt.Sprintf("'%v' has no field '%v'", typ.name, field.Name.Value)}
+		}
+		if fields[i] != nil {
+			return nil, &typeError{msg: fmt.Sprintf("field '%v' given twice", field.Name.Value)}
+		}
+
+		fields[i], err = in.eval(field.Value, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, field := range fields {
+		if field == nil {
+			return nil, &typeError{msg: fmt.Sprintf("missing field '%v' in '%v' literal", typ.fields[i], typ.name)}
+		}
+	}
+
+	return &structObject{typ: typ, fields: fields}, nil
+}
+
+// evalMatchExpr evaluates the body of the first arm whose pattern matches
+// the subject.
+func (in *evaluator) evalMatchExpr(node *ast.Match, env *environment) (object, error) {
+	val, err := in.eval(node.Subject, env)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, arm := range node.Arms {
+		ok, err := in.match(arm.Pattern, val, env)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return in.eval(arm.Body, env)
+		}
+	}
+	return nil, &matchError{msg: fmt.Sprintf("no pattern matches value of type '%v'", val.Info())}
+}
+
+// match reports whether val matches pattern and binds the variables of the
+// pattern if so.
+func (in *evaluator) match(pattern ast.Pattern, val object, env *environment) (bool, error) {
+	switch p := pattern.(type) {
+	case *ast.WildcardPattern:
+		return true, nil
+	case *ast.IdentPattern:
+		if in.info.Variants[p.Ident] == nil {
+			*in.variable(in.info.Idents[p.Ident], env) = val
+			return true, nil
+		}
+		variant, err := in.eval(p.Ident, env)
+		if err != nil {
+			return false, err
+		}
+		return val == variant, nil
+	case *ast.LiteralPattern:
+		switch lit := p.Value.(type) {
+		case *ast.Int:
+			v, ok := val.(*intObject)
+			return ok && v.value == lit.Value, nil
+		case *ast.String:
+			v, ok := val.(*stringObject)
+			return ok && v.value == lit.Value, nil
+		case *ast.Bool:
+			return val == boolInstance(lit.Value), nil
+		}
+	case *ast.ConstructorPattern:
+		typ, err := in.eval(p.Name, env)
+		if err != nil {
+			return false, err
+		}
+		v, ok := val.(*variantObject)
+		if !ok || v.typ != typ {
+			return false, nil
+		}
+		for i, arg := range p.Args {
+			if ok, err := in.match(arg, v.fields[i], env); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case *ast.ArrayPattern:
+		v, ok := val.(*arrayObject)
+		if !ok || len(v.elems) != len(p.Elems) {
+			return false, nil
+		}
+		for i, elem := range p.Elems {
+			if ok, err := in.match(elem, v.elems[i], env); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case *ast.ObjectPattern:
+		for _, f := range p.Fields {
+			v, ok := field(val, f.Name.Value)
+			if !ok {
+				return false, nil
+			}
+			if ok, err := in.match(f.Pattern, v, env); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	return false, &internalError{msg: "pattern not supported"}
+}
+
+// destructure binds the variables of pattern, which is used by a let
+// statement or a parameter and must match val. Unlike match it explains
+// why val does not match.
+func (in *evaluator) destructure(pattern ast.Pattern, val object, env *environment) error {
+	switch p := pattern.(type) {
+	case *ast.ArrayPattern:
+		v, ok := val.(*arrayObject)
+		if !ok {
+			return &matchError{msg: fmt.Sprintf("cannot destructure '%v' as an array", val.Info())}
+		}
+		if len(v.elems) != len(p.Elems) {
+			return &matchError{msg: fmt.Sprintf("cannot destructure array of length %v into %v element(s)", len(v.elems), len(p.Elems))}
+		}
+		for i, elem := range p.Elems {
+			if err := in.destructure(elem, v.elems[i], env); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *ast.ObjectPattern:
+		for _, f := range p.Fields {
+			v, ok := field(val, f.Name.Value)
+			if !ok {
+				return &matchError{msg: fmt.Sprintf("cannot destructure '%v', it has no field '%v'", val.Info(), f.Name.Value)}
+			}
+			if err := in.destructure(f.Pattern, v, env); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ok, err := in.match(pattern, val, env)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &matchError{msg: fmt.Sprintf("value of type '%v' does not match pattern", val.Info())}
+	}
+	return nil
+}
+
+// evalTryExpr evaluates to the value of the try body or, if it raised a
+// catchable error, to the value of the catch clause. The finally clause
+// always runs afterwards; its value is discarded unless it returns.
+func (in *evaluator) evalTryExpr(node *ast.Try, env *environment) (object, error) {
+	obj, err := in.eval(node.Body, env)
+	if err != nil && node.Catch != nil {
+		if errObj, ok := catchable(err); ok {
+			*in.variable(in.info.Idents[node.Param], env) = errObj
+			obj, err = in.eval(node.Catch, env)
+		}
+	}
+
+	if node.Finally != nil {
+		finObj, finErr := in.eval(node.Finally, env)
+		if finErr != nil {
+			return nil, finErr
+		}
+		if _, ok := finObj.(*returnObject); ok {
+			return finObj, nil
+		}
+	}
+	return obj, err
 }
 
-func evalLetStmt(node *ast.LetStmt, env *environment) (object, error) {
-	if _, ok := env.get(node.Ident.Value); ok {
-		return nil, &nameError{msg: fmt.Sprintf("'%v' already defined", node.Ident.Value)}
+// evalPropagateExpr unwraps an ok result. An err result is returned from
+// the enclosing function instead.
+func (in *evaluator) evalPropagateExpr(node *ast.Propagate, env *environment) (object, error) {
+	obj, err := in.eval(node.Expr, env)
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := obj.(*resultObject)
+	if !ok {
+		return nil, &typeError{msg: fmt.Sprintf("'?' requires a result, got '%v'", obj.Info())}
+	}
+	if !result.ok {
+		return nil, &earlyReturn{result: result}
 	}
+	return result.value, nil
+}
+
+func (in *evaluator) evalExprStmt(stmt *ast.ExprStmt, env *environment) (object, error) {
+	return in.eval(stmt.Expr, env)
+}
 
-	val, err := eval(node.Expr, env)
+func (in *evaluator) evalLetStmt(node *ast.LetStmt, env *environment) (object, error) {
+	val, err := in.eval(node.Expr, env)
 	if err != nil {
 		return nil, err
 	}
-	env.set(node.Ident.Value, val)
+	if node.Pattern != nil {
+		if err := in.destructure(node.Pattern, val, env); err != nil {
+			return nil, err
+		}
+		return nilInstance, nil
+	}
+
+	if _, ok := node.Expr.(*ast.Function); ok {
+		val.(*functionObject).name = node.Ident.Value
+	}
+	*in.variable(in.info.Idents[node.Ident], env) = val
 	return nilInstance, nil
 }
 
-func evalReturnStmt(stmt *ast.ReturnStmt, env *environment) (object, error) {
-	obj, err := eval(stmt.Expr, env)
+func (in *evaluator) evalReturnStmt(stmt *ast.ReturnStmt, env *environment) (object, error) {
+	obj, err := in.eval(stmt.Expr, env)
 	if err != nil {
 		return nil, err
 	}
 	return &returnObject{value: obj}, nil
 }
 
-func evalBlockStmt(blockStmt *ast.BlockStmt, env *environment) (object, error) {
-	return evalStmts(blockStmt.Stmts, env, false)
+func (in *evaluator) evalThrowStmt(stmt *ast.ThrowStmt, env *environment) (object, error) {
+	obj, err := in.eval(stmt.Expr, env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch obj := obj.(type) {
+	case *errorObject:
+		return nil, &thrownError{obj: obj}
+	case *stringObject:
+		return nil, &thrownError{obj: &errorObject{kind: userErrorKind, message: obj.value}}
+	}
+	return nil, &typeError{msg: fmt.Sprintf("can only throw strings and errors, got '%v'", obj.Info())}
 }
 
-func evalProgram(prog *ast.Program, env *environment) (object, error) {
-	return evalStmts(prog.Stmts, env, true)
+func (in *evaluator) evalStructStmt(node *ast.StructStmt, env *environment) (object, error) {
+	typ := &structType{
+		name:    node.Name.Value,
+		fields:  make([]string, len(node.Fields)),
+		methods: make(map[string]*functionObject),
+	}
+	for i, field := range node.Fields {
+		if typ.field(field.Value) >= 0 {
+			return nil, &typeError{msg: fmt.Sprintf("duplicate field '%v' in struct '%v'", field.Value, typ.name)}
+		}
+		typ.fields[i] = field.Value
+	}
+
+	*in.variable(in.info.Idents[node.Name], env) = typ
+	return nilInstance, nil
 }
 
-func evalStmts(stmts []ast.Stmt, env *environment, unwrap bool) (object, error) {
+func (in *evaluator) evalEnumStmt(node *ast.EnumStmt, env *environment) (object, error) {
+	enum := &enumType{name: node.Name.Value}
+	*in.variable(in.info.Idents[node.Name], env) = enum
+
+	for _, variant := range node.Variants {
+		typ := &variantType{enum: enum, name: variant.Name.Value}
+		var val object = typ
+		if variant.Fields == nil {
+			val = &variantObject{typ: typ}
+		}
+		for _, field := range variant.Fields {
+			typ.fields = append(typ.fields, field.Value)
+		}
+		*in.variable(in.info.Idents[variant.Name], env) = val
+	}
+	return nilInstance, nil
+}
+
+func (in *evaluator) evalMethodStmt(node *ast.MethodStmt, env *environment) (object, error) {
+	obj, err := in.eval(node.Type, env)
+	if err != nil {
+		return nil, err
+	}
+	typ, ok := obj.(*structType)
+	if !ok {
+		return nil, &typeError{msg: fmt.Sprintf("'%v' is not a struct", node.Type.Value)}
+	}
+
+	name := node.Name.Value
+	if _, ok := typ.methods[name]; ok || typ.field(name) >= 0 {
+		return nil, &typeError{msg: fmt.Sprintf("'%v' already has a field or method '%v'", typ.name, name)}
+	}
+
+	fn, err := in.evalFunctionExpr(node.Function, env)
+	if err != nil {
+		return nil, err
+	}
+	method := fn.(*functionObject)
+	method.name = typ.name + "." + name
+	method.method = true
+	typ.methods[name] = method
+	return nilInstance, nil
+}
+
+// evalBlockStmt runs a block in the environment of the enclosing function.
+// The scope of the block is static: the resolver gives the names declared in
+// it slots of their own, which are not visible after the block.
+func (in *evaluator) evalBlockStmt(blockStmt *ast.BlockStmt, env *environment) (object, error) {
+	return in.evalStmts(blockStmt.Stmts, env, false)
+}
+
+func (in *evaluator) evalProgram(prog *ast.Program, env *environment) (object, error) {
+	return in.evalStmts(prog.Stmts, env, true)
+}
+
+func (in *evaluator) evalStmts(stmts []ast.Stmt, env *environment, unwrap bool) (object, error) {
 	var obj object
 	var err error
 	for _, statement := range stmts {
-		obj, err = eval(statement, env)
+		if err := in.interp.step(statement.Pos()); err != nil {
+			return nil, err
+		}
+		obj, err = in.eval(statement, env)
+		if ret, ok := err.(*earlyReturn); ok {
+			obj, err = &returnObject{value: ret.result}, nil
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -314,6 +969,18 @@ func evalStmts(stmts []ast.Stmt, env *environment, unwrap bool) (object, error)
 	return obj, nil
 }
 
+// variable returns the storage of a global, local or captured variable. It
+// holds nil while the variable is not yet defined.
+func (in *evaluator) variable(binding resolver.Binding, env *environment) *object {
+	switch binding.Kind {
+	case resolver.Local:
+		return &env.slots[binding.Index]
+	case resolver.Upvalue:
+		return env.upvalues[binding.Index]
+	}
+	return &in.globals[binding.Index]
+}
+
 func boolInstance(val bool) object {
 	if val {
 		return trueInstance
@@ -321,10 +988,10 @@ func boolInstance(val bool) object {
 	return falseInstance
 }
 
-func evalExpressions(exprs []ast.Expr, env *environment) ([]object, error) {
+func (in *evaluator) evalExpressions(exprs []ast.Expr, env *environment) ([]object, error) {
 	var objs []object
 	for _, e := range exprs {
-		val, err := eval(e, env)
+		val, err := in.eval(e, env)
 		if err != nil {
 			return nil, err
 		}
@@ -2,9 +2,15 @@ package eval
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
 
+	"github.com/tombuente/lily/ast"
 	"github.com/tombuente/lily/lexer"
 	"github.com/tombuente/lily/parser"
 )
@@ -90,6 +96,25 @@ func TestEval(t *testing.T) {
 				funnyAdd(5);`,
 			expected: &intObject{value: 15},
 		},
+		{
+			name: "mutual recursion",
+			src: `
+				let even = fn(n) { if (n == 0) { return true }; odd(n - 1) };
+				let odd = fn(n) { if (n == 0) { return false }; even(n - 1) };
+				even(10);`,
+			expected: trueInstance,
+		},
+		{
+			name: "closure counter",
+			src: `
+				let counter = fn() {
+					let n = 0;
+					fn() { n = n + 1; n }
+				};
+				let c = counter();
+				c(); c(); c();`,
+			expected: &intObject{value: 3},
+		},
 		{
 			src:      `let x = "tom"; x`,
 			expected: &stringObject{value: "tom"},
@@ -104,6 +129,39 @@ func TestEval(t *testing.T) {
 	test(t, tests)
 }
 
+func TestTailCall(t *testing.T) {
+	// Recursion that grew the Go stack would exceed this limit long before
+	// reaching the bottom and crash the test.
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+
+	tests := []evalTest{
+		{
+			name: "countdown",
+			src: `
+				let countdown = fn(n) { if (n == 0) { return 0 }; countdown(n - 1) };
+				countdown(10000000);`,
+			expected: &intObject{value: 0},
+		},
+		{
+			name: "mutual recursion",
+			src: `
+				let even = fn(n) { if (n == 0) { true } { odd(n - 1) } };
+				let odd = fn(n) { if (n == 0) { return false }; return even(n - 1) };
+				even(100001);`,
+			expected: falseInstance,
+		},
+		{
+			name: "accumulator",
+			src: `
+				let sum = fn(n, acc) { if (n == 0) { acc } { sum(n - 1, acc + n) } };
+				sum(100000, 0);`,
+			expected: &intObject{value: 5000050000},
+		},
+	}
+
+	test(t, tests)
+}
+
 func TestBuiltin(t *testing.T) {
 	tests := []evalTest{
 		{src: `len("123")`, expected: &intObject{value: 3}},
@@ -124,15 +182,681 @@ func TestTypeError(t *testing.T) {
 	testError[*typeError](t, tests)
 }
 
+func TestTypeCheck(t *testing.T) {
+	in := New()
+	in.SetTypeCheck(true)
+	in.SetLoader(MapLoader{"lib": `export let f = fn(): int { "a" }`})
+
+	for _, tt := range []struct{ src, expected string }{
+		{`let x: int = 1; x + true`, "unsupported operand type(s) for '+': 'int' 'bool'"},
+		{`import "lib" as m`, `cannot import "lib": cannot return 'string' from function returning 'int'`},
+	} {
+		_, err := in.Eval(parse(t, tt.src))
+		var typeErr *typeError
+		if !errors.As(err, &typeErr) || typeErr.msg != tt.expected {
+			t.Errorf("%v: want=%v, got=%v", tt.src, tt.expected, err)
+		}
+	}
+
+	res, err := in.Eval(parse(t, `let f = fn(a: int, b): int { a + b }; f(1, 2)`))
+	if err != nil || !reflect.DeepEqual(res, &intObject{value: 3}) {
+		t.Fatalf("want=3, got=%v, %v", res, err)
+	}
+	// Annotations are not enforced without the check.
+	res, err = Eval(parse(t, `try { let x: int = "a"; x + 1 } catch (e) { e.kind }`))
+	if err != nil || !reflect.DeepEqual(res, &stringObject{value: "type"}) {
+		t.Fatalf("want=type, got=%v, %v", res, err)
+	}
+}
+
 func TestNameError(t *testing.T) {
 	tests := []errorTest{
 		{name: "test double declaration", src: "let x = 5; let x = 6;"},
 		{name: "x undefined", src: "x = 5;"},
+		{name: "use before definition", src: "x; let x = 5;"},
+		{name: "reported without running", src: "1 > true; y"},
 	}
 
 	testError[*nameError](t, tests)
 }
 
+func TestTryCatch(t *testing.T) {
+	tests := []evalTest{
+		{name: "no error", src: `try { 1 } catch (e) { 2 }`, expected: &intObject{value: 1}},
+		{name: "throw string", src: `try { throw "bad input" } catch (e) { e.message }`, expected: &stringObject{value: "bad input"}},
+		{name: "user kind", src: `try { throw "bad input" } catch (e) { e.kind }`, expected: &stringObject{value: "user"}},
+		{name: "type error", src: `try { 1 + "a" } catch (e) { e.kind }`, expected: &stringObject{value: "type"}},
+		{name: "builtin type error", src: `try { len(1) } catch (e) { e.kind }`, expected: &stringObject{value: "type"}},
+		{name: "name error", src: `let f = fn() { g() }; let k = try { f() } catch (e) { e.kind }; let g = fn() { 1 }; k`, expected: &stringObject{value: "name"}},
+		{name: "zero division", src: `try { 1 / 0 } catch (e) { e.kind + ": " + e.message }`, expected: &stringObject{value: "zero-division: division by zero"}},
+		{name: "thrown from call", src: `let check = fn(n) { if n < 0 { throw "negative" }; n }; try { check(-1) } catch (e) { e.message }`, expected: &stringObject{value: "negative"}},
+		{name: "rethrow keeps kind", src: `try { try { 1 / 0 } catch (e) { throw e } } catch (e) { e.kind }`, expected: &stringObject{value: "zero-division"}},
+		{name: "error in catch", src: `try { try { throw "a" } catch (e) { throw "b" } } catch (e) { e.message }`, expected: &stringObject{value: "b"}},
+		{name: "finally runs", src: `let x = 1; try { x = 2 } finally { x = x + 1 }; x`, expected: &intObject{value: 3}},
+		{name: "finally runs after catch", src: `let x = 1; try { throw "a" } catch (e) { x = 2 } finally { x = x * 10 }; x`, expected: &intObject{value: 20}},
+		{name: "finally runs on return", src: `let x = 1; let f = fn() { try { return 5 } finally { x = 2 } }; f() + x`, expected: &intObject{value: 7}},
+		{name: "finally value discarded", src: `try { 1 } finally { 2 }`, expected: &intObject{value: 1}},
+		{name: "return from finally", src: `let f = fn() { try { throw "a" } finally { return 3 } }; f()`, expected: &intObject{value: 3}},
+		{name: "return from catch", src: `let f = fn() { try { throw "a" } catch (e) { return e.message }; "b" }; f()`, expected: &stringObject{value: "a"}},
+		{name: "tail call inside try", src: `let f = fn() { throw "a" }; let g = fn() { try { f() } catch (e) { e.message } }; g()`, expected: &stringObject{value: "a"}},
+		{name: "catch variable per clause", src: `try { throw "a" } catch (e) { 1 }; try { throw "b" } catch (e) { e.message }`, expected: &stringObject{value: "b"}},
+	}
+
+	test(t, tests)
+
+	errorTests := []struct {
+		name     string
+		src      string
+		expected string
+	}{
+		{name: "uncaught throw", src: `throw "bad"`, expected: "bad"},
+		{name: "error in finally", src: `try { 1 } finally { throw "fin" }`, expected: "fin"},
+		{name: "no catch", src: `try { throw "a" } finally { 1 }`, expected: "a"},
+		{name: "throw non-string", src: `throw 1`, expected: "can only throw strings and errors, got 'int'"},
+		{name: "unknown field", src: `try { throw "a" } catch (e) { e.code }`, expected: "'error' has no field 'code'"},
+	}
+	for _, tt := range errorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := evalHelper(t, tt.src)
+			if err == nil || err.Error() != tt.expected {
+				t.Fatalf("want=%v, got=%v", tt.expected, err)
+			}
+		})
+	}
+
+	_, err := evalHelper(t, `let f = fn() { throw "bad" }; f()`)
+	expected := `Traceback (most recent call last):
+  line 1, column 31, in f()
+Error: bad`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("want=\n%v\ngot=\n%v", expected, err)
+	}
+}
+
+func TestResult(t *testing.T) {
+	tests := []evalTest{
+		{name: "ok", src: `ok(1).value`, expected: &intObject{value: 1}},
+		{name: "err", src: `err("bad").error`, expected: &stringObject{value: "bad"}},
+		{name: "ok flag", src: `err("bad").ok`, expected: falseInstance},
+		{name: "unwrap ok", src: `let f = fn() { let x = ok(1)?; ok(x + 1) }; f().value`, expected: &intObject{value: 2}},
+		{name: "propagate err", src: `let f = fn() { let x = err("bad")?; ok(x + 1) }; f().error`, expected: &stringObject{value: "bad"}},
+		{name: "propagate nested", src: `
+let parse = fn(s) { if len(s) > 2 { return err("too long") }; ok(len(s)) };
+let double = fn(s) { ok(parse(s)? * 2) };
+let both = fn(a, b) { ok(double(a)? + double(b)?) };
+let first = both("ab", "c");
+let second = both("ab", "xyz");
+if first.ok { if second.ok { 0 } { second.error + ": " + "6" } } { 0 }`, expected: &stringObject{value: "too long: 6"}},
+		{name: "finally runs on propagate", src: `let x = 1; let f = fn() { try { err("a")? } finally { x = 2 } }; f(); x`, expected: &intObject{value: 2}},
+		{name: "top level", src: `err("bad")?; 1`, expected: &resultObject{value: &stringObject{value: "bad"}}},
+	}
+
+	test(t, tests)
+
+	testError[*typeError](t, []errorTest{
+		{name: "propagate non result", src: "1?"},
+		{name: "value of err", src: `err(1).value`},
+		{name: "error of ok", src: `ok(1).error`},
+	})
+}
+
+func TestStruct(t *testing.T) {
+	point := `struct Point { x, y };
+fn (p Point) norm() { p.x * p.x + p.y * p.y };
+fn (p Point) add(q) { Point{x: p.x + q.x, y: p.y + q.y} };
+fn (p Point) move(dx) { p.x = p.x + dx };
+`
+	tests := []evalTest{
+		{name: "field access", src: point + `Point{x: 1, y: 2}.y`, expected: &intObject{value: 2}},
+		{name: "field order", src: point + `let p = Point{y: 2, x: 1}; p.x`, expected: &intObject{value: 1}},
+		{name: "method", src: point + `Point{x: 3, y: 4}.norm()`, expected: &intObject{value: 25}},
+		{name: "method with argument", src: point + `let p = Point{x: 1, y: 2}.add(Point{x: 10, y: 20}); p.x + p.y`, expected: &intObject{value: 33}},
+		{name: "field assignment", src: point + `let p = Point{x: 1, y: 2}; p.x = 5; p.x`, expected: &intObject{value: 5}},
+		{name: "method mutates receiver", src: point + `let p = Point{x: 1, y: 2}; p.move(2); p.x`, expected: &intObject{value: 3}},
+		{name: "bound method", src: point + `let f = Point{x: 1, y: 1}.norm; f()`, expected: &intObject{value: 2}},
+		{name: "method calls method", src: point + `fn (p Point) twice() { p.norm() * 2 }; Point{x: 1, y: 0}.twice()`, expected: &intObject{value: 2}},
+		{name: "struct in if", src: point + `if 1 < 2 { Point{x: 1, y: 0} } { Point{x: 2, y: 0} }.x`, expected: &intObject{value: 1}},
+		{name: "struct in function", src: `let f = fn() { struct S { v }; S{v: 7} }; f().v`, expected: &intObject{value: 7}},
+		{name: "empty struct", src: `struct Unit {}; fn (u Unit) one() { 1 }; Unit{}.one()`, expected: &intObject{value: 1}},
+	}
+
+	test(t, tests)
+
+	testError[*typeError](t, []errorTest{
+		{name: "unknown field", src: point + `Point{x: 1, y: 2}.z`},
+		{name: "unknown field in literal", src: point + `Point{x: 1, y: 2, z: 3}`},
+		{name: "missing field", src: point + `Point{x: 1}`},
+		{name: "field given twice", src: point + `Point{x: 1, x: 2, y: 3}`},
+		{name: "not a struct", src: `let P = 1; P{}`},
+		{name: "method arity", src: point + `Point{x: 1, y: 2}.add()`},
+		{name: "method shadows field", src: `struct S { v }; fn (s S) v() { 1 }`},
+		{name: "assign to unknown field", src: point + `let p = Point{x: 1, y: 2}; p.z = 1`},
+		{name: "duplicate field", src: `struct S { v, v }`},
+	})
+
+	_, err := evalHelper(t, point+`fn (p Point) bad() { p.x + "a" }; Point{x: 1, y: 2}.bad()`)
+	expected := `Traceback (most recent call last):
+  line 5, column 35, in Point.bad(Point)
+TypeError: unsupported operand type(s) for '+': 'int' 'string'`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("want=\n%v\ngot=\n%v", expected, err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	shape := `enum Shape { Circle(r), Rect(w, h), Empty };
+let area = fn(s) {
+	match s {
+		Circle(r) => 3 * r * r,
+		Rect(w, h) => { let a = w * h; a },
+		Empty => 0,
+	}
+};
+`
+	tests := []evalTest{
+		{name: "constructor", src: shape + `area(Circle(2))`, expected: &intObject{value: 12}},
+		{name: "block arm", src: shape + `area(Rect(2, 3))`, expected: &intObject{value: 6}},
+		{name: "variant without fields", src: shape + `area(Empty)`, expected: &intObject{value: 0}},
+		{name: "field access", src: shape + `Rect(2, 3).h`, expected: &intObject{value: 3}},
+		{name: "literal", src: `match 2 { 1 => "one", 2 => "two", _ => "many" }`, expected: &stringObject{value: "two"}},
+		{name: "negative literal", src: `match -1 { -1 => "minus one", _ => "other" }`, expected: &stringObject{value: "minus one"}},
+		{name: "string and bool literals", src: `match "a" { "b" => false, "a" => match true { false => 1, true => 2 } }`, expected: &intObject{value: 2}},
+		{name: "wildcard", src: `match 5 { 1 => 1, _ => 2 }`, expected: &intObject{value: 2}},
+		{name: "binding", src: `match 5 { 1 => 1, n => n * 2 }`, expected: &intObject{value: 10}},
+		{name: "nested", src: shape + `enum Opt { Some(v), None }; match Some(Rect(1, 2)) { Some(Rect(1, h)) => h, Some(_) => 0, None => -1 }`, expected: &intObject{value: 2}},
+		{name: "nested literal mismatch", src: shape + `enum Opt { Some(v), None }; match Some(Rect(3, 2)) { Some(Rect(1, h)) => h, Some(_) => 0, None => -1 }`, expected: &intObject{value: 0}},
+		{name: "return from arm", src: `let f = fn(n) { match n { 0 => { return "zero" }, _ => 1 }; "other" }; f(0)`, expected: &stringObject{value: "zero"}},
+		{name: "bindings per arm", src: `let n = 1; match 2 { n => n }; n`, expected: &intObject{value: 1}},
+		{name: "recursion in tail position", src: `enum List { Cons(head, tail), Nil };
+let sum = fn(l, acc) { match l { Cons(h, t) => sum(t, acc + h), Nil => acc } };
+sum(Cons(1, Cons(2, Cons(3, Nil))), 0)`, expected: &intObject{value: 6}},
+	}
+
+	test(t, tests)
+
+	testError[*matchError](t, []errorTest{
+		{name: "no match", src: `match 3 { 1 => 1, 2 => 2 }`},
+	})
+
+	testError[*typeError](t, []errorTest{
+		{name: "constructor arity", src: shape + `Circle(1, 2)`},
+	})
+
+	_, err := evalHelper(t, shape+`match Empty { Circle(r) => r, Rect(w, h) => w }`)
+	expected := "match on 'Shape' is not exhaustive, missing Empty"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("want=%v, got=%v", expected, err)
+	}
+	_, err = evalHelper(t, shape+`match Empty { Circle(2) => 1, Rect(_, _) => 2, Empty => 3 }`)
+	expected = "match on 'Shape' is not exhaustive, missing Circle"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("want=%v, got=%v", expected, err)
+	}
+
+	res, err := evalHelper(t, `try { match 1 { 2 => 2 } } catch (e) { e.kind }`)
+	if err != nil || !reflect.DeepEqual(res, &stringObject{value: "match"}) {
+		t.Fatalf("want=match, got=%v, %v", res, err)
+	}
+}
+
+func TestDestructuring(t *testing.T) {
+	person := `struct Person { name, age };
+let p = Person{name: "ann", age: 30};
+`
+	tests := []evalTest{
+		{name: "array literal", src: `len([1, 2, 3])`, expected: &intObject{value: 3}},
+		{name: "index", src: `let xs = [1, [2, 3]]; xs[1][0]`, expected: &intObject{value: 2}},
+		{name: "let array", src: `let pair = [1, 2]; let [a, b] = pair; a * 10 + b`, expected: &intObject{value: 12}},
+		{name: "let object", src: person + `let {name, age} = p; age`, expected: &intObject{value: 30}},
+		{name: "let object renamed", src: person + `let {name: n} = p; n`, expected: &stringObject{value: "ann"}},
+		{name: "nested", src: person + `let [_, {age: [x, y]}] = [0, Person{name: "b", age: [4, 5]}]; x + y`, expected: &intObject{value: 9}},
+		{name: "variant fields", src: `enum E { A(x, y) }; let {y} = A(1, 2); y`, expected: &intObject{value: 2}},
+		{name: "error fields", src: `try { throw "boom" } catch (e) { let {kind, message} = e; message }`, expected: &stringObject{value: "boom"}},
+		{name: "parameter", src: `let f = fn([x, y], z) { x + y + z }; f([1, 2], 3)`, expected: &intObject{value: 6}},
+		{name: "object parameter", src: person + `let age = fn({age}) { age }; age(p)`, expected: &intObject{value: 30}},
+		{name: "method parameter", src: person + `fn (p Person) older([a]) { p.age + a }; p.older([5])`, expected: &intObject{value: 35}},
+		{name: "captured", src: `let f = fn([x]) { fn() { x } }; f([7])()`, expected: &intObject{value: 7}},
+		{name: "local", src: `let f = fn(xs) { let [a, b] = xs; b }; f([1, 2])`, expected: &intObject{value: 2}},
+		{name: "match array", src: `match [1, 2] { [1] => 1, [1, y] => y, _ => 0 }`, expected: &intObject{value: 2}},
+		{name: "match object", src: person + `match p { {age: 31} => 1, {age: 30, name} => name, _ => 0 }`, expected: &stringObject{value: "ann"}},
+	}
+
+	test(t, tests)
+
+	for _, tt := range []struct{ src, expected string }{
+		{`let [a, b] = 1`, "cannot destructure 'int' as an array"},
+		{`let [a, b] = [1, 2, 3]`, "cannot destructure array of length 3 into 2 element(s)"},
+		{person + `let {height} = p`, "cannot destructure 'Person', it has no field 'height'"},
+		{`let [1, a] = [2, 3]`, "value of type 'int' does not match pattern"},
+		{`let f = fn([x]) { x }; f([])`, "cannot destructure array of length 0 into 1 element(s)"},
+	} {
+		_, err := evalHelper(t, tt.src)
+		var matchErr *matchError
+		if !errors.As(err, &matchErr) || matchErr.msg != tt.expected {
+			t.Errorf("%v: want=%v, got=%v", tt.src, tt.expected, err)
+		}
+	}
+
+	testError[*indexError](t, []errorTest{
+		{name: "index out of range", src: `[1, 2][2]`},
+		{name: "negative index", src: `[1][-1]`},
+	})
+
+	testError[*typeError](t, []errorTest{
+		{name: "index non-array", src: `1[0]`},
+		{name: "non-int index", src: `[1]["a"]`},
+	})
+}
+
+func TestClosures(t *testing.T) {
+	tests := []evalTest{
+		// shadowing
+		{name: "parameter shadows global", src: `let x = 1; let f = fn(x) { x = 5; x }; f(2) * 10 + x`, expected: &intObject{value: 51}},
+		{name: "parameter shadows captured", src: `let f = fn(x) { fn(x) { x = x + 1; x } }; let g = f(1); g(10) + g(10)`, expected: &intObject{value: 22}},
+		{name: "parameter shadows outer local", src: `let f = fn() { let x = 1; let g = fn(x) { x = 9 }; g(2); x }; f()`, expected: &intObject{value: 1}},
+		{name: "let shadows global", src: `let x = 1; let f = fn() { let x = 2; x = 3; x }; f() * 10 + x`, expected: &intObject{value: 31}},
+		{name: "let shadows captured", src: `let f = fn() { let x = 1; let g = fn() { let x = 2; x }; g() * 10 + x }; f()`, expected: &intObject{value: 21}},
+
+		// assignment
+		{name: "assignment updates global", src: `let x = 1; let f = fn() { x = 2 }; f(); x`, expected: &intObject{value: 2}},
+		{name: "assignment updates captured parameter", src: `let f = fn(x) { let set = fn() { x = 10 }; set(); x }; f(1)`, expected: &intObject{value: 10}},
+		{name: "assignment through two functions", src: `let f = fn() { let n = 0; let g = fn() { let h = fn() { n = n + 5 }; h(); h() }; g(); n }; f()`, expected: &intObject{value: 10}},
+		{name: "capture sees later assignment", src: `let f = fn() { let x = 1; let g = fn() { x }; x = 2; g() }; f()`, expected: &intObject{value: 2}},
+		{name: "function sees later global", src: `let f = fn() { g() }; let g = fn() { 7 }; f()`, expected: &intObject{value: 7}},
+
+		// closures outliving their function
+		{name: "counter", src: `let make = fn() { let n = 0; fn() { n = n + 1; n } }; let c = make(); c(); c(); c()`, expected: &intObject{value: 3}},
+		{name: "independent counters", src: `let make = fn() { let n = 0; fn() { n = n + 1; n } }; let a = make(); let b = make(); a(); a(); b() * 10 + a()`, expected: &intObject{value: 13}},
+		{name: "shared capture", src: `let pair = fn() { let n = 0; [fn() { n = n + 1 }, fn() { n }] }; let [inc, get] = pair(); inc(); inc(); get()`, expected: &intObject{value: 2}},
+		{name: "closure returned from closure", src: `let adder = fn(a) { fn(b) { fn(c) { a * 100 + b * 10 + c } } }; adder(1)(2)(3)`, expected: &intObject{value: 123}},
+		{name: "partial application", src: `let adder = fn(a) { fn(b) { fn(c) { a + b + c } } }; let addOne = adder(1); let addThree = addOne(2); addThree(3) + addOne(10)(20)`, expected: &intObject{value: 37}},
+		{name: "closure factory captures own frame", src: `let mk = fn(n) { fn() { n } }; let a = mk(1); let b = mk(2); a() + b() * 10`, expected: &intObject{value: 21}},
+
+		// recursion
+		{name: "frames are independent", src: `let f = fn(n) { let local = n; if n > 0 { f(n - 1) }; local }; f(3)`, expected: &intObject{value: 3}},
+		{name: "closures per recursive frame", src: `let f = fn(n, acc) { if n == 0 { acc } { f(n - 1, [fn() { n }, acc]) } }; let [g, [h, _]] = f(2, 0); g() * 10 + h()`, expected: &intObject{value: 12}},
+		{name: "recursive closure", src: `let outer = fn() { let fact = fn(n) { if n < 2 { 1 } { n * fact(n - 1) } }; fact }; outer()(5)`, expected: &intObject{value: 120}},
+		{name: "recursion does not clobber captured", src: `let f = fn(n) { let get = fn() { n }; if n > 0 { f(n - 1) }; get() }; f(4)`, expected: &intObject{value: 4}},
+	}
+
+	test(t, tests)
+}
+
+func TestBlockScope(t *testing.T) {
+	tests := []evalTest{
+		{name: "let in both branches", src: `let f = fn(c) { if c { let x = 1; x } { let x = 2; x } }; f(true) + f(false)`, expected: &intObject{value: 3}},
+		{name: "shadowing", src: `let x = 1; let y = if true { let x = 2; x }; x * 10 + y`, expected: &intObject{value: 12}},
+		{name: "shadowed parameter", src: `let f = fn(x) { if true { let y = x + 1; let x = y; x } }; f(1)`, expected: &intObject{value: 2}},
+		{name: "assignment to outer", src: `let x = 1; if true { x = 2 }; x`, expected: &intObject{value: 2}},
+		{name: "nested blocks", src: `let x = 1; if true { let x = 2; if true { let x = 3 }; x }`, expected: &intObject{value: 2}},
+		{name: "block runs again", src: `let f = fn(n) { if n > 0 { let m = n - 1; f(m) } { 0 } }; f(3)`, expected: &intObject{value: 0}},
+		{name: "closure over block local", src: `let f = fn() { if true { let x = 5; fn() { x } } }; f()()`, expected: &intObject{value: 5}},
+		{name: "try block", src: `let x = 1; try { let x = 2 } finally { let x = 3 }; x`, expected: &intObject{value: 1}},
+	}
+
+	test(t, tests)
+
+	_, err := evalHelper(t, `if true { let y = 1 }; y`)
+	if err == nil || !strings.Contains(err.Error(), "name 'y' not defined") {
+		t.Fatalf("want name error for leaked binding, got=%v", err)
+	}
+}
+
+func TestConst(t *testing.T) {
+	config := `struct Config { name, ports };
+const config = freeze(Config{name: "srv", ports: [80, 443]});
+`
+	tests := []evalTest{
+		{name: "const", src: `const x = 1; x + 1`, expected: &intObject{value: 2}},
+		{name: "const destructuring", src: `const [a, b] = [1, 2]; a + b`, expected: &intObject{value: 3}},
+		{name: "shadowed in function", src: `const x = 1; let f = fn() { let x = 2; x = 3; x }; f()`, expected: &intObject{value: 3}},
+		{name: "index assignment", src: `let xs = [1, 2]; xs[1] = 5; xs[1]`, expected: &intObject{value: 5}},
+		{name: "mutable contents", src: `const xs = [1]; xs[0] = 2; xs[0]`, expected: &intObject{value: 2}},
+		{name: "freeze returns value", src: config + `config.ports[1]`, expected: &intObject{value: 443}},
+		{name: "freeze is idempotent", src: `let xs = [1]; freeze(freeze(xs))[0]`, expected: &intObject{value: 1}},
+		{name: "frozen copy is mutable", src: config + `let c = Config{name: config.name, ports: [1]}; c.ports[0] = 2; c.ports[0]`, expected: &intObject{value: 2}},
+		{name: "caught", src: config + `try { config.name = "x" } catch (e) { e.kind }`, expected: &stringObject{value: "type"}},
+	}
+
+	test(t, tests)
+
+	testError[*typeError](t, []errorTest{
+		{name: "frozen field", src: config + `config.name = "other"`},
+		{name: "frozen nested array", src: config + `config.ports[0] = 8080`},
+		{name: "frozen by method", src: `struct C { n }; fn (c C) inc() { c.n = c.n + 1 }; let c = freeze(C{n: 1}); c.inc()`},
+		{name: "frozen in variant", src: `enum E { A(v) }; let xs = [1]; freeze(A(xs)); xs[0] = 2`},
+		{name: "index assignment on non-array", src: `let x = 1; x[0] = 1`},
+	})
+
+	testError[*indexError](t, []errorTest{
+		{name: "index assignment out of range", src: `let xs = [1]; xs[1] = 2`},
+	})
+
+	for _, src := range []string{
+		`const x = 1; x = 2`,
+		`const x = 1; let f = fn() { x = 2 }`,
+		`const [a, b] = [1, 2]; b = 3`,
+	} {
+		_, err := evalHelper(t, src)
+		if err == nil || !strings.Contains(err.Error(), "cannot assign to constant") {
+			t.Errorf("%v: want constant error, got=%v", src, err)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	loader := MapLoader{
+		"lib/math": `import "lib/counter" as counter;
+counter.hit();
+export let square = fn(x) { x * x };
+export struct Point { x, y };
+fn (p Point) norm() { square(p.x) + square(p.y) };
+export let origin = Point{x: 0, y: 0};
+export enum Opt { Some(v), None };
+let hidden = 1`,
+		"lib/counter": `let count = [0];
+export let hit = fn() { count = [count[0] + 1] };
+export let hits = fn() { count[0] }`,
+		"cycle/a":     `import "cycle/b" as b`,
+		"cycle/b":     `import "cycle/c" as c`,
+		"cycle/c":     `import "cycle/a" as a`,
+		"bad/syntax":  `let = 1`,
+		"bad/runtime": `export let x = 1 / 0`,
+	}
+	run := func(src string) (Value, error) {
+		in := New()
+		in.SetLoader(loader)
+		return in.Eval(parse(t, src))
+	}
+
+	tests := []struct {
+		name     string
+		src      string
+		expected object
+	}{
+		{name: "exported function", src: `import "lib/math" as m; m.square(3)`, expected: &intObject{value: 9}},
+		{name: "exported struct with methods", src: `import "lib/math" as m; m.origin.norm()`, expected: &intObject{value: 0}},
+		{name: "exported variant", src: `import "lib/math" as m; match m.Some(2) { {v} => v }`, expected: &intObject{value: 2}},
+		{name: "destructured module", src: `import "lib/math" as m; let {square} = m; square(4)`, expected: &intObject{value: 16}},
+		{name: "evaluated once", src: `import "lib/math" as m; import "lib/math" as n; import "lib/counter" as c; c.hits()`, expected: &intObject{value: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := run(tt.src)
+			if err != nil {
+				t.Fatalf("Failed to evaluate: %v", err)
+			}
+			if !reflect.DeepEqual(res, tt.expected) {
+				t.Fatalf("want=%v, got=%v", tt.expected, res)
+			}
+		})
+	}
+
+	for _, tt := range []struct{ src, expected string }{
+		{`import "cycle/a" as a`, `import cycle: "cycle/a" -> "cycle/b" -> "cycle/c" -> "cycle/a"`},
+		{`import "missing" as m`, `cannot import "missing": file does not exist`},
+		{`import "bad/syntax" as m`, `cannot import "bad/syntax": `},
+	} {
+		_, err := run(tt.src)
+		var importErr *importError
+		if !errors.As(err, &importErr) || !strings.HasPrefix(importErr.msg, tt.expected) {
+			t.Errorf("%v: want=%v, got=%v", tt.src, tt.expected, err)
+		}
+	}
+
+	if _, err := run(`import "bad/runtime" as m`); !errors.As(err, new(*zeroDivisionError)) {
+		t.Errorf("want zero division error, got=%v", err)
+	}
+	if _, err := run(`import "lib/math" as m; m.hidden`); !errors.As(err, new(*typeError)) {
+		t.Errorf("want type error for unexported name, got=%v", err)
+	}
+	if _, err := run(`import "lib/math" as m; m.square = 1`); !errors.As(err, new(*typeError)) {
+		t.Errorf("want type error for assignment to export, got=%v", err)
+	}
+	if _, err := Eval(parse(t, `import "lib/math" as m`)); !errors.As(err, new(*importError)) {
+		t.Errorf("want import error without loader, got=%v", err)
+	}
+
+	for _, src := range []string{`fn() { import "lib/math" as m }`, `try { import "lib/math" as m } catch (e) { 1 }`} {
+		if _, err := run(src); err == nil {
+			t.Fatalf("%v: want error for import outside of the top level", src)
+		}
+	}
+
+	fsys := fstest.MapFS{"lib/greet.lily": {Data: []byte(`export let greet = fn(name) { "hi " + name }`)}}
+	in := New()
+	in.SetLoader(FSLoader{FS: fsys})
+	res, err := in.Eval(parse(t, `import "lib/greet" as g; g.greet("bob")`))
+	if err != nil || !reflect.DeepEqual(res, &stringObject{value: "hi bob"}) {
+		t.Fatalf("want=hi bob, got=%v, %v", res, err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	in := New()
+	in.Register("parse_int", func(args ...Value) (Value, error) {
+		s, _ := ToGo(args[0])
+		n, err := strconv.ParseInt(s.(string), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return Int(n), nil
+	})
+
+	res, err := in.Eval(parse(t, `let f = fn(s) { ok(parse_int(s)? + 1) }; f("41").value`))
+	if err != nil {
+		t.Fatalf("Failed with error: %v", err)
+	}
+	if v, _ := ToGo(res); v != int64(42) {
+		t.Fatalf("want=42, got=%v", v)
+	}
+
+	res, err = in.Eval(parse(t, `let r = parse_int("x"); r.error.kind + ": " + r.error.message`))
+	if err != nil {
+		t.Fatalf("Failed with error: %v", err)
+	}
+	expected := `host: strconv.ParseInt: parsing "x": invalid syntax`
+	if v, _ := ToGo(res); v != expected {
+		t.Fatalf("want=%v, got=%v", expected, v)
+	}
+
+	if _, err := Eval(parse(t, `parse_int("1")`)); err == nil {
+		t.Fatalf("builtin registered on one interpreter leaked into the default builtins")
+	}
+}
+
+func TestZeroDivisionError(t *testing.T) {
+	testError[*zeroDivisionError](t, []errorTest{{src: "1 / 0"}, {src: "let f = fn(x) { 1 / x }; f(0)"}})
+}
+
+func TestTraceback(t *testing.T) {
+	src := `let inner = fn(a, b) { a + b };
+let outer = fn(x) {
+	let y = x;
+	inner(y, "1") + 1
+};
+let apply = fn(f, v) { f(v) };
+1 + apply(outer, 2)`
+
+	_, err := evalHelper(t, src)
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("want=%T, got=%v", runtimeErr, err)
+	}
+	var typeErr *typeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("want=%T, got=%v", typeErr, err)
+	}
+
+	// apply calls outer in tail position, so outer replaces its frame.
+	expected := `Traceback (most recent call last):
+  line 6, column 24, in outer(int)
+  line 4, column 2, in inner(int, string)
+TypeError: unsupported operand type(s) for '+': 'int' 'string'`
+	if err.Error() != expected {
+		t.Fatalf("want=\n%v\ngot=\n%v", expected, err)
+	}
+
+	_, err = evalHelper(t, `let f = fn(s) { len(s) + 1 }; fn() { f(1) + 1 }()`)
+	expected = `Traceback (most recent call last):
+  line 1, column 31, in <anonymous>()
+  line 1, column 38, in f(int)
+  line 1, column 17, in len(int)
+TypeError: arg not supported for len, got=int`
+	if err == nil || err.Error() != expected {
+		t.Fatalf("want=\n%v\ngot=\n%v", expected, err)
+	}
+}
+
+func TestHook(t *testing.T) {
+	src := `let sq = fn(x) {
+	x * x
+};
+let a = sq(2);
+len([a])`
+
+	in := New()
+	var events []string
+	in.SetHook(func(ev Event) error {
+		frame := ev.Stack[len(ev.Stack)-1]
+		switch ev.Kind {
+		case StmtEvent:
+			events = append(events, fmt.Sprintf("%v stmt %v", frame.Function, ev.Pos))
+		case CallEvent:
+			events = append(events, fmt.Sprintf("%v call %v at %v", frame.Function, ev.Function, ev.Pos))
+		}
+		return nil
+	})
+	if _, err := in.Eval(parse(t, src)); err != nil {
+		t.Fatalf("Failed with error: %v", err)
+	}
+
+	expected := []string{
+		"<main> stmt 1:1",
+		"<main> stmt 4:1",
+		"<main> call sq at 4:9",
+		"sq stmt 2:2",
+		"<main> stmt 5:1",
+		"<main> call len at 5:1",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("want=%q, got=%q", expected, events)
+	}
+
+	// An error of the hook aborts the evaluation.
+	stop := errors.New("stop")
+	in.SetHook(func(ev Event) error {
+		if ev.Kind == CallEvent {
+			return stop
+		}
+		return nil
+	})
+	if _, err := in.Eval(parse(t, src)); !errors.Is(err, stop) {
+		t.Fatalf("want=%v, got=%v", stop, err)
+	}
+}
+
+func TestStackFrame(t *testing.T) {
+	src := `let g = 1;
+let make = fn(n) {
+	let [a, b] = [n, n + 1];
+	fn(x) {
+		let y = x + a;
+		if (true) { let y = 2 * x; y }
+	}
+};
+let f = make(10);
+try { f(1) } catch (e) { 0 }`
+
+	in := New()
+	var stack, scopes, results []string
+	in.SetHook(func(ev Event) error {
+		// Stop at the last statement of line 6.
+		if ev.Kind != StmtEvent || ev.Pos.Line != 6 {
+			return nil
+		}
+		stack, scopes, results = nil, nil, nil
+		for _, frame := range ev.Stack {
+			stack = append(stack, fmt.Sprintf("%v@%v", frame.Function, frame.Pos))
+		}
+		frame := ev.Stack[len(ev.Stack)-1]
+		for _, scope := range frame.Scopes() {
+			var vars []string
+			for _, v := range scope.Vars {
+				vars = append(vars, v.Name+"="+Format(v.Value))
+			}
+			scopes = append(scopes, scope.Name+": "+strings.Join(vars, ", "))
+		}
+		for _, src := range []string{"y + a + g", "make", "[y, fn() { y }()]", "len", "z", "y = 1"} {
+			val, err := frame.Eval(src)
+			if err != nil {
+				results = append(results, "error: "+err.Error())
+				continue
+			}
+			results = append(results, Format(val))
+		}
+		return nil
+	})
+	if _, err := in.Eval(parse(t, src)); err != nil {
+		t.Fatalf("Failed with error: %v", err)
+	}
+
+	expectedStack := []string{"<main>@10:7", "<anonymous>@6:30"}
+	if !reflect.DeepEqual(stack, expectedStack) {
+		t.Fatalf("want=%q, got=%q", expectedStack, stack)
+	}
+
+	// The y of the block shadows the one of the function.
+	expectedScopes := []string{
+		"Locals: x=1, y=2",
+		"Captured: a=10",
+		"Globals: g=1, make=fn make, f=fn <anonymous>",
+	}
+	if !reflect.DeepEqual(scopes, expectedScopes) {
+		t.Fatalf("want=%q, got=%q", expectedScopes, scopes)
+	}
+
+	expectedResults := []string{
+		"13",
+		"fn make",
+		"[2, 2]",
+		"builtin len",
+		"error: name 'z' not defined",
+		"error: 'y' is not defined",
+	}
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Fatalf("want=%q, got=%q", expectedResults, results)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{`1`, `1`},
+		{`"a"`, `"a"`},
+		{`[1, [true], if (false) { 1 }]`, `[1, [true], nil]`},
+		{`struct P { x, y } P { x: 1, y: "b" }`, `P { x: 1, y: "b" }`},
+		{`enum E { A, B(v) } [A, B(1), B]`, `[E.A, E.B(1), E.B]`},
+		{`[ok(1), err(2)]`, `[ok(1), err(2)]`},
+		{`try { throw "x" } catch (e) { e }`, `error(user: x)`},
+		{`[fn() {}, len]`, `[fn <anonymous>, builtin len]`},
+		{`let a = [1]; a[0] = a; a`, `[[[[[...]]]]]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			res, err := evalHelper(t, tt.src)
+			if err != nil {
+				t.Fatalf("Failed with error: %v", err)
+			}
+			if got := Format(res); got != tt.expected {
+				t.Fatalf("want=%v, got=%v", tt.expected, got)
+			}
+		})
+	}
+}
+
 func test(t *testing.T, tests []evalTest) {
 	t.Helper()
 	for _, tt := range tests {
@@ -178,11 +902,33 @@ func testError[T error](t *testing.T, tests []errorTest) {
 // It fails the test on parsing errors.
 func evalHelper(t *testing.T, src string) (object, error) {
 	t.Helper()
-	l := lexer.New(src)
-	p := parser.New(l)
-	prog, err := p.Parse()
+	return Eval(parse(t, src))
+}
+
+func parse(t testing.TB, src string) *ast.Program {
+	t.Helper()
+	prog, err := parser.New(lexer.New(src)).Parse()
 	if err != nil {
 		t.Fatalf("Failed to parse program: %v", err)
 	}
-	return Eval(prog)
+	return prog
+}
+
+func BenchmarkFib(b *testing.B) {
+	src := `
+		let fib = fn(n) {
+			if (n < 2) { return n };
+			fib(n - 1) + fib(n - 2)
+		};
+		fib(20);`
+	prog, err := parser.New(lexer.New(src)).Parse()
+	if err != nil {
+		b.Fatalf("Failed to parse program: %v", err)
+	}
+
+	for b.Loop() {
+		if _, err := Eval(prog); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
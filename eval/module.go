@@ -0,0 +1,119 @@
+package eval
+
+import (
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+	"github.com/tombuente/lily/resolver"
+	"github.com/tombuente/lily/typecheck"
+)
+
+// ModuleLoader provides the source of the modules imported by scripts, see
+// [Interpreter.SetLoader].
+type ModuleLoader interface {
+	// Load returns the source of the module imported as path.
+	Load(path string) (string, error)
+}
+
+// FSLoader loads the module imported as path from the file path.lily of FS.
+type FSLoader struct {
+	FS fs.FS
+}
+
+func (x FSLoader) Load(path string) (string, error) {
+	src, err := fs.ReadFile(x.FS, path+".lily")
+	if err != nil {
+		return "", err
+	}
+	return string(src), nil
+}
+
+// MapLoader loads modules from a map of paths to sources.
+type MapLoader map[string]string
+
+func (x MapLoader) Load(path string) (string, error) {
+	src, ok := x[path]
+	if !ok {
+		return "", fs.ErrNotExist
+	}
+	return src, nil
+}
+
+// SetLoader sets the loader of the modules imported by scripts. Without a
+// loader every import fails.
+func (x *Interpreter) SetLoader(loader ModuleLoader) {
+	x.loader = loader
+}
+
+func (in *evaluator) evalImportStmt(node *ast.ImportStmt, env *environment) (object, error) {
+	mod, err := in.interp.module(node.Path.Value)
+	if err != nil {
+		return nil, err
+	}
+	*in.variable(in.info.Idents[node.Name], env) = mod
+	return nilInstance, nil
+}
+
+// module returns the module imported as path. A module is evaluated by its
+// first import only, later imports share its exports.
+func (x *Interpreter) module(path string) (*moduleObject, error) {
+	if mod, ok := x.modules[path]; ok {
+		return mod, nil
+	}
+	if i := slices.Index(x.loading, path); i >= 0 {
+		chain := make([]string, 0, len(x.loading)-i+1)
+		for _, p := range append(x.loading[i:], path) {
+			chain = append(chain, strconv.Quote(p))
+		}
+		return nil, &importError{msg: fmt.Sprintf("import cycle: %v", strings.Join(chain, " -> "))}
+	}
+	if x.loader == nil {
+		return nil, &importError{msg: fmt.Sprintf("cannot import %q, no module loader set", path)}
+	}
+
+	src, err := x.loader.Load(path)
+	if err != nil {
+		return nil, &importError{msg: fmt.Sprintf("cannot import %q: %v", path, err)}
+	}
+	prog, err := parser.New(lexer.New(src)).Parse()
+	if err != nil {
+		return nil, &importError{msg: fmt.Sprintf("cannot import %q: %v", path, err)}
+	}
+	info, err := resolver.Resolve(prog, slices.Collect(maps.Keys(x.builtins)))
+	if err != nil {
+		return nil, &importError{msg: fmt.Sprintf("cannot import %q: %v", path, err)}
+	}
+	if x.typecheck {
+		if _, err := typecheck.Check(prog, info); err != nil {
+			return nil, &typeError{msg: fmt.Sprintf("cannot import %q: %v", path, err)}
+		}
+	}
+
+	x.loading = append(x.loading, path)
+	defer func() { x.loading = x.loading[:len(x.loading)-1] }()
+
+	in := &evaluator{
+		interp:   x,
+		info:     info,
+		builtins: x.builtins,
+		globals:  make([]object, len(info.Globals)),
+		module:   path,
+	}
+	if _, err := in.run(&StackFrame{Function: "<module>", Module: path}, prog); err != nil {
+		return nil, err
+	}
+
+	mod := &moduleObject{path: path, exports: make(map[string]object)}
+	for _, ident := range info.Exports {
+		mod.exports[ident.Value] = in.globals[info.Idents[ident].Index]
+	}
+	x.modules[path] = mod
+	return mod, nil
+}
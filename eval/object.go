@@ -1,20 +1,44 @@
 package eval
 
 import (
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/resolver"
+	"github.com/tombuente/lily/token"
 )
 
-type object interface {
+// Value is a lily value. Hosts create values with [Int], [String], [Bool]
+// and [Nil] and read them with [ToGo].
+type Value interface {
 	Info() string
 }
 
+type object = Value
+
 type builtinFunc func(args ...object) (object, error)
 
+// HostFunc is a builtin implemented by the host, see [Interpreter.Register].
+type HostFunc func(args ...Value) (Value, error)
+
+// environment holds the variables of a running function. Variables are
+// addressed by the slots assigned by the resolver, names play no role at
+// run time:
+//   - Every call gets a fresh environment. Parameters and let statements
+//     always write a slot of it, they never touch an enclosing variable of
+//     the same name.
+//   - Assignment writes the variable the resolver bound the name to, which
+//     is the nearest declaration in scope: a local, an upvalue or a global.
+//   - A closure captures the variables of enclosing functions by reference
+//     when it is created. It shares them with the function declaring them
+//     and with every other closure capturing them, also after that function
+//     has returned.
 type environment struct {
-	local    map[string]object
-	captured *environment
+	slots    []object  // locals, starting with the parameters
+	upvalues []*object // variables captured from enclosing functions
 }
 
 type intObject struct {
@@ -34,18 +58,106 @@ type returnObject struct {
 	value object
 }
 
+// Returned by calls in tail position instead of applying the function, so
+// that applyFunction can run it without growing the Go stack.
+type tailCallObject struct {
+	fn   object
+	args []object
+	call *ast.Call
+}
+
 type functionObject struct {
-	params   []*ast.Ident
+	name     string // name of the let binding the function was declared by
+	method   bool   // the receiver is passed as an extra first argument
+	params   []ast.Pattern
 	body     *ast.BlockStmt
-	captured *environment
+	info     *resolver.Function
+	upvalues []*object
+	in       *evaluator // of the program or module declaring the function
 }
 
 type builtinFunctionObject struct {
-	fn builtinFunc
+	name string
+	fn   builtinFunc
 }
 
 type nilObject struct{}
 
+type arrayObject struct {
+	elems  []object
+	frozen bool // set by freeze, the elements cannot be assigned
+}
+
+// structType is the value a struct statement binds the name of the struct
+// to. It is used to construct values of the struct.
+type structType struct {
+	name    string
+	fields  []string
+	methods map[string]*functionObject
+}
+
+type structObject struct {
+	typ    *structType
+	fields []object // indexed like the fields of typ
+	frozen bool     // set by freeze, the fields cannot be assigned
+}
+
+// enumType is the value an enum statement binds the name of the enum to.
+type enumType struct {
+	name string
+}
+
+// variantType is bound to the name of a variant with fields and constructs
+// values of the variant when called. Variants without fields are bound to
+// their only value instead.
+type variantType struct {
+	enum   *enumType
+	name   string
+	fields []string
+}
+
+type variantObject struct {
+	typ    *variantType
+	fields []object // indexed like the fields of typ
+}
+
+// moduleObject is the value an import statement binds the name of the
+// module to.
+type moduleObject struct {
+	path    string
+	exports map[string]object
+}
+
+// boundMethod is a method selected from a struct value, which is passed as
+// the receiver when it is called.
+type boundMethod struct {
+	recv *structObject
+	fn   *functionObject
+}
+
+// errorObject is the value a catch clause binds an error to.
+type errorObject struct {
+	kind    string // one of the error kinds below
+	message string
+}
+
+const (
+	typeErrorKind         = "type"
+	nameErrorKind         = "name"
+	zeroDivisionErrorKind = "zero-division"
+	matchErrorKind        = "match"
+	indexErrorKind        = "index"
+	importErrorKind       = "import"
+	userErrorKind         = "user"
+	hostErrorKind         = "host" // error returned by a HostFunc
+)
+
+// resultObject is created by the ok and err builtins.
+type resultObject struct {
+	ok    bool
+	value object // the value for ok, the error for err
+}
+
 type internalError struct {
 	msg string
 	err error
@@ -59,41 +171,50 @@ type nameError struct {
 	msg string
 }
 
-func NewEnvironment() *environment {
-	return &environment{local: make(map[string]object)}
+type zeroDivisionError struct {
+	msg string
 }
 
-func (env *environment) get(key string) (object, bool) {
-	obj, ok := env.local[key]
-	if !ok && env.captured != nil {
-		obj, ok = env.captured.get(key)
-	}
-	return obj, ok
+// matchError is raised by a match expression without a matching arm.
+type matchError struct {
+	msg string
 }
 
-func (env *environment) set(key string, obj object) {
-	if env.captured != nil {
-		if _, ok := env.captured.get(key); ok {
-			env.captured.update(key, obj)
-		}
-	}
-	env.local[key] = obj
+// indexError is raised by an index out of range.
+type indexError struct {
+	msg string
 }
 
-func (env *environment) update(key string, obj object) error {
-	if _, ok := env.local[key]; ok {
-		env.set(key, obj)
-		return nil
-	}
+// importError is raised by an import statement whose module cannot be
+// loaded.
+type importError struct {
+	msg string
+}
 
-	if env.captured != nil {
-		if _, ok := env.captured.get(key); ok {
-			env.captured.set(key, obj)
-			return nil
-		}
-	}
+// earlyReturn is raised by the ? operator on an err result. It is turned
+// into a returnObject by the enclosing statement list.
+type earlyReturn struct {
+	result *resultObject
+}
+
+// thrownError is raised by a throw statement.
+type thrownError struct {
+	obj *errorObject
+}
+
+// RuntimeError is an error raised inside a function call together with the
+// lily-level stack trace that led to it.
+type RuntimeError struct {
+	Err error
+	// Trace holds the calls active when Err was raised, outermost first.
+	// Calls in tail position replace the frame of their caller.
+	Trace []Frame
+}
 
-	return &nameError{msg: fmt.Sprintf("'%v' is not defined", key)}
+type Frame struct {
+	Function string    // name of the called function
+	Pos      token.Pos // position of the call
+	Args     []string  // types of the arguments
 }
 
 func (x *intObject) Info() string {
@@ -112,6 +233,10 @@ func (x *returnObject) Info() string {
 	return "return"
 }
 
+func (x *tailCallObject) Info() string {
+	return "tail call"
+}
+
 func (x *functionObject) Info() string {
 	return "function"
 }
@@ -124,13 +249,72 @@ func (x *nilObject) Info() string {
 	return "nil"
 }
 
+func (x *arrayObject) Info() string {
+	return "array"
+}
+
+func (x *structType) Info() string {
+	return "struct"
+}
+
+func (x *structObject) Info() string {
+	return x.typ.name
+}
+
+func (x *enumType) Info() string {
+	return "enum"
+}
+
+func (x *variantType) Info() string {
+	return "constructor"
+}
+
+func (x *variantObject) Info() string {
+	return x.typ.enum.name
+}
+
+func (x *moduleObject) Info() string {
+	return "module"
+}
+
+func (x *boundMethod) Info() string {
+	return "method"
+}
+
+// field returns the index of the field name, or -1 if there is none.
+func (x *structType) field(name string) int {
+	return slices.Index(x.fields, name)
+}
+
+func (x *errorObject) Info() string {
+	return "error"
+}
+
+func (x *resultObject) Info() string {
+	return "result"
+}
+
 func (x *internalError) Error() string {
-	if x.err != nil {
+	if x.err == nil {
 		return fmt.Sprintf("%v", x.msg)
 	}
 	return fmt.Sprintf("%v: %v", x.msg, x.err)
 }
 
+func (x *RuntimeError) Error() string {
+	var b strings.Builder
+	b.WriteString("Traceback (most recent call last):\n")
+	for _, frame := range x.Trace {
+		fmt.Fprintf(&b, "  line %v, column %v, in %v(%v)\n", frame.Pos.Line, frame.Pos.Column, frame.Function, strings.Join(frame.Args, ", "))
+	}
+	fmt.Fprintf(&b, "%v: %v", errorKind(x.Err), x.Err)
+	return b.String()
+}
+
+func (x *RuntimeError) Unwrap() error {
+	return x.Err
+}
+
 func (x *typeError) Error() string {
 	return fmt.Sprintf("%v", x.msg)
 }
@@ -138,3 +322,144 @@ func (x *typeError) Error() string {
 func (x *nameError) Error() string {
 	return fmt.Sprintf("%v", x.msg)
 }
+
+func (x *zeroDivisionError) Error() string {
+	return fmt.Sprintf("%v", x.msg)
+}
+
+func (x *matchError) Error() string {
+	return fmt.Sprintf("%v", x.msg)
+}
+
+func (x *indexError) Error() string {
+	return fmt.Sprintf("%v", x.msg)
+}
+
+func (x *importError) Error() string {
+	return fmt.Sprintf("%v", x.msg)
+}
+
+func (x *earlyReturn) Error() string {
+	return "early return of err result"
+}
+
+func (x *thrownError) Error() string {
+	return x.obj.message
+}
+
+func errorKind(err error) string {
+	switch err := err.(type) {
+	case *typeError:
+		return "TypeError"
+	case *nameError:
+		return "NameError"
+	case *zeroDivisionError:
+		return "ZeroDivisionError"
+	case *matchError:
+		return "MatchError"
+	case *indexError:
+		return "IndexError"
+	case *importError:
+		return "ImportError"
+	case *internalError:
+		return "InternalError"
+	case *thrownError:
+		switch err.obj.kind {
+		case typeErrorKind:
+			return "TypeError"
+		case nameErrorKind:
+			return "NameError"
+		case zeroDivisionErrorKind:
+			return "ZeroDivisionError"
+		case matchErrorKind:
+			return "MatchError"
+		case indexErrorKind:
+			return "IndexError"
+		case importErrorKind:
+			return "ImportError"
+		}
+	}
+	return "Error"
+}
+
+// catchable converts err into the value bound by a catch clause. Internal
+// errors are not catchable.
+func catchable(err error) (*errorObject, bool) {
+	var (
+		thrownErr       *thrownError
+		typeErr         *typeError
+		nameErr         *nameError
+		zeroDivisionErr *zeroDivisionError
+		matchErr        *matchError
+		indexErr        *indexError
+		importErr       *importError
+	)
+	switch {
+	case errors.As(err, &thrownErr):
+		return thrownErr.obj, true
+	case errors.As(err, &typeErr):
+		return &errorObject{kind: typeErrorKind, message: typeErr.msg}, true
+	case errors.As(err, &nameErr):
+		return &errorObject{kind: nameErrorKind, message: nameErr.msg}, true
+	case errors.As(err, &zeroDivisionErr):
+		return &errorObject{kind: zeroDivisionErrorKind, message: zeroDivisionErr.msg}, true
+	case errors.As(err, &matchErr):
+		return &errorObject{kind: matchErrorKind, message: matchErr.msg}, true
+	case errors.As(err, &indexErr):
+		return &errorObject{kind: indexErrorKind, message: indexErr.msg}, true
+	case errors.As(err, &importErr):
+		return &errorObject{kind: importErrorKind, message: importErr.msg}, true
+	}
+	return nil, false
+}
+
+// withFrame adds the call of the function name at pos to the stack trace of
+// err, which was raised inside that call.
+func withFrame(err error, name string, pos token.Pos, args []object) error {
+	if name == "" {
+		name = "<anonymous>"
+	}
+	frame := Frame{Function: name, Pos: pos, Args: make([]string, len(args))}
+	for i, arg := range args {
+		frame.Args[i] = arg.Info()
+	}
+
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		runtimeErr.Trace = append([]Frame{frame}, runtimeErr.Trace...)
+		return err
+	}
+	return &RuntimeError{Err: err, Trace: []Frame{frame}}
+}
+
+func Int(v int64) Value {
+	return &intObject{value: v}
+}
+
+func String(v string) Value {
+	return &stringObject{value: v}
+}
+
+func Bool(v bool) Value {
+	return boolInstance(v)
+}
+
+func Nil() Value {
+	return nilInstance
+}
+
+// ToGo returns the Go representation of v: an int64, string or bool, or nil
+// for nil. It reports false for values without one, such as functions.
+func ToGo(v Value) (any, bool) {
+	switch v := v.(type) {
+	case *intObject:
+		return v.value, true
+	case *stringObject:
+		return v.value, true
+	case *boolObject:
+		return v.value, true
+	case *nilObject:
+		return nil, true
+	}
+	return nil, false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tombuente/lily/format"
+)
+
+// runFmt formats the files and directories in args, or standard input if
+// there are none. Directories are walked for .lily files.
+func runFmt(args []string) error {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "write the result to the source file instead of standard output")
+	diff := flags.Bool("d", false, "print diffs instead of the formatted source")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: lily fmt [-w] [-d] [path ...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	f := &formatter{write: *write, diff: *diff, out: os.Stdout}
+	if flags.NArg() == 0 {
+		if f.write {
+			return errors.New("cannot use -w with standard input")
+		}
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		return f.format("<standard input>", src)
+	}
+
+	failed := false
+	for _, path := range flags.Args() {
+		if err := walkFiles(path, f.file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		return errors.New("some files could not be formatted")
+	}
+	return nil
+}
+
+type formatter struct {
+	write bool
+	diff  bool
+	out   io.Writer
+}
+
+func (f *formatter) file(path string) error {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return f.format(path, src)
+}
+
+// format formats src, read from name, according to the flags.
+func (f *formatter) format(name string, src []byte) error {
+	res, err := format.Source(string(src))
+	if err != nil {
+		return fmt.Errorf("%v: %w", name, err)
+	}
+
+	if f.diff {
+		fmt.Fprint(f.out, unifiedDiff(name, string(src), res))
+	}
+	if f.write {
+		if res == string(src) {
+			return nil
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(name, []byte(res), info.Mode().Perm())
+	}
+	if !f.diff {
+		fmt.Fprint(f.out, res)
+	}
+	return nil
+}
@@ -0,0 +1,545 @@
+// Package format prints programs as canonically formatted lily source.
+//
+// Statements are put on lines of their own and indented by one tab per
+// block, statements but the last one of a block are terminated by a
+// semicolon. Binary operators are surrounded by spaces and parentheses are
+// only added where the parser needs them, so parsing the output yields the
+// printed program again and formatting is idempotent.
+//
+// [Source] keeps the comments of the source. Comments on lines of their own
+// stay before the statement, match arm or enum variant they precede, and a
+// comment following code on its line stays at the end of that line. Other
+// comments within a statement are moved to the end of it.
+package format
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+	"github.com/tombuente/lily/token"
+)
+
+// primary is the precedence of expressions that never need parentheses,
+// such as literals and identifiers.
+const primary = parser.CallPrecedence + 1
+
+// Source formats the lily program src.
+func Source(src string) (string, error) {
+	l := lexer.New(src)
+	prog, err := parser.New(l).Parse()
+	if err != nil {
+		return "", err
+	}
+
+	p := &printer{braces: braces(src)}
+	lines := strings.Split(src, "\n")
+	for _, tok := range l.Comments() {
+		code := strings.TrimSpace(lines[tok.Pos.Line-1][:tok.Pos.Column-1])
+		p.comments = append(p.comments, comment{Token: tok, trailing: code != ""})
+	}
+	p.program(prog)
+	return p.b.String(), nil
+}
+
+// Program returns the formatted source of prog.
+func Program(prog *ast.Program) string {
+	p := &printer{}
+	p.program(prog)
+	return p.b.String()
+}
+
+// braces maps the position of each '{' of src to the position of its '}'.
+func braces(src string) map[token.Pos]token.Pos {
+	braces := make(map[token.Pos]token.Pos)
+	l := lexer.New(src)
+	var open []token.Pos
+	for tok := l.Next(); tok.Type != token.EOF; tok = l.Next() {
+		switch tok.Type {
+		case token.LBrace:
+			open = append(open, tok.Pos)
+		case token.RBrace:
+			if len(open) > 0 {
+				braces[open[len(open)-1]] = tok.Pos
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	return braces
+}
+
+// comment is a comment of the source that is yet to be printed.
+type comment struct {
+	token.Token
+	trailing bool // follows code on its line
+}
+
+type printer struct {
+	b      strings.Builder
+	indent int
+
+	comments []comment               // in source order
+	braces   map[token.Pos]token.Pos // see [braces]
+
+	// noStructLit is set while printing an if condition or match subject,
+	// where struct literals must be parenthesized.
+	noStructLit bool
+}
+
+func (p *printer) write(s string) {
+	p.b.WriteString(s)
+}
+
+func (p *printer) newline() {
+	p.b.WriteByte('\n')
+	for range p.indent {
+		p.b.WriteByte('\t')
+	}
+}
+
+// pending reports whether the next comment comes before pos. The zero pos
+// is the end of the source.
+func (p *printer) pending(pos token.Pos) bool {
+	if len(p.comments) == 0 {
+		return false
+	}
+	next := p.comments[0].Pos
+	return !pos.IsValid() || next.Line < pos.Line || next.Line == pos.Line && next.Column < pos.Column
+}
+
+// leadingComments prints the comments before pos on lines of their own,
+// the current line must be empty.
+func (p *printer) leadingComments(pos token.Pos) {
+	for p.pending(pos) {
+		p.write(p.comments[0].Literal)
+		p.newline()
+		p.comments = p.comments[1:]
+	}
+}
+
+// trailingComment prints the next comment at the end of the current line if
+// it comes before pos and follows code on its line.
+func (p *printer) trailingComment(pos token.Pos) {
+	if p.pending(pos) && p.comments[0].trailing {
+		p.write(" " + p.comments[0].Literal)
+		p.comments = p.comments[1:]
+	}
+}
+
+func (p *printer) program(prog *ast.Program) {
+	p.stmts(prog.Stmts, token.Pos{})
+	if p.b.Len() > 0 {
+		p.write("\n")
+	}
+}
+
+// stmts prints statements on lines of their own, followed by the comments
+// before end. The current line must be empty.
+func (p *printer) stmts(stmts []ast.Stmt, end token.Pos) {
+	for i, stmt := range stmts {
+		if i > 0 {
+			p.newline()
+		}
+		p.leadingComments(stmt.Pos())
+		p.stmt(stmt)
+		next := end
+		if i < len(stmts)-1 {
+			p.write(";")
+			next = stmts[i+1].Pos()
+		}
+		p.trailingComment(next)
+	}
+
+	for first := len(stmts) == 0; p.pending(end); first = false {
+		if !first {
+			p.newline()
+		}
+		p.write(p.comments[0].Literal)
+		p.comments = p.comments[1:]
+	}
+}
+
+// allowStructLit clears noStructLit until the returned function is called,
+// like [parser.Parser] does for nested brackets and blocks.
+func (p *printer) allowStructLit() func() {
+	prev := p.noStructLit
+	p.noStructLit = false
+	return func() { p.noStructLit = prev }
+}
+
+func (p *printer) stmt(stmt ast.Stmt) {
+	switch stmt := stmt.(type) {
+	case *ast.LetStmt:
+		if stmt.Const {
+			p.write("const ")
+		} else {
+			p.write("let ")
+		}
+		if stmt.Pattern != nil {
+			p.pattern(stmt.Pattern)
+		} else {
+			p.write(stmt.Ident.Value)
+		}
+		p.annotation(stmt.Type)
+		p.write(" = ")
+		p.expr(stmt.Expr)
+	case *ast.ReturnStmt:
+		p.write("return ")
+		p.expr(stmt.Expr)
+	case *ast.ThrowStmt:
+		p.write("throw ")
+		p.expr(stmt.Expr)
+	case *ast.StructStmt:
+		p.write("struct " + stmt.Name.Value + " {")
+		for i, field := range stmt.Fields {
+			if i > 0 {
+				p.write(",")
+			}
+			p.write(" " + field.Value)
+		}
+		if len(stmt.Fields) > 0 {
+			p.write(" ")
+		}
+		p.write("}")
+	case *ast.EnumStmt:
+		p.write("enum " + stmt.Name.Value + " {")
+		p.indent++
+		for i, variant := range stmt.Variants {
+			p.newline()
+			p.leadingComments(variant.Pos())
+			p.write(variant.Name.Value)
+			if variant.Fields != nil {
+				p.identList(variant.Fields)
+			}
+			p.write(",")
+			// Variants take a single line.
+			next := token.Pos{Line: variant.Pos().Line + 1, Column: 1}
+			if i < len(stmt.Variants)-1 {
+				next = stmt.Variants[i+1].Pos()
+			}
+			p.trailingComment(next)
+		}
+		p.indent--
+		if len(stmt.Variants) > 0 {
+			p.newline()
+		}
+		p.write("}")
+	case *ast.MethodStmt:
+		p.write("fn (" + stmt.Receiver.Value + " " + stmt.Type.Value + ") " + stmt.Name.Value)
+		p.signature(stmt.Function)
+		p.write(" ")
+		p.block(stmt.Function.Body)
+	case *ast.ImportStmt:
+		p.write("import " + quote(stmt.Path.Value) + " as " + stmt.Name.Value)
+	case *ast.ExportStmt:
+		p.write("export ")
+		p.stmt(stmt.Stmt)
+	case *ast.ExprStmt:
+		p.expr(stmt.Expr)
+	case *ast.BlockStmt:
+		p.block(stmt)
+	}
+}
+
+// block prints a block with one statement per line, or {} if it is empty.
+func (p *printer) block(block *ast.BlockStmt) {
+	defer p.allowStructLit()()
+
+	end := p.braces[block.Pos()]
+	if len(block.Stmts) == 0 && !p.pending(end) {
+		p.write("{}")
+		return
+	}
+
+	p.write("{")
+	p.indent++
+	p.newline()
+	p.stmts(block.Stmts, end)
+	p.indent--
+	p.newline()
+	p.write("}")
+}
+
+func (p *printer) identList(idents []*ast.Ident) {
+	p.write("(")
+	for i, ident := range idents {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.write(ident.Value)
+	}
+	p.write(")")
+}
+
+// signature prints the parameters and the result type of fn.
+func (p *printer) signature(fn *ast.Function) {
+	p.write("(")
+	for i, param := range fn.Params {
+		if i > 0 {
+			p.write(", ")
+		}
+		p.pattern(param)
+		if i < len(fn.ParamTypes) {
+			p.annotation(fn.ParamTypes[i])
+		}
+	}
+	p.write(")")
+	p.annotation(fn.Result)
+}
+
+// annotation prints ": typ" unless typ is nil.
+func (p *printer) annotation(typ ast.TypeExpr) {
+	if typ != nil {
+		p.write(": ")
+		p.typeExpr(typ)
+	}
+}
+
+func (p *printer) typeExpr(typ ast.TypeExpr) {
+	switch typ := typ.(type) {
+	case *ast.NamedType:
+		p.write(typ.Name.Value)
+	case *ast.ArrayType:
+		p.write("[")
+		p.typeExpr(typ.Elem)
+		p.write("]")
+	case *ast.FuncType:
+		p.write("fn(")
+		for i, param := range typ.Params {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.typeExpr(param)
+		}
+		p.write(")")
+		p.annotation(typ.Result)
+	}
+}
+
+// expr prints e, in parentheses if needed.
+func (p *printer) expr(e ast.Expr) {
+	if _, ok := e.(*ast.StructLit); ok && p.noStructLit {
+		p.group(e)
+		return
+	}
+
+	switch e := e.(type) {
+	case *ast.Ident:
+		p.write(e.Value)
+	case *ast.Int:
+		p.write(strconv.FormatInt(e.Value, 10))
+	case *ast.Bool:
+		p.write(strconv.FormatBool(e.Value))
+	case *ast.String:
+		p.write(quote(e.Value))
+	case *ast.UnaryOp:
+		p.write(e.Op)
+		p.operand(e.Rhs, parser.PrefixPrecedence)
+	case *ast.BinaryOp:
+		prec := parser.Precedence(token.Type(e.Op))
+		p.operand(e.Left, prec)
+		p.write(" " + e.Op + " ")
+		// Binary operators are left-associative.
+		p.operand(e.Right, prec+1)
+	case *ast.Assignment:
+		p.write(e.Ident.Value + " = ")
+		p.expr(e.Expr)
+	case *ast.FieldAssignment:
+		p.expr(e.Target)
+		p.write(" = ")
+		p.expr(e.Expr)
+	case *ast.IndexAssignment:
+		p.expr(e.Target)
+		p.write(" = ")
+		p.expr(e.Expr)
+	case *ast.If:
+		p.write("if ")
+		p.noStructLit = true
+		p.expr(e.Condition)
+		p.noStructLit = false
+		p.write(" ")
+		p.block(e.Consequence)
+		if e.Alternative != nil {
+			p.write(" ")
+			p.block(e.Alternative)
+		}
+	case *ast.Function:
+		p.write("fn")
+		p.signature(e)
+		p.write(" ")
+		p.block(e.Body)
+	case *ast.Call:
+		p.operand(e.Lhs, parser.CallPrecedence)
+		p.write("(")
+		restore := p.allowStructLit()
+		for i, arg := range e.Args {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.expr(arg)
+		}
+		restore()
+		p.write(")")
+	case *ast.Selector:
+		p.operand(e.Expr, parser.CallPrecedence)
+		p.write("." + e.Field.Value)
+	case *ast.Index:
+		p.operand(e.Expr, parser.CallPrecedence)
+		p.write("[")
+		restore := p.allowStructLit()
+		p.expr(e.Index)
+		restore()
+		p.write("]")
+	case *ast.Propagate:
+		p.operand(e.Expr, parser.CallPrecedence)
+		p.write("?")
+	case *ast.ArrayLit:
+		p.write("[")
+		restore := p.allowStructLit()
+		for i, elem := range e.Elems {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.expr(elem)
+		}
+		restore()
+		p.write("]")
+	case *ast.StructLit:
+		p.write(e.Type.Value + "{")
+		for i, field := range e.Fields {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.write(field.Name.Value + ": ")
+			p.expr(field.Value)
+		}
+		p.write("}")
+	case *ast.Match:
+		p.write("match ")
+		p.noStructLit = true
+		p.expr(e.Subject)
+		p.noStructLit = false
+		p.write(" {")
+		p.indent++
+		for i, arm := range e.Arms {
+			p.newline()
+			p.leadingComments(arm.Pos())
+			p.pattern(arm.Pattern)
+			p.write(" => ")
+			restore := p.allowStructLit()
+			p.stmt(arm.Body)
+			restore()
+			p.write(",")
+			if i < len(e.Arms)-1 {
+				p.trailingComment(e.Arms[i+1].Pos())
+			}
+		}
+		p.indent--
+		if len(e.Arms) > 0 {
+			p.newline()
+		}
+		p.write("}")
+	case *ast.Try:
+		p.write("try ")
+		p.block(e.Body)
+		if e.Catch != nil {
+			p.write(" catch (" + e.Param.Value + ") ")
+			p.block(e.Catch)
+		}
+		if e.Finally != nil {
+			p.write(" finally ")
+			p.block(e.Finally)
+		}
+	}
+}
+
+// operand prints e as an operand of an operator with precedence prec. It
+// is parenthesized if it binds less tightly than prec.
+func (p *printer) operand(e ast.Expr, prec int) {
+	if precedence(e) < prec {
+		p.group(e)
+		return
+	}
+	p.expr(e)
+}
+
+func (p *printer) group(e ast.Expr) {
+	p.write("(")
+	restore := p.allowStructLit()
+	p.expr(e)
+	restore()
+	p.write(")")
+}
+
+// precedence returns the precedence of the operator of e.
+func precedence(e ast.Expr) int {
+	switch e := e.(type) {
+	case *ast.Assignment, *ast.FieldAssignment, *ast.IndexAssignment:
+		return parser.Precedence(token.Assign)
+	case *ast.BinaryOp:
+		return parser.Precedence(token.Type(e.Op))
+	case *ast.UnaryOp:
+		return parser.PrefixPrecedence
+	case *ast.Int:
+		// A negative int, as created by the optimizer, is printed with a
+		// unary minus.
+		if e.Value < 0 {
+			return parser.PrefixPrecedence
+		}
+	case *ast.Call, *ast.Selector, *ast.Index, *ast.Propagate:
+		return parser.CallPrecedence
+	}
+	return primary
+}
+
+func (p *printer) pattern(pattern ast.Pattern) {
+	switch pattern := pattern.(type) {
+	case *ast.WildcardPattern:
+		p.write("_")
+	case *ast.IdentPattern:
+		p.write(pattern.Ident.Value)
+	case *ast.LiteralPattern:
+		p.expr(pattern.Value)
+	case *ast.ConstructorPattern:
+		p.write(pattern.Name.Value + "(")
+		for i, arg := range pattern.Args {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.pattern(arg)
+		}
+		p.write(")")
+	case *ast.ArrayPattern:
+		p.write("[")
+		for i, elem := range pattern.Elems {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.pattern(elem)
+		}
+		p.write("]")
+	case *ast.ObjectPattern:
+		p.write("{")
+		for i, field := range pattern.Fields {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.write(field.Name.Value)
+			// {name} is short for {name: name}.
+			if ident, ok := field.Pattern.(*ast.IdentPattern); ok && ident.Ident.Value == field.Name.Value {
+				continue
+			}
+			p.write(": ")
+			p.pattern(field.Pattern)
+		}
+		p.write("}")
+	}
+}
+
+// quote returns the literal of the string s. Strings cannot contain '"',
+// lily has no escape sequences.
+func quote(s string) string {
+	return `"` + s + `"`
+}
@@ -0,0 +1,246 @@
+package format
+
+import (
+	"testing"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+)
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		expected string
+	}{
+		{
+			name:     "spacing",
+			src:      "let   x=1+2*3;x",
+			expected: "let x = 1 + 2 * 3;\nx\n",
+		},
+		{
+			name:     "minimal parentheses",
+			src:      "((1 + 2)) * (3); (1 * 2) + 3; 1 - (2 - 3); (1 - 2) - 3; -(1 + 2); (-x).y; (a = 1) + 2",
+			expected: "(1 + 2) * 3;\n1 * 2 + 3;\n1 - (2 - 3);\n1 - 2 - 3;\n-(1 + 2);\n(-x).y;\n(a = 1) + 2\n",
+		},
+		{
+			name:     "comparison",
+			src:      "(a < b) == (c > d); a == (b == c)",
+			expected: "a < b == c > d;\na == (b == c)\n",
+		},
+		{
+			name: "if and function",
+			src:  "let f = fn(n) { if (n < 2) { return n }; f(n - 1) + f(n - 2) }; if true {} { 1 }",
+			expected: `let f = fn(n) {
+	if n < 2 {
+		return n
+	};
+	f(n - 1) + f(n - 2)
+};
+if true {} {
+	1
+}
+`,
+		},
+		{
+			name:     "struct literal in condition",
+			src:      "if (P{x: 1}).x == f(P{x: 2}) { 1 }; match (P{x: 1}) { _ => P{x: 2} }",
+			expected: "if (P{x: 1}).x == f(P{x: 2}) {\n\t1\n};\nmatch (P{x: 1}) {\n\t_ => P{x: 2},\n}\n",
+		},
+		{
+			name: "declarations",
+			src:  `struct Point {x,y}; struct Unit {}; fn (p Point) add(q) { Point{x: p.x + q.x, y: p.y + q.y} }; enum Shape { Circle(r), Empty }; import "lib/math" as m; export const k = m.pi`,
+			expected: `struct Point { x, y };
+struct Unit {};
+fn (p Point) add(q) {
+	Point{x: p.x + q.x, y: p.y + q.y}
+};
+enum Shape {
+	Circle(r),
+	Empty,
+};
+import "lib/math" as m;
+export const k = m.pi
+`,
+		},
+		{
+			name: "match",
+			src:  `match s { Circle(r) => 3 * r * r, Rect(w, -1) => { let a = w; a }, [x, _] => x, {name, age: n} => n, "a" => true }`,
+			expected: `match s {
+	Circle(r) => 3 * r * r,
+	Rect(w, -1) => {
+		let a = w;
+		a
+	},
+	[x, _] => x,
+	{name, age: n} => n,
+	"a" => true,
+}
+`,
+		},
+		{
+			name: "try",
+			src:  `try { throw "a" } catch (e) { e.message } finally { x = 1 }; try { f()? } finally {}`,
+			expected: `try {
+	throw "a"
+} catch (e) {
+	e.message
+} finally {
+	x = 1
+};
+try {
+	f()?
+} finally {}
+`,
+		},
+		{
+			name:     "destructuring and arrays",
+			src:      `let [a, {b}] = [1, p]; let g = fn([x, y], {z}) { xs[0] = x }; xs[1][2]; ""`,
+			expected: "let [a, {b}] = [1, p];\nlet g = fn([x, y], {z}) {\n\txs[0] = x\n};\nxs[1][2];\n\"\"\n",
+		},
+		{
+			name:     "postfix on block expressions",
+			src:      "fn(x) { x }(1); if a { P{x: 1} } { P{x: 2} }.x",
+			expected: "fn(x) {\n\tx\n}(1);\nif a {\n\tP{x: 1}\n} {\n\tP{x: 2}\n}.x\n",
+		},
+		{
+			name:     "statement after block expression",
+			src:      "let f = fn() { 1 }; (a + b).c; [1]; -x",
+			expected: "let f = fn() {\n\t1\n};\n(a + b).c;\n[1];\n-x\n",
+		},
+		{
+			name:     "empty program",
+			src:      "",
+			expected: "",
+		},
+		{
+			name: "comments",
+			src: `// Package doc.
+
+let x = 1;   // one
+// before y
+let y = fn() {
+  // only a comment
+};
+let z = fn() { 1 // trailing
+  // after
+};
+enum E {
+  // first
+  A, // a
+  B
+};
+match x {
+  1 => 2, // first arm
+  // second arm
+  _ => 3
+}
+// end`,
+			expected: `// Package doc.
+let x = 1; // one
+// before y
+let y = fn() {
+	// only a comment
+};
+let z = fn() {
+	1 // trailing
+	// after
+};
+enum E {
+	// first
+	A, // a
+	B,
+};
+match x {
+	1 => 2, // first arm
+	// second arm
+	_ => 3,
+}
+// end
+`,
+		},
+		{
+			name:     "comment within a statement",
+			src:      "let x = 1 + // one\n  2;\nx",
+			expected: "let x = 1 + 2; // one\nx\n",
+		},
+		{
+			name:     "type annotations",
+			src:      "let f:fn(int,[P]):bool=fn(a:int,b,[c] : [P]):bool{true};fn (p P) m(q:string):fn(){fn(){}}",
+			expected: "let f: fn(int, [P]): bool = fn(a: int, b, [c]: [P]): bool {\n\ttrue\n};\nfn (p P) m(q: string): fn() {\n\tfn() {}\n}\n",
+		},
+		{
+			name:     "only comments",
+			src:      "// a\n// b",
+			expected: "// a\n// b\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := Source(tt.src)
+			if err != nil {
+				t.Fatalf("Failed to format: %v", err)
+			}
+			if actual != tt.expected {
+				t.Fatalf("want=\n%v\ngot=\n%v", tt.expected, actual)
+			}
+			if again, _ := Source(actual); again != actual {
+				t.Fatalf("formatting is not idempotent, got=\n%v", again)
+			}
+			roundTrip(t, tt.src)
+		})
+	}
+}
+
+// TestRoundTrip checks that formatting is idempotent and preserves the
+// program.
+func TestRoundTrip(t *testing.T) {
+	tests := []string{
+		`let fib = fn(n) { if n < 2 { n } { fib(n - 1) + fib(n - 2) } }; fib(10)`,
+		`let outer = 5; let mutate = fn() { outer = 10; }; let add = fn(x) { return outer + x; }; mutate(); add(5);`,
+		`!(1 < 2) == !true; -(-x); --x; !!y; -(1 * 2) * 3; 1 / (2 / 3) / 4`,
+		`a = b = c; p.x = q.y = 1; xs[0] = ys[1] = 2; (f = g)(1)`,
+		`enum List { Cons(head, tail), Nil }; let sum = fn(l, acc) { match l { Cons(h, t) => sum(t, acc + h), Nil => acc } }; sum(Cons(1, Nil), 0)`,
+		`enum Opt { Some(v), None }; match Some(Rect(1, 2)) { Some(Rect(1, h)) => h, Some(_) => 0, None => -1 }`,
+		`struct S { v }; fn (s S) get([a, b], c) { s.v + a + b + c }; S{v: 1}.get([1, 2], 3)`,
+		`try { try { 1 / 0 } catch (e) { throw e } } catch (e) { e.kind } finally { if true { return 1 } }`,
+		`let read = fn(r) { let v = r?; ok(v + 1) }; read(ok(1)).value`,
+		`if if a { b } { c } { d } { e }; match match x { _ => y } { _ => z }`,
+		`if (f)(P{x: 1}) { 1 }; if [P{x: 1}][0].x { 2 }; if g(fn() { P{x: 1} }) { 3 }`,
+		`const {a, b: [c, d]} = x; export let y = fn() {}; export struct E {}; export enum F {}`,
+		`match x {}; [] ; f()()[0]?.y`,
+	}
+
+	for _, src := range tests {
+		t.Run(src, func(t *testing.T) {
+			roundTrip(t, src)
+		})
+	}
+}
+
+// roundTrip checks that the formatted src parses to the same program as src
+// and is formatted as is.
+func roundTrip(t *testing.T, src string) {
+	t.Helper()
+	prog := parse(t, src)
+	formatted := Program(prog)
+
+	reparsed := parse(t, formatted)
+	if !ast.Equal(prog, reparsed) {
+		t.Fatalf("formatted program differs from the original:\n%v", formatted)
+	}
+	if again := Program(reparsed); again != formatted {
+		t.Fatalf("formatting is not idempotent, want=\n%v\ngot=\n%v", formatted, again)
+	}
+}
+
+func parse(t *testing.T, src string) *ast.Program {
+	t.Helper()
+	prog, err := parser.New(lexer.New(src)).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse program %q: %v", src, err)
+	}
+	return prog
+}
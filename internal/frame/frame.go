@@ -0,0 +1,55 @@
+// Package frame reads and writes the messages of the language server and
+// debug adapter protocols: JSON bodies preceded by a header with their
+// Content-Length.
+package frame
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+)
+
+// MaxSize is the size of the largest body read.
+const MaxSize = 32 << 20
+
+// ErrLength is returned by Read if the Content-Length of a message is
+// missing, malformed, negative or larger than MaxSize.
+var ErrLength = errors.New("invalid Content-Length")
+
+// Read reads the body of the next message from r.
+func Read(r *bufio.Reader) ([]byte, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLength, err)
+	}
+	if length < 0 || length > MaxSize {
+		return nil, fmt.Errorf("%w: %v", ErrLength, length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// Write writes v as JSON to w, preceded by its header.
+func Write(w io.Writer, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "Content-Length: %v\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
@@ -0,0 +1,50 @@
+package frame
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		input string
+		body  string
+		err   error
+	}{
+		{"Content-Length: 2\r\n\r\n{}", "{}", nil},
+		{"Content-Type: application/json\r\nContent-Length: 4\r\n\r\nnull", "null", nil},
+		{"Content-Length: 0\r\n\r\n", "", nil},
+		{"\r\n", "", ErrLength},
+		{"Content-Length: x\r\n\r\n", "", ErrLength},
+		{"Content-Length: -1\r\n\r\n", "", ErrLength},
+		{"Content-Length: 33554433\r\n\r\n", "", ErrLength},
+		{"Content-Length: 10000000000000000000000\r\n\r\n", "", ErrLength},
+	}
+
+	for _, tt := range tests {
+		body, err := Read(bufio.NewReader(strings.NewReader(tt.input)))
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%q: want=%v, got=%v", tt.input, tt.err, err)
+		}
+		if string(body) != tt.body {
+			t.Fatalf("%q: want=%q, got=%q", tt.input, tt.body, body)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	var b strings.Builder
+	if err := Write(&b, map[string]int{"a": 1}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	body, err := Read(bufio.NewReader(strings.NewReader(b.String())))
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if expected := `{"a":1}`; string(body) != expected {
+		t.Fatalf("want=%v, got=%v", expected, string(body))
+	}
+}
@@ -1,6 +1,8 @@
 package lexer
 
 import (
+	"strings"
+
 	"github.com/tombuente/lily/token"
 )
 
@@ -10,11 +12,17 @@ type Lexer struct {
 	currPos int
 	nextPos int
 	ch      byte // char at currPos
+
+	line int // line of currPos
+	col  int // column of currPos
+
+	comments []token.Token
 }
 
 func New(src string) *Lexer {
 	l := &Lexer{
-		src: src,
+		src:  src,
+		line: 1,
 	}
 	return l
 }
@@ -23,6 +31,13 @@ func (l *Lexer) Next() token.Token {
 	l.next()
 	l.skipWhitespace()
 
+	pos := token.Pos{Line: l.line, Column: l.col}
+	tok := l.lex()
+	tok.Pos = pos
+	return tok
+}
+
+func (l *Lexer) lex() token.Token {
 	switch l.ch {
 	case '=':
 		if l.nextChar() == '=' {
@@ -30,6 +45,11 @@ func (l *Lexer) Next() token.Token {
 			l.next()
 			return token.Token{Type: token.EQ, Literal: string(ch) + string(l.ch)}
 		}
+		if l.nextChar() == '>' {
+			ch := l.ch
+			l.next()
+			return token.Token{Type: token.Arrow, Literal: string(ch) + string(l.ch)}
+		}
 		return token.Token{Type: token.Assign, Literal: string(l.ch)}
 	case '!':
 		if l.nextChar() == '=' {
@@ -38,6 +58,8 @@ func (l *Lexer) Next() token.Token {
 			return token.Token{Type: token.NotEQ, Literal: string(ch) + string(l.ch)}
 		}
 		return token.Token{Type: token.Bang, Literal: string(l.ch)}
+	case '?':
+		return token.Token{Type: token.Question, Literal: string(l.ch)}
 	case '+':
 		return token.Token{Type: token.Plus, Literal: string(l.ch)}
 	case '-':
@@ -60,10 +82,22 @@ func (l *Lexer) Next() token.Token {
 		return token.Token{Type: token.LBrace, Literal: string(l.ch)}
 	case '}':
 		return token.Token{Type: token.RBrace, Literal: string(l.ch)}
+	case '[':
+		return token.Token{Type: token.LBracket, Literal: string(l.ch)}
+	case ']':
+		return token.Token{Type: token.RBracket, Literal: string(l.ch)}
 	case ',':
 		return token.Token{Type: token.Comma, Literal: string(l.ch)}
+	case '.':
+		return token.Token{Type: token.Dot, Literal: string(l.ch)}
+	case ':':
+		return token.Token{Type: token.Colon, Literal: string(l.ch)}
 	case '"':
-		return token.Token{Type: token.String, Literal: l.readString()}
+		literal, ok := l.readString()
+		if !ok {
+			return token.Token{Type: token.Illegal, Literal: literal}
+		}
+		return token.Token{Type: token.String, Literal: literal}
 	case 0:
 		return token.Token{Type: token.EOF, Literal: "EOF"}
 	}
@@ -79,13 +113,43 @@ func (l *Lexer) Next() token.Token {
 	return token.Token{Type: token.Illegal, Literal: string(l.ch)}
 }
 
+// Comments returns the comments skipped so far, in source order. A comment
+// runs from // to the end of the line, its literal excludes the newline.
+func (l *Lexer) Comments() []token.Token {
+	return l.comments
+}
+
+// skipWhitespace skips whitespace and comments.
 func (l *Lexer) skipWhitespace() {
-	for l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r' {
+	for {
+		switch {
+		case l.ch == ' ' || l.ch == '\t' || l.ch == '\n' || l.ch == '\r':
+			l.next()
+		case l.ch == '/' && l.nextChar() == '/':
+			l.skipComment()
+		default:
+			return
+		}
+	}
+}
+
+func (l *Lexer) skipComment() {
+	pos, start := token.Pos{Line: l.line, Column: l.col}, l.currPos
+	for l.nextChar() != '\n' && l.nextChar() != 0 {
 		l.next()
 	}
+	literal := strings.TrimSuffix(l.src[start:l.currPos+1], "\r")
+	l.comments = append(l.comments, token.Token{Type: token.Comment, Literal: literal, Pos: pos})
+	l.next()
 }
 
 func (l *Lexer) next() {
+	if l.ch == '\n' {
+		l.line++
+		l.col = 0
+	}
+	l.col++
+
 	if l.nextPos >= len(l.src) {
 		l.ch = 0
 	} else {
@@ -127,15 +191,18 @@ func isLetter(ch byte) bool {
 	return 'a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z' || ch == '_'
 }
 
-func (l *Lexer) readString() string {
-	l.next() // consume '"'
-
-	pos := l.currPos
+// readString reads a string literal. It reports false if the source ends
+// before the closing '"'.
+func (l *Lexer) readString() (string, bool) {
+	pos := l.currPos + 1 // after the opening '"'
 	for l.nextChar() != '"' {
+		if l.nextChar() == 0 {
+			return l.src[pos-1:], false
+		}
 		l.next()
 	}
 	literal := l.src[pos : l.currPos+1]
 
 	l.next() // consume '"'
-	return literal
+	return literal, true
 }
@@ -2,7 +2,10 @@ package lexer
 
 import (
 	"fmt"
+	"slices"
 	"testing"
+
+	"github.com/tombuente/lily/token"
 )
 
 func TestManual(t *testing.T) {
@@ -15,6 +18,53 @@ func TestManual(t *testing.T) {
 	}
 }
 
+func TestString(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected []token.Token
+	}{
+		{src: `""`, expected: []token.Token{{Type: token.String, Literal: ""}, {Type: token.EOF, Literal: "EOF"}}},
+		{src: `"a b" x`, expected: []token.Token{{Type: token.String, Literal: "a b"}, {Type: token.Ident, Literal: "x"}}},
+		{src: `"" ""`, expected: []token.Token{{Type: token.String, Literal: ""}, {Type: token.String, Literal: ""}}},
+		{src: `"abc`, expected: []token.Token{{Type: token.Illegal, Literal: `"abc`}, {Type: token.EOF, Literal: "EOF"}}},
+		{src: `"`, expected: []token.Token{{Type: token.Illegal, Literal: `"`}, {Type: token.EOF, Literal: "EOF"}}},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.src)
+		for i, expected := range tt.expected {
+			actual := l.Next()
+			actual.Pos = token.Pos{}
+			if actual != expected {
+				t.Errorf("%v: token %d: want=%+v, got=%+v", tt.src, i, expected, actual)
+			}
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	src := "// a\nx // b\r\n/ y //\n// c"
+	l := New(src)
+
+	var types []token.Type
+	for tok := l.Next(); tok.Type != token.EOF; tok = l.Next() {
+		types = append(types, tok.Type)
+	}
+	if expected := []token.Type{token.Ident, token.Slash, token.Ident}; !slices.Equal(types, expected) {
+		t.Fatalf("want=%v, got=%v", expected, types)
+	}
+
+	expected := []token.Token{
+		{Type: token.Comment, Literal: "// a", Pos: token.Pos{Line: 1, Column: 1}},
+		{Type: token.Comment, Literal: "// b", Pos: token.Pos{Line: 2, Column: 3}},
+		{Type: token.Comment, Literal: "//", Pos: token.Pos{Line: 3, Column: 5}},
+		{Type: token.Comment, Literal: "// c", Pos: token.Pos{Line: 4, Column: 1}},
+	}
+	if !slices.Equal(l.Comments(), expected) {
+		t.Fatalf("want=%v, got=%v", expected, l.Comments())
+	}
+}
+
 // func TestArithmeticOperators(t *testing.T) {
 // 	src := "+-*/<>==()"
 // 	expected := []token.Token{
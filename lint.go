@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tombuente/lily/eval"
+	"github.com/tombuente/lily/lint"
+)
+
+// errFindings is returned by runLint and runTypes if they reported
+// problems.
+var errFindings = errors.New("found problems")
+
+// runLint checks the files and directories in args, or standard input if
+// there are none. Directories are walked for .lily files.
+func runLint(args []string) error {
+	flags := flag.NewFlagSet("lint", flag.ExitOnError)
+	enable := flags.String("enable", "", "comma-separated IDs of the only rules to run")
+	disable := flags.String("disable", "", "comma-separated IDs of rules not to run")
+	list := flags.Bool("list", false, "list the rules and exit")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: lily lint [-enable ids] [-disable ids] [-list] [path ...]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *list {
+		for _, rule := range lint.Rules {
+			fmt.Printf("%-18v %v\n", rule.ID, rule.Doc)
+		}
+		return nil
+	}
+	rules, err := selectRules(*enable, *disable)
+	if err != nil {
+		return err
+	}
+
+	l := &linter{rules: rules, builtins: eval.New().Builtins(), out: os.Stdout}
+	if flags.NArg() == 0 {
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		if err := l.lint("<standard input>", src); err != nil {
+			return err
+		}
+	}
+
+	failed := false
+	for _, path := range flags.Args() {
+		if err := walkFiles(path, l.file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	switch {
+	case failed:
+		return errors.New("some files could not be checked")
+	case l.found:
+		return errFindings
+	}
+	return nil
+}
+
+// selectRules returns the rules listed in enable, or all rules if it is
+// empty, except for the ones listed in disable.
+func selectRules(enable, disable string) ([]*lint.Rule, error) {
+	ids := func(list string) (map[string]bool, error) {
+		set := make(map[string]bool)
+		for _, id := range strings.Split(list, ",") {
+			if id = strings.TrimSpace(id); id == "" {
+				continue
+			}
+			if lint.Lookup(id) == nil {
+				return nil, fmt.Errorf("unknown rule %q", id)
+			}
+			set[id] = true
+		}
+		return set, nil
+	}
+	enabled, err := ids(enable)
+	if err != nil {
+		return nil, err
+	}
+	disabled, err := ids(disable)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*lint.Rule
+	for _, rule := range lint.Rules {
+		if (len(enabled) == 0 || enabled[rule.ID]) && !disabled[rule.ID] {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+type linter struct {
+	rules    []*lint.Rule
+	builtins []string
+	out      io.Writer
+	found    bool // some diagnostics were reported
+}
+
+func (l *linter) file(path string) error {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return l.lint(path, src)
+}
+
+// lint checks src, read from name, and prints its diagnostics.
+func (l *linter) lint(name string, src []byte) error {
+	diags, err := lint.Source(string(src), l.builtins, l.rules)
+	if err != nil {
+		return fmt.Errorf("%v: %w", name, err)
+	}
+	for _, diag := range diags {
+		fmt.Fprintf(l.out, "%v:%v\n", name, diag)
+		l.found = true
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Package lint reports suspicious constructs in lily programs, such as
+// unused variables or code that cannot run.
+//
+// Every check is a [Rule] with a stable ID, which selects the rule and
+// suppresses its diagnostics. A comment of the form
+//
+//	// lint:ignore <id>[,<id>] [reason]
+//
+// suppresses the diagnostics of the listed rules on its line if it follows
+// code, and otherwise on the next line that is not a comment.
+package lint
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+	"github.com/tombuente/lily/resolver"
+	"github.com/tombuente/lily/token"
+)
+
+// Rule is a check run by [Source].
+type Rule struct {
+	ID  string // stable name of the rule, such as "unused-let"
+	Doc string // one line describing what the rule reports
+
+	check func(p *pass)
+}
+
+// Rules holds all rules in the order they are run.
+var Rules = []*Rule{
+	unusedLet,
+	unusedParam,
+	shadow,
+	unreachable,
+	mismatchedTypes,
+	undeclaredAssign,
+}
+
+// Lookup returns the rule with the given ID, or nil if there is none.
+func Lookup(id string) *Rule {
+	for _, rule := range Rules {
+		if rule.ID == id {
+			return rule
+		}
+	}
+	return nil
+}
+
+type Diagnostic struct {
+	Pos     token.Pos
+	Rule    string // ID of the rule reporting the diagnostic
+	Message string
+}
+
+func (x Diagnostic) String() string {
+	return fmt.Sprintf("%v: %v (%v)", x.Pos, x.Message, x.Rule)
+}
+
+// Source checks the lily program src with rules and returns the diagnostics
+// that are not suppressed, ordered by position. Names that are not declared
+// by the program are looked up in builtins. It fails only if src does not
+// parse; other errors of the program, such as the ones reported by
+// [resolver.Resolve], are left to the tools running it.
+func Source(src string, builtins []string, rules []*Rule) ([]Diagnostic, error) {
+	l := lexer.New(src)
+	prog, err := parser.New(l).Parse()
+	if err != nil {
+		return nil, err
+	}
+	info, _ := resolver.Resolve(prog, builtins)
+
+	p := newPass(prog, info, builtins)
+	for _, rule := range rules {
+		p.rule = rule
+		rule.check(p)
+	}
+
+	ignored := directives(src, l.Comments())
+	diags := slices.DeleteFunc(p.diags, func(d Diagnostic) bool {
+		return ignored[d.Pos.Line][d.Rule]
+	})
+	slices.SortStableFunc(diags, func(a, b Diagnostic) int {
+		return cmp.Or(cmp.Compare(a.Pos.Line, b.Pos.Line), cmp.Compare(a.Pos.Column, b.Pos.Column))
+	})
+	return diags, nil
+}
+
+// directives returns the IDs of the rules suppressed by the lint:ignore
+// comments of src by line.
+func directives(src string, comments []token.Token) map[int]map[string]bool {
+	lines := strings.Split(src, "\n")
+	ownLine := make(map[int]bool) // lines holding nothing but a comment
+	for _, c := range comments {
+		if strings.TrimSpace(lines[c.Pos.Line-1][:c.Pos.Column-1]) == "" {
+			ownLine[c.Pos.Line] = true
+		}
+	}
+
+	ignored := make(map[int]map[string]bool)
+	for _, c := range comments {
+		text, ok := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(c.Literal, "//")), "lint:ignore")
+		fields := strings.Fields(text)
+		if !ok || len(fields) == 0 || !strings.HasPrefix(text, " ") {
+			continue
+		}
+
+		line := c.Pos.Line
+		if ownLine[line] {
+			for line++; ownLine[line]; line++ {
+			}
+		}
+		if ignored[line] == nil {
+			ignored[line] = make(map[string]bool)
+		}
+		for _, id := range strings.Split(fields[0], ",") {
+			ignored[line][id] = true
+		}
+	}
+	return ignored
+}
+
+// pass holds a program and the facts about it shared by the rules.
+type pass struct {
+	prog     *ast.Program
+	info     *resolver.Info
+	builtins map[string]bool
+	exported map[*ast.Ident]bool
+	uses     map[*ast.Ident]int // declarations by the number of times they are read
+
+	rule  *Rule // the rule running
+	diags []Diagnostic
+}
+
+func newPass(prog *ast.Program, info *resolver.Info, builtins []string) *pass {
+	p := &pass{
+		prog:     prog,
+		info:     info,
+		builtins: make(map[string]bool),
+		exported: make(map[*ast.Ident]bool),
+		uses:     make(map[*ast.Ident]int),
+	}
+	for _, name := range builtins {
+		p.builtins[name] = true
+	}
+	for _, ident := range info.Exports {
+		p.exported[ident] = true
+	}
+
+	// Assigning a variable does not read it.
+	assigned := make(map[*ast.Ident]bool)
+	ast.Inspect(prog, func(node ast.Node) bool {
+		if node, ok := node.(*ast.Assignment); ok {
+			assigned[node.Ident] = true
+		}
+		return true
+	})
+	for ident, decl := range info.Decls {
+		if ident != decl && !assigned[ident] {
+			p.uses[decl]++
+		}
+	}
+	return p
+}
+
+func (p *pass) reportf(pos token.Pos, format string, args ...any) {
+	p.diags = append(p.diags, Diagnostic{Pos: pos, Rule: p.rule.ID, Message: fmt.Sprintf(format, args...)})
+}
+
+// bindings returns the identifiers bound by pattern.
+func (p *pass) bindings(pattern ast.Pattern) []*ast.Ident {
+	var idents []*ast.Ident
+	ast.Inspect(pattern, func(node ast.Node) bool {
+		if node, ok := node.(*ast.IdentPattern); ok && p.info.Variants[node.Ident] == nil {
+			idents = append(idents, node.Ident)
+		}
+		return true
+	})
+	return idents
+}
@@ -0,0 +1,147 @@
+package lint
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		rule     string
+		src      string
+		expected []string
+	}{
+		{
+			rule: "unused-let",
+			src: `let a = 1; let b = 2; let _c = 3; b = 4;
+let [d, e] = [1, 2]; let {x, y: z} = p; export let f = 5;
+let g = fn() { g() }; const h = 6; h;
+match d { q => 1 }`,
+			expected: []string{
+				"1:5: 'a' is declared but not used (unused-let)",
+				"1:16: 'b' is declared but not used (unused-let)",
+				"2:9: 'e' is declared but not used (unused-let)",
+				"2:27: 'x' is declared but not used (unused-let)",
+				"2:33: 'z' is declared but not used (unused-let)",
+			},
+		},
+		{
+			rule: "unused-param",
+			src: `let f = fn(a, b, _c, [d, e]) { a + d };
+fn (p P) m(q) { 1 };
+f; P;`,
+			expected: []string{
+				"1:15: parameter 'b' is not used (unused-param)",
+				"1:26: parameter 'e' is not used (unused-param)",
+				"2:12: parameter 'q' is not used (unused-param)",
+			},
+		},
+		{
+			rule: "shadow",
+			src: `let x = 1; let len = 2;
+let f = fn(x) { if x { let y = 1; if y { let y = 2 } } };
+match x { x => x };
+let g = fn() { let z = 1; z };
+let h = fn() { let z = 2; z }`,
+			expected: []string{
+				"1:16: 'len' shadows a builtin (shadow)",
+				"2:12: 'x' shadows the declaration at 1:5 (shadow)",
+				"2:46: 'y' shadows the declaration at 2:28 (shadow)",
+				"3:11: 'x' shadows the declaration at 1:5 (shadow)",
+			},
+		},
+		{
+			rule: "unreachable",
+			src: `let f = fn(x) {
+	if x { throw "x"; x };
+	return 1;
+	2;
+	3
+};
+return 0;
+f(1)`,
+			expected: []string{
+				"2:20: unreachable code (unreachable)",
+				"4:2: unreachable code (unreachable)",
+				"8:1: unreachable code (unreachable)",
+			},
+		},
+		{
+			rule: "mismatched-types",
+			src:  `1 == true; "a" != 1; -1 < 2; [1] == [1]; !true == 0; x == 1; 1 + "a"`,
+			expected: []string{
+				"1:1: comparison of mismatched types int and bool (mismatched-types)",
+				"1:12: comparison of mismatched types string and int (mismatched-types)",
+				"1:42: comparison of mismatched types bool and int (mismatched-types)",
+			},
+		},
+		{
+			rule: "undeclared-assign",
+			src:  "let a = 1; a = 2; b = 3; len = 4; let f = fn() { c = 5; a = 6 }; const d = 1; d = 2",
+			expected: []string{
+				"1:19: assignment to undeclared name 'b' (undeclared-assign)",
+				"1:26: assignment to undeclared name 'len' (undeclared-assign)",
+				"1:50: assignment to undeclared name 'c' (undeclared-assign)",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			rule := Lookup(tt.rule)
+			if rule == nil {
+				t.Fatalf("rule %v does not exist", tt.rule)
+			}
+			check(t, tt.src, []*Rule{rule}, tt.expected)
+		})
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	src := `let a = 1; // lint:ignore unused-let
+// lint:ignore unused-let,shadow because
+// another comment
+let len = 2;
+let b = 3; // lint:ignore shadow
+let c = 4; //lint:ignore unused-let
+let d = 5; // lint:ignoreunused-let
+let e = 6`
+	expected := []string{
+		"5:5: 'b' is declared but not used (unused-let)",
+		"7:5: 'd' is declared but not used (unused-let)",
+		"8:5: 'e' is declared but not used (unused-let)",
+	}
+	check(t, src, Rules, expected)
+}
+
+func TestRuleIDs(t *testing.T) {
+	var ids []string
+	for _, rule := range Rules {
+		ids = append(ids, rule.ID)
+	}
+	expected := []string{"unused-let", "unused-param", "shadow", "unreachable", "mismatched-types", "undeclared-assign"}
+	if !slices.Equal(ids, expected) {
+		t.Fatalf("want=%v, got=%v", expected, ids)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	if _, err := Source("let = 1", nil, Rules); err == nil {
+		t.Fatalf("want error, got none")
+	}
+}
+
+func check(t *testing.T, src string, rules []*Rule, expected []string) {
+	t.Helper()
+	diags, err := Source(src, []string{"len"}, rules)
+	if err != nil {
+		t.Fatalf("Failed to lint: %v", err)
+	}
+	var actual []string
+	for _, diag := range diags {
+		actual = append(actual, diag.String())
+	}
+	if !slices.Equal(actual, expected) {
+		t.Fatalf("want=%q,\ngot=%q", expected, actual)
+	}
+}
@@ -0,0 +1,160 @@
+package lint
+
+import (
+	"strings"
+
+	"github.com/tombuente/lily/ast"
+)
+
+// Names starting with an underscore are meant to be unused and are left
+// out by the rules on unused names.
+
+var unusedLet = &Rule{
+	ID:  "unused-let",
+	Doc: "variables declared by let or const that are never read",
+	check: func(p *pass) {
+		ast.Inspect(p.prog, func(node ast.Node) bool {
+			let, ok := node.(*ast.LetStmt)
+			if !ok {
+				return true
+			}
+			idents := []*ast.Ident{let.Ident}
+			if let.Pattern != nil {
+				idents = p.bindings(let.Pattern)
+			}
+			for _, ident := range idents {
+				if p.unused(ident) && !p.exported[ident] {
+					p.reportf(ident.Pos(), "'%v' is declared but not used", ident.Value)
+				}
+			}
+			return true
+		})
+	},
+}
+
+var unusedParam = &Rule{
+	ID:  "unused-param",
+	Doc: "function parameters that are never read",
+	check: func(p *pass) {
+		ast.Inspect(p.prog, func(node ast.Node) bool {
+			fn, ok := node.(*ast.Function)
+			if !ok {
+				return true
+			}
+			for _, param := range fn.Params {
+				for _, ident := range p.bindings(param) {
+					if p.unused(ident) {
+						p.reportf(ident.Pos(), "parameter '%v' is not used", ident.Value)
+					}
+				}
+			}
+			return true
+		})
+	},
+}
+
+var shadow = &Rule{
+	ID:  "shadow",
+	Doc: "declarations hiding a variable of an enclosing scope or a builtin",
+	check: func(p *pass) {
+		ast.Inspect(p.prog, func(node ast.Node) bool {
+			ident, ok := node.(*ast.Ident)
+			if !ok || p.info.Decls[ident] != ident {
+				return true
+			}
+			if outer, ok := p.info.Shadows[ident]; ok {
+				p.reportf(ident.Pos(), "'%v' shadows the declaration at %v", ident.Value, outer.Pos())
+			} else if p.builtins[ident.Value] {
+				p.reportf(ident.Pos(), "'%v' shadows a builtin", ident.Value)
+			}
+			return true
+		})
+	},
+}
+
+var unreachable = &Rule{
+	ID:  "unreachable",
+	Doc: "statements following a return or throw statement",
+	check: func(p *pass) {
+		ast.Inspect(p.prog, func(node ast.Node) bool {
+			var stmts []ast.Stmt
+			switch node := node.(type) {
+			case *ast.Program:
+				stmts = node.Stmts
+			case *ast.BlockStmt:
+				stmts = node.Stmts
+			}
+			for i, stmt := range stmts[:max(len(stmts)-1, 0)] {
+				switch stmt.(type) {
+				case *ast.ReturnStmt, *ast.ThrowStmt:
+					p.reportf(stmts[i+1].Pos(), "unreachable code")
+					return true
+				}
+			}
+			return true
+		})
+	},
+}
+
+var mismatchedTypes = &Rule{
+	ID:  "mismatched-types",
+	Doc: "comparisons of literals of different types, which fail at run time",
+	check: func(p *pass) {
+		ast.Inspect(p.prog, func(node ast.Node) bool {
+			op, ok := node.(*ast.BinaryOp)
+			if !ok {
+				return true
+			}
+			switch op.Op {
+			case "==", "!=", "<", ">":
+			default:
+				return true
+			}
+			left, right := literalType(op.Left), literalType(op.Right)
+			if left != "" && right != "" && left != right {
+				p.reportf(op.Pos(), "comparison of mismatched types %v and %v", left, right)
+			}
+			return true
+		})
+	},
+}
+
+var undeclaredAssign = &Rule{
+	ID:  "undeclared-assign",
+	Doc: "assignments to names that are not declared",
+	check: func(p *pass) {
+		ast.Inspect(p.prog, func(node ast.Node) bool {
+			if node, ok := node.(*ast.Assignment); ok && p.info.Decls[node.Ident] == nil {
+				p.reportf(node.Ident.Pos(), "assignment to undeclared name '%v'", node.Ident.Value)
+			}
+			return true
+		})
+	},
+}
+
+// unused reports whether the variable declared by ident is never read.
+func (p *pass) unused(ident *ast.Ident) bool {
+	return p.uses[ident] == 0 && !strings.HasPrefix(ident.Value, "_")
+}
+
+// literalType returns the type of the value of expr if it is a literal, or
+// "" if it is not.
+func literalType(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.Int:
+		return "int"
+	case *ast.Bool:
+		return "bool"
+	case *ast.String:
+		return "string"
+	case *ast.ArrayLit:
+		return "array"
+	case *ast.Function:
+		return "function"
+	case *ast.UnaryOp:
+		if typ := literalType(expr.Rhs); expr.Op == "-" && typ == "int" || expr.Op == "!" && typ == "bool" {
+			return typ
+		}
+	}
+	return ""
+}
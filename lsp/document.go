@@ -0,0 +1,379 @@
+package lsp
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+	"github.com/tombuente/lily/resolver"
+	"github.com/tombuente/lily/token"
+	"github.com/tombuente/lily/typecheck"
+)
+
+// document is the analysis of the text of an open document.
+type document struct {
+	lines []string
+	diags []Diagnostic
+
+	// The fields below are unset if the text does not parse.
+	prog   *ast.Program
+	info   *resolver.Info // incomplete if the program has errors
+	idents []*ast.Ident   // in source order
+	// types holds the inferred types of the declarations, see
+	// [typecheck.Infer]. It is nil if the program does not resolve.
+	types map[*ast.Ident]typecheck.Type
+
+	// decls describes the declarations of the program, by the identifier
+	// they declare.
+	decls map[*ast.Ident]declaration
+	// scopes holds the region each declaration is visible in.
+	scopes map[*ast.Ident]span
+
+	// braces maps the position of each '{' to the position of its '}'.
+	braces map[token.Pos]token.Pos
+	tokens []token.Token
+}
+
+// declaration describes the declaration of a name.
+type declaration struct {
+	desc string // such as "let f: fn(x)"
+	kind CompletionItemKind
+}
+
+// span is a region of a document, from start up to end. The zero end is the
+// end of the document.
+type span struct {
+	start, end token.Pos
+}
+
+func (x span) contains(pos token.Pos) bool {
+	return !before(pos, x.start) && (x.end == token.Pos{} || before(pos, x.end))
+}
+
+// before reports whether a comes before b.
+func before(a, b token.Pos) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+func analyze(text string, builtins []string) *document {
+	d := &document{
+		lines:  strings.Split(text, "\n"),
+		decls:  make(map[*ast.Ident]declaration),
+		scopes: make(map[*ast.Ident]span),
+		braces: make(map[token.Pos]token.Pos),
+	}
+
+	prog, err := parser.New(lexer.New(text)).Parse()
+	if err != nil {
+		var perr *parser.Error
+		if errors.As(err, &perr) {
+			d.diags = append(d.diags, d.diagnostic(perr.Pos, 1, err.Error()))
+		}
+		return d
+	}
+	d.prog = prog
+
+	info, err := resolver.Resolve(prog, builtins)
+	d.info = info
+	var errs resolver.ErrorList
+	errors.As(err, &errs)
+
+	ast.Inspect(prog, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			d.idents = append(d.idents, ident)
+		}
+		d.describe(node)
+		return true
+	})
+	for _, err := range errs {
+		length := 1
+		if ident := d.identAt(err.Pos); ident != nil {
+			length = len(ident.Value)
+		}
+		d.diags = append(d.diags, d.diagnostic(err.Pos, length, err.Msg))
+	}
+	if err == nil {
+		// Types are only meaningful for programs that resolve.
+		_, err := typecheck.Check(prog, info)
+		var errs typecheck.ErrorList
+		errors.As(err, &errs)
+		for _, err := range errs {
+			d.diags = append(d.diags, d.diagnostic(err.Pos, 1, err.Msg))
+		}
+		// Inference rejects more programs than the language, its errors
+		// are not reported but the types it infers are shown on hover.
+		inferred, _ := typecheck.Infer(prog, info)
+		d.types = inferred.Defs
+	}
+	slices.SortStableFunc(d.diags, func(a, b Diagnostic) int {
+		return cmp.Or(cmp.Compare(a.Range.Start.Line, b.Range.Start.Line), cmp.Compare(a.Range.Start.Character, b.Range.Start.Character))
+	})
+
+	d.lex(text)
+	ast.Walk(scopeVisitor{d: d}, prog)
+	return d
+}
+
+func (d *document) diagnostic(pos token.Pos, length int, msg string) Diagnostic {
+	return Diagnostic{
+		Range:    d.rangeOf(pos, length),
+		Severity: SeverityError,
+		Source:   "lily",
+		Message:  msg,
+	}
+}
+
+// lex matches the braces of text.
+func (d *document) lex(text string) {
+	l := lexer.New(text)
+	var open []token.Pos
+	for tok := l.Next(); tok.Type != token.EOF; tok = l.Next() {
+		d.tokens = append(d.tokens, tok)
+		switch tok.Type {
+		case token.LBrace:
+			open = append(open, tok.Pos)
+		case token.RBrace:
+			if len(open) > 0 {
+				d.braces[open[len(open)-1]] = tok.Pos
+				open = open[:len(open)-1]
+			}
+		}
+	}
+}
+
+// describe records a description of the names declared by node.
+func (d *document) describe(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.LetStmt:
+		keyword := "let"
+		if n.Const {
+			keyword = "const"
+		}
+		if n.Ident != nil {
+			decl := declaration{desc: keyword + " " + n.Ident.Value, kind: CompletionVariable}
+			if kind := valueKind(n.Expr); kind != "" {
+				decl.desc += ": " + kind
+			}
+			if _, ok := n.Expr.(*ast.Function); ok {
+				decl.kind = CompletionFunction
+			}
+			d.decls[n.Ident] = decl
+		} else {
+			d.bindings(n.Pattern, keyword)
+		}
+	case *ast.Function:
+		for _, param := range n.Params {
+			d.bindings(param, "param")
+		}
+	case *ast.MethodStmt:
+		d.decls[n.Receiver] = declaration{fmt.Sprintf("receiver %v: %v", n.Receiver.Value, n.Type.Value), CompletionVariable}
+	case *ast.StructStmt:
+		d.decls[n.Name] = declaration{fmt.Sprintf("struct %v { %v }", n.Name.Value, identList(n.Fields)), CompletionStruct}
+	case *ast.EnumStmt:
+		var variants []string
+		for _, variant := range n.Variants {
+			desc := variant.Name.Value
+			if variant.Fields != nil {
+				desc += "(" + identList(variant.Fields) + ")"
+			}
+			variants = append(variants, desc)
+			d.decls[variant.Name] = declaration{fmt.Sprintf("variant %v.%v", n.Name.Value, desc), CompletionEnumMember}
+		}
+		d.decls[n.Name] = declaration{fmt.Sprintf("enum %v { %v }", n.Name.Value, strings.Join(variants, ", ")), CompletionEnum}
+	case *ast.ImportStmt:
+		d.decls[n.Name] = declaration{fmt.Sprintf("module %v: %q", n.Name.Value, n.Path.Value), CompletionModule}
+	case *ast.Try:
+		if n.Param != nil {
+			d.decls[n.Param] = declaration{fmt.Sprintf("catch %v: error", n.Param.Value), CompletionVariable}
+		}
+	case *ast.MatchArm:
+		d.bindings(n.Pattern, "binding")
+	}
+}
+
+// bindings describes the names bound by pattern.
+func (d *document) bindings(pattern ast.Pattern, keyword string) {
+	ast.Inspect(pattern, func(node ast.Node) bool {
+		// The names of variants are not bound.
+		if p, ok := node.(*ast.IdentPattern); ok && d.info.Decls[p.Ident] == p.Ident {
+			d.decls[p.Ident] = declaration{keyword + " " + p.Ident.Value, CompletionVariable}
+		}
+		return true
+	})
+}
+
+// valueKind returns the kind of the value of expr if it is evident from the
+// expression, otherwise "".
+func valueKind(expr ast.Expr) string {
+	switch expr := expr.(type) {
+	case *ast.Function:
+		return "fn(" + paramList(expr.Params) + ")"
+	case *ast.Int:
+		return "int"
+	case *ast.String:
+		return "string"
+	case *ast.Bool:
+		return "bool"
+	case *ast.ArrayLit:
+		return "array"
+	case *ast.StructLit:
+		return expr.Type.Value
+	case *ast.UnaryOp:
+		if expr.Op == "!" {
+			return "bool"
+		}
+		return "int"
+	case *ast.BinaryOp:
+		switch expr.Op {
+		case "==", "!=", "<", ">":
+			return "bool"
+		}
+	}
+	return ""
+}
+
+func identList(idents []*ast.Ident) string {
+	names := make([]string, len(idents))
+	for i, ident := range idents {
+		names[i] = ident.Value
+	}
+	return strings.Join(names, ", ")
+}
+
+// paramList returns the parameters of a function as written, with
+// destructured parameters abbreviated.
+func paramList(params []ast.Pattern) string {
+	names := make([]string, len(params))
+	for i, param := range params {
+		switch param := param.(type) {
+		case *ast.IdentPattern:
+			names[i] = param.Ident.Value
+		case *ast.ArrayPattern:
+			names[i] = "[...]"
+		default:
+			names[i] = "{...}"
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// scopeVisitor records the scope of each declaration, end is the end of the
+// innermost scope of the visited nodes.
+type scopeVisitor struct {
+	d   *document
+	end token.Pos
+}
+
+func (v scopeVisitor) Visit(node ast.Node) ast.Visitor {
+	switch n := node.(type) {
+	case *ast.BlockStmt:
+		return scopeVisitor{d: v.d, end: v.d.braces[n.Pos()]}
+	case *ast.Function:
+		// The parameters share the scope of the body.
+		return scopeVisitor{d: v.d, end: v.d.braces[n.Body.Pos()]}
+	case *ast.MethodStmt:
+		v.d.scopes[n.Receiver] = span{n.Receiver.Pos(), v.d.braces[n.Function.Body.Pos()]}
+	case *ast.Try:
+		if n.Param != nil {
+			v.d.scopes[n.Param] = span{n.Param.Pos(), v.d.braces[n.Catch.Pos()]}
+		}
+	case *ast.Match:
+		// An arm is in scope up to the next arm or the end of the match.
+		end := v.d.matchEnd(n)
+		for i := len(n.Arms) - 1; i >= 0; i-- {
+			ast.Walk(scopeVisitor{d: v.d, end: end}, n.Arms[i])
+			end = n.Arms[i].Pos()
+		}
+		ast.Walk(v, n.Subject)
+		return nil
+	case *ast.Ident:
+		if _, ok := v.d.scopes[n]; !ok && v.d.info.Decls[n] == n {
+			v.d.scopes[n] = span{n.Pos(), v.end}
+		}
+	}
+	return v
+}
+
+// matchEnd returns the position of the '}' closing the arms of node.
+func (d *document) matchEnd(node *ast.Match) token.Pos {
+	if len(node.Arms) == 0 {
+		return token.Pos{}
+	}
+	for i, tok := range d.tokens {
+		if tok.Pos == node.Arms[0].Pos() && i > 0 && d.tokens[i-1].Type == token.LBrace {
+			return d.braces[d.tokens[i-1].Pos]
+		}
+	}
+	return token.Pos{}
+}
+
+// identAt returns the identifier at pos, or nil if there is none. An
+// identifier ends right after its last character.
+func (d *document) identAt(pos token.Pos) *ast.Ident {
+	for _, ident := range d.idents {
+		start := ident.Pos()
+		if start.Line == pos.Line && start.Column <= pos.Column && pos.Column <= start.Column+len(ident.Value) {
+			return ident
+		}
+	}
+	return nil
+}
+
+// visible reports whether the name declared by decl is in scope at pos.
+// Globals are visible everywhere since functions may refer to the globals
+// declared after them.
+func (d *document) visible(decl *ast.Ident, pos token.Pos) bool {
+	if d.info.Idents[decl].Kind == resolver.Global {
+		return true
+	}
+	s, ok := d.scopes[decl]
+	return ok && s.contains(pos)
+}
+
+// position converts pos to a position of the protocol.
+func (d *document) position(pos token.Pos) Position {
+	line, col := pos.Line-1, pos.Column-1
+	if line < 0 || line >= len(d.lines) {
+		return Position{Line: max(line, 0)}
+	}
+	text := d.lines[line][:min(max(col, 0), len(d.lines[line]))]
+	chars := 0
+	for _, r := range text {
+		chars += utf16.RuneLen(r)
+	}
+	return Position{Line: line, Character: chars}
+}
+
+// pos converts a position of the protocol to pos.
+func (d *document) pos(position Position) token.Pos {
+	pos := token.Pos{Line: position.Line + 1, Column: 1}
+	if position.Line < 0 || position.Line >= len(d.lines) {
+		return pos
+	}
+	text := d.lines[position.Line]
+	for chars := 0; chars < position.Character && len(text) > 0; {
+		r, size := utf8.DecodeRuneInString(text)
+		chars += utf16.RuneLen(r)
+		pos.Column += size
+		text = text[size:]
+	}
+	return pos
+}
+
+// rangeOf returns the range of length bytes starting at pos.
+func (d *document) rangeOf(pos token.Pos, length int) Range {
+	end := pos
+	end.Column += length
+	return Range{Start: d.position(pos), End: d.position(end)}
+}
+
+func (d *document) identRange(ident *ast.Ident) Range {
+	return d.rangeOf(ident.Pos(), len(ident.Value))
+}
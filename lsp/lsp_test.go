@@ -0,0 +1,458 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tombuente/lily/internal/frame"
+)
+
+const uri = "file:///test.lily"
+
+// client talks to a server running in the same process.
+type client struct {
+	t    *testing.T
+	w    io.WriteCloser
+	msgs chan map[string]json.RawMessage
+	done chan error
+	id   int
+}
+
+func newClient(t *testing.T) *client {
+	t.Helper()
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+
+	c := &client{
+		t:    t,
+		w:    inW,
+		msgs: make(chan map[string]json.RawMessage, 16),
+		done: make(chan error, 1),
+	}
+	go func() {
+		c.done <- NewServer([]string{"len", "ok"}).Serve(inR, outW)
+		outW.Close()
+	}()
+	go func() {
+		defer close(c.msgs)
+		r := bufio.NewReader(outR)
+		for {
+			body, err := frame.Read(r)
+			if err != nil {
+				return
+			}
+			var msg map[string]json.RawMessage
+			if err := json.Unmarshal(body, &msg); err != nil {
+				return
+			}
+			c.msgs <- msg
+		}
+	}()
+	t.Cleanup(func() {
+		c.notify("exit", nil)
+		select {
+		case err := <-c.done:
+			if err != nil {
+				t.Errorf("Serve failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("server did not exit")
+		}
+	})
+
+	var res InitializeResult
+	c.call("initialize", map[string]any{"capabilities": map[string]any{}}, &res)
+	if !res.Capabilities.HoverProvider || res.Capabilities.TextDocumentSync != TextDocumentSyncFull {
+		t.Fatalf("unexpected capabilities: %+v", res.Capabilities)
+	}
+	c.notify("initialized", map[string]any{})
+	return c
+}
+
+func (c *client) send(v any) {
+	c.t.Helper()
+	if err := frame.Write(c.w, v); err != nil {
+		c.t.Fatalf("Failed to send: %v", err)
+	}
+}
+
+func (c *client) notify(method string, params any) {
+	c.t.Helper()
+	c.send(map[string]any{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+// next returns the next message of the server.
+func (c *client) next() map[string]json.RawMessage {
+	c.t.Helper()
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatal("server closed the connection")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("no message from the server")
+	}
+	return nil
+}
+
+// call sends a request and unmarshals its result into result. It fails if
+// the server responds with an error.
+func (c *client) call(method string, params any, result any) {
+	c.t.Helper()
+	if err := c.request(method, params, result); err != nil {
+		c.t.Fatalf("%v failed: %v", method, err.Message)
+	}
+}
+
+func (c *client) request(method string, params any, result any) *rpcError {
+	c.t.Helper()
+	c.id++
+	c.send(map[string]any{"jsonrpc": "2.0", "id": c.id, "method": method, "params": params})
+
+	msg := c.next()
+	var id int
+	if err := json.Unmarshal(msg["id"], &id); err != nil || id != c.id {
+		c.t.Fatalf("want response to %v, got=%v", c.id, msg)
+	}
+	if raw, ok := msg["error"]; ok {
+		var err rpcError
+		json.Unmarshal(raw, &err)
+		return &err
+	}
+	if err := json.Unmarshal(msg["result"], result); err != nil {
+		c.t.Fatalf("Failed to unmarshal result of %v: %v", method, err)
+	}
+	return nil
+}
+
+// open opens the test document and returns its diagnostics.
+func (c *client) open(text string) []Diagnostic {
+	c.t.Helper()
+	c.notify("textDocument/didOpen", DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "lily", Version: 1, Text: text},
+	})
+	return c.diagnostics()
+}
+
+func (c *client) change(text string) []Diagnostic {
+	c.t.Helper()
+	c.notify("textDocument/didChange", DidChangeTextDocumentParams{
+		TextDocument:   VersionedTextDocumentIdentifier{URI: uri, Version: 2},
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: text}},
+	})
+	return c.diagnostics()
+}
+
+func (c *client) diagnostics() []Diagnostic {
+	c.t.Helper()
+	msg := c.next()
+	var method string
+	json.Unmarshal(msg["method"], &method)
+	if method != "textDocument/publishDiagnostics" {
+		c.t.Fatalf("want diagnostics, got=%v", msg)
+	}
+	var p PublishDiagnosticsParams
+	if err := json.Unmarshal(msg["params"], &p); err != nil {
+		c.t.Fatalf("Failed to unmarshal diagnostics: %v", err)
+	}
+	return p.Diagnostics
+}
+
+func at(line, char int) TextDocumentPositionParams {
+	return TextDocumentPositionParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     Position{Line: line, Character: char},
+	}
+}
+
+func span_(line, start, end int) Range {
+	return Range{Start: Position{Line: line, Character: start}, End: Position{Line: line, Character: end}}
+}
+
+const src = `let add = fn(x, y) { x + y };
+let total = add(1, 2);
+struct P { x };
+let f = fn(n) {
+	let m = n;
+	match m { 1 => len("a"), k => add(k, total) }
+};
+f(total)`
+
+func TestDiagnostics(t *testing.T) {
+	c := newClient(t)
+
+	if diags := c.open(src); len(diags) != 0 {
+		t.Fatalf("want no diagnostics, got=%v", diags)
+	}
+
+	expected := []Diagnostic{
+		{Range: span_(1, 16, 17), Severity: SeverityError, Source: "lily", Message: "name 'z' not defined"},
+		{Range: span_(2, 4, 5), Severity: SeverityError, Source: "lily", Message: "'a' already defined"},
+	}
+	if diags := c.change("let a = 1;\nlet b = a + 2 * z;\nlet a = b"); !reflect.DeepEqual(diags, expected) {
+		t.Fatalf("want=%v, got=%v", expected, diags)
+	}
+
+	expected = []Diagnostic{
+		{Range: span_(1, 13, 14), Severity: SeverityError, Source: "lily", Message: "cannot use 'bool' as 'int' in let statement"},
+	}
+	if diags := c.change("let a = 1;\nlet b: int = a > 2"); !reflect.DeepEqual(diags, expected) {
+		t.Fatalf("want=%v, got=%v", expected, diags)
+	}
+
+	diags := c.change("let a = 1;\nlet b = ;")
+	if len(diags) != 1 || diags[0].Range.Start != (Position{Line: 1, Character: 8}) {
+		t.Fatalf("want a parse error at 1:8, got=%v", diags)
+	}
+
+	c.notify("textDocument/didClose", DidCloseTextDocumentParams{TextDocument: TextDocumentIdentifier{URI: uri}})
+	if diags := c.diagnostics(); len(diags) != 0 {
+		t.Fatalf("want diagnostics to be cleared, got=%v", diags)
+	}
+}
+
+func TestHover(t *testing.T) {
+	c := newClient(t)
+	c.open(src)
+
+	tests := []struct {
+		pos      TextDocumentPositionParams
+		expected string
+		typ      string // inferred type, if any
+	}{
+		{at(1, 13), "let add: fn(x, y)", "fn('a, 'a): 'a where 'a: int | string"},
+		{at(0, 22), "param x", "'a where 'a: int | string"},
+		{at(1, 5), "let total", "int"},
+		{at(5, 19), "builtin len", ""},
+		{at(5, 26), "binding k", "int"},
+		{at(2, 8), "struct P { x }", ""},
+		{at(3, 5), "let f: fn(n)", "fn(int): int"},
+	}
+	for _, tt := range tests {
+		var hover *Hover
+		c.call("textDocument/hover", tt.pos, &hover)
+		if hover == nil {
+			t.Errorf("%v: want hover %q, got none", tt.pos.Position, tt.expected)
+			continue
+		}
+		expected := "```lily\n" + tt.expected + "\n```"
+		if tt.typ != "" {
+			expected += "\n\nType: `" + tt.typ + "`"
+		}
+		if hover.Contents.Value != expected {
+			t.Errorf("%v: want=%q, got=%q", tt.pos.Position, expected, hover.Contents.Value)
+		}
+	}
+
+	var hover *Hover
+	c.call("textDocument/hover", at(0, 23), &hover)
+	if hover != nil {
+		t.Fatalf("want no hover on an operator, got=%v", hover)
+	}
+}
+
+func TestDefinition(t *testing.T) {
+	c := newClient(t)
+	c.open(src)
+
+	tests := []struct {
+		pos      TextDocumentPositionParams
+		expected Range
+	}{
+		{at(1, 12), span_(0, 4, 7)},   // add
+		{at(0, 21), span_(0, 13, 14)}, // x
+		{at(5, 7), span_(4, 5, 6)},    // m
+		{at(5, 35), span_(5, 26, 27)}, // k
+		{at(7, 3), span_(1, 4, 9)},    // total
+	}
+	for _, tt := range tests {
+		var locs []Location
+		c.call("textDocument/definition", tt.pos, &locs)
+		expected := []Location{{URI: uri, Range: tt.expected}}
+		if !reflect.DeepEqual(locs, expected) {
+			t.Errorf("%v: want=%v, got=%v", tt.pos.Position, expected, locs)
+		}
+	}
+
+	var locs []Location
+	c.call("textDocument/definition", at(5, 19), &locs)
+	if locs != nil {
+		t.Fatalf("want no definition of a builtin, got=%v", locs)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	c := newClient(t)
+	c.open(src)
+
+	var locs []Location
+	c.call("textDocument/references", ReferenceParams{
+		TextDocumentPositionParams: at(1, 5),
+		Context:                    ReferenceContext{IncludeDeclaration: true},
+	}, &locs)
+	expected := []Location{
+		{URI: uri, Range: span_(1, 4, 9)},
+		{URI: uri, Range: span_(5, 38, 43)},
+		{URI: uri, Range: span_(7, 2, 7)},
+	}
+	if !reflect.DeepEqual(locs, expected) {
+		t.Fatalf("want=%v, got=%v", expected, locs)
+	}
+
+	c.call("textDocument/references", ReferenceParams{TextDocumentPositionParams: at(1, 5)}, &locs)
+	if !reflect.DeepEqual(locs, expected[1:]) {
+		t.Fatalf("want=%v, got=%v", expected[1:], locs)
+	}
+}
+
+func TestDocumentSymbol(t *testing.T) {
+	c := newClient(t)
+	c.open(src)
+
+	var symbols []DocumentSymbol
+	c.call("textDocument/documentSymbol", DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: uri}}, &symbols)
+	expected := []DocumentSymbol{
+		{
+			Name:           "add",
+			Detail:         "fn(x, y)",
+			Kind:           SymbolFunction,
+			Range:          Range{Start: Position{Line: 0, Character: 0}, End: Position{Line: 1, Character: 0}},
+			SelectionRange: span_(0, 4, 7),
+		},
+		{
+			Name:           "f",
+			Detail:         "fn(n)",
+			Kind:           SymbolFunction,
+			Range:          Range{Start: Position{Line: 3, Character: 0}, End: Position{Line: 7, Character: 0}},
+			SelectionRange: span_(3, 4, 5),
+		},
+	}
+	if !reflect.DeepEqual(symbols, expected) {
+		t.Fatalf("want=%v, got=%v", expected, symbols)
+	}
+
+	// The last symbol ends with the text, in UTF-16 code units.
+	c.change(`let s = fn() { "é😀" }`)
+	c.call("textDocument/documentSymbol", DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: uri}}, &symbols)
+	if expected := (Range{Start: Position{Line: 0, Character: 0}, End: Position{Line: 0, Character: 22}}); len(symbols) != 1 || symbols[0].Range != expected {
+		t.Fatalf("want range %v, got=%v", expected, symbols)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	c := newClient(t)
+	c.open(src)
+
+	tests := []struct {
+		pos      TextDocumentPositionParams
+		expected []string
+	}{
+		{at(7, 0), []string{"P", "add", "f", "len", "ok", "total"}},
+		{at(0, 21), []string{"P", "add", "f", "len", "ok", "total", "x", "y"}},
+		{at(5, 1), []string{"P", "add", "f", "len", "m", "n", "ok", "total"}},
+		{at(5, 38), []string{"P", "add", "f", "k", "len", "m", "n", "ok", "total"}},
+	}
+	for _, tt := range tests {
+		var items []CompletionItem
+		c.call("textDocument/completion", tt.pos, &items)
+		var labels []string
+		for _, item := range items {
+			labels = append(labels, item.Label)
+		}
+		if !slices.Equal(labels, tt.expected) {
+			t.Errorf("%v: want=%v, got=%v", tt.pos.Position, tt.expected, labels)
+		}
+	}
+
+	var items []CompletionItem
+	c.call("textDocument/completion", at(0, 0), &items)
+	i := slices.IndexFunc(items, func(item CompletionItem) bool { return item.Label == "add" })
+	if i < 0 || items[i].Kind != CompletionFunction || items[i].Detail != "let add: fn(x, y)" {
+		t.Fatalf("unexpected completion of add: %+v", items)
+	}
+}
+
+func TestShadowing(t *testing.T) {
+	c := newClient(t)
+	c.open("let x = 1;\nlet f = fn(x) {\n\tx\n};\nx")
+
+	var locs []Location
+	c.call("textDocument/definition", at(2, 1), &locs)
+	if expected := span_(1, 11, 12); len(locs) != 1 || locs[0].Range != expected {
+		t.Fatalf("want=%v, got=%v", expected, locs)
+	}
+	c.call("textDocument/definition", at(4, 0), &locs)
+	if expected := span_(0, 4, 5); len(locs) != 1 || locs[0].Range != expected {
+		t.Fatalf("want=%v, got=%v", expected, locs)
+	}
+
+	var items []CompletionItem
+	c.call("textDocument/completion", at(2, 1), &items)
+	i := slices.IndexFunc(items, func(item CompletionItem) bool { return item.Label == "x" })
+	if i < 0 || items[i].Detail != "param x" {
+		t.Fatalf("want the parameter x, got=%+v", items)
+	}
+}
+
+func TestStaleAnalysis(t *testing.T) {
+	c := newClient(t)
+	c.open("let value = 1;\nvalue")
+
+	// While the document does not parse, the last analysis is used.
+	c.change("let value = 1;\nvalue +")
+	var hover *Hover
+	c.call("textDocument/hover", at(1, 2), &hover)
+	if hover == nil || hover.Contents.Value != "```lily\nlet value: int\n```\n\nType: `int`" {
+		t.Fatalf("want hover of value, got=%v", hover)
+	}
+}
+
+func TestUnknownMethod(t *testing.T) {
+	c := newClient(t)
+
+	err := c.request("textDocument/rename", at(0, 0), new(any))
+	if err == nil || err.Code != codeMethodNotFound {
+		t.Fatalf("want method not found, got=%v", err)
+	}
+
+	var res any
+	c.call("shutdown", nil, &res)
+}
+
+func TestInvalidLength(t *testing.T) {
+	c := newClient(t)
+
+	for _, header := range []string{"Content-Length: -1\r\n\r\n", "Content-Length: 1000000000000\r\n\r\n"} {
+		if _, err := io.WriteString(c.w, header); err != nil {
+			t.Fatalf("Failed to send: %v", err)
+		}
+		msg := c.next()
+		var err rpcError
+		if json.Unmarshal(msg["error"], &err) != nil || err.Code != codeInvalidRequest {
+			t.Fatalf("want invalid request, got=%v", msg)
+		}
+	}
+
+	// The server keeps running.
+	var res any
+	c.call("shutdown", nil, &res)
+}
+
+func TestPositions(t *testing.T) {
+	d := analyze("let s = \"äö😀\"; s", nil)
+
+	// The use of s is at column 21 but at UTF-16 character 16.
+	ident := d.identAt(d.pos(Position{Line: 0, Character: 16}))
+	if ident == nil || ident.Value != "s" || ident.Pos().Column != 21 {
+		t.Fatalf("want the use of s, got=%v", ident)
+	}
+	if actual := d.identRange(ident); actual != span_(0, 16, 17) {
+		t.Fatalf("want=%v, got=%v", span_(0, 16, 17), actual)
+	}
+}
@@ -0,0 +1,363 @@
+// Package lsp implements a Language Server Protocol server for lily.
+//
+// The server speaks JSON-RPC over a reader and a writer, usually standard
+// input and output, and supports diagnostics, hover, go to definition, find
+// references, document symbols and completion. Documents are synchronized
+// in full on every change. While a document does not parse, requests are
+// answered from the last version that did.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/internal/frame"
+	"github.com/tombuente/lily/resolver"
+	"github.com/tombuente/lily/token"
+	"github.com/tombuente/lily/typecheck"
+)
+
+type handler func(params json.RawMessage) (any, error)
+
+// Server is a language server. Its zero value is not usable, use
+// [NewServer].
+type Server struct {
+	builtins []string
+	docs     map[string]*document // open documents by URI
+	w        io.Writer
+
+	handlers map[string]handler
+}
+
+// NewServer returns a server for scripts that may use builtins.
+func NewServer(builtins []string) *Server {
+	s := &Server{
+		builtins: builtins,
+		docs:     make(map[string]*document),
+	}
+
+	s.handlers = map[string]handler{
+		"initialize":                  s.initialize,
+		"initialized":                 ignore,
+		"shutdown":                    ignore,
+		"textDocument/didOpen":        s.didOpen,
+		"textDocument/didChange":      s.didChange,
+		"textDocument/didClose":       s.didClose,
+		"textDocument/hover":          s.hover,
+		"textDocument/definition":     s.definition,
+		"textDocument/references":     s.references,
+		"textDocument/documentSymbol": s.documentSymbol,
+		"textDocument/completion":     s.completion,
+	}
+	return s
+}
+
+// Serve reads requests from r and writes responses to w until the client
+// sends the exit notification or closes r.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.w = w
+	br := bufio.NewReader(r)
+	for {
+		msg, err := readMessage(br)
+		var rerr *rpcError
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case errors.As(err, &rerr):
+			if err := frame.Write(w, response{JSONRPC: "2.0", Error: rerr}); err != nil {
+				return err
+			}
+			continue
+		case err != nil:
+			return err
+		}
+
+		if msg.Method == "exit" {
+			return nil
+		}
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// handle handles msg and responds to it, unless it is a notification.
+func (s *Server) handle(msg *message) error {
+	h, ok := s.handlers[msg.Method]
+	if !ok {
+		if msg.ID == nil {
+			// Unknown notifications are ignored.
+			return nil
+		}
+		return s.respond(msg.ID, nil, &rpcError{Code: codeMethodNotFound, Message: "method not found: " + msg.Method})
+	}
+
+	result, err := h(msg.Params)
+	if msg.ID == nil {
+		return nil
+	}
+	if err != nil {
+		rerr, ok := err.(*rpcError)
+		if !ok {
+			rerr = &rpcError{Code: codeInternalError, Message: err.Error()}
+		}
+		return s.respond(msg.ID, nil, rerr)
+	}
+	return s.respond(msg.ID, result, nil)
+}
+
+func (s *Server) respond(id *json.RawMessage, result any, rerr *rpcError) error {
+	res := response{JSONRPC: "2.0", ID: id, Error: rerr}
+	if rerr == nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		res.Result = data
+	}
+	return frame.Write(s.w, res)
+}
+
+func (s *Server) notify(method string, params any) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return frame.Write(s.w, message{JSONRPC: "2.0", Method: method, Params: data})
+}
+
+// decode unmarshals the params of a request into v.
+func decode[T any](params json.RawMessage) (T, error) {
+	var v T
+	if err := json.Unmarshal(params, &v); err != nil {
+		return v, &rpcError{Code: codeInvalidParams, Message: err.Error()}
+	}
+	return v, nil
+}
+
+func ignore(json.RawMessage) (any, error) {
+	return nil, nil
+}
+
+func (s *Server) initialize(json.RawMessage) (any, error) {
+	return InitializeResult{
+		Capabilities: ServerCapabilities{
+			TextDocumentSync:       TextDocumentSyncFull,
+			HoverProvider:          true,
+			DefinitionProvider:     true,
+			ReferencesProvider:     true,
+			DocumentSymbolProvider: true,
+		},
+		ServerInfo: ServerInfo{Name: "lily"},
+	}, nil
+}
+
+func (s *Server) didOpen(params json.RawMessage) (any, error) {
+	p, err := decode[DidOpenTextDocumentParams](params)
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.update(p.TextDocument.URI, p.TextDocument.Text)
+}
+
+func (s *Server) didChange(params json.RawMessage) (any, error) {
+	p, err := decode[DidChangeTextDocumentParams](params)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.ContentChanges) == 0 {
+		return nil, nil
+	}
+	return nil, s.update(p.TextDocument.URI, p.ContentChanges[len(p.ContentChanges)-1].Text)
+}
+
+func (s *Server) didClose(params json.RawMessage) (any, error) {
+	p, err := decode[DidCloseTextDocumentParams](params)
+	if err != nil {
+		return nil, err
+	}
+	delete(s.docs, p.TextDocument.URI)
+	return nil, s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: p.TextDocument.URI, Diagnostics: []Diagnostic{}})
+}
+
+// update analyzes the new text of a document and publishes its
+// diagnostics.
+func (s *Server) update(uri, text string) error {
+	doc := analyze(text, s.builtins)
+	if old, ok := s.docs[uri]; doc.prog != nil || !ok || old.prog == nil {
+		s.docs[uri] = doc
+	}
+
+	diags := doc.diags
+	if diags == nil {
+		diags = []Diagnostic{}
+	}
+	return s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: uri, Diagnostics: diags})
+}
+
+// lookup returns the document and the identifier at the position of p, or
+// nil if there is none.
+func (s *Server) lookup(p TextDocumentPositionParams) (*document, *ast.Ident) {
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok || doc.prog == nil {
+		return nil, nil
+	}
+	return doc, doc.identAt(doc.pos(p.Position))
+}
+
+func (s *Server) hover(params json.RawMessage) (any, error) {
+	p, err := decode[TextDocumentPositionParams](params)
+	if err != nil {
+		return nil, err
+	}
+	doc, ident := s.lookup(p)
+	if ident == nil {
+		return nil, nil
+	}
+
+	var desc string
+	var typ typecheck.Type
+	if decl, ok := doc.info.Decls[ident]; ok {
+		desc, typ = doc.decls[decl].desc, doc.types[decl]
+	} else if binding, ok := doc.info.Idents[ident]; ok && binding.Kind == resolver.Builtin {
+		desc = "builtin " + ident.Value
+	}
+	if desc == "" {
+		return nil, nil
+	}
+	value := "```lily\n" + desc + "\n```"
+	if typ != nil {
+		value += "\n\nType: `" + typ.String() + "`"
+	}
+	return Hover{
+		Contents: MarkupContent{Kind: "markdown", Value: value},
+		Range:    doc.identRange(ident),
+	}, nil
+}
+
+func (s *Server) definition(params json.RawMessage) (any, error) {
+	p, err := decode[TextDocumentPositionParams](params)
+	if err != nil {
+		return nil, err
+	}
+	doc, ident := s.lookup(p)
+	if ident == nil {
+		return nil, nil
+	}
+	decl, ok := doc.info.Decls[ident]
+	if !ok {
+		return nil, nil
+	}
+	return []Location{{URI: p.TextDocument.URI, Range: doc.identRange(decl)}}, nil
+}
+
+func (s *Server) references(params json.RawMessage) (any, error) {
+	p, err := decode[ReferenceParams](params)
+	if err != nil {
+		return nil, err
+	}
+	doc, ident := s.lookup(p.TextDocumentPositionParams)
+	if ident == nil {
+		return nil, nil
+	}
+	decl, ok := doc.info.Decls[ident]
+	if !ok {
+		return nil, nil
+	}
+
+	locs := []Location{}
+	for _, ref := range doc.idents {
+		if doc.info.Decls[ref] != decl || ref == decl && !p.Context.IncludeDeclaration {
+			continue
+		}
+		locs = append(locs, Location{URI: p.TextDocument.URI, Range: doc.identRange(ref)})
+	}
+	return locs, nil
+}
+
+// documentSymbol lists the functions bound by top-level let and const
+// statements.
+func (s *Server) documentSymbol(params json.RawMessage) (any, error) {
+	p, err := decode[DocumentSymbolParams](params)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok || doc.prog == nil {
+		return nil, nil
+	}
+
+	symbols := []DocumentSymbol{}
+	for i, stmt := range doc.prog.Stmts {
+		if export, ok := stmt.(*ast.ExportStmt); ok {
+			stmt = export.Stmt
+		}
+		let, ok := stmt.(*ast.LetStmt)
+		if !ok || let.Ident == nil {
+			continue
+		}
+		fn, ok := let.Expr.(*ast.Function)
+		if !ok {
+			continue
+		}
+
+		// A statement reaches up to the next one.
+		last := len(doc.lines) - 1
+		end := doc.position(token.Pos{Line: last + 1, Column: len(doc.lines[last]) + 1})
+		if i+1 < len(doc.prog.Stmts) {
+			end = doc.position(doc.prog.Stmts[i+1].Pos())
+		}
+		symbols = append(symbols, DocumentSymbol{
+			Name:           let.Ident.Value,
+			Detail:         "fn(" + paramList(fn.Params) + ")",
+			Kind:           SymbolFunction,
+			Range:          Range{Start: doc.position(doc.prog.Stmts[i].Pos()), End: end},
+			SelectionRange: doc.identRange(let.Ident),
+		})
+	}
+	return symbols, nil
+}
+
+// completion lists the names in scope at the position and the builtins.
+func (s *Server) completion(params json.RawMessage) (any, error) {
+	p, err := decode[TextDocumentPositionParams](params)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := s.docs[p.TextDocument.URI]
+	if !ok || doc.prog == nil {
+		return []CompletionItem{}, nil
+	}
+	pos := doc.pos(p.Position)
+
+	// A name declared in a nested scope shadows the ones of the enclosing
+	// scopes, which start earlier.
+	names := make(map[string]*ast.Ident)
+	for decl := range doc.decls {
+		if !doc.visible(decl, pos) {
+			continue
+		}
+		if prev, ok := names[decl.Value]; !ok || before(doc.scopes[prev].start, doc.scopes[decl].start) {
+			names[decl.Value] = decl
+		}
+	}
+
+	items := []CompletionItem{}
+	for name, decl := range names {
+		items = append(items, CompletionItem{Label: name, Kind: doc.decls[decl].kind, Detail: doc.decls[decl].desc})
+	}
+	for _, name := range s.builtins {
+		if _, ok := names[name]; !ok {
+			items = append(items, CompletionItem{Label: name, Kind: CompletionFunction, Detail: "builtin " + name})
+		}
+	}
+	slices.SortFunc(items, func(a, b CompletionItem) int {
+		return strings.Compare(a.Label, b.Label)
+	})
+	return items, nil
+}
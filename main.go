@@ -1 +1,105 @@
+// Command lily runs the tools for lily source code.
+//
+// Usage:
+//
+//	lily <command> [arguments]
+//
+// The commands are:
+//
+//	dap    run the debug adapter
+//	doc    print the API reference of lily source
+//	fmt    format lily source
+//	lint   report suspicious constructs in lily source
+//	lsp    run the language server
+//	types  print the inferred types of lily source
 package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/tombuente/lily/dap"
+	"github.com/tombuente/lily/eval"
+	"github.com/tombuente/lily/lsp"
+)
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "dap":
+		err = dap.NewServer().Serve(os.Stdin, os.Stdout)
+	case "doc":
+		err = runDoc(args)
+	case "fmt":
+		err = runFmt(args)
+	case "lint":
+		err = runLint(args)
+	case "lsp":
+		err = lsp.NewServer(eval.New().Builtins()).Serve(os.Stdin, os.Stdout)
+	case "types":
+		err = runTypes(args)
+	default:
+		fmt.Fprintf(os.Stderr, "lily: unknown command %q\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+	if errors.Is(err, errFindings) {
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "lily %v: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `Usage: lily <command> [arguments]
+
+Commands:
+	dap    run the debug adapter
+	doc    print the API reference of lily source
+	fmt    format lily source
+	lint   report suspicious constructs in lily source
+	lsp    run the language server
+	types  print the inferred types of lily source
+`)
+}
+
+// walkFiles calls fn with path if it is a file, or with each .lily file in
+// the directory path and its subdirectories. The errors of fn do not stop
+// the walk and are returned together.
+func walkFiles(path string, fn func(file string) error) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fn(path)
+	}
+
+	var errs []error
+	err = filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(file) != ".lily" {
+			return nil
+		}
+		if err := fn(file); err != nil {
+			errs = append(errs, err)
+		}
+		return nil
+	})
+	return errors.Join(append(errs, err)...)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		a        string
+		b        string
+		expected string
+	}{
+		{
+			name:     "equal",
+			a:        "a\nb\n",
+			b:        "a\nb\n",
+			expected: "",
+		},
+		{
+			name:     "change",
+			a:        "let x=1;\nx\n",
+			b:        "let x = 1;\nx\n",
+			expected: "--- f.orig\n+++ f\n@@ -1,2 +1,2 @@\n-let x=1;\n+let x = 1;\n x\n",
+		},
+		{
+			name:     "missing newline",
+			a:        "x",
+			b:        "x\n",
+			expected: "--- f.orig\n+++ f\n@@ -1 +1 @@\n-x\n\\ No newline at end of file\n+x\n",
+		},
+		{
+			name: "separate hunks",
+			a:    "a\n1\n2\n3\n4\n5\n6\n7\n8\nb\n",
+			b:    "A\n1\n2\n3\n4\n5\n6\n7\n8\nB\n",
+			expected: "--- f.orig\n+++ f\n" +
+				"@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n" +
+				"@@ -7,4 +7,4 @@\n 6\n 7\n 8\n-b\n+B\n",
+		},
+		{
+			name:     "from empty",
+			a:        "",
+			b:        "x\n",
+			expected: "--- f.orig\n+++ f\n@@ -0,0 +1 @@\n+x\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := unifiedDiff("f", tt.a, tt.b)
+			if actual != tt.expected {
+				t.Fatalf("want=\n%v\ngot=\n%v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestWalkFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.lily", "b.txt", "sub/c.lily", "sub/d.lily"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var files []string
+	failed := errors.New("failed")
+	err := walkFiles(dir, func(file string) error {
+		rel, _ := filepath.Rel(dir, file)
+		files = append(files, filepath.ToSlash(rel))
+		if rel == "a.lily" {
+			return failed
+		}
+		return nil
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("want=%v, got=%v", failed, err)
+	}
+	if expected := []string{"a.lily", "sub/c.lily", "sub/d.lily"}; !slices.Equal(files, expected) {
+		t.Fatalf("want=%v, got=%v", expected, files)
+	}
+
+	files = nil
+	file := filepath.Join(dir, "b.txt")
+	if err := walkFiles(file, func(file string) error {
+		files = append(files, file)
+		return nil
+	}); err != nil || !slices.Equal(files, []string{file}) {
+		t.Fatalf("want=[%v], got=%v (%v)", file, files, err)
+	}
+}
+
+func TestPrintTypes(t *testing.T) {
+	var out, errOut strings.Builder
+	src := "let id = fn(x) { x };\nlet n = id(1) + 1;\nn(\"a\")"
+	if err := printTypes(&out, &errOut, "f.lily", src); err != errFindings {
+		t.Fatalf("want errFindings, got=%v", err)
+	}
+
+	expected := "f.lily:1:5: id: fn('a): 'a\nf.lily:1:13: x: 'a\nf.lily:2:5: n: int\n"
+	if out.String() != expected {
+		t.Fatalf("want=\n%v\ngot=\n%v", expected, out.String())
+	}
+	expected = "f.lily:3:1: 'int' is not callable (see 2:9)\n"
+	if errOut.String() != expected {
+		t.Fatalf("want=\n%v\ngot=\n%v", expected, errOut.String())
+	}
+}
@@ -0,0 +1,254 @@
+// Package optimize rewrites programs into cheaper, equivalent programs.
+//
+// Only code that cannot fail at run time is rewritten: operations on
+// literals that would raise an error, such as 1 / 0 or -true, are left in
+// place so that they still fail when evaluated. Static errors in code that
+// is eliminated are not reported anymore, programs should therefore be
+// resolved before they are optimized.
+package optimize
+
+import (
+	"github.com/tombuente/lily/ast"
+)
+
+// Program optimizes prog in place and returns it. It
+//   - folds unary and binary operations on literals,
+//   - eliminates the branches of if expressions that cannot be taken, and
+//   - drops statements following a return or throw statement.
+func Program(prog *ast.Program) *ast.Program {
+	prog.Stmts = stmts(prog.Stmts)
+	return prog
+}
+
+func stmts(list []ast.Stmt) []ast.Stmt {
+	out := make([]ast.Stmt, 0, len(list))
+	for i, stmt := range list {
+		for _, stmt := range expand(stmt, i == len(list)-1) {
+			out = append(out, stmt)
+			switch stmt.(type) {
+			case *ast.ReturnStmt, *ast.ThrowStmt:
+				return out
+			}
+		}
+	}
+	return out
+}
+
+// expand optimizes stmt and returns the statements replacing it. last tells
+// whether the value of stmt is the value of its statement list.
+func expand(stmt ast.Stmt, last bool) []ast.Stmt {
+	switch stmt := stmt.(type) {
+	case *ast.ExprStmt:
+		stmt.Expr = expr(stmt.Expr)
+
+		// A branch that is always taken can replace the if expression
+		// unless it declares names, which would leak out of the scope of
+		// its block. As the last statement the value of the if matters,
+		// which is nil for an empty or missing branch.
+		if branch, ok := takenBranch(stmt.Expr); ok && !declares(branch) {
+			if !last {
+				if branch == nil {
+					return nil
+				}
+				return branch.Stmts
+			}
+			if branch != nil && len(branch.Stmts) > 0 {
+				return branch.Stmts
+			}
+		}
+	case *ast.LetStmt:
+		stmt.Expr = expr(stmt.Expr)
+	case *ast.ReturnStmt:
+		stmt.Expr = expr(stmt.Expr)
+	case *ast.ThrowStmt:
+		stmt.Expr = expr(stmt.Expr)
+	case *ast.ExportStmt:
+		stmt.Stmt = expand(stmt.Stmt, false)[0]
+	case *ast.MethodStmt:
+		stmt.Function.Body.Stmts = stmts(stmt.Function.Body.Stmts)
+	case *ast.BlockStmt:
+		stmt.Stmts = stmts(stmt.Stmts)
+	}
+	return []ast.Stmt{stmt}
+}
+
+func expr(e ast.Expr) ast.Expr {
+	switch e := e.(type) {
+	case *ast.UnaryOp:
+		e.Rhs = expr(e.Rhs)
+		if folded := foldUnary(e); folded != nil {
+			return folded
+		}
+	case *ast.BinaryOp:
+		e.Left = expr(e.Left)
+		e.Right = expr(e.Right)
+		if folded := foldBinary(e); folded != nil {
+			return folded
+		}
+	case *ast.If:
+		e.Condition = expr(e.Condition)
+		e.Consequence.Stmts = stmts(e.Consequence.Stmts)
+		if e.Alternative != nil {
+			e.Alternative.Stmts = stmts(e.Alternative.Stmts)
+		}
+
+		if cond, ok := e.Condition.(*ast.Bool); ok && cond.Value {
+			e.Alternative = nil
+		}
+		if branch, ok := takenBranch(e); ok && branch != nil && len(branch.Stmts) == 1 {
+			if stmt, ok := branch.Stmts[0].(*ast.ExprStmt); ok {
+				return stmt.Expr
+			}
+		}
+	case *ast.Function:
+		e.Body.Stmts = stmts(e.Body.Stmts)
+	case *ast.Call:
+		e.Lhs = expr(e.Lhs)
+		for i, arg := range e.Args {
+			e.Args[i] = expr(arg)
+		}
+	case *ast.Assignment:
+		e.Expr = expr(e.Expr)
+	case *ast.Selector:
+		e.Expr = expr(e.Expr)
+	case *ast.Propagate:
+		e.Expr = expr(e.Expr)
+	case *ast.FieldAssignment:
+		e.Target.Expr = expr(e.Target.Expr)
+		e.Expr = expr(e.Expr)
+	case *ast.IndexAssignment:
+		e.Target.Expr = expr(e.Target.Expr)
+		e.Target.Index = expr(e.Target.Index)
+		e.Expr = expr(e.Expr)
+	case *ast.StructLit:
+		for _, field := range e.Fields {
+			field.Value = expr(field.Value)
+		}
+	case *ast.ArrayLit:
+		for i, elem := range e.Elems {
+			e.Elems[i] = expr(elem)
+		}
+	case *ast.Index:
+		e.Expr = expr(e.Expr)
+		e.Index = expr(e.Index)
+	case *ast.Match:
+		e.Subject = expr(e.Subject)
+		for _, arm := range e.Arms {
+			switch body := arm.Body.(type) {
+			case *ast.BlockStmt:
+				body.Stmts = stmts(body.Stmts)
+			case *ast.ExprStmt:
+				body.Expr = expr(body.Expr)
+			}
+		}
+	case *ast.Try:
+		e.Body.Stmts = stmts(e.Body.Stmts)
+		if e.Catch != nil {
+			e.Catch.Stmts = stmts(e.Catch.Stmts)
+		}
+		if e.Finally != nil {
+			e.Finally.Stmts = stmts(e.Finally.Stmts)
+		}
+	}
+	return e
+}
+
+// declares reports whether a statement of block declares a name in the
+// scope of block.
+func declares(block *ast.BlockStmt) bool {
+	if block == nil {
+		return false
+	}
+	for _, stmt := range block.Stmts {
+		switch stmt.(type) {
+		case *ast.LetStmt, *ast.StructStmt, *ast.EnumStmt, *ast.ImportStmt, *ast.ExportStmt:
+			return true
+		}
+	}
+	return false
+}
+
+// takenBranch returns the branch taken by e if e is an if expression with a
+// literal condition. The branch is nil if there is no alternative.
+func takenBranch(e ast.Expr) (*ast.BlockStmt, bool) {
+	ifExpr, ok := e.(*ast.If)
+	if !ok {
+		return nil, false
+	}
+	cond, ok := ifExpr.Condition.(*ast.Bool)
+	if !ok {
+		return nil, false
+	}
+	if cond.Value {
+		return ifExpr.Consequence, true
+	}
+	return ifExpr.Alternative, true
+}
+
+// foldUnary returns the literal e evaluates to, or nil if e cannot be folded.
+func foldUnary(e *ast.UnaryOp) ast.Expr {
+	switch rhs := e.Rhs.(type) {
+	case *ast.Int:
+		if e.Op == "-" {
+			return &ast.Int{Value: -rhs.Value, Position: e.Position}
+		}
+	case *ast.Bool:
+		if e.Op == "!" {
+			return &ast.Bool{Value: !rhs.Value, Position: e.Position}
+		}
+	}
+	return nil
+}
+
+// foldBinary returns the literal e evaluates to, or nil if e cannot be
+// folded. Operations the evaluator rejects are never folded.
+func foldBinary(e *ast.BinaryOp) ast.Expr {
+	switch left := e.Left.(type) {
+	case *ast.Int:
+		right, ok := e.Right.(*ast.Int)
+		if !ok {
+			return nil
+		}
+		switch e.Op {
+		case "+":
+			return &ast.Int{Value: left.Value + right.Value, Position: e.Position}
+		case "-":
+			return &ast.Int{Value: left.Value - right.Value, Position: e.Position}
+		case "*":
+			return &ast.Int{Value: left.Value * right.Value, Position: e.Position}
+		case "/":
+			if right.Value == 0 {
+				return nil
+			}
+			return &ast.Int{Value: left.Value / right.Value, Position: e.Position}
+		case "<":
+			return &ast.Bool{Value: left.Value < right.Value, Position: e.Position}
+		case ">":
+			return &ast.Bool{Value: left.Value > right.Value, Position: e.Position}
+		case "==":
+			return &ast.Bool{Value: left.Value == right.Value, Position: e.Position}
+		case "!=":
+			return &ast.Bool{Value: left.Value != right.Value, Position: e.Position}
+		}
+	case *ast.Bool:
+		right, ok := e.Right.(*ast.Bool)
+		if !ok {
+			return nil
+		}
+		switch e.Op {
+		case "==":
+			return &ast.Bool{Value: left.Value == right.Value, Position: e.Position}
+		case "!=":
+			return &ast.Bool{Value: left.Value != right.Value, Position: e.Position}
+		}
+	case *ast.String:
+		right, ok := e.Right.(*ast.String)
+		if !ok {
+			return nil
+		}
+		if e.Op == "+" {
+			return &ast.String{Value: left.Value + right.Value, Position: e.Position}
+		}
+	}
+	return nil
+}
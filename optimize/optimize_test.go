@@ -0,0 +1,119 @@
+package optimize
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/eval"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+)
+
+func TestProgram(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{src: "2 + 3 * 4", expected: "14"},
+		{src: "-(1 - 3)", expected: "2"},
+		{src: "!(1 < 2)", expected: "false"},
+		{src: "true != (2 == 2)", expected: "false"},
+		{src: `"a" + "b" + "c"`, expected: `"abc"`},
+		{src: "let x = 1; x + 2 * 3", expected: "let x = 1; x + 6"},
+		{src: "1 / 0", expected: "1 / 0"},
+		{src: "6 / (2 - 2)", expected: "6 / 0"},
+		{src: "-true", expected: "-true"},
+		{src: "1 + true", expected: "1 + true"},
+		{src: `"a" - "b"`, expected: `"a" - "b"`},
+		{src: "if (true) { 1 } { 2 }; 3", expected: "1; 3"},
+		{src: "if (false) { 1 } { 2 }; 3", expected: "2; 3"},
+		{src: "if (false) { 1 }; 3", expected: "3"},
+		{src: "if (1 < 2) { let x = 1; x }", expected: "if (true) { let x = 1; x }"},
+		{src: "if (false) { 1 } { let x = 1 }; 2", expected: "if (false) { 1 } { let x = 1 }; 2"},
+		{src: "if (false) { 1 }", expected: "if (false) { 1 }"},
+		{src: "let x = if (2 > 1) { 10 } { 20 }", expected: "let x = 10"},
+		{src: "let x = if (true) { 10 } { 20 } + 1", expected: "let x = 11"},
+		{src: "let c = true; if (c) { 1 } { 2 }", expected: "let c = true; if (c) { 1 } { 2 }"},
+		{src: "1; return 2; 3; 4", expected: "1; return 2"},
+		{src: "let f = fn() { return 1; 2 }", expected: "let f = fn() { return 1 }"},
+		{src: "if (true) { return 1 }; 2", expected: "return 1"},
+		{src: `try { throw "a"; 1 } catch (e) { 1 + 2 }`, expected: `try { throw "a" } catch (e) { 3 }`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			actual := Program(parse(t, tt.src))
+			expected := parse(t, tt.expected)
+			if !ast.Equal(actual, expected) {
+				actualJSON, _ := actual.MarshalJSON()
+				expectedJSON, _ := expected.MarshalJSON()
+				t.Fatalf("want=%s, got=%s", expectedJSON, actualJSON)
+			}
+		})
+	}
+}
+
+// TestEquivalence checks that optimized programs evaluate to the same
+// values and fail with the same errors as the original ones.
+func TestEquivalence(t *testing.T) {
+	tests := []string{
+		"2 + 3 * 4",
+		"(2 + 3) * 4 - 10 / 3",
+		"-9223372036854775807 - 2",
+		"!true == false",
+		`"hello" + " " + "world"`,
+		"if (1 > 2) { 10 }",
+		"if (1 < 2) { 10 } { 20 }",
+		"if (1 > 2) { 10 } { let y = 20; y }",
+		"if (true) { }",
+		"let x = if (true) { 1 }; x",
+		"let f = fn(n) { if (true) { return n * 2 }; n }; f(21)",
+		"let f = fn() { if (false) { 1 } }; f()",
+		"1; return 2; 3",
+		"if (1 < 2) { if (2 < 3) { return 10 }; 20 }; 30",
+		"1 + 2; let a = 3; a",
+		"let x = 1; if (true) { let x = 2 }; x",
+		"if (true) { let y = 1 }; let y = 2; y",
+		"-true",
+		"!1",
+		"1 + true",
+		"true == (1 > true)",
+		`"a" * "b"`,
+		"if (1) { 2 }",
+		`try { 2 / 0 } catch (e) { e.kind }`,
+		"enum E { A(x), B }; match A(1 + 2) { A(3) => { if (true) { 1 * 5 } }, A(_) => 0, B => 2 - 1 }",
+		"struct P { x }; fn (p P) f() { if (true) { p.x * (2 + 3) } }; let p = P{x: 1 + 1}; p.x = p.f(); p.x",
+		`try { throw "a" + "b"; 1 } catch (e) { e.message } finally { 1 + 1 }`,
+	}
+
+	for _, src := range tests {
+		t.Run(src, func(t *testing.T) {
+			expected, expectedErr := eval.Eval(parse(t, src))
+			actual, actualErr := eval.Eval(Program(parse(t, src)))
+
+			if !reflect.DeepEqual(errString(actualErr), errString(expectedErr)) {
+				t.Fatalf("want error=%v, got=%v", expectedErr, actualErr)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Fatalf("want=%v, got=%v", expected, actual)
+			}
+		})
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func parse(t *testing.T, src string) *ast.Program {
+	t.Helper()
+	prog, err := parser.New(lexer.New(src)).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse program: %v", err)
+	}
+	return prog
+}
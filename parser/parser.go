@@ -30,6 +30,9 @@ var precedences = map[token.Type]int{
 	token.Asterisk: mul,
 	token.Slash:    mul,
 	token.LParan:   call,
+	token.Dot:      call,
+	token.Question: call,
+	token.LBracket: call,
 }
 
 type (
@@ -44,12 +47,32 @@ type Lexer interface {
 type Parser struct {
 	l Lexer
 
-	tok token.Token
+	tok   token.Token
+	ahead []token.Token // tokens read by peek but not consumed yet
+
+	// noStructLit disables struct literals while parsing an if condition,
+	// where the brace after an identifier opens the consequence.
+	noStructLit bool
 
 	prefixParseFns map[token.Type]prefixParseFn
 	infixParseFns  map[token.Type]infixParseFn
 }
 
+// Error is returned by [Parser.Parse]. Pos is the position of the token the
+// parser failed at.
+type Error struct {
+	Pos token.Pos
+	Err error
+}
+
+func (x *Error) Error() string {
+	return x.Err.Error()
+}
+
+func (x *Error) Unwrap() error {
+	return x.Err
+}
+
 func New(lexer Lexer) *Parser {
 	p := &Parser{l: lexer}
 
@@ -60,6 +83,9 @@ func New(lexer Lexer) *Parser {
 	p.prefixParseFns[token.False] = p.parseBool
 	p.prefixParseFns[token.String] = p.parseString
 	p.prefixParseFns[token.If] = p.parseIf
+	p.prefixParseFns[token.Try] = p.parseTry
+	p.prefixParseFns[token.Match] = p.parseMatch
+	p.prefixParseFns[token.LBracket] = p.parseArrayLit
 	p.prefixParseFns[token.LParan] = p.parseGroup
 	p.prefixParseFns[token.Fn] = p.parseFunction
 	p.prefixParseFns[token.Minus] = p.parseUnaryOp
@@ -75,6 +101,9 @@ func New(lexer Lexer) *Parser {
 	p.infixParseFns[token.Less] = p.parseBinaryOp
 	p.infixParseFns[token.Greater] = p.parseBinaryOp
 	p.infixParseFns[token.LParan] = p.parseCall
+	p.infixParseFns[token.Dot] = p.parseSelector
+	p.infixParseFns[token.Question] = p.parsePropagate
+	p.infixParseFns[token.LBracket] = p.parseIndex
 	p.infixParseFns[token.Assign] = p.parseAssingment
 
 	p.next()
@@ -87,7 +116,7 @@ func (p *Parser) Parse() (*ast.Program, error) {
 	for p.tok.Type != token.EOF {
 		stmt, err := p.parseStmt()
 		if err != nil {
-			return nil, err
+			return nil, &Error{Pos: p.tok.Pos, Err: err}
 		}
 		stmts = append(stmts, stmt)
 	}
@@ -121,15 +150,62 @@ func (p *Parser) parseExpr(prec int) (ast.Expr, error) {
 }
 
 func (p *Parser) parseIdent() (ast.Expr, error) {
-	value := p.tok.Literal
+	value, pos := p.tok.Literal, p.tok.Pos
 	p.next()
 
-	return &ast.Ident{
-		Value: value,
+	ident := &ast.Ident{
+		Value:    value,
+		Position: pos,
+	}
+	if p.tok.Type == token.LBrace && !p.noStructLit {
+		return p.parseStructLit(ident)
+	}
+	return ident, nil
+}
+
+// <type>{<ident>: <expr>, <ident>: <expr>}
+func (p *Parser) parseStructLit(typ *ast.Ident) (ast.Expr, error) {
+	p.next() // consume "{"
+
+	defer p.allowStructLit()()
+
+	fields := []*ast.FieldValue{}
+	for p.tok.Type != token.RBrace {
+		if err := p.expect(token.Ident); err != nil {
+			return nil, fmt.Errorf("expected a field name: %w", err)
+		}
+		name := &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+		p.next()
+
+		if err := p.expectNext(token.Colon); err != nil {
+			return nil, fmt.Errorf("field name must be followed by '%v': %w", token.Colon, err)
+		}
+
+		value, err := p.parseExpr(none)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse value of field '%v': %w", name.Value, err)
+		}
+		fields = append(fields, &ast.FieldValue{Name: name, Value: value, Position: name.Position})
+
+		if p.tok.Type != token.Comma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectNext(token.RBrace); err != nil {
+		return nil, fmt.Errorf("struct literal must end with '%v': %w", token.RBrace, err)
+	}
+
+	return &ast.StructLit{
+		Type:     typ,
+		Fields:   fields,
+		Position: typ.Position,
 	}, nil
 }
 
 func (p *Parser) parseInt() (ast.Expr, error) {
+	pos := p.tok.Pos
 	value, err := strconv.ParseInt(p.tok.Literal, 0, 64)
 	if err != nil {
 		return nil, err
@@ -137,31 +213,36 @@ func (p *Parser) parseInt() (ast.Expr, error) {
 	p.next()
 
 	return &ast.Int{
-		Value: value,
+		Value:    value,
+		Position: pos,
 	}, nil
 }
 
 func (p *Parser) parseBool() (ast.Expr, error) {
-	value := p.tok.Type == token.True
+	value, pos := p.tok.Type == token.True, p.tok.Pos
 	p.next()
 
 	return &ast.Bool{
-		Value: value,
+		Value:    value,
+		Position: pos,
 	}, nil
 }
 
 func (p *Parser) parseString() (ast.Expr, error) {
-	value := p.tok.Literal
+	value, pos := p.tok.Literal, p.tok.Pos
 	p.next()
 
-	return &ast.String{Value: value}, nil
+	return &ast.String{Value: value, Position: pos}, nil
 }
 
 // if <condition> { <consequence> } { <alternative> }
 func (p *Parser) parseIf() (ast.Expr, error) {
+	pos := p.tok.Pos
 	p.next()
 
+	p.noStructLit = true
 	condition, err := p.parseExpr(none)
+	p.noStructLit = false
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse if condition: %w", err)
 	}
@@ -183,6 +264,286 @@ func (p *Parser) parseIf() (ast.Expr, error) {
 		Condition:   condition,
 		Consequence: consequence,
 		Alternative: alternative,
+		Position:    pos,
+	}, nil
+}
+
+// try { <body> } catch (<ident>) { <catch> } finally { <finally> }
+// Either the catch or the finally clause may be omitted, but not both.
+func (p *Parser) parseTry() (ast.Expr, error) {
+	pos := p.tok.Pos
+	p.next() // consume try
+
+	body, err := p.parseBlockStmt()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse try body: %w", err)
+	}
+
+	var (
+		param        *ast.Ident
+		catch, final *ast.BlockStmt
+	)
+	if p.tok.Type == token.Catch {
+		p.next()
+
+		if err := p.expectNext(token.LParan); err != nil {
+			return nil, fmt.Errorf("catch parameter must start with '%v': %w", token.LParan, err)
+		}
+		if err := p.expect(token.Ident); err != nil {
+			return nil, fmt.Errorf("expected an identifier: %w", err)
+		}
+		param = &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+		p.next()
+		if err := p.expectNext(token.RParan); err != nil {
+			return nil, fmt.Errorf("catch parameter must end with '%v': %w", token.RParan, err)
+		}
+
+		catch, err = p.parseBlockStmt()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse catch body: %w", err)
+		}
+	}
+	if p.tok.Type == token.Finally {
+		p.next()
+
+		final, err = p.parseBlockStmt()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse finally body: %w", err)
+		}
+	}
+	if catch == nil && final == nil {
+		return nil, fmt.Errorf("try requires a '%v' or '%v' clause", token.Catch, token.Finally)
+	}
+
+	return &ast.Try{
+		Body:     body,
+		Param:    param,
+		Catch:    catch,
+		Finally:  final,
+		Position: pos,
+	}, nil
+}
+
+// match <expr> { <pattern> => <expr>, <pattern> => { <statement> } }
+func (p *Parser) parseMatch() (ast.Expr, error) {
+	pos := p.tok.Pos
+	p.next() // consume match
+
+	p.noStructLit = true
+	subject, err := p.parseExpr(none)
+	p.noStructLit = false
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse match subject: %w", err)
+	}
+
+	if err := p.expectNext(token.LBrace); err != nil {
+		return nil, fmt.Errorf("match arms must start with '%v': %w", token.LBrace, err)
+	}
+
+	arms := []*ast.MatchArm{}
+	for p.tok.Type != token.RBrace {
+		arm, err := p.parseMatchArm()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse match arm: %w", err)
+		}
+		arms = append(arms, arm)
+
+		if p.tok.Type != token.Comma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectNext(token.RBrace); err != nil {
+		return nil, fmt.Errorf("match arms must end with '%v': %w", token.RBrace, err)
+	}
+
+	return &ast.Match{
+		Subject:  subject,
+		Arms:     arms,
+		Position: pos,
+	}, nil
+}
+
+func (p *Parser) parseMatchArm() (*ast.MatchArm, error) {
+	pos := p.tok.Pos
+	pattern, err := p.parsePattern()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pattern: %w", err)
+	}
+
+	if err := p.expectNext(token.Arrow); err != nil {
+		return nil, fmt.Errorf("pattern must be followed by '%v': %w", token.Arrow, err)
+	}
+
+	var body ast.Stmt
+	if p.tok.Type == token.LBrace {
+		body, err = p.parseBlockStmt()
+	} else {
+		defer p.allowStructLit()()
+
+		var expr ast.Expr
+		expr, err = p.parseExpr(none)
+		if err == nil {
+			body = &ast.ExprStmt{Expr: expr, Position: expr.Pos()}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse arm body: %w", err)
+	}
+
+	return &ast.MatchArm{
+		Pattern:  pattern,
+		Body:     body,
+		Position: pos,
+	}, nil
+}
+
+// _
+// <ident>
+// <ident>(<pattern>, <pattern>)
+// [<pattern>, <pattern>]
+// {<ident>, <ident>: <pattern>}
+// <int>, -<int>, <string>, true or false
+func (p *Parser) parsePattern() (ast.Pattern, error) {
+	pos := p.tok.Pos
+	switch p.tok.Type {
+	case token.LBracket:
+		return p.parseArrayPattern()
+	case token.LBrace:
+		return p.parseObjectPattern()
+	case token.Ident:
+		ident := &ast.Ident{Value: p.tok.Literal, Position: pos}
+		p.next()
+
+		if p.tok.Type == token.LParan {
+			return p.parseConstructorPattern(ident)
+		}
+		if ident.Value == "_" {
+			return &ast.WildcardPattern{Position: pos}, nil
+		}
+		return &ast.IdentPattern{Ident: ident, Position: pos}, nil
+	case token.Int, token.String, token.True, token.False:
+		value, err := p.parseExpr(prefix)
+		if err != nil {
+			return nil, err
+		}
+		return &ast.LiteralPattern{Value: value, Position: pos}, nil
+	case token.Minus:
+		p.next()
+		if err := p.expect(token.Int); err != nil {
+			return nil, fmt.Errorf("expected an int after '%v': %w", token.Minus, err)
+		}
+		value, err := p.parseInt()
+		if err != nil {
+			return nil, err
+		}
+		value.(*ast.Int).Value *= -1
+		value.(*ast.Int).Position = pos
+		return &ast.LiteralPattern{Value: value, Position: pos}, nil
+	}
+	return nil, fmt.Errorf("unexpected %v in pattern", p.tok.Type)
+}
+
+// [<pattern>, <pattern>]
+func (p *Parser) parseArrayPattern() (ast.Pattern, error) {
+	pos := p.tok.Pos
+	p.next() // consume "["
+
+	elems := []ast.Pattern{}
+	for p.tok.Type != token.RBracket {
+		elem, err := p.parsePattern()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+
+		if p.tok.Type != token.Comma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectNext(token.RBracket); err != nil {
+		return nil, fmt.Errorf("array pattern must end with '%v': %w", token.RBracket, err)
+	}
+
+	return &ast.ArrayPattern{
+		Elems:    elems,
+		Position: pos,
+	}, nil
+}
+
+// {<ident>, <ident>: <pattern>}
+func (p *Parser) parseObjectPattern() (ast.Pattern, error) {
+	pos := p.tok.Pos
+	p.next() // consume "{"
+
+	fields := []*ast.FieldPattern{}
+	for p.tok.Type != token.RBrace {
+		if err := p.expect(token.Ident); err != nil {
+			return nil, fmt.Errorf("expected a field name: %w", err)
+		}
+		name := &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+		p.next()
+
+		var pattern ast.Pattern = &ast.IdentPattern{
+			Ident:    &ast.Ident{Value: name.Value, Position: name.Position},
+			Position: name.Position,
+		}
+		if p.tok.Type == token.Colon {
+			p.next()
+
+			var err error
+			pattern, err = p.parsePattern()
+			if err != nil {
+				return nil, err
+			}
+		}
+		fields = append(fields, &ast.FieldPattern{Name: name, Pattern: pattern, Position: name.Position})
+
+		if p.tok.Type != token.Comma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectNext(token.RBrace); err != nil {
+		return nil, fmt.Errorf("object pattern must end with '%v': %w", token.RBrace, err)
+	}
+
+	return &ast.ObjectPattern{
+		Fields:   fields,
+		Position: pos,
+	}, nil
+}
+
+// <ident>(<pattern>, <pattern>)
+func (p *Parser) parseConstructorPattern(name *ast.Ident) (ast.Pattern, error) {
+	p.next() // consume "("
+
+	args := []ast.Pattern{}
+	for p.tok.Type != token.RParan {
+		arg, err := p.parsePattern()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		if p.tok.Type != token.Comma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectNext(token.RParan); err != nil {
+		return nil, fmt.Errorf("constructor pattern must end with '%v': %w", token.RParan, err)
+	}
+
+	return &ast.ConstructorPattern{
+		Name:     name,
+		Args:     args,
+		Position: name.Position,
 	}, nil
 }
 
@@ -190,6 +551,8 @@ func (p *Parser) parseIf() (ast.Expr, error) {
 func (p *Parser) parseGroup() (ast.Expr, error) {
 	p.next()
 
+	defer p.allowStructLit()()
+
 	group, err := p.parseExpr(none)
 	if err != nil {
 		return nil, err
@@ -203,51 +566,178 @@ func (p *Parser) parseGroup() (ast.Expr, error) {
 }
 
 // fn(<ident>, <ident>) { <statement> }
+// fn(<ident>: <type>, <ident>): <type> { <statement> }
 func (p *Parser) parseFunction() (ast.Expr, error) {
+	pos := p.tok.Pos
 	p.next() // consume fn
 
-	params, err := p.parseFunctionParams()
+	fn, err := p.parseFunctionRest(pos)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse function parameter list: %w", err)
+		return nil, fmt.Errorf("failed to parse function: %w", err)
+	}
+	return fn, nil
+}
+
+// parseFunctionRest parses the parameters, result type and body of a
+// function starting at pos.
+func (p *Parser) parseFunctionRest(pos token.Pos) (*ast.Function, error) {
+	params, types, err := p.parseFunctionParams()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameter list: %w", err)
+	}
+
+	result, err := p.parseAnnotation()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse result type: %w", err)
 	}
 
 	body, err := p.parseBlockStmt()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse function body: %w", err)
+		return nil, fmt.Errorf("failed to parse body: %w", err)
 	}
 
 	return &ast.Function{
-		Params: params,
-		Body:   body,
+		Params:     params,
+		ParamTypes: types,
+		Result:     result,
+		Body:       body,
+		Position:   pos,
 	}, nil
 }
 
-// (<ident>, <ident>)
-func (p *Parser) parseFunctionParams() ([]*ast.Ident, error) {
+// (<ident>, [<pattern>, <pattern>], {<field>, <field>}), each optionally
+// followed by : <type>. The types are nil unless a parameter is annotated.
+func (p *Parser) parseFunctionParams() ([]ast.Pattern, []ast.TypeExpr, error) {
 	if err := p.expectNext(token.LParan); err != nil {
-		return nil, fmt.Errorf("function parameters must start with '%v': %w", token.LParan, err)
+		return nil, nil, fmt.Errorf("function parameters must start with '%v': %w", token.LParan, err)
 	}
 
-	idents := []*ast.Ident{}
-	if p.tok.Type == token.RParan {
+	params := []ast.Pattern{}
+	var types []ast.TypeExpr
+	annotated := false
+	for p.tok.Type != token.RParan {
+		switch p.tok.Type {
+		case token.LBracket, token.LBrace:
+			param, err := p.parsePattern()
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse parameter pattern: %w", err)
+			}
+			params = append(params, param)
+		default:
+			if err := p.expect(token.Ident); err != nil {
+				return nil, nil, fmt.Errorf("expected a parameter: %w", err)
+			}
+			ident := &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+			params = append(params, &ast.IdentPattern{Ident: ident, Position: ident.Position})
+			p.next()
+		}
+
+		typ, err := p.parseAnnotation()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse parameter type: %w", err)
+		}
+		types = append(types, typ)
+		annotated = annotated || typ != nil
+
+		// Consume the comma "," if present after the argument.
+		// Comma will not be there if this was the last argument.
+		if p.tok.Type != token.Comma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectNext(token.RParan); err != nil {
+		return nil, nil, fmt.Errorf("function parameters must end with '%v': %w", token.RParan, err)
+	}
+
+	if !annotated {
+		types = nil
+	}
+	return params, types, nil
+}
+
+// parseAnnotation parses : <type> if the current token is a colon, and
+// returns nil otherwise.
+func (p *Parser) parseAnnotation() (ast.TypeExpr, error) {
+	if p.tok.Type != token.Colon {
+		return nil, nil
+	}
+	p.next()
+	return p.parseType()
+}
+
+// <ident>
+// [<type>]
+// fn(<type>, <type>): <type>
+func (p *Parser) parseType() (ast.TypeExpr, error) {
+	pos := p.tok.Pos
+	switch p.tok.Type {
+	case token.Ident:
+		name := &ast.Ident{Value: p.tok.Literal, Position: pos}
+		p.next()
+		return &ast.NamedType{Name: name, Position: pos}, nil
+	case token.LBracket:
+		p.next()
+		elem, err := p.parseType()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse element type: %w", err)
+		}
+		if err := p.expectNext(token.RBracket); err != nil {
+			return nil, fmt.Errorf("array type must end with '%v': %w", token.RBracket, err)
+		}
+		return &ast.ArrayType{Elem: elem, Position: pos}, nil
+	case token.Fn:
 		p.next()
-		return idents, nil
+		if err := p.expectNext(token.LParan); err != nil {
+			return nil, fmt.Errorf("parameter types must start with '%v': %w", token.LParan, err)
+		}
+		params := []ast.TypeExpr{}
+		for p.tok.Type != token.RParan {
+			param, err := p.parseType()
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse parameter type: %w", err)
+			}
+			params = append(params, param)
+			if p.tok.Type != token.Comma {
+				break
+			}
+			p.next()
+		}
+		if err := p.expectNext(token.RParan); err != nil {
+			return nil, fmt.Errorf("parameter types must end with '%v': %w", token.RParan, err)
+		}
+		result, err := p.parseAnnotation()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse result type: %w", err)
+		}
+		return &ast.FuncType{Params: params, Result: result, Position: pos}, nil
 	}
+	return nil, fmt.Errorf("expected a type, got %v", p.tok.Type)
+}
 
+// (<ident>, <ident>)
+func (p *Parser) parseIdentList() ([]*ast.Ident, error) {
+	if err := p.expectNext(token.LParan); err != nil {
+		return nil, fmt.Errorf("list must start with '%v': %w", token.LParan, err)
+	}
+
+	idents := []*ast.Ident{}
 	for p.tok.Type != token.RParan {
-		ident := &ast.Ident{Value: p.tok.Literal}
-		idents = append(idents, ident)
+		if err := p.expect(token.Ident); err != nil {
+			return nil, fmt.Errorf("expected an identifier: %w", err)
+		}
+		idents = append(idents, &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos})
 		p.next()
 
-		// Consume the comma "," if present after the argument.
-		// Comma will not be there if this was the last argument.
-		if p.tok.Type == token.Comma {
-			p.next()
+		if p.tok.Type != token.Comma {
+			break
 		}
+		p.next()
 	}
 
 	if err := p.expectNext(token.RParan); err != nil {
-		return nil, fmt.Errorf("function parameters must end with '%v': %w", token.RParan, err)
+		return nil, fmt.Errorf("list must end with '%v': %w", token.RParan, err)
 	}
 
 	return idents, nil
@@ -256,7 +746,7 @@ func (p *Parser) parseFunctionParams() ([]*ast.Ident, error) {
 // -<ident>
 // !<ident>
 func (p *Parser) parseUnaryOp() (ast.Expr, error) {
-	op := p.tok.Literal
+	op, pos := p.tok.Literal, p.tok.Pos
 	p.next()
 
 	rhs, err := p.parseExpr(prefix)
@@ -265,8 +755,9 @@ func (p *Parser) parseUnaryOp() (ast.Expr, error) {
 	}
 
 	return &ast.UnaryOp{
-		Op:  op,
-		Rhs: rhs,
+		Op:       op,
+		Rhs:      rhs,
+		Position: pos,
 	}, nil
 }
 
@@ -283,9 +774,10 @@ func (p *Parser) parseBinaryOp(left ast.Expr) (ast.Expr, error) {
 	}
 
 	return &ast.BinaryOp{
-		Op:    op,
-		Left:  left,
-		Right: rhs,
+		Op:       op,
+		Left:     left,
+		Right:    rhs,
+		Position: left.Pos(),
 	}, nil
 }
 
@@ -298,8 +790,89 @@ func (p *Parser) parseCall(lhs ast.Expr) (ast.Expr, error) {
 	}
 
 	return &ast.Call{
-		Lhs:  lhs,
-		Args: args,
+		Lhs:      lhs,
+		Args:     args,
+		Position: lhs.Pos(),
+	}, nil
+}
+
+// <lhs>.<ident>
+func (p *Parser) parseSelector(lhs ast.Expr) (ast.Expr, error) {
+	p.next() // consume "."
+
+	if err := p.expect(token.Ident); err != nil {
+		return nil, fmt.Errorf("expected a field name: %w", err)
+	}
+	field := &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+	p.next()
+
+	return &ast.Selector{
+		Expr:     lhs,
+		Field:    field,
+		Position: lhs.Pos(),
+	}, nil
+}
+
+// [<expr>, <expr>]
+func (p *Parser) parseArrayLit() (ast.Expr, error) {
+	pos := p.tok.Pos
+	p.next() // consume "["
+
+	defer p.allowStructLit()()
+
+	elems := []ast.Expr{}
+	for p.tok.Type != token.RBracket {
+		elem, err := p.parseExpr(none)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse array element: %w", err)
+		}
+		elems = append(elems, elem)
+
+		if p.tok.Type != token.Comma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectNext(token.RBracket); err != nil {
+		return nil, fmt.Errorf("array must end with '%v': %w", token.RBracket, err)
+	}
+
+	return &ast.ArrayLit{
+		Elems:    elems,
+		Position: pos,
+	}, nil
+}
+
+// <lhs>[<expr>]
+func (p *Parser) parseIndex(lhs ast.Expr) (ast.Expr, error) {
+	p.next() // consume "["
+
+	defer p.allowStructLit()()
+
+	index, err := p.parseExpr(none)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse index: %w", err)
+	}
+
+	if err := p.expectNext(token.RBracket); err != nil {
+		return nil, fmt.Errorf("index must end with '%v': %w", token.RBracket, err)
+	}
+
+	return &ast.Index{
+		Expr:     lhs,
+		Index:    index,
+		Position: lhs.Pos(),
+	}, nil
+}
+
+// <lhs>?
+func (p *Parser) parsePropagate(lhs ast.Expr) (ast.Expr, error) {
+	p.next() // consume "?"
+
+	return &ast.Propagate{
+		Expr:     lhs,
+		Position: lhs.Pos(),
 	}, nil
 }
 
@@ -308,6 +881,8 @@ func (p *Parser) parseCallArgs() ([]ast.Expr, error) {
 		return nil, fmt.Errorf("call args must start with '%v': %w", token.LParan, err)
 	}
 
+	defer p.allowStructLit()()
+
 	args := []ast.Expr{}
 	if p.tok.Type == token.RParan {
 		p.next()
@@ -336,9 +911,11 @@ func (p *Parser) parseCallArgs() ([]ast.Expr, error) {
 }
 
 func (p *Parser) parseAssingment(ident ast.Expr) (ast.Expr, error) {
+	selector, isSelector := ident.(*ast.Selector)
+	index, isIndex := ident.(*ast.Index)
 	identExpr, ok := ident.(*ast.Ident)
-	if !ok {
-		return nil, fmt.Errorf("indet is not *ast.Ident")
+	if !ok && !isSelector && !isIndex {
+		return nil, fmt.Errorf("indet is not *ast.Ident, *ast.Selector or *ast.Index")
 	}
 
 	if err := p.expectNext(token.Assign); err != nil {
@@ -350,31 +927,84 @@ func (p *Parser) parseAssingment(ident ast.Expr) (ast.Expr, error) {
 		return nil, err
 	}
 
+	if isSelector {
+		return &ast.FieldAssignment{
+			Target:   selector,
+			Expr:     expr,
+			Position: selector.Pos(),
+		}, nil
+	}
+	if isIndex {
+		return &ast.IndexAssignment{
+			Target:   index,
+			Expr:     expr,
+			Position: index.Pos(),
+		}, nil
+	}
 	return &ast.Assignment{
-		Ident: identExpr,
-		Expr:  expr,
+		Ident:    identExpr,
+		Expr:     expr,
+		Position: identExpr.Pos(),
 	}, nil
 }
 
 func (p *Parser) parseStmt() (ast.Stmt, error) {
 	switch p.tok.Type {
-	case token.Let:
+	case token.Let, token.Const:
 		return p.parseLetStmt()
 	case token.Return:
 		return p.parseReturnStmt()
+	case token.Throw:
+		return p.parseThrowStmt()
+	case token.Struct:
+		return p.parseStructStmt()
+	case token.Enum:
+		return p.parseEnumStmt()
+	case token.Import:
+		return p.parseImportStmt()
+	case token.Export:
+		return p.parseExportStmt()
+	case token.Fn:
+		// fn (<ident> <ident>) starts a method, fn (<ident>, ... a function.
+		if p.peek(1).Type == token.LParan && p.peek(2).Type == token.Ident && p.peek(3).Type == token.Ident {
+			return p.parseMethodStmt()
+		}
 	}
 	return p.parseExprStmt()
 }
 
 // let <ident> = <expr>
+// let <ident>: <type> = <expr>
+// let [<pattern>, <pattern>] = <expr>
+// let {<ident>, <ident>} = <expr>
+// const <ident or pattern> = <expr>
 func (p *Parser) parseLetStmt() (*ast.LetStmt, error) {
-	p.next() // consume let
+	pos, constant := p.tok.Pos, p.tok.Type == token.Const
+	p.next() // consume let or const
 
-	if err := p.expect(token.Ident); err != nil {
-		return nil, fmt.Errorf("expected an identifier: %w", err)
+	var (
+		ident   *ast.Ident
+		pattern ast.Pattern
+	)
+	switch p.tok.Type {
+	case token.LBracket, token.LBrace:
+		var err error
+		pattern, err = p.parsePattern()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pattern: %w", err)
+		}
+	default:
+		if err := p.expect(token.Ident); err != nil {
+			return nil, fmt.Errorf("expected an identifier: %w", err)
+		}
+		ident = &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+		p.next()
+	}
+
+	typ, err := p.parseAnnotation()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse type: %w", err)
 	}
-	ident := &ast.Ident{Value: p.tok.Literal}
-	p.next()
 
 	if err := p.expectNext(token.Assign); err != nil {
 		return nil, fmt.Errorf("expected assigment token: %w", err)
@@ -390,13 +1020,18 @@ func (p *Parser) parseLetStmt() (*ast.LetStmt, error) {
 	}
 
 	return &ast.LetStmt{
-		Ident: ident,
-		Expr:  expr,
+		Const:    constant,
+		Ident:    ident,
+		Pattern:  pattern,
+		Type:     typ,
+		Expr:     expr,
+		Position: pos,
 	}, nil
 }
 
 // return <expr>
 func (p *Parser) parseReturnStmt() (*ast.ReturnStmt, error) {
+	pos := p.tok.Pos
 	p.next() // consume "return"
 
 	expr, err := p.parseExpr(none)
@@ -409,7 +1044,228 @@ func (p *Parser) parseReturnStmt() (*ast.ReturnStmt, error) {
 	}
 
 	return &ast.ReturnStmt{
-		Expr: expr,
+		Expr:     expr,
+		Position: pos,
+	}, nil
+}
+
+// throw <expr>
+func (p *Parser) parseThrowStmt() (*ast.ThrowStmt, error) {
+	pos := p.tok.Pos
+	p.next() // consume "throw"
+
+	expr, err := p.parseExpr(none)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse expression: %w", err)
+	}
+
+	if p.tok.Type == token.Semicolon {
+		p.next()
+	}
+
+	return &ast.ThrowStmt{
+		Expr:     expr,
+		Position: pos,
+	}, nil
+}
+
+// import "<path>" as <ident>
+func (p *Parser) parseImportStmt() (*ast.ImportStmt, error) {
+	pos := p.tok.Pos
+	p.next() // consume "import"
+
+	if err := p.expect(token.String); err != nil {
+		return nil, fmt.Errorf("expected a module path: %w", err)
+	}
+	path := &ast.String{Value: p.tok.Literal, Position: p.tok.Pos}
+	p.next()
+
+	if err := p.expectNext(token.As); err != nil {
+		return nil, fmt.Errorf("module path must be followed by '%v': %w", token.As, err)
+	}
+
+	if err := p.expect(token.Ident); err != nil {
+		return nil, fmt.Errorf("expected a module name: %w", err)
+	}
+	name := &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+	p.next()
+
+	if p.tok.Type == token.Semicolon {
+		p.next()
+	}
+
+	return &ast.ImportStmt{
+		Path:     path,
+		Name:     name,
+		Position: pos,
+	}, nil
+}
+
+// export <let, const, struct or enum statement>
+func (p *Parser) parseExportStmt() (*ast.ExportStmt, error) {
+	pos := p.tok.Pos
+	p.next() // consume "export"
+
+	var (
+		stmt ast.Stmt
+		err  error
+	)
+	switch p.tok.Type {
+	case token.Let, token.Const:
+		stmt, err = p.parseLetStmt()
+	case token.Struct:
+		stmt, err = p.parseStructStmt()
+	case token.Enum:
+		stmt, err = p.parseEnumStmt()
+	default:
+		return nil, fmt.Errorf("can only export let, const, struct and enum statements, got '%v'", p.tok.Literal)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &ast.ExportStmt{
+		Stmt:     stmt,
+		Position: pos,
+	}, nil
+}
+
+// struct <ident> { <ident>, <ident> }
+func (p *Parser) parseStructStmt() (*ast.StructStmt, error) {
+	pos := p.tok.Pos
+	p.next() // consume "struct"
+
+	if err := p.expect(token.Ident); err != nil {
+		return nil, fmt.Errorf("expected a struct name: %w", err)
+	}
+	name := &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+	p.next()
+
+	if err := p.expectNext(token.LBrace); err != nil {
+		return nil, fmt.Errorf("struct fields must start with '%v': %w", token.LBrace, err)
+	}
+
+	fields := []*ast.Ident{}
+	for p.tok.Type != token.RBrace {
+		if err := p.expect(token.Ident); err != nil {
+			return nil, fmt.Errorf("expected a field name: %w", err)
+		}
+		fields = append(fields, &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos})
+		p.next()
+
+		if p.tok.Type != token.Comma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectNext(token.RBrace); err != nil {
+		return nil, fmt.Errorf("struct fields must end with '%v': %w", token.RBrace, err)
+	}
+
+	if p.tok.Type == token.Semicolon {
+		p.next()
+	}
+
+	return &ast.StructStmt{
+		Name:     name,
+		Fields:   fields,
+		Position: pos,
+	}, nil
+}
+
+// enum <ident> { <ident>, <ident>(<ident>, <ident>) }
+func (p *Parser) parseEnumStmt() (*ast.EnumStmt, error) {
+	pos := p.tok.Pos
+	p.next() // consume "enum"
+
+	if err := p.expect(token.Ident); err != nil {
+		return nil, fmt.Errorf("expected an enum name: %w", err)
+	}
+	name := &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+	p.next()
+
+	if err := p.expectNext(token.LBrace); err != nil {
+		return nil, fmt.Errorf("enum variants must start with '%v': %w", token.LBrace, err)
+	}
+
+	variants := []*ast.Variant{}
+	for p.tok.Type != token.RBrace {
+		if err := p.expect(token.Ident); err != nil {
+			return nil, fmt.Errorf("expected a variant name: %w", err)
+		}
+		variant := &ast.Variant{
+			Name:     &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos},
+			Position: p.tok.Pos,
+		}
+		p.next()
+
+		if p.tok.Type == token.LParan {
+			fields, err := p.parseIdentList()
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse fields of variant '%v': %w", variant.Name.Value, err)
+			}
+			variant.Fields = fields
+		}
+		variants = append(variants, variant)
+
+		if p.tok.Type != token.Comma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expectNext(token.RBrace); err != nil {
+		return nil, fmt.Errorf("enum variants must end with '%v': %w", token.RBrace, err)
+	}
+
+	if p.tok.Type == token.Semicolon {
+		p.next()
+	}
+
+	return &ast.EnumStmt{
+		Name:     name,
+		Variants: variants,
+		Position: pos,
+	}, nil
+}
+
+// fn (<ident> <ident>) <ident>(<ident>, <ident>): <type> { <statement> }
+func (p *Parser) parseMethodStmt() (*ast.MethodStmt, error) {
+	pos := p.tok.Pos
+	p.next() // consume "fn"
+	p.next() // consume "("
+
+	receiver := &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+	p.next()
+	typ := &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+	p.next()
+
+	if err := p.expectNext(token.RParan); err != nil {
+		return nil, fmt.Errorf("method receiver must end with '%v': %w", token.RParan, err)
+	}
+
+	if err := p.expect(token.Ident); err != nil {
+		return nil, fmt.Errorf("expected a method name: %w", err)
+	}
+	name := &ast.Ident{Value: p.tok.Literal, Position: p.tok.Pos}
+	p.next()
+
+	fn, err := p.parseFunctionRest(p.tok.Pos)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse method: %w", err)
+	}
+
+	if p.tok.Type == token.Semicolon {
+		p.next()
+	}
+
+	return &ast.MethodStmt{
+		Receiver: receiver,
+		Type:     typ,
+		Name:     name,
+		Function: fn,
+		Position: pos,
 	}, nil
 }
 
@@ -425,15 +1281,19 @@ func (p *Parser) parseExprStmt() (*ast.ExprStmt, error) {
 	}
 
 	return &ast.ExprStmt{
-		Expr: expr,
+		Expr:     expr,
+		Position: expr.Pos(),
 	}, nil
 }
 
 func (p *Parser) parseBlockStmt() (*ast.BlockStmt, error) {
+	pos := p.tok.Pos
 	if err := p.expectNext(token.LBrace); err != nil {
 		return nil, fmt.Errorf("block must start with '%v': %w", token.LBrace, err)
 	}
 
+	defer p.allowStructLit()()
+
 	stmts := []ast.Stmt{}
 	for p.tok.Type != token.RBrace && p.tok.Type != token.EOF {
 		stmt, err := p.parseStmt()
@@ -447,19 +1307,39 @@ func (p *Parser) parseBlockStmt() (*ast.BlockStmt, error) {
 		return nil, fmt.Errorf("block must stop with '%v': %w", token.RBrace, err)
 	}
 
-	if p.tok.Type == token.Semicolon {
-		p.next()
-	}
-
 	return &ast.BlockStmt{
-		Stmts: stmts,
+		Stmts:    stmts,
+		Position: pos,
 	}, nil
 }
 
 func (p *Parser) next() {
+	if len(p.ahead) > 0 {
+		p.tok = p.ahead[0]
+		p.ahead = p.ahead[1:]
+		return
+	}
 	p.tok = p.l.Next()
 }
 
+// peek returns the token n tokens after the current one without consuming
+// any tokens.
+func (p *Parser) peek(n int) token.Token {
+	for len(p.ahead) < n {
+		p.ahead = append(p.ahead, p.l.Next())
+	}
+	return p.ahead[n-1]
+}
+
+// allowStructLit enables struct literals until the returned function is
+// called, which restores the previous state. It is used where braces can
+// no longer be confused with the consequence of an if.
+func (p *Parser) allowStructLit() func() {
+	prev := p.noStructLit
+	p.noStructLit = false
+	return func() { p.noStructLit = prev }
+}
+
 // expect checks whether the current token matches the expected type.
 // If not, it returns an error indicating the mismatch.
 func (p *Parser) expect(typ token.Type) error {
@@ -478,6 +1358,19 @@ func (p *Parser) expectNext(typ token.Type) error {
 	return nil
 }
 
+// Precedences of the operands that are no binary operators, see
+// [Precedence].
+const (
+	PrefixPrecedence = prefix // operand of a unary operator
+	CallPrecedence   = call   // operand of a call, selector, index or '?'
+)
+
+// Precedence returns how tightly the infix operator typ binds, operators of
+// a higher precedence bind tighter. It returns 0 for other tokens.
+func Precedence(typ token.Type) int {
+	return precedence(typ)
+}
+
 func precedence(typ token.Type) int {
 	if p, ok := precedences[typ]; ok {
 		return p
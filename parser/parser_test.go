@@ -1,11 +1,12 @@
 package parser
 
 import (
-	"reflect"
+	"errors"
 	"testing"
 
 	"github.com/tombuente/lily/ast"
 	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/token"
 )
 
 type parserTest struct {
@@ -50,9 +51,9 @@ func TestParse(t *testing.T) {
 					&ast.LetStmt{
 						Ident: &ast.Ident{Value: "add"},
 						Expr: &ast.Function{
-							Params: []*ast.Ident{
-								{Value: "x"},
-								{Value: "y"},
+							Params: []ast.Pattern{
+								&ast.IdentPattern{Ident: &ast.Ident{Value: "x"}},
+								&ast.IdentPattern{Ident: &ast.Ident{Value: "y"}},
 							},
 							Body: &ast.BlockStmt{
 								Stmts: []ast.Stmt{
@@ -96,11 +97,419 @@ func TestParse(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "try catch finally",
+			src:  `try { throw "bad" } catch (e) { e.message } finally { 1 }`,
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.ExprStmt{
+						Expr: &ast.Try{
+							Body: &ast.BlockStmt{
+								Stmts: []ast.Stmt{&ast.ThrowStmt{Expr: &ast.String{Value: "bad"}}},
+							},
+							Param: &ast.Ident{Value: "e"},
+							Catch: &ast.BlockStmt{
+								Stmts: []ast.Stmt{
+									&ast.ExprStmt{
+										Expr: &ast.Selector{
+											Expr:  &ast.Ident{Value: "e"},
+											Field: &ast.Ident{Value: "message"},
+										},
+									},
+								},
+							},
+							Finally: &ast.BlockStmt{
+								Stmts: []ast.Stmt{&ast.ExprStmt{Expr: &ast.Int{Value: 1}}},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "try finally",
+			src:  "try { f() } finally { g() }",
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.ExprStmt{
+						Expr: &ast.Try{
+							Body: &ast.BlockStmt{
+								Stmts: []ast.Stmt{&ast.ExprStmt{Expr: &ast.Call{Lhs: &ast.Ident{Value: "f"}, Args: []ast.Expr{}}}},
+							},
+							Finally: &ast.BlockStmt{
+								Stmts: []ast.Stmt{&ast.ExprStmt{Expr: &ast.Call{Lhs: &ast.Ident{Value: "g"}, Args: []ast.Expr{}}}},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "propagate",
+			src:  "f(x)?.value",
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.ExprStmt{
+						Expr: &ast.Selector{
+							Expr: &ast.Propagate{
+								Expr: &ast.Call{Lhs: &ast.Ident{Value: "f"}, Args: []ast.Expr{&ast.Ident{Value: "x"}}},
+							},
+							Field: &ast.Ident{Value: "value"},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "struct",
+			src:  "struct Point { x, y }; let p = Point{x: 1, y: 2}; p.x = p.y",
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.StructStmt{
+						Name:   &ast.Ident{Value: "Point"},
+						Fields: []*ast.Ident{{Value: "x"}, {Value: "y"}},
+					},
+					&ast.LetStmt{
+						Ident: &ast.Ident{Value: "p"},
+						Expr: &ast.StructLit{
+							Type: &ast.Ident{Value: "Point"},
+							Fields: []*ast.FieldValue{
+								{Name: &ast.Ident{Value: "x"}, Value: &ast.Int{Value: 1}},
+								{Name: &ast.Ident{Value: "y"}, Value: &ast.Int{Value: 2}},
+							},
+						},
+					},
+					&ast.ExprStmt{
+						Expr: &ast.FieldAssignment{
+							Target: &ast.Selector{Expr: &ast.Ident{Value: "p"}, Field: &ast.Ident{Value: "x"}},
+							Expr:   &ast.Selector{Expr: &ast.Ident{Value: "p"}, Field: &ast.Ident{Value: "y"}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "method",
+			src:  "fn (p Point) scale(k) { p.x * k }",
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.MethodStmt{
+						Receiver: &ast.Ident{Value: "p"},
+						Type:     &ast.Ident{Value: "Point"},
+						Name:     &ast.Ident{Value: "scale"},
+						Function: &ast.Function{
+							Params: []ast.Pattern{&ast.IdentPattern{Ident: &ast.Ident{Value: "k"}}},
+							Body: &ast.BlockStmt{
+								Stmts: []ast.Stmt{
+									&ast.ExprStmt{
+										Expr: &ast.BinaryOp{
+											Op:    "*",
+											Left:  &ast.Selector{Expr: &ast.Ident{Value: "p"}, Field: &ast.Ident{Value: "x"}},
+											Right: &ast.Ident{Value: "k"},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "no struct literal in if condition",
+			src:  "if ok { Unit{} } { (Unit{}) }",
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.ExprStmt{
+						Expr: &ast.If{
+							Condition: &ast.Ident{Value: "ok"},
+							Consequence: &ast.BlockStmt{
+								Stmts: []ast.Stmt{&ast.ExprStmt{Expr: &ast.StructLit{Type: &ast.Ident{Value: "Unit"}, Fields: []*ast.FieldValue{}}}},
+							},
+							Alternative: &ast.BlockStmt{
+								Stmts: []ast.Stmt{&ast.ExprStmt{Expr: &ast.StructLit{Type: &ast.Ident{Value: "Unit"}, Fields: []*ast.FieldValue{}}}},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "enum",
+			src:  "enum Shape { Circle(r), Rect(w, h), Empty }",
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.EnumStmt{
+						Name: &ast.Ident{Value: "Shape"},
+						Variants: []*ast.Variant{
+							{Name: &ast.Ident{Value: "Circle"}, Fields: []*ast.Ident{{Value: "r"}}},
+							{Name: &ast.Ident{Value: "Rect"}, Fields: []*ast.Ident{{Value: "w"}, {Value: "h"}}},
+							{Name: &ast.Ident{Value: "Empty"}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "match",
+			src:  `match s { Circle(r) => r, Rect(_, 2) => { 1 }, -1 => 2, "a" => 3, x => x }`,
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.ExprStmt{
+						Expr: &ast.Match{
+							Subject: &ast.Ident{Value: "s"},
+							Arms: []*ast.MatchArm{
+								{
+									Pattern: &ast.ConstructorPattern{
+										Name: &ast.Ident{Value: "Circle"},
+										Args: []ast.Pattern{&ast.IdentPattern{Ident: &ast.Ident{Value: "r"}}},
+									},
+									Body: &ast.ExprStmt{Expr: &ast.Ident{Value: "r"}},
+								},
+								{
+									Pattern: &ast.ConstructorPattern{
+										Name: &ast.Ident{Value: "Rect"},
+										Args: []ast.Pattern{&ast.WildcardPattern{}, &ast.LiteralPattern{Value: &ast.Int{Value: 2}}},
+									},
+									Body: &ast.BlockStmt{Stmts: []ast.Stmt{&ast.ExprStmt{Expr: &ast.Int{Value: 1}}}},
+								},
+								{
+									Pattern: &ast.LiteralPattern{Value: &ast.Int{Value: -1}},
+									Body:    &ast.ExprStmt{Expr: &ast.Int{Value: 2}},
+								},
+								{
+									Pattern: &ast.LiteralPattern{Value: &ast.String{Value: "a"}},
+									Body:    &ast.ExprStmt{Expr: &ast.Int{Value: 3}},
+								},
+								{
+									Pattern: &ast.IdentPattern{Ident: &ast.Ident{Value: "x"}},
+									Body:    &ast.ExprStmt{Expr: &ast.Ident{Value: "x"}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "destructuring",
+			src:  "let [a, {name, age: n}] = [1, p]; fn([x, _]) { x }; xs[0]",
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.LetStmt{
+						Pattern: &ast.ArrayPattern{
+							Elems: []ast.Pattern{
+								&ast.IdentPattern{Ident: &ast.Ident{Value: "a"}},
+								&ast.ObjectPattern{
+									Fields: []*ast.FieldPattern{
+										{Name: &ast.Ident{Value: "name"}, Pattern: &ast.IdentPattern{Ident: &ast.Ident{Value: "name"}}},
+										{Name: &ast.Ident{Value: "age"}, Pattern: &ast.IdentPattern{Ident: &ast.Ident{Value: "n"}}},
+									},
+								},
+							},
+						},
+						Expr: &ast.ArrayLit{Elems: []ast.Expr{&ast.Int{Value: 1}, &ast.Ident{Value: "p"}}},
+					},
+					&ast.ExprStmt{
+						Expr: &ast.Function{
+							Params: []ast.Pattern{
+								&ast.ArrayPattern{
+									Elems: []ast.Pattern{
+										&ast.IdentPattern{Ident: &ast.Ident{Value: "x"}},
+										&ast.WildcardPattern{},
+									},
+								},
+							},
+							Body: &ast.BlockStmt{Stmts: []ast.Stmt{&ast.ExprStmt{Expr: &ast.Ident{Value: "x"}}}},
+						},
+					},
+					&ast.ExprStmt{
+						Expr: &ast.Index{Expr: &ast.Ident{Value: "xs"}, Index: &ast.Int{Value: 0}},
+					},
+				},
+			},
+		},
+		{
+			name: "const and index assignment",
+			src:  `const xs = [1]; xs[0] = 2`,
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.LetStmt{
+						Const: true,
+						Ident: &ast.Ident{Value: "xs"},
+						Expr:  &ast.ArrayLit{Elems: []ast.Expr{&ast.Int{Value: 1}}},
+					},
+					&ast.ExprStmt{
+						Expr: &ast.IndexAssignment{
+							Target: &ast.Index{Expr: &ast.Ident{Value: "xs"}, Index: &ast.Int{Value: 0}},
+							Expr:   &ast.Int{Value: 2},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "import and export",
+			src:  `import "lib/math" as m; export let x = m.y`,
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.ImportStmt{
+						Path: &ast.String{Value: "lib/math"},
+						Name: &ast.Ident{Value: "m"},
+					},
+					&ast.ExportStmt{
+						Stmt: &ast.LetStmt{
+							Ident: &ast.Ident{Value: "x"},
+							Expr:  &ast.Selector{Expr: &ast.Ident{Value: "m"}, Field: &ast.Ident{Value: "y"}},
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "statement after function literal",
+			src:  "let f = fn() { 1 }; (2)",
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.LetStmt{
+						Ident: &ast.Ident{Value: "f"},
+						Expr: &ast.Function{
+							Params: []ast.Pattern{},
+							Body: &ast.BlockStmt{
+								Stmts: []ast.Stmt{
+									&ast.ExprStmt{Expr: &ast.Int{Value: 1}},
+								},
+							},
+						},
+					},
+					&ast.ExprStmt{Expr: &ast.Int{Value: 2}},
+				},
+			},
+		},
+		{
+			name: "type annotations",
+			src:  "let f: fn(int, [P]): bool = fn(a: int, b, [c]: [P]): bool { true }; let x: any = f",
+			expected: &ast.Program{
+				Stmts: []ast.Stmt{
+					&ast.LetStmt{
+						Ident: &ast.Ident{Value: "f"},
+						Type: &ast.FuncType{
+							Params: []ast.TypeExpr{
+								&ast.NamedType{Name: &ast.Ident{Value: "int"}},
+								&ast.ArrayType{Elem: &ast.NamedType{Name: &ast.Ident{Value: "P"}}},
+							},
+							Result: &ast.NamedType{Name: &ast.Ident{Value: "bool"}},
+						},
+						Expr: &ast.Function{
+							Params: []ast.Pattern{
+								&ast.IdentPattern{Ident: &ast.Ident{Value: "a"}},
+								&ast.IdentPattern{Ident: &ast.Ident{Value: "b"}},
+								&ast.ArrayPattern{Elems: []ast.Pattern{&ast.IdentPattern{Ident: &ast.Ident{Value: "c"}}}},
+							},
+							ParamTypes: []ast.TypeExpr{
+								&ast.NamedType{Name: &ast.Ident{Value: "int"}},
+								nil,
+								&ast.ArrayType{Elem: &ast.NamedType{Name: &ast.Ident{Value: "P"}}},
+							},
+							Result: &ast.NamedType{Name: &ast.Ident{Value: "bool"}},
+							Body: &ast.BlockStmt{
+								Stmts: []ast.Stmt{&ast.ExprStmt{Expr: &ast.Bool{Value: true}}},
+							},
+						},
+					},
+					&ast.LetStmt{
+						Ident: &ast.Ident{Value: "x"},
+						Type:  &ast.NamedType{Name: &ast.Ident{Value: "any"}},
+						Expr:  &ast.Ident{Value: "f"},
+					},
+				},
+			},
+		},
 	}
 
 	test(t, tests)
 }
 
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"try { 1 }",
+		"import lib as m",
+		`import "lib" m`,
+		"export fn() { 1 }",
+		"const = 1",
+		"try { 1 } catch { 2 }",
+		"a.1",
+		"struct P { x y }",
+		"P{x 1}",
+		"1 = 2",
+		"match x { 1 2 }",
+		"match x { a + 1 => 2 }",
+		"fn(1) { 1 }",
+		"fn(a",
+		"let [a, b = c",
+		"[1, 2",
+		"let x: = 1",
+		"let x: [int = 1",
+		"fn(a: 1) { a }",
+		"fn(a): fn(int { a }",
+	}
+
+	for _, src := range tests {
+		t.Run(src, func(t *testing.T) {
+			if _, err := New(lexer.New(src)).Parse(); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+func TestErrorPos(t *testing.T) {
+	_, err := New(lexer.New("let a = 1;\nlet b = ;")).Parse()
+	var perr *Error
+	if !errors.As(err, &perr) {
+		t.Fatalf("want *Error, got=%v", err)
+	}
+	if expected := (token.Pos{Line: 2, Column: 9}); perr.Pos != expected {
+		t.Fatalf("want=%v, got=%v", expected, perr.Pos)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	src := "let add = fn(x, y) {\n\treturn x + -y;\n};\nadd(1, \"a\")"
+	program := parse(t, src)
+
+	let := program.Stmts[0].(*ast.LetStmt)
+	fn := let.Expr.(*ast.Function)
+	ret := fn.Body.Stmts[0].(*ast.ReturnStmt)
+	sum := ret.Expr.(*ast.BinaryOp)
+	neg := sum.Right.(*ast.UnaryOp)
+	stmt := program.Stmts[1].(*ast.ExprStmt)
+	call := stmt.Expr.(*ast.Call)
+
+	tests := []struct {
+		node     ast.Node
+		expected token.Pos
+	}{
+		{let, token.Pos{Line: 1, Column: 1}},
+		{let.Ident, token.Pos{Line: 1, Column: 5}},
+		{fn, token.Pos{Line: 1, Column: 11}},
+		{fn.Params[1], token.Pos{Line: 1, Column: 17}},
+		{fn.Body, token.Pos{Line: 1, Column: 20}},
+		{ret, token.Pos{Line: 2, Column: 2}},
+		{sum, token.Pos{Line: 2, Column: 9}},
+		{neg, token.Pos{Line: 2, Column: 13}},
+		{neg.Rhs, token.Pos{Line: 2, Column: 14}},
+		{stmt, token.Pos{Line: 4, Column: 1}},
+		{call, token.Pos{Line: 4, Column: 1}},
+		{call.Args[1], token.Pos{Line: 4, Column: 8}},
+	}
+	for _, tt := range tests {
+		if actual := tt.node.Pos(); actual != tt.expected {
+			t.Errorf("%T: want=%v, got=%v", tt.node, tt.expected, actual)
+		}
+	}
+}
+
 func test(t *testing.T, tests []parserTest) {
 	t.Helper()
 	for _, tt := range tests {
@@ -111,7 +520,7 @@ func test(t *testing.T, tests []parserTest) {
 		t.Run(name, func(t *testing.T) {
 			t.Helper()
 			program := parse(t, tt.src)
-			if !reflect.DeepEqual(program, tt.expected) {
+			if !ast.Equal(program, tt.expected) {
 				expectedJSON, err := tt.expected.MarshalJSON()
 				if err != nil {
 					t.Fatalf("Failed to marshal expected: %v", err)
@@ -0,0 +1,715 @@
+// Package resolver statically binds every identifier of a program to the
+// variable it refers to, so that evaluation can address variables by slot
+// instead of looking them up by name.
+//
+// Names are lexically scoped. Every block, match arm and catch clause opens
+// a scope nested in the enclosing one; the parameters of a function share
+// the scope of its body, and so do the bindings of a match arm or catch
+// clause. A name is visible from its declaration to the end of its scope,
+// nested scopes and functions included, and it may be shadowed by a
+// declaration in a nested scope. The shadowing name is in scope in its own
+// initializer already, so let x = x + 1 does not refer to the outer x but
+// fails. Declaring a name twice in the same scope is an error.
+package resolver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/token"
+)
+
+type Kind int
+
+const (
+	Global  Kind = iota // variable declared at the top level
+	Local               // variable of the function the identifier is used in
+	Upvalue             // local of an enclosing function captured by a closure
+	Builtin             // builtin provided by the host
+)
+
+// Binding describes the variable an identifier refers to.
+type Binding struct {
+	Kind Kind
+	// Index is the slot of the variable in the global table for Global, in
+	// the frame of the function for Local, and in the upvalues of the
+	// function for Upvalue. It is unused for Builtin.
+	Index int
+}
+
+// Capture describes how a closure obtains one of its upvalues when it is
+// created.
+type Capture struct {
+	Local bool // captures a local of the enclosing function, otherwise one of its upvalues
+	Index int
+	Name  string
+}
+
+type Function struct {
+	Locals   []string // local names indexed by slot, starting with the parameters
+	Upvalues []Capture
+}
+
+type Info struct {
+	// Idents maps every identifier, including the ones introduced by let
+	// statements and parameters, to its binding.
+	Idents    map[*ast.Ident]Binding
+	Functions map[*ast.Function]*Function
+	Globals   []string // global names indexed by slot
+
+	// TailCalls holds the calls in tail position, whose value is returned
+	// by the enclosing function as is. They can reuse the caller's frame.
+	TailCalls map[*ast.Call]bool
+
+	// Variants maps the identifiers of patterns that name an enum variant
+	// to its declaration. The identifiers of other [ast.IdentPattern]s are
+	// bindings.
+	Variants map[*ast.Ident]*ast.Variant
+
+	// Exports holds the names declared by export statements, including the
+	// variants of exported enums.
+	Exports []*ast.Ident
+
+	// Decls maps every identifier bound to a name declared by the program,
+	// declarations included, to the identifier declaring the name.
+	// Identifiers of builtins are left out.
+	Decls map[*ast.Ident]*ast.Ident
+
+	// Shadows maps the declarations of names that shadow a name of an
+	// enclosing scope to the declaration they shadow.
+	Shadows map[*ast.Ident]*ast.Ident
+}
+
+type Error struct {
+	Pos token.Pos
+	Msg string
+}
+
+func (x *Error) Error() string {
+	return x.Msg
+}
+
+// ErrorList is returned by [Resolve] and holds all errors found in a program.
+type ErrorList []*Error
+
+func (x ErrorList) Error() string {
+	msgs := make([]string, len(x))
+	for i, err := range x {
+		msgs[i] = err.Msg
+	}
+	return strings.Join(msgs, "\n")
+}
+
+type symbol struct {
+	name     string
+	decl     *ast.Ident
+	binding  Binding
+	defined  bool         // false until the declaring statement has been resolved
+	constant bool         // declared by a const statement
+	variant  *ast.Variant // set if the symbol is declared by an enum variant
+}
+
+type scope struct {
+	parent *scope
+	fn     *function // nil for the top level
+	names  map[string]*symbol
+
+	// pending are the functions declared in this scope or its blocks
+	// whose bodies are resolved once the scope is complete, so that they
+	// can refer to names declared after them. Only the outermost scope of
+	// a function or the top level has pending functions.
+	pending []pending
+
+	// unresolved are the uses of names not declared at the time. They are
+	// reported once the scope is complete, depending on whether the name
+	// was declared later on.
+	unresolved []unresolved
+}
+
+type pending struct {
+	fn       *ast.Function
+	receiver *ast.Ident // nil unless fn is the function of a method
+	scope    *scope     // the scope fn is declared in
+}
+
+type unresolved struct {
+	ident  *ast.Ident
+	assign bool
+}
+
+type function struct {
+	parent   *function
+	info     *Function
+	upvalues map[*symbol]int
+}
+
+type resolver struct {
+	info     *Info
+	builtins map[string]bool
+	errs     ErrorList
+	enums    map[*ast.Variant]*ast.EnumStmt
+
+	scope     *scope
+	exporting bool // names declared at the top level now are exported
+}
+
+// Resolve resolves all identifiers in node. Names that are not declared by
+// the program are looked up in builtins. If node has errors, Resolve returns
+// an [ErrorList] along with the info gathered anyway, which covers the
+// identifiers that could be resolved; tools such as editors use it.
+func Resolve(node ast.Node, builtins []string) (*Info, error) {
+	r := &resolver{
+		info: &Info{
+			Idents:    make(map[*ast.Ident]Binding),
+			Functions: make(map[*ast.Function]*Function),
+			TailCalls: make(map[*ast.Call]bool),
+			Variants:  make(map[*ast.Ident]*ast.Variant),
+			Decls:     make(map[*ast.Ident]*ast.Ident),
+			Shadows:   make(map[*ast.Ident]*ast.Ident),
+		},
+		builtins: make(map[string]bool),
+		enums:    make(map[*ast.Variant]*ast.EnumStmt),
+	}
+	for _, name := range builtins {
+		r.builtins[name] = true
+	}
+
+	r.scope = &scope{names: make(map[string]*symbol)}
+	switch node := node.(type) {
+	case *ast.Program:
+		r.stmts(node.Stmts)
+	case ast.Stmt:
+		r.stmt(node)
+	case ast.Expr:
+		r.expr(node)
+	}
+	r.closeScope()
+
+	if len(r.errs) > 0 {
+		return r.info, r.errs
+	}
+	return r.info, nil
+}
+
+func (r *resolver) stmts(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		r.stmt(stmt)
+	}
+}
+
+func (r *resolver) stmt(stmt ast.Stmt) {
+	switch stmt := stmt.(type) {
+	case *ast.LetStmt:
+		var syms []*symbol
+		if stmt.Pattern != nil {
+			syms = r.pattern(stmt.Pattern, nil)
+		} else {
+			syms = append(syms, r.declare(stmt.Ident))
+		}
+		r.expr(stmt.Expr)
+		define(syms)
+		for _, sym := range syms {
+			if sym != nil {
+				sym.constant = stmt.Const
+			}
+		}
+	case *ast.ReturnStmt:
+		r.expr(stmt.Expr)
+	case *ast.ThrowStmt:
+		r.expr(stmt.Expr)
+	case *ast.StructStmt:
+		if sym := r.declare(stmt.Name); sym != nil {
+			sym.defined = true
+		}
+	case *ast.EnumStmt:
+		if sym := r.declare(stmt.Name); sym != nil {
+			sym.defined = true
+		}
+		for _, variant := range stmt.Variants {
+			r.enums[variant] = stmt
+			if sym := r.declare(variant.Name); sym != nil {
+				sym.defined = true
+				sym.variant = variant
+			}
+		}
+	case *ast.ImportStmt:
+		if !r.topLevel() {
+			r.errorf(stmt.Pos(), "import of '%v' must be at the top level", stmt.Path.Value)
+		}
+		if sym := r.declare(stmt.Name); sym != nil {
+			sym.defined = true
+		}
+	case *ast.ExportStmt:
+		if !r.topLevel() {
+			r.errorf(stmt.Pos(), "export must be at the top level")
+		}
+		r.exporting = true
+		r.stmt(stmt.Stmt)
+		r.exporting = false
+	case *ast.MethodStmt:
+		r.use(stmt.Type)
+		r.later(pending{fn: stmt.Function, receiver: stmt.Receiver})
+	case *ast.ExprStmt:
+		r.expr(stmt.Expr)
+	case *ast.BlockStmt:
+		r.openScope()
+		r.stmts(stmt.Stmts)
+		r.closeScope()
+	}
+}
+
+func (r *resolver) expr(expr ast.Expr) {
+	switch expr := expr.(type) {
+	case *ast.Ident:
+		r.use(expr)
+	case *ast.UnaryOp:
+		r.expr(expr.Rhs)
+	case *ast.BinaryOp:
+		r.expr(expr.Left)
+		r.expr(expr.Right)
+	case *ast.If:
+		r.expr(expr.Condition)
+		r.stmt(expr.Consequence)
+		if expr.Alternative != nil {
+			r.stmt(expr.Alternative)
+		}
+	case *ast.Function:
+		r.later(pending{fn: expr})
+	case *ast.Call:
+		r.expr(expr.Lhs)
+		for _, arg := range expr.Args {
+			r.expr(arg)
+		}
+	case *ast.Assignment:
+		r.expr(expr.Expr)
+		r.assign(expr.Ident)
+	case *ast.Selector:
+		r.expr(expr.Expr)
+	case *ast.Propagate:
+		r.expr(expr.Expr)
+	case *ast.FieldAssignment:
+		r.expr(expr.Expr)
+		r.expr(expr.Target.Expr)
+	case *ast.IndexAssignment:
+		r.expr(expr.Expr)
+		r.expr(expr.Target.Expr)
+		r.expr(expr.Target.Index)
+	case *ast.StructLit:
+		r.use(expr.Type)
+		for _, field := range expr.Fields {
+			r.expr(field.Value)
+		}
+	case *ast.ArrayLit:
+		for _, elem := range expr.Elems {
+			r.expr(elem)
+		}
+	case *ast.Index:
+		r.expr(expr.Expr)
+		r.expr(expr.Index)
+	case *ast.Try:
+		r.try(expr)
+	case *ast.Match:
+		r.match(expr)
+	}
+}
+
+// topLevel reports whether the current scope is the top level of the
+// program.
+func (r *resolver) topLevel() bool {
+	return r.scope.parent == nil
+}
+
+// later defers resolving the function of p until the outermost scope of
+// the current function or the top level is complete.
+func (r *resolver) later(p pending) {
+	p.scope = r.scope
+	root := r.scope
+	for root.parent != nil && root.parent.fn == root.fn {
+		root = root.parent
+	}
+	root.pending = append(root.pending, p)
+}
+
+// openScope enters a scope nested in the current function, such as the
+// scope of a block.
+func (r *resolver) openScope() {
+	r.scope = &scope{parent: r.scope, fn: r.scope.fn, names: make(map[string]*symbol)}
+}
+
+// try resolves a try expression. The catch clause gets a scope of its own
+// so that its parameter is only visible inside of it.
+func (r *resolver) try(node *ast.Try) {
+	r.stmt(node.Body)
+	if node.Catch != nil {
+		r.openScope()
+		if sym := r.declare(node.Param); sym != nil {
+			sym.defined = true
+		}
+		r.stmts(node.Catch.Stmts)
+		r.closeScope()
+	}
+	if node.Finally != nil {
+		r.stmt(node.Finally)
+	}
+}
+
+// match resolves a match expression. Every arm gets a scope of its own for
+// the bindings of its pattern.
+func (r *resolver) match(node *ast.Match) {
+	r.expr(node.Subject)
+	for _, arm := range node.Arms {
+		r.openScope()
+		define(r.pattern(arm.Pattern, nil))
+		if block, ok := arm.Body.(*ast.BlockStmt); ok {
+			r.stmts(block.Stmts)
+		} else {
+			r.stmt(arm.Body)
+		}
+		r.closeScope()
+	}
+	r.exhaustive(node)
+}
+
+// pattern resolves the names used by pattern and declares its bindings,
+// which it appends to syms. The bindings are not defined yet, see [define].
+func (r *resolver) pattern(pattern ast.Pattern, syms []*symbol) []*symbol {
+	switch p := pattern.(type) {
+	case *ast.IdentPattern:
+		sym := r.find(p.Ident.Value)
+		if sym == nil || sym.variant == nil {
+			return append(syms, r.declare(p.Ident))
+		}
+		if sym.variant.Fields != nil {
+			r.errorf(p.Ident.Pos(), "variant '%v' has fields, match it with '%v(...)'", p.Ident.Value, p.Ident.Value)
+		}
+		r.use(p.Ident)
+		r.info.Variants[p.Ident] = sym.variant
+	case *ast.ConstructorPattern:
+		sym := r.find(p.Name.Value)
+		switch {
+		case sym == nil || sym.variant == nil || sym.variant.Fields == nil:
+			r.errorf(p.Name.Pos(), "'%v' is not an enum variant with fields", p.Name.Value)
+		case len(p.Args) != len(sym.variant.Fields):
+			r.errorf(p.Name.Pos(), "pattern '%v' takes %v field(s), got %v", p.Name.Value, len(sym.variant.Fields), len(p.Args))
+		default:
+			r.use(p.Name)
+			r.info.Variants[p.Name] = sym.variant
+		}
+		for _, arg := range p.Args {
+			syms = r.pattern(arg, syms)
+		}
+	case *ast.ArrayPattern:
+		for _, elem := range p.Elems {
+			syms = r.pattern(elem, syms)
+		}
+	case *ast.ObjectPattern:
+		for _, field := range p.Fields {
+			syms = r.pattern(field.Pattern, syms)
+		}
+	}
+	return syms
+}
+
+// define marks the symbols declared by a statement as defined. Symbols that
+// could not be declared are nil.
+func define(syms []*symbol) {
+	for _, sym := range syms {
+		if sym != nil {
+			sym.defined = true
+		}
+	}
+}
+
+// exhaustive reports a match whose arms name the variants of an enum if it
+// neither covers all of them nor has an arm matching any value.
+func (r *resolver) exhaustive(node *ast.Match) {
+	var enum *ast.EnumStmt
+	covered := make(map[*ast.Variant]bool)
+	for _, arm := range node.Arms {
+		if r.irrefutable(arm.Pattern) {
+			return
+		}
+
+		var (
+			variant *ast.Variant
+			all     bool // the arm matches every value of the variant
+		)
+		switch p := arm.Pattern.(type) {
+		case *ast.IdentPattern:
+			variant, all = r.info.Variants[p.Ident], true
+		case *ast.ConstructorPattern:
+			variant, all = r.info.Variants[p.Name], true
+			for _, arg := range p.Args {
+				all = all && r.irrefutable(arg)
+			}
+		}
+		if variant == nil {
+			continue
+		}
+		enum = r.enums[variant]
+		covered[variant] = covered[variant] || all
+	}
+	if enum == nil {
+		return
+	}
+
+	var missing []string
+	for _, variant := range enum.Variants {
+		if !covered[variant] {
+			missing = append(missing, variant.Name.Value)
+		}
+	}
+	if len(missing) > 0 {
+		r.errorf(node.Pos(), "match on '%v' is not exhaustive, missing %v", enum.Name.Value, strings.Join(missing, ", "))
+	}
+}
+
+// irrefutable reports whether pattern matches any value.
+func (r *resolver) irrefutable(pattern ast.Pattern) bool {
+	switch p := pattern.(type) {
+	case *ast.WildcardPattern:
+		return true
+	case *ast.IdentPattern:
+		return r.info.Variants[p.Ident] == nil
+	}
+	return false
+}
+
+// function resolves the body of node. The receiver of a method is its
+// first local, followed by the parameters. A destructured parameter gets a
+// hidden local holding the argument, its bindings follow the parameters.
+func (r *resolver) function(node *ast.Function, receiver *ast.Ident) {
+	fn := &function{
+		info:     &Function{},
+		upvalues: make(map[*symbol]int),
+	}
+	if r.scope.fn != nil {
+		fn.parent = r.scope.fn
+	}
+	r.info.Functions[node] = fn.info
+
+	r.scope = &scope{parent: r.scope, fn: fn, names: make(map[string]*symbol)}
+	if receiver != nil {
+		if sym := r.declare(receiver); sym != nil {
+			sym.defined = true
+		}
+	}
+	var destructured []ast.Pattern
+	for i, param := range node.Params {
+		if param, ok := param.(*ast.IdentPattern); ok {
+			if sym := r.declare(param.Ident); sym != nil {
+				sym.defined = true
+			}
+			continue
+		}
+		fn.info.Locals = append(fn.info.Locals, fmt.Sprintf("[param %v]", i))
+		destructured = append(destructured, param)
+	}
+	for _, param := range destructured {
+		define(r.pattern(param, nil))
+	}
+	r.stmts(node.Body.Stmts)
+	r.tailStmts(node.Body.Stmts, true)
+	r.closeScope()
+}
+
+// tailStmts marks the tail calls in stmts, a statement list whose return
+// statements leave the function. If last is set, the value of the last
+// statement is the value of the function as well.
+func (r *resolver) tailStmts(stmts []ast.Stmt, last bool) {
+	for i, stmt := range stmts {
+		switch stmt := stmt.(type) {
+		case *ast.ReturnStmt:
+			r.tailExpr(stmt.Expr)
+		case *ast.ExprStmt:
+			if last && i == len(stmts)-1 {
+				r.tailExpr(stmt.Expr)
+			} else if ifExpr, ok := stmt.Expr.(*ast.If); ok {
+				r.tailBranches(ifExpr, false)
+			} else if match, ok := stmt.Expr.(*ast.Match); ok {
+				r.tailArms(match, false)
+			}
+		}
+	}
+}
+
+func (r *resolver) tailExpr(expr ast.Expr) {
+	switch expr := expr.(type) {
+	case *ast.Call:
+		r.info.TailCalls[expr] = true
+	case *ast.If:
+		r.tailBranches(expr, true)
+	case *ast.Match:
+		r.tailArms(expr, true)
+	}
+}
+
+func (r *resolver) tailArms(expr *ast.Match, last bool) {
+	for _, arm := range expr.Arms {
+		switch body := arm.Body.(type) {
+		case *ast.BlockStmt:
+			r.tailStmts(body.Stmts, last)
+		case *ast.ExprStmt:
+			r.tailStmts([]ast.Stmt{body}, last)
+		}
+	}
+}
+
+func (r *resolver) tailBranches(expr *ast.If, last bool) {
+	r.tailStmts(expr.Consequence.Stmts, last)
+	if expr.Alternative != nil {
+		r.tailStmts(expr.Alternative.Stmts, last)
+	}
+}
+
+// closeScope resolves the functions pending in the current scope and then
+// leaves it.
+func (r *resolver) closeScope() {
+	for current := r.scope; len(current.pending) > 0; {
+		p := current.pending[0]
+		current.pending = current.pending[1:]
+		r.scope = p.scope
+		r.function(p.fn, p.receiver)
+		r.scope = current
+	}
+
+	for _, u := range r.scope.unresolved {
+		name := u.ident.Value
+		switch {
+		case r.scope.names[name] != nil && u.assign:
+			r.errorf(u.ident.Pos(), "'%v' assigned before definition", name)
+		case r.scope.names[name] != nil:
+			r.errorf(u.ident.Pos(), "name '%v' used before definition", name)
+		case r.scope.parent != nil && r.scope.parent.fn == r.scope.fn:
+			r.scope.parent.unresolved = append(r.scope.parent.unresolved, u)
+		case u.assign:
+			r.errorf(u.ident.Pos(), "'%v' is not defined", name)
+		default:
+			r.errorf(u.ident.Pos(), "name '%v' not defined", name)
+		}
+	}
+
+	r.scope = r.scope.parent
+}
+
+// declare adds ident to the current scope. It returns nil if ident is
+// already declared in it.
+func (r *resolver) declare(ident *ast.Ident) *symbol {
+	if _, ok := r.scope.names[ident.Value]; ok {
+		r.errorf(ident.Pos(), "'%v' already defined", ident.Value)
+		return nil
+	}
+	if outer := r.find(ident.Value); outer != nil {
+		r.info.Shadows[ident] = outer.decl
+	}
+
+	var binding Binding
+	if fn := r.scope.fn; fn != nil {
+		binding = Binding{Kind: Local, Index: len(fn.info.Locals)}
+		fn.info.Locals = append(fn.info.Locals, ident.Value)
+	} else {
+		binding = Binding{Kind: Global, Index: len(r.info.Globals)}
+		r.info.Globals = append(r.info.Globals, ident.Value)
+	}
+
+	sym := &symbol{name: ident.Value, decl: ident, binding: binding}
+	r.scope.names[ident.Value] = sym
+	r.info.Idents[ident] = binding
+	r.info.Decls[ident] = ident
+	if r.exporting && r.topLevel() {
+		r.info.Exports = append(r.info.Exports, ident)
+	}
+	return sym
+}
+
+// find returns the symbol name refers to in the current scope, or nil if
+// there is none.
+func (r *resolver) find(name string) *symbol {
+	for s := r.scope; s != nil; s = s.parent {
+		if sym, ok := s.names[name]; ok {
+			return sym
+		}
+	}
+	return nil
+}
+
+func (r *resolver) use(ident *ast.Ident) {
+	binding, ok := r.lookup(ident, "name '%v' used before definition")
+	if !ok {
+		if !r.builtins[ident.Value] {
+			r.scope.unresolved = append(r.scope.unresolved, unresolved{ident: ident})
+			return
+		}
+		binding = Binding{Kind: Builtin}
+	}
+	r.info.Idents[ident] = binding
+}
+
+func (r *resolver) assign(ident *ast.Ident) {
+	if sym := r.find(ident.Value); sym != nil && sym.constant {
+		r.errorf(ident.Pos(), "cannot assign to constant '%v'", ident.Value)
+		r.info.Decls[ident] = sym.decl
+		return
+	}
+	binding, ok := r.lookup(ident, "'%v' assigned before definition")
+	if !ok {
+		r.scope.unresolved = append(r.scope.unresolved, unresolved{ident: ident, assign: true})
+		return
+	}
+	r.info.Idents[ident] = binding
+}
+
+// lookup finds the binding of the name of ident as seen from the current
+// scope and records its declaration. Names of the current function and, at
+// the top level, globals must be defined before they are used. Functions
+// may refer to any name of their enclosing scopes since they run after
+// those have been set up.
+func (r *resolver) lookup(ident *ast.Ident, undefinedFormat string) (Binding, bool) {
+	name := ident.Value
+	crossed := false
+	for s := r.scope; s != nil; s = s.parent {
+		if s.fn != r.scope.fn {
+			crossed = true
+		}
+
+		sym, ok := s.names[name]
+		if !ok {
+			continue
+		}
+
+		if !crossed && !sym.defined {
+			r.errorf(ident.Pos(), undefinedFormat, name)
+		}
+		r.info.Decls[ident] = sym.decl
+		if !crossed || sym.binding.Kind == Global {
+			return sym.binding, true
+		}
+		return Binding{Kind: Upvalue, Index: r.capture(r.scope.fn, sym, s.fn)}, true
+	}
+	return Binding{}, false
+}
+
+// capture returns the upvalue index of sym, a local of owner, in fn and in
+// all functions between fn and owner.
+func (r *resolver) capture(fn *function, sym *symbol, owner *function) int {
+	if idx, ok := fn.upvalues[sym]; ok {
+		return idx
+	}
+
+	var c Capture
+	if fn.parent == owner {
+		c = Capture{Local: true, Index: sym.binding.Index, Name: sym.name}
+	} else {
+		c = Capture{Local: false, Index: r.capture(fn.parent, sym, owner), Name: sym.name}
+	}
+
+	fn.info.Upvalues = append(fn.info.Upvalues, c)
+	idx := len(fn.info.Upvalues) - 1
+	fn.upvalues[sym] = idx
+	return idx
+}
+
+func (r *resolver) errorf(pos token.Pos, format string, args ...any) {
+	r.errs = append(r.errs, &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,513 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+	"github.com/tombuente/lily/token"
+)
+
+type binding struct {
+	name    string
+	binding Binding
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		expected []binding // in order of appearance, definitions included
+	}{
+		{
+			src: "let x = 1; x",
+			expected: []binding{
+				{"x", Binding{Kind: Global, Index: 0}},
+				{"x", Binding{Kind: Global, Index: 0}},
+			},
+		},
+		{
+			src: `len("a")`,
+			expected: []binding{
+				{"len", Binding{Kind: Builtin}},
+			},
+		},
+		{
+			name: "params and locals",
+			src:  "let f = fn(a, b) { let c = a; b; c }",
+			expected: []binding{
+				{"f", Binding{Kind: Global, Index: 0}},
+				{"a", Binding{Kind: Local, Index: 0}},
+				{"b", Binding{Kind: Local, Index: 1}},
+				{"c", Binding{Kind: Local, Index: 2}},
+				{"a", Binding{Kind: Local, Index: 0}},
+				{"b", Binding{Kind: Local, Index: 1}},
+				{"c", Binding{Kind: Local, Index: 2}},
+			},
+		},
+		{
+			name: "upvalues",
+			src:  "fn(a, b) { fn() { fn() { b + a } } }",
+			expected: []binding{
+				{"a", Binding{Kind: Local, Index: 0}},
+				{"b", Binding{Kind: Local, Index: 1}},
+				{"b", Binding{Kind: Upvalue, Index: 0}},
+				{"a", Binding{Kind: Upvalue, Index: 1}},
+			},
+		},
+		{
+			name: "parameter shadows global",
+			src:  "let x = 1; fn(x) { x }",
+			expected: []binding{
+				{"x", Binding{Kind: Global, Index: 0}},
+				{"x", Binding{Kind: Local, Index: 0}},
+				{"x", Binding{Kind: Local, Index: 0}},
+			},
+		},
+		{
+			name: "forward reference from function",
+			src:  "let f = fn() { g() }; let g = fn() { 1 }",
+			expected: []binding{
+				{"f", Binding{Kind: Global, Index: 0}},
+				{"g", Binding{Kind: Global, Index: 1}},
+				{"g", Binding{Kind: Global, Index: 1}},
+			},
+		},
+		{
+			name: "global overrides builtin",
+			src:  "let len = 1; len",
+			expected: []binding{
+				{"len", Binding{Kind: Global, Index: 0}},
+				{"len", Binding{Kind: Global, Index: 0}},
+			},
+		},
+		{
+			name: "match",
+			src:  "enum E { A(x), B }; let f = fn(e) { match e { A(v) => v, B => 0 } }",
+			expected: []binding{
+				{"E", Binding{Kind: Global, Index: 0}},
+				{"A", Binding{Kind: Global, Index: 1}},
+				{"B", Binding{Kind: Global, Index: 2}},
+				{"f", Binding{Kind: Global, Index: 3}},
+				{"e", Binding{Kind: Local, Index: 0}},
+				{"e", Binding{Kind: Local, Index: 0}},
+				{"A", Binding{Kind: Global, Index: 1}},
+				{"v", Binding{Kind: Local, Index: 1}},
+				{"v", Binding{Kind: Local, Index: 1}},
+				{"B", Binding{Kind: Global, Index: 2}},
+			},
+		},
+		{
+			name: "struct and method",
+			src:  "struct P { x }; fn (p P) get(k) { p.x + k }; P{x: 1}",
+			expected: []binding{
+				{"P", Binding{Kind: Global, Index: 0}},
+				{"P", Binding{Kind: Global, Index: 0}},
+				{"p", Binding{Kind: Local, Index: 0}},
+				{"k", Binding{Kind: Local, Index: 1}},
+				{"p", Binding{Kind: Local, Index: 0}},
+				{"k", Binding{Kind: Local, Index: 1}},
+				{"P", Binding{Kind: Global, Index: 0}},
+			},
+		},
+		{
+			name: "destructuring",
+			src:  "let [a, {b}] = [1, 2]; fn(x, [y, _], z) { y }",
+			expected: []binding{
+				{"a", Binding{Kind: Global, Index: 0}},
+				{"b", Binding{Kind: Global, Index: 1}},
+				{"x", Binding{Kind: Local, Index: 0}},
+				{"y", Binding{Kind: Local, Index: 3}},
+				{"z", Binding{Kind: Local, Index: 2}},
+				{"y", Binding{Kind: Local, Index: 3}},
+			},
+		},
+		{
+			name: "block scope",
+			src:  "let x = 1; if x { let x = 2; x } { let y = x; y }; x",
+			expected: []binding{
+				{"x", Binding{Kind: Global, Index: 0}},
+				{"x", Binding{Kind: Global, Index: 0}},
+				{"x", Binding{Kind: Global, Index: 1}},
+				{"x", Binding{Kind: Global, Index: 1}},
+				{"y", Binding{Kind: Global, Index: 2}},
+				{"x", Binding{Kind: Global, Index: 0}},
+				{"y", Binding{Kind: Global, Index: 2}},
+				{"x", Binding{Kind: Global, Index: 0}},
+			},
+		},
+		{
+			name: "function in block",
+			src:  "fn(a) { if a { let f = fn() { a + b }; f() }; let b = 1 }",
+			expected: []binding{
+				{"a", Binding{Kind: Local, Index: 0}},
+				{"a", Binding{Kind: Local, Index: 0}},
+				{"f", Binding{Kind: Local, Index: 1}},
+				{"a", Binding{Kind: Upvalue, Index: 0}},
+				{"b", Binding{Kind: Upvalue, Index: 1}},
+				{"f", Binding{Kind: Local, Index: 1}},
+				{"b", Binding{Kind: Local, Index: 2}},
+			},
+		},
+		{
+			name: "import",
+			src:  `import "lib" as lib; lib`,
+			expected: []binding{
+				{"lib", Binding{Kind: Global, Index: 0}},
+				{"lib", Binding{Kind: Global, Index: 0}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.name
+		if name == "" {
+			name = tt.src
+		}
+		t.Run(name, func(t *testing.T) {
+			prog := parse(t, tt.src)
+			info, err := Resolve(prog, []string{"len"})
+			if err != nil {
+				t.Fatalf("Failed to resolve: %v", err)
+			}
+
+			var actual []binding
+			for _, ident := range idents(prog) {
+				actual = append(actual, binding{ident.Value, info.Idents[ident]})
+			}
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("want=%v, got=%v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestCaptures(t *testing.T) {
+	prog := parse(t, "fn(a, b) { fn() { fn() { b + a } } }")
+	info, err := Resolve(prog, nil)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	outer := prog.Stmts[0].(*ast.ExprStmt).Expr.(*ast.Function)
+	middle := outer.Body.Stmts[0].(*ast.ExprStmt).Expr.(*ast.Function)
+	inner := middle.Body.Stmts[0].(*ast.ExprStmt).Expr.(*ast.Function)
+
+	expected := []Capture{{Local: true, Index: 1, Name: "b"}, {Local: true, Index: 0, Name: "a"}}
+	if actual := info.Functions[middle].Upvalues; !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("want=%v, got=%v", expected, actual)
+	}
+	expected = []Capture{{Local: false, Index: 0, Name: "b"}, {Local: false, Index: 1, Name: "a"}}
+	if actual := info.Functions[inner].Upvalues; !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("want=%v, got=%v", expected, actual)
+	}
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected []string // callee names of the tail calls
+	}{
+		{src: "f()", expected: nil},
+		{src: "fn() { f() }", expected: []string{"f"}},
+		{src: "fn() { f(); g() }", expected: []string{"g"}},
+		{src: "fn() { f() + 1 }", expected: nil},
+		{src: "fn() { g(f()) }", expected: []string{"g"}},
+		{src: "fn() { return f(); g() }", expected: []string{"f", "g"}},
+		{src: "fn() { if (c) { f() } { g() } }", expected: []string{"f", "g"}},
+		{src: "fn() { if (c) { f() }; g() }", expected: []string{"g"}},
+		{src: "fn() { if (c) { return f() }; g() }", expected: []string{"f", "g"}},
+		{src: "fn() { let x = f(); x }", expected: nil},
+		{src: "fn() { fn() { f() } }", expected: []string{"f"}},
+		{src: "fn() { match c { 1 => f(), _ => { g() } } }", expected: []string{"f", "g"}},
+		{src: "fn() { match c { 1 => f(), _ => { return g() } }; 1 }", expected: []string{"g"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			info, err := Resolve(parse(t, tt.src), []string{"f", "g", "c"})
+			if err != nil {
+				t.Fatalf("Failed to resolve: %v", err)
+			}
+
+			var actual []string
+			for call := range info.TailCalls {
+				actual = append(actual, call.Lhs.(*ast.Ident).Value)
+			}
+			slices.Sort(actual)
+			if !reflect.DeepEqual(actual, tt.expected) {
+				t.Fatalf("want=%v, got=%v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestExports(t *testing.T) {
+	prog := parse(t, "export let a = 1; let b = 2; export let [c, d] = [b, a]; export enum E { X, Y(v) }; export let f = match a { z => z }")
+	info, err := Resolve(prog, nil)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	var names []string
+	for _, ident := range info.Exports {
+		names = append(names, ident.Value)
+	}
+	expected := []string{"a", "c", "d", "E", "X", "Y", "f"}
+	if !slices.Equal(names, expected) {
+		t.Fatalf("want=%v, got=%v", expected, names)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{src: "x", expected: "name 'x' not defined"},
+		{src: "x = 1", expected: "'x' is not defined"},
+		{src: "let x = 1; let x = 2", expected: "'x' already defined"},
+		{src: "fn(x, x) { x }", expected: "'x' already defined"},
+		{src: "x; let x = 1", expected: "name 'x' used before definition"},
+		{src: "let x = x", expected: "name 'x' used before definition"},
+		{src: "let [a, b] = [a, 1]", expected: "name 'a' used before definition"},
+		{src: "fn(x, [x]) { x }", expected: "'x' already defined"},
+		{src: "fn() { x = 1; let x = 2 }", expected: "'x' assigned before definition"},
+		{src: "fn() { y }", expected: "name 'y' not defined"},
+		{src: "try { 1 } catch (e) { e }; e", expected: "name 'e' not defined"},
+		{src: "fn (p P) f() { p }", expected: "name 'P' not defined"},
+		{src: "struct P { x }; struct P { y }", expected: "'P' already defined"},
+		{src: "enum E { A, B(x), C }; match A { A => 1, B(1) => 2 }", expected: "match on 'E' is not exhaustive, missing B, C"},
+		{src: "enum E { A(x) }; match 1 { A => 1 }", expected: "variant 'A' has fields, match it with 'A(...)'"},
+		{src: "match 1 { A(x) => 1 }", expected: "'A' is not an enum variant with fields"},
+		{src: "enum E { A(x) }; match 1 { A(x, y) => 1 }", expected: "pattern 'A' takes 1 field(s), got 2"},
+		{src: "enum E { A(x, y) }; match 1 { A(v, v) => 1 }", expected: "'v' already defined"},
+		{src: "try { 1 } catch (e) { 2 }; try { 1 } catch (e) { 2 }; let e = 1; e = e.kind; let e = 2", expected: "'e' already defined"},
+		{src: `fn() { import "a" as a }`, expected: "import of 'a' must be at the top level"},
+		{src: `fn() { export let x = 1 }`, expected: "export must be at the top level"},
+		{src: "if true { let x = 1 }; x", expected: "name 'x' not defined"},
+		{src: "fn() { if true { let x = 1; let x = 2 } }", expected: "'x' already defined"},
+		{src: "if true { x }; let x = 1", expected: "name 'x' used before definition"},
+		{src: "let x = 1; if true { let x = x + 1 }", expected: "name 'x' used before definition"},
+		{src: "if true { import \"a\" as a }", expected: "import of 'a' must be at the top level"},
+		{src: "const x = 1; x = 2", expected: "cannot assign to constant 'x'"},
+		{src: "const x = 1; fn() { fn() { x = 2 } }", expected: "cannot assign to constant 'x'"},
+		{src: "const {a} = b; a = 1; let b = 1", expected: "cannot assign to constant 'a'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := Resolve(parse(t, tt.src), nil)
+			var errs ErrorList
+			if !errors.As(err, &errs) {
+				t.Fatalf("want ErrorList, got=%v", err)
+			}
+			if errs[0].Msg != tt.expected {
+				t.Fatalf("want=%q, got=%q", tt.expected, errs[0].Msg)
+			}
+		})
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected token.Pos
+	}{
+		{src: "let a = 1;\nlet b = c", expected: token.Pos{Line: 2, Column: 9}},
+		{src: "let a = 1; let a = 2", expected: token.Pos{Line: 1, Column: 16}},
+		{src: "fn() {\n\tx = 1;\n\tlet x = 2\n}", expected: token.Pos{Line: 2, Column: 2}},
+		{src: "enum E { A, B }; match A {\n  A => 1 }", expected: token.Pos{Line: 1, Column: 18}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := Resolve(parse(t, tt.src), nil)
+			var errs ErrorList
+			if !errors.As(err, &errs) {
+				t.Fatalf("want ErrorList, got=%v", err)
+			}
+			if errs[0].Pos != tt.expected {
+				t.Fatalf("want=%v, got=%v", tt.expected, errs[0].Pos)
+			}
+		})
+	}
+}
+
+func TestDecls(t *testing.T) {
+	src := `struct P { x };
+enum E { A, B(v) };
+let f = fn(n) { let m = n; m = g(n); P{x: m} };
+let g = fn(k) { match k { A => len(k), B(w) => w } }`
+	prog := parse(t, src)
+	info, err := Resolve(prog, []string{"len"})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	// Every bound identifier is listed as name@declaration.
+	var actual []string
+	ast.Inspect(prog, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			if decl, ok := info.Decls[ident]; ok {
+				actual = append(actual, fmt.Sprintf("%v@%v", ident.Value, decl.Pos()))
+			} else {
+				actual = append(actual, ident.Value+"@-")
+			}
+		}
+		return true
+	})
+
+	expected := []string{
+		"P@1:8", "x@-", // struct fields are not bound
+		"E@2:6", "A@2:10", "B@2:13", "v@-",
+		"f@3:5", "n@3:12", "m@3:21", "n@3:12", "m@3:21", "g@4:5", "n@3:12", "P@1:8", "x@-", "m@3:21",
+		"g@4:5", "k@4:12", "k@4:12", "A@2:10", "len@-", "k@4:12", "B@2:13", "w@4:42", "w@4:42",
+	}
+	if !slices.Equal(actual, expected) {
+		t.Fatalf("want=%v,\ngot=%v", expected, actual)
+	}
+}
+
+func TestShadows(t *testing.T) {
+	src := `let x = 1;
+let f = fn(x) { let y = x; if true { let y = 2; y } };
+match x { x => x, _ => 0 };
+let g = fn(z) { try { z } catch (x) { x } }`
+	prog := parse(t, src)
+	info, err := Resolve(prog, nil)
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	var actual []string
+	ast.Inspect(prog, func(node ast.Node) bool {
+		if ident, ok := node.(*ast.Ident); ok {
+			if outer, ok := info.Shadows[ident]; ok {
+				actual = append(actual, fmt.Sprintf("%v@%v:%v", ident.Value, ident.Pos(), outer.Pos()))
+			}
+		}
+		return true
+	})
+
+	expected := []string{"x@2:12:1:5", "y@2:42:2:21", "x@3:11:1:5", "x@4:34:1:5"}
+	if !slices.Equal(actual, expected) {
+		t.Fatalf("want=%v, got=%v", expected, actual)
+	}
+}
+
+func parse(t *testing.T, src string) *ast.Program {
+	t.Helper()
+	prog, err := parser.New(lexer.New(src)).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse program: %v", err)
+	}
+	return prog
+}
+
+// idents returns all identifiers of node in source order.
+func idents(node ast.Node) []*ast.Ident {
+	var out []*ast.Ident
+	switch node := node.(type) {
+	case *ast.Program:
+		for _, stmt := range node.Stmts {
+			out = append(out, idents(stmt)...)
+		}
+	case *ast.BlockStmt:
+		for _, stmt := range node.Stmts {
+			out = append(out, idents(stmt)...)
+		}
+	case *ast.LetStmt:
+		if node.Pattern != nil {
+			out = append(out, idents(node.Pattern)...)
+		} else {
+			out = append(out, node.Ident)
+		}
+		out = append(out, idents(node.Expr)...)
+	case *ast.ReturnStmt:
+		out = append(out, idents(node.Expr)...)
+	case *ast.ExprStmt:
+		out = append(out, idents(node.Expr)...)
+	case *ast.Ident:
+		out = append(out, node)
+	case *ast.UnaryOp:
+		out = append(out, idents(node.Rhs)...)
+	case *ast.BinaryOp:
+		out = append(out, idents(node.Left)...)
+		out = append(out, idents(node.Right)...)
+	case *ast.If:
+		out = append(out, idents(node.Condition)...)
+		out = append(out, idents(node.Consequence)...)
+		if node.Alternative != nil {
+			out = append(out, idents(node.Alternative)...)
+		}
+	case *ast.Function:
+		for _, param := range node.Params {
+			out = append(out, idents(param)...)
+		}
+		out = append(out, idents(node.Body)...)
+	case *ast.Call:
+		out = append(out, idents(node.Lhs)...)
+		for _, arg := range node.Args {
+			out = append(out, idents(arg)...)
+		}
+	case *ast.Assignment:
+		out = append(out, node.Ident)
+		out = append(out, idents(node.Expr)...)
+	case *ast.ImportStmt:
+		out = append(out, node.Name)
+	case *ast.ExportStmt:
+		out = append(out, idents(node.Stmt)...)
+	case *ast.StructStmt:
+		out = append(out, node.Name)
+	case *ast.EnumStmt:
+		out = append(out, node.Name)
+		for _, variant := range node.Variants {
+			out = append(out, variant.Name)
+		}
+	case *ast.Match:
+		out = append(out, idents(node.Subject)...)
+		for _, arm := range node.Arms {
+			out = append(out, idents(arm.Pattern)...)
+			out = append(out, idents(arm.Body)...)
+		}
+	case *ast.IdentPattern:
+		out = append(out, node.Ident)
+	case *ast.ConstructorPattern:
+		out = append(out, node.Name)
+		for _, arg := range node.Args {
+			out = append(out, idents(arg)...)
+		}
+	case *ast.ArrayPattern:
+		for _, elem := range node.Elems {
+			out = append(out, idents(elem)...)
+		}
+	case *ast.ObjectPattern:
+		for _, field := range node.Fields {
+			out = append(out, idents(field.Pattern)...)
+		}
+	case *ast.ArrayLit:
+		for _, elem := range node.Elems {
+			out = append(out, idents(elem)...)
+		}
+	case *ast.Index:
+		out = append(out, idents(node.Expr)...)
+		out = append(out, idents(node.Index)...)
+	case *ast.MethodStmt:
+		out = append(out, node.Type, node.Receiver)
+		out = append(out, idents(node.Function)...)
+	case *ast.Selector:
+		out = append(out, idents(node.Expr)...)
+	case *ast.StructLit:
+		out = append(out, node.Type)
+		for _, field := range node.Fields {
+			out = append(out, idents(field.Value)...)
+		}
+	}
+	return out
+}
@@ -1,13 +1,19 @@
 package token
 
+import "fmt"
+
 const (
 	Illegal Type = "illegal"
 
 	Semicolon Type = "semicolon"
 	Bang      Type = "exclamation_mark"
+	Question  Type = "?"
 	Comma     Type = ","
+	Colon     Type = ":"
+	Dot       Type = "."
 
 	Assign   Type = "="
+	Arrow    Type = "=>"
 	Minus    Type = "-"
 	Plus     Type = "+"
 	Asterisk Type = "*"
@@ -24,25 +30,60 @@ const (
 	String Type = "string"
 
 	Let    Type = "let"
+	Const  Type = "const"
 	Return Type = "return"
 	If     Type = "if"
 	Fn     Type = "fn"
 
+	Try     Type = "try"
+	Catch   Type = "catch"
+	Finally Type = "finally"
+	Throw   Type = "throw"
+
+	Struct Type = "struct"
+	Enum   Type = "enum"
+	Match  Type = "match"
+
+	Import Type = "import"
+	Export Type = "export"
+	As     Type = "as"
+
 	LParan Type = "("
 	RParan Type = ")"
 	LBrace Type = "{"
 	RBrace Type = "}"
 
+	LBracket Type = "["
+	RBracket Type = "]"
+
+	// Comment is a line comment, which the lexer skips like whitespace
+	// but records, see [lexer.Lexer.Comments].
+	Comment Type = "comment"
+
 	EOF Type = "eof"
 )
 
 var keywords = map[string]Type{
 	"let":    Let,
+	"const":  Const,
 	"return": Return,
 	"if":     If,
 	"true":   True,
 	"false":  False,
 	"fn":     Fn,
+
+	"try":     Try,
+	"catch":   Catch,
+	"finally": Finally,
+	"throw":   Throw,
+
+	"struct": Struct,
+	"enum":   Enum,
+	"match":  Match,
+
+	"import": Import,
+	"export": Export,
+	"as":     As,
 }
 
 type Type string
@@ -50,6 +91,25 @@ type Type string
 type Token struct {
 	Type    Type   `json:"type"`
 	Literal string `json:"literal"`
+	Pos     Pos    `json:"pos"`
+}
+
+// Pos is a position in the source code. Lines and columns start at 1, the
+// zero value is an unknown position.
+type Pos struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	if !p.IsValid() {
+		return "-"
+	}
+	return fmt.Sprintf("%v:%v", p.Line, p.Column)
 }
 
 func LookupLiteral(literal string) Type {
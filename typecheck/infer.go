@@ -0,0 +1,1142 @@
+package typecheck
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/resolver"
+	"github.com/tombuente/lily/token"
+)
+
+// genericLevel is the level of the type variables of polymorphic types,
+// which are replaced by fresh variables wherever the types are used.
+const genericLevel = math.MaxInt
+
+// errorType is the type of the errors caught by try expressions.
+var errorType = &Named{Name: "error"}
+
+type inferer struct {
+	info     *Info
+	resolved *resolver.Info
+	errs     ErrorList
+
+	types map[ast.Expr]Type
+	// defs holds the types of the declared names. The ones of polymorphic
+	// functions hold generic type variables.
+	defs map[*ast.Ident]Type
+	// pending holds the names declared by lets and methods that have not
+	// been inferred yet along with the level of their declaration.
+	pending  map[*ast.Ident]int
+	assigned map[*ast.Ident]bool
+
+	decls    map[*ast.Ident]*typeDecl // by the name of the declaration
+	named    map[string]*typeDecl
+	order    []*typeDecl                  // in source order
+	variants map[*ast.Ident]*ast.Variant  // by the name of the variant
+	funcs    map[*ast.Ident]*ast.Function // functions bound by lets and methods, by name
+
+	level int       // number of enclosing lets whose value is generalized
+	fn    *inferred // the function being inferred, nil at the top level
+}
+
+// typeDecl is a struct or enum declared by the program.
+type typeDecl struct {
+	name    *ast.Ident
+	enum    bool
+	fields  []*ast.Ident          // of the struct, or of all variants of the enum
+	methods map[string]*ast.Ident // names of the methods of a struct
+}
+
+// inferred is a function being inferred.
+type inferred struct {
+	result Type
+	pos    token.Pos // position that determined the result type, if any
+}
+
+// Infer infers the principal types of prog, which info is the result of
+// resolving, by unification. Unlike [Check], it needs no annotations and
+// has no type any: every expression has a single static type and
+// functions are polymorphic in the types they do not depend on. It is
+// therefore stricter than the language, a variable cannot hold an int and
+// later a string.
+//
+// A function bound by a let or declared as a method, which is not
+// assigned elsewhere, is generalized after its declaration and may then be
+// used with different types. Uses before the declaration, which functions
+// declared earlier may contain, all share a single type. Struct and enum
+// types take the types of their fields, P(int) is the type of P{x: 1} for
+// struct P { x }, and ok(1) is of type result(int, 'a). A field selected
+// from a value whose type is not known yet, which no single struct or enum
+// has, is checked once the type is known, at the call of a function for
+// its parameters. Builtins registered by the host and imported modules are
+// of type any, as are annotations of type any, which are not checked.
+//
+// If prog has type errors, Infer returns an [ErrorList] along with the
+// types inferred anyway. Errors about conflicting types hold the positions
+// of both sides of the conflict.
+func Infer(prog *ast.Program, info *resolver.Info) (*Info, error) {
+	c := &inferer{
+		info: &Info{
+			Types: make(map[ast.Expr]Type),
+			Defs:  make(map[*ast.Ident]Type),
+		},
+		resolved: info,
+		types:    make(map[ast.Expr]Type),
+		defs:     make(map[*ast.Ident]Type),
+		pending:  make(map[*ast.Ident]int),
+		assigned: make(map[*ast.Ident]bool),
+		decls:    make(map[*ast.Ident]*typeDecl),
+		named:    make(map[string]*typeDecl),
+		variants: make(map[*ast.Ident]*ast.Variant),
+		funcs:    make(map[*ast.Ident]*ast.Function),
+	}
+	c.declareTypes(prog)
+	c.stmts(prog.Stmts)
+
+	// Each type is named on its own, 'a is the first variable of each.
+	for expr, typ := range c.types {
+		c.info.Types[expr] = newNamer().resolve(typ)
+	}
+	for ident, typ := range c.defs {
+		c.info.Defs[ident] = newNamer().resolve(typ)
+	}
+	if len(c.errs) > 0 {
+		return c.info, c.errs
+	}
+	return c.info, nil
+}
+
+// declareTypes collects the structs, enums and methods of prog, which may be
+// used before they are declared, and the variables that are assigned. The
+// variants are polymorphic in the types of the fields of their enum.
+func (c *inferer) declareTypes(prog *ast.Program) {
+	ast.Inspect(prog, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.StructStmt:
+			c.declareType(&typeDecl{name: node.Name, fields: node.Fields, methods: make(map[string]*ast.Ident)})
+		case *ast.EnumStmt:
+			d := &typeDecl{name: node.Name, enum: true}
+			for _, variant := range node.Variants {
+				d.fields = append(d.fields, variant.Fields...)
+			}
+			c.declareType(d)
+
+			offset := 0
+			for _, variant := range node.Variants {
+				c.variants[variant.Name] = variant
+				typ := c.instance(d, genericLevel)
+				if variant.Fields == nil {
+					c.defs[variant.Name] = typ
+					continue
+				}
+				params := typ.Args[offset : offset+len(variant.Fields)]
+				c.defs[variant.Name] = &Func{Params: params, Result: typ}
+				offset += len(variant.Fields)
+			}
+		case *ast.MethodStmt:
+			c.funcs[node.Name] = node.Function
+			c.pending[node.Name] = 0
+		case *ast.Assignment:
+			if decl := c.resolved.Decls[node.Ident]; decl != nil {
+				c.assigned[decl] = true
+			}
+		}
+		return true
+	})
+
+	ast.Inspect(prog, func(node ast.Node) bool {
+		if node, ok := node.(*ast.MethodStmt); ok {
+			if d := c.decls[c.resolved.Decls[node.Type]]; d != nil && !d.enum {
+				d.methods[node.Name.Value] = node.Name
+			}
+		}
+		return true
+	})
+}
+
+func (c *inferer) declareType(d *typeDecl) {
+	c.decls[d.name] = d
+	c.named[d.name.Value] = d
+	c.order = append(c.order, d)
+}
+
+// instance returns the type of a value of the struct or enum d with new
+// type variables of the given level for the types of its fields.
+func (c *inferer) instance(d *typeDecl, level int) *Named {
+	typ := &Named{Name: d.name.Value, Args: make([]Type, len(d.fields)), decl: d.name}
+	for i := range typ.Args {
+		typ.Args[i] = &Var{level: level}
+	}
+	return typ
+}
+
+func (c *inferer) newVar() *Var {
+	return &Var{level: c.level}
+}
+
+// stmts infers stmts and returns the type of the value of the last one.
+// The names declared by the lets among them may be used before, by the
+// functions declared earlier.
+func (c *inferer) stmts(stmts []ast.Stmt) Type {
+	for _, stmt := range stmts {
+		if export, ok := stmt.(*ast.ExportStmt); ok {
+			stmt = export.Stmt
+		}
+		if let, ok := stmt.(*ast.LetStmt); ok && let.Ident != nil {
+			c.pending[let.Ident] = c.level
+			if fn, ok := let.Expr.(*ast.Function); ok {
+				c.funcs[let.Ident] = fn
+			}
+		}
+	}
+
+	var typ Type = Nil
+	for _, stmt := range stmts {
+		typ = c.stmt(stmt)
+	}
+	return typ
+}
+
+// stmt infers stmt and returns the type of its value. Statements that do
+// not complete, like return, have values of any type.
+func (c *inferer) stmt(stmt ast.Stmt) Type {
+	switch stmt := stmt.(type) {
+	case *ast.LetStmt:
+		if stmt.Ident != nil {
+			c.let(stmt.Ident, stmt.Type, stmt.Expr)
+			return Nil
+		}
+		c.bind(stmt.Pattern, c.annotated(stmt.Type, stmt.Expr))
+		return Nil
+	case *ast.ReturnStmt:
+		typ := c.expr(stmt.Expr)
+		if c.fn != nil {
+			c.ret(typ, stmt.Expr.Pos())
+		}
+		return c.newVar()
+	case *ast.ThrowStmt:
+		typ := c.expr(stmt.Expr)
+		switch t := prune(typ).(type) {
+		case *Var:
+			c.unify(t, String, stmt.Expr.Pos())
+		case *Named:
+			if t.decl != nil {
+				c.errorf(stmt.Expr.Pos(), origin(typ), "can only throw strings and errors, got '%v'", typ)
+			}
+		default:
+			if t != String && t != Any {
+				c.errorf(stmt.Expr.Pos(), origin(typ), "can only throw strings and errors, got '%v'", typ)
+			}
+		}
+		return c.newVar()
+	case *ast.MethodStmt:
+		var recv Type = Any
+		if d := c.decls[c.resolved.Decls[stmt.Type]]; d != nil && !d.enum {
+			recv = c.instance(d, c.level+1)
+		}
+		c.declare(stmt.Name, true, stmt.Function.Pos(), func() Type {
+			c.defs[stmt.Receiver] = recv
+			fn := c.function(stmt.Function)
+			c.types[stmt.Function] = fn
+			return &Func{Params: append([]Type{recv}, fn.Params...), Result: fn.Result}
+		})
+	case *ast.ImportStmt:
+		c.defs[stmt.Name] = Any
+	case *ast.ExportStmt:
+		return c.stmt(stmt.Stmt)
+	case *ast.ExprStmt:
+		return c.expr(stmt.Expr)
+	case *ast.BlockStmt:
+		return c.stmts(stmt.Stmts)
+	}
+	return Nil
+}
+
+// let infers a let statement declaring ident. Functions are generalized
+// unless they are assigned elsewhere.
+func (c *inferer) let(ident *ast.Ident, annotation ast.TypeExpr, expr ast.Expr) {
+	_, ok := expr.(*ast.Function)
+	c.declare(ident, ok && !c.assigned[ident], expr.Pos(), func() Type {
+		return c.annotated(annotation, expr)
+	})
+}
+
+// declare declares ident with the type returned by infer, which may refer
+// to ident itself. If generalize is set, the type variables introduced by
+// infer become generic.
+func (c *inferer) declare(ident *ast.Ident, generalize bool, pos token.Pos, infer func() Type) {
+	if generalize {
+		c.level++
+	}
+	// A name used before its declaration has the type of its uses.
+	self, used := c.defs[ident]
+	if !used {
+		self = c.newVar()
+		c.defs[ident] = self
+	}
+	delete(c.pending, ident)
+
+	typ := infer()
+	v, unbound := prune(self).(*Var)
+	if !c.unify(typ, self, pos) {
+		if unbound && v.kinds == 0 {
+			// The value contains itself.
+			c.errorf(pos, token.Pos{}, "'%v' needs an infinite type", ident.Value)
+		} else {
+			c.errorf(pos, origin(self), "'%v' is of type '%v' but used as '%v'", ident.Value, typ, self)
+		}
+	}
+	if generalize {
+		c.level--
+		c.generalize(typ)
+	}
+	c.defs[ident] = typ
+}
+
+// annotated infers expr, which must be of the type of annotation if it is
+// not nil, and returns its type.
+func (c *inferer) annotated(annotation ast.TypeExpr, expr ast.Expr) Type {
+	typ := c.expr(expr)
+	if annotation == nil {
+		return typ
+	}
+	want := c.typeExpr(annotation)
+	if !c.unify(typ, want, expr.Pos()) {
+		c.errorf(expr.Pos(), annotation.Pos(), "cannot use '%v' as '%v' in let statement", typ, want)
+	}
+	return want
+}
+
+// bind declares the variables bound by pattern to a value of type typ.
+func (c *inferer) bind(pattern ast.Pattern, typ Type) {
+	match := func(want Type) {
+		if !c.unify(typ, want, pattern.Pos()) {
+			c.errorf(pattern.Pos(), origin(typ), "cannot match '%v' with a pattern of type '%v'", typ, want)
+		}
+	}
+	switch p := pattern.(type) {
+	case *ast.IdentPattern:
+		if c.resolved.Variants[p.Ident] == nil {
+			c.defs[p.Ident] = typ
+			return
+		}
+		match(c.use(c.resolved.Decls[p.Ident]))
+	case *ast.LiteralPattern:
+		match(c.expr(p.Value))
+	case *ast.ConstructorPattern:
+		ctor, ok := c.use(c.resolved.Decls[p.Name]).(*Func)
+		if !ok || len(ctor.Params) != len(p.Args) {
+			// Reported by the resolver.
+			return
+		}
+		match(ctor.Result)
+		for i, arg := range p.Args {
+			c.bind(arg, ctor.Params[i])
+		}
+	case *ast.ArrayPattern:
+		elem := c.newVar()
+		match(&Array{Elem: elem})
+		for _, e := range p.Elems {
+			c.bind(e, elem)
+		}
+	case *ast.ObjectPattern:
+		for _, field := range p.Fields {
+			c.bind(field.Pattern, c.field(typ, field.Name, false))
+		}
+	}
+}
+
+// expr infers expr and returns its type.
+func (c *inferer) expr(expr ast.Expr) Type {
+	typ := c.exprType(expr)
+	c.types[expr] = typ
+	return typ
+}
+
+func (c *inferer) exprType(expr ast.Expr) Type {
+	switch e := expr.(type) {
+	case *ast.Int:
+		return Int
+	case *ast.Bool:
+		return Bool
+	case *ast.String:
+		return String
+	case *ast.Ident:
+		decl := c.resolved.Decls[e]
+		if decl == nil {
+			if binding, ok := c.resolved.Idents[e]; ok && binding.Kind == resolver.Builtin {
+				return c.instantiate(builtinType(e.Value))
+			}
+			return Any
+		}
+		return c.use(decl)
+	case *ast.UnaryOp:
+		operand := c.expr(e.Rhs)
+		var typ Type = Int
+		if e.Op == "!" {
+			typ = Bool
+		}
+		if !c.unify(operand, typ, e.Rhs.Pos()) {
+			c.errorf(e.Pos(), origin(operand), "bad operand type for unary %v: '%v'", e.Op, operand)
+		}
+		return typ
+	case *ast.BinaryOp:
+		return c.binary(e)
+	case *ast.If:
+		if typ := c.expr(e.Condition); !c.unify(typ, Bool, e.Condition.Pos()) {
+			c.errorf(e.Condition.Pos(), origin(typ), "if condition must evaluate to bool: '%v'", typ)
+		}
+		cons := c.stmt(e.Consequence)
+		if e.Alternative == nil {
+			return Nil
+		}
+		if alt := c.stmt(e.Alternative); !c.unify(alt, cons, e.Alternative.Pos()) {
+			c.errorf(e.Alternative.Pos(), e.Consequence.Pos(), "cannot use '%v' as '%v' in else branch", alt, cons)
+		}
+		return cons
+	case *ast.Function:
+		return c.function(e)
+	case *ast.Call:
+		return c.call(e)
+	case *ast.Assignment:
+		value := c.expr(e.Expr)
+		if decl := c.resolved.Decls[e.Ident]; decl != nil {
+			if typ := c.use(decl); !c.unify(value, typ, e.Expr.Pos()) {
+				c.errorf(e.Expr.Pos(), decl.Pos(), "cannot assign '%v' to '%v' of type '%v'", value, e.Ident.Value, typ)
+			}
+		}
+		return Nil
+	case *ast.Selector:
+		return c.field(c.expr(e.Expr), e.Field, true)
+	case *ast.Propagate:
+		typ := c.expr(e.Expr)
+		value, errType := c.newVar(), c.newVar()
+		if !c.unify(typ, &Result{Value: value, Error: errType}, e.Expr.Pos()) {
+			c.errorf(e.Expr.Pos(), origin(typ), "cannot propagate the error of '%v', which is not a result", typ)
+		}
+		if c.fn != nil {
+			c.ret(&Result{Value: c.newVar(), Error: errType}, e.Pos())
+		}
+		return value
+	case *ast.FieldAssignment:
+		value := c.expr(e.Expr)
+		typ := c.field(c.expr(e.Target.Expr), e.Target.Field, false)
+		c.types[e.Target] = typ
+		if !c.unify(value, typ, e.Expr.Pos()) {
+			c.errorf(e.Expr.Pos(), origin(typ), "cannot assign '%v' to field '%v' of type '%v'", value, e.Target.Field.Value, typ)
+		}
+		return Nil
+	case *ast.IndexAssignment:
+		value := c.expr(e.Expr)
+		elem := c.expr(e.Target)
+		if !c.unify(value, elem, e.Expr.Pos()) {
+			c.errorf(e.Expr.Pos(), origin(elem), "cannot use '%v' as element of '[%v]'", value, elem)
+		}
+		return Nil
+	case *ast.StructLit:
+		return c.structLit(e)
+	case *ast.ArrayLit:
+		elem := c.newVar()
+		for i, el := range e.Elems {
+			if typ := c.expr(el); !c.unify(typ, elem, el.Pos()) {
+				c.errorf(el.Pos(), e.Elems[i-1].Pos(), "cannot use '%v' as '%v' in array element", typ, elem)
+			}
+		}
+		return &Array{Elem: elem}
+	case *ast.Index:
+		elem := c.newVar()
+		if typ := c.expr(e.Expr); !c.unify(typ, &Array{Elem: elem}, e.Expr.Pos()) {
+			c.errorf(e.Expr.Pos(), origin(typ), "'%v' is not indexable", typ)
+		}
+		if typ := c.expr(e.Index); !c.unify(typ, Int, e.Index.Pos()) {
+			c.errorf(e.Index.Pos(), origin(typ), "array index must be int, got '%v'", typ)
+		}
+		return elem
+	case *ast.Try:
+		typ := c.stmt(e.Body)
+		if e.Catch != nil {
+			c.defs[e.Param] = errorType
+			if catch := c.stmt(e.Catch); !c.unify(catch, typ, e.Catch.Pos()) {
+				c.errorf(e.Catch.Pos(), e.Body.Pos(), "cannot use '%v' as '%v' in catch", catch, typ)
+			}
+		}
+		if e.Finally != nil {
+			c.stmt(e.Finally)
+		}
+		return typ
+	case *ast.Match:
+		subject := c.expr(e.Subject)
+		var typ Type = c.newVar()
+		for i, arm := range e.Arms {
+			c.bind(arm.Pattern, subject)
+			if body := c.stmt(arm.Body); !c.unify(body, typ, arm.Body.Pos()) {
+				c.errorf(arm.Body.Pos(), e.Arms[i-1].Body.Pos(), "cannot use '%v' as '%v' in match arm", body, typ)
+			}
+		}
+		return typ
+	}
+	return Any
+}
+
+// use returns the type of a use of the name declared by decl.
+func (c *inferer) use(decl *ast.Ident) Type {
+	typ, ok := c.defs[decl]
+	if !ok {
+		level, ok := c.pending[decl]
+		if !ok {
+			// Such as the names of structs.
+			return Any
+		}
+		// Used before its declaration, by a function declared earlier.
+		typ = &Var{level: level}
+		c.defs[decl] = typ
+	}
+	return c.instantiate(typ)
+}
+
+// binary infers a binary operation. The operands of + are both ints or
+// both strings, the ones of == and != both ints or both bools and the
+// others ints.
+func (c *inferer) binary(e *ast.BinaryOp) Type {
+	left, right := c.expr(e.Left), c.expr(e.Right)
+	var operand, result Type
+	switch e.Op {
+	case "+":
+		operand = &Var{kinds: intKind | stringKind, level: c.level}
+		result = operand
+	case "-", "*", "/":
+		operand, result = Int, Int
+	case "<", ">":
+		operand, result = Int, Bool
+	case "==", "!=":
+		operand, result = &Var{kinds: intKind | boolKind, level: c.level}, Bool
+	default:
+		return Any
+	}
+	if !c.unify(left, operand, e.Left.Pos()) || !c.unify(right, operand, e.Right.Pos()) {
+		c.errorf(e.Pos(), e.Right.Pos(), "unsupported operand type(s) for '%v': '%v' '%v'", e.Op, left, right)
+	}
+	return result
+}
+
+// function infers fn and returns its type.
+func (c *inferer) function(fn *ast.Function) *Func {
+	typ := &Func{Params: make([]Type, len(fn.Params))}
+	for i, param := range fn.Params {
+		if i < len(fn.ParamTypes) && fn.ParamTypes[i] != nil {
+			typ.Params[i] = c.typeExpr(fn.ParamTypes[i])
+		} else {
+			typ.Params[i] = c.newVar()
+		}
+		c.bind(param, typ.Params[i])
+	}
+
+	outer := c.fn
+	c.fn = &inferred{result: c.newVar()}
+	if fn.Result != nil {
+		c.fn.result, c.fn.pos = c.typeExpr(fn.Result), fn.Result.Pos()
+	}
+	body := c.stmts(fn.Body.Stmts)
+	pos := fn.Body.Pos()
+	if n := len(fn.Body.Stmts); n > 0 {
+		pos = fn.Body.Stmts[n-1].Pos()
+	}
+	c.ret(body, pos)
+	typ.Result = c.fn.result
+	c.fn = outer
+	return typ
+}
+
+// ret unifies typ, the type of a value returned at pos, with the result
+// type of the function being inferred.
+func (c *inferer) ret(typ Type, pos token.Pos) {
+	if !c.unify(typ, c.fn.result, pos) {
+		c.errorf(pos, c.fn.pos, "cannot return '%v' from function returning '%v'", typ, c.fn.result)
+	}
+	if c.fn.pos == (token.Pos{}) {
+		c.fn.pos = pos
+	}
+}
+
+func (c *inferer) call(e *ast.Call) Type {
+	callee := c.expr(e.Lhs)
+	args := make([]Type, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = c.expr(arg)
+	}
+
+	switch fn := prune(callee).(type) {
+	case *Var:
+		result := c.newVar()
+		kinds := fn.kinds
+		if !c.unify(fn, &Func{Params: args, Result: result}, e.Pos()) {
+			if kinds != 0 {
+				c.errorf(e.Lhs.Pos(), origin(fn), "'%v' is not callable", fn)
+			} else {
+				// The function is passed to itself.
+				c.errorf(e.Pos(), token.Pos{}, "the call needs an infinite type")
+			}
+		}
+		return result
+	case *Func:
+		params := c.params(e.Lhs)
+		if len(args) != len(fn.Params) {
+			var related token.Pos
+			if len(params) > 0 {
+				related = params[0]
+			}
+			c.errorf(e.Pos(), related, "function takes %v argument(s), got %v", len(fn.Params), len(args))
+			return fn.Result
+		}
+		for i, arg := range e.Args {
+			if !c.unify(args[i], fn.Params[i], arg.Pos()) {
+				related := origin(fn.Params[i])
+				if params != nil {
+					related = params[i]
+				}
+				c.errorf(arg.Pos(), related, "cannot use '%v' as '%v' in argument %v", args[i], fn.Params[i], i+1)
+			}
+		}
+		return fn.Result
+	}
+	if callee != Any {
+		c.errorf(e.Lhs.Pos(), origin(callee), "'%v' is not callable", callee)
+	}
+	return Any
+}
+
+// params returns the positions of the parameters of the function callee
+// refers to, or nil if it is not known.
+func (c *inferer) params(callee ast.Expr) []token.Pos {
+	var fn *ast.Function
+	switch e := callee.(type) {
+	case *ast.Ident:
+		decl := c.resolved.Decls[e]
+		if variant := c.variants[decl]; variant != nil {
+			var params []token.Pos
+			for _, field := range variant.Fields {
+				params = append(params, field.Pos())
+			}
+			return params
+		}
+		fn = c.funcs[decl]
+	case *ast.Selector:
+		if typ, ok := prune(c.types[e.Expr]).(*Named); ok {
+			if d := c.decls[typ.decl]; d != nil && !d.enum {
+				fn = c.funcs[d.methods[e.Field.Value]]
+			}
+		}
+	}
+	if fn == nil {
+		return nil
+	}
+	params := make([]token.Pos, len(fn.Params))
+	for i, param := range fn.Params {
+		params[i] = param.Pos()
+	}
+	return params
+}
+
+// field returns the type of the field name of a value of type typ, or of
+// its method if methods is set.
+func (c *inferer) field(typ Type, name *ast.Ident, methods bool) Type {
+	if v, ok := prune(typ).(*Var); ok {
+		switch owner := c.owner(name.Value, methods); {
+		case owner != nil:
+			c.unify(v, c.instance(owner, c.level), name.Pos())
+		case name.Value == "ok" || name.Value == "value" || name.Value == "error":
+			c.unify(v, &Result{Value: c.newVar(), Error: c.newVar()}, name.Pos())
+		case name.Value == "kind" || name.Value == "message":
+			c.unify(v, errorType, name.Pos())
+		default:
+			// Checked once the type of the value is known, see checkFields.
+			use := &fieldUse{name: name, typ: &Var{level: v.level}, methods: methods}
+			v.fields = append(v.fields, use)
+			return use.typ
+		}
+	}
+
+	if t, ok := c.fieldOf(typ, name.Value, methods); ok {
+		return t
+	}
+	c.errorf(name.Pos(), origin(typ), "'%v' has no field '%v'", typ, name.Value)
+	return Any
+}
+
+// fieldOf returns the type of the field name of typ, or of its method if
+// methods is set, and whether there is one. Values of type any have every
+// field.
+func (c *inferer) fieldOf(typ Type, name string, methods bool) (Type, bool) {
+	switch t := prune(typ).(type) {
+	case *Named:
+		if t.decl == nil {
+			// The type of errors.
+			if name == "kind" || name == "message" {
+				return String, true
+			}
+			break
+		}
+		d := c.decls[t.decl]
+		for i, field := range d.fields {
+			if field.Value == name {
+				return t.Args[i], true
+			}
+		}
+		if method, ok := d.methods[name]; ok && methods {
+			return c.method(t, method), true
+		}
+	case *Result:
+		switch name {
+		case "ok":
+			return Bool, true
+		case "value":
+			return t.Value, true
+		case "error":
+			return t.Error, true
+		}
+	case Basic:
+		if t == Any {
+			return Any, true
+		}
+	}
+	return nil, false
+}
+
+// checkFields checks the field uses of a variable bound to typ by the
+// expression at pos.
+func (c *inferer) checkFields(uses []*fieldUse, typ Type, pos token.Pos) {
+	for _, use := range uses {
+		t, ok := c.fieldOf(typ, use.name.Value, use.methods)
+		if !ok {
+			c.errorf(pos, use.name.Pos(), "'%v' has no field '%v'", typ, use.name.Value)
+			continue
+		}
+		if !c.unify(t, use.typ, use.name.Pos()) {
+			c.errorf(use.name.Pos(), pos, "field '%v' is of type '%v' but used as '%v'", use.name.Value, t, use.typ)
+		}
+	}
+}
+
+// owner returns the only struct or enum with a field name, or a method if
+// methods is set, or nil if there is none or several.
+func (c *inferer) owner(name string, methods bool) *typeDecl {
+	var owner *typeDecl
+	for _, d := range c.order {
+		has := methods && d.methods[name] != nil
+		for _, field := range d.fields {
+			has = has || field.Value == name
+		}
+		if has {
+			if owner != nil {
+				return nil
+			}
+			owner = d
+		}
+	}
+	return owner
+}
+
+// method returns the type of the method declared by name of a receiver of
+// type recv, without the receiver.
+func (c *inferer) method(recv *Named, name *ast.Ident) Type {
+	typ := c.use(name)
+	if v, ok := prune(typ).(*Var); ok {
+		// Used before its declaration.
+		fn := &Func{Params: []Type{c.newVar()}, Result: c.newVar()}
+		for range c.funcs[name].Params {
+			fn.Params = append(fn.Params, c.newVar())
+		}
+		c.unify(v, fn, name.Pos())
+		typ = fn
+	}
+	fn := prune(typ).(*Func)
+	c.unify(recv, fn.Params[0], name.Pos())
+	return &Func{Params: fn.Params[1:], Result: fn.Result}
+}
+
+func (c *inferer) structLit(e *ast.StructLit) Type {
+	d := c.decls[c.resolved.Decls[e.Type]]
+	if d == nil || d.enum {
+		for _, field := range e.Fields {
+			c.expr(field.Value)
+		}
+		return Any
+	}
+
+	typ := c.instance(d, c.level)
+	given := make(map[string]bool)
+	for _, field := range e.Fields {
+		value := c.expr(field.Value)
+		i := -1
+		for j, f := range d.fields {
+			if f.Value == field.Name.Value {
+				i = j
+			}
+		}
+		switch {
+		case i < 0:
+			c.errorf(field.Name.Pos(), d.name.Pos(), "'%v' has no field '%v'", d.name.Value, field.Name.Value)
+		case given[field.Name.Value]:
+			c.errorf(field.Name.Pos(), token.Pos{}, "field '%v' given twice", field.Name.Value)
+		case !c.unify(value, typ.Args[i], field.Value.Pos()):
+			c.errorf(field.Value.Pos(), origin(typ.Args[i]), "cannot use '%v' as '%v' in field '%v'", value, typ.Args[i], field.Name.Value)
+		}
+		given[field.Name.Value] = true
+	}
+	for _, field := range d.fields {
+		if !given[field.Value] {
+			c.errorf(e.Pos(), field.Pos(), "missing field '%v' in '%v' literal", field.Value, d.name.Value)
+		}
+	}
+	return typ
+}
+
+// typeExpr returns the type an annotation stands for. The types of the
+// fields of structs and enums are inferred.
+func (c *inferer) typeExpr(typ ast.TypeExpr) Type {
+	switch t := typ.(type) {
+	case *ast.NamedType:
+		switch name := Basic(t.Name.Value); name {
+		case Any, Int, Bool, String, Nil:
+			return name
+		}
+		if d, ok := c.named[t.Name.Value]; ok {
+			return c.instance(d, c.level)
+		}
+		c.errorf(t.Pos(), token.Pos{}, "unknown type '%v'", t.Name.Value)
+		return Any
+	case *ast.ArrayType:
+		return &Array{Elem: c.typeExpr(t.Elem)}
+	case *ast.FuncType:
+		fn := &Func{Params: make([]Type, len(t.Params)), Result: c.newVar()}
+		for i, param := range t.Params {
+			fn.Params[i] = c.typeExpr(param)
+		}
+		if t.Result != nil {
+			fn.Result = c.typeExpr(t.Result)
+		}
+		return fn
+	}
+	return Any
+}
+
+// builtinType returns the type of the builtin name, whose type variables
+// are generic.
+func builtinType(name string) Type {
+	a, b := &Var{level: genericLevel}, &Var{level: genericLevel}
+	switch name {
+	case "len":
+		a.kinds = stringKind | arrayKind
+		return &Func{Params: []Type{a}, Result: Int}
+	case "ok":
+		return &Func{Params: []Type{a}, Result: &Result{Value: a, Error: b}}
+	case "err":
+		return &Func{Params: []Type{b}, Result: &Result{Value: a, Error: b}}
+	case "freeze":
+		return &Func{Params: []Type{a}, Result: a}
+	}
+	return Any
+}
+
+// prune returns typ, or the type it is bound to if it is a bound type
+// variable.
+func prune(typ Type) Type {
+	for {
+		v, ok := typ.(*Var)
+		if !ok || v.inst == nil {
+			return typ
+		}
+		typ = v.inst
+	}
+}
+
+// origin returns the position of the expression that bound typ if it is a
+// bound type variable, otherwise the zero Pos.
+func origin(typ Type) token.Pos {
+	for {
+		v, ok := typ.(*Var)
+		if !ok || v.inst == nil {
+			return token.Pos{}
+		}
+		if v.pos != (token.Pos{}) {
+			return v.pos
+		}
+		typ = v.inst
+	}
+}
+
+// unify makes a and b the same type by binding their type variables, for
+// the expression at pos, and reports whether it could. Any unifies with
+// every type.
+func (c *inferer) unify(a, b Type, pos token.Pos) bool {
+	a, b = prune(a), prune(b)
+	if a == b || a == Any || b == Any {
+		return true
+	}
+	if v, ok := a.(*Var); ok {
+		return c.bindVar(v, b, pos)
+	}
+	if v, ok := b.(*Var); ok {
+		return c.bindVar(v, a, pos)
+	}
+
+	switch a := a.(type) {
+	case *Array:
+		b, ok := b.(*Array)
+		return ok && c.unify(a.Elem, b.Elem, pos)
+	case *Func:
+		b, ok := b.(*Func)
+		if !ok || len(a.Params) != len(b.Params) {
+			return false
+		}
+		for i := range a.Params {
+			if !c.unify(a.Params[i], b.Params[i], pos) {
+				return false
+			}
+		}
+		return c.unify(a.Result, b.Result, pos)
+	case *Named:
+		b, ok := b.(*Named)
+		if !ok || a.decl != b.decl {
+			return false
+		}
+		for i := range a.Args {
+			if !c.unify(a.Args[i], b.Args[i], pos) {
+				return false
+			}
+		}
+		return true
+	case *Result:
+		b, ok := b.(*Result)
+		return ok && c.unify(a.Value, b.Value, pos) && c.unify(a.Error, b.Error, pos)
+	}
+	return false
+}
+
+// bindVar binds the unbound variable v to typ, which must be one of its
+// kinds and must not contain v.
+func (c *inferer) bindVar(v *Var, typ Type, pos token.Pos) bool {
+	if w, ok := typ.(*Var); ok {
+		kinds := v.kinds
+		switch {
+		case kinds == 0:
+			kinds = w.kinds
+		case w.kinds != 0:
+			if kinds &= w.kinds; kinds == 0 {
+				return false
+			}
+		}
+		v.inst, v.pos = w, pos
+		w.kinds, w.level = kinds, min(v.level, w.level)
+		w.fields = append(w.fields, v.fields...)
+
+		// A variable of a single kind stands for a single type.
+		switch kinds {
+		case intKind:
+			w.inst = Int
+		case boolKind:
+			w.inst = Bool
+		case stringKind:
+			w.inst = String
+		case arrayKind:
+			w.inst = &Array{Elem: &Var{level: w.level}}
+		}
+		if w.inst != nil {
+			c.checkFields(w.fields, w.inst, pos)
+		}
+		return true
+	}
+
+	if v.kinds != 0 {
+		var kind kinds
+		switch typ := typ.(type) {
+		case Basic:
+			kind = map[Basic]kinds{Int: intKind, Bool: boolKind, String: stringKind}[typ]
+		case *Array:
+			kind = arrayKind
+		}
+		if v.kinds&kind == 0 {
+			return false
+		}
+	}
+	if c.occurs(v, typ) {
+		return false
+	}
+	v.inst, v.pos = typ, pos
+	c.checkFields(v.fields, typ, pos)
+	return true
+}
+
+// occurs reports whether v occurs in typ. It lowers the levels of the
+// variables of typ to the one of v, which typ becomes part of.
+func (c *inferer) occurs(v *Var, typ Type) bool {
+	switch t := prune(typ).(type) {
+	case *Var:
+		t.level = min(t.level, v.level)
+		return t == v
+	case *Array:
+		return c.occurs(v, t.Elem)
+	case *Func:
+		for _, param := range t.Params {
+			if c.occurs(v, param) {
+				return true
+			}
+		}
+		return c.occurs(v, t.Result)
+	case *Named:
+		for _, arg := range t.Args {
+			if c.occurs(v, arg) {
+				return true
+			}
+		}
+	case *Result:
+		return c.occurs(v, t.Value) || c.occurs(v, t.Error)
+	}
+	return false
+}
+
+// generalize makes the unbound variables of typ generic that were created
+// within the let being left, which are not shared with the types of the
+// enclosing scopes.
+func (c *inferer) generalize(typ Type) {
+	switch t := prune(typ).(type) {
+	case *Var:
+		if t.level > c.level && t.level != genericLevel {
+			t.level = genericLevel
+			for _, use := range t.fields {
+				c.generalize(use.typ)
+			}
+		}
+	case *Array:
+		c.generalize(t.Elem)
+	case *Func:
+		for _, param := range t.Params {
+			c.generalize(param)
+		}
+		c.generalize(t.Result)
+	case *Named:
+		for _, arg := range t.Args {
+			c.generalize(arg)
+		}
+	case *Result:
+		c.generalize(t.Value)
+		c.generalize(t.Error)
+	}
+}
+
+// generic reports whether typ contains generic variables.
+func generic(typ Type) bool {
+	switch t := prune(typ).(type) {
+	case *Var:
+		return t.level == genericLevel
+	case *Array:
+		return generic(t.Elem)
+	case *Func:
+		return slices.ContainsFunc(t.Params, generic) || generic(t.Result)
+	case *Named:
+		return slices.ContainsFunc(t.Args, generic)
+	case *Result:
+		return generic(t.Value) || generic(t.Error)
+	}
+	return false
+}
+
+// instantiate returns typ with its generic variables replaced by new ones.
+func (c *inferer) instantiate(typ Type) Type {
+	if !generic(typ) {
+		// Keeps the bound variables, which know where they were bound.
+		return typ
+	}
+	vars := make(map[*Var]*Var)
+	var inst func(Type) Type
+	list := func(types []Type) []Type {
+		out := make([]Type, len(types))
+		for i, t := range types {
+			out[i] = inst(t)
+		}
+		return out
+	}
+	inst = func(typ Type) Type {
+		switch t := prune(typ).(type) {
+		case *Var:
+			if t.level != genericLevel {
+				return t
+			}
+			if _, ok := vars[t]; !ok {
+				v := &Var{kinds: t.kinds, level: c.level}
+				vars[t] = v
+				for _, use := range t.fields {
+					v.fields = append(v.fields, &fieldUse{name: use.name, typ: inst(use.typ), methods: use.methods})
+				}
+			}
+			return vars[t]
+		case *Array:
+			return &Array{Elem: inst(t.Elem)}
+		case *Func:
+			return &Func{Params: list(t.Params), Result: inst(t.Result)}
+		case *Named:
+			return &Named{Name: t.Name, Args: list(t.Args), decl: t.decl}
+		case *Result:
+			return &Result{Value: inst(t.Value), Error: inst(t.Error)}
+		default:
+			return t
+		}
+	}
+	return inst(typ)
+}
+
+func (c *inferer) errorf(pos, related token.Pos, format string, args ...any) {
+	// The types of a message share their names.
+	n := newNamer()
+	for i, arg := range args {
+		if typ, ok := arg.(Type); ok {
+			args[i] = n.resolve(typ)
+		}
+	}
+	c.errs = append(c.errs, &Error{Pos: pos, Msg: fmt.Sprintf(format, args...), Related: related})
+}
+
+// namer resolves the type variables of inferred types and names the
+// unbound ones 'a, 'b and so on in order of appearance.
+type namer struct {
+	vars map[*Var]*Var
+}
+
+func newNamer() *namer {
+	return &namer{vars: make(map[*Var]*Var)}
+}
+
+func (n *namer) resolve(typ Type) Type {
+	list := func(types []Type) []Type {
+		out := make([]Type, len(types))
+		for i, t := range types {
+			out[i] = n.resolve(t)
+		}
+		return out
+	}
+	switch t := prune(typ).(type) {
+	case *Var:
+		if _, ok := n.vars[t]; !ok {
+			i := len(n.vars)
+			name := "'" + string(rune('a'+i%26))
+			if i >= 26 {
+				name += strconv.Itoa(i / 26)
+			}
+			n.vars[t] = &Var{Name: name, kinds: t.kinds}
+		}
+		return n.vars[t]
+	case *Array:
+		return &Array{Elem: n.resolve(t.Elem)}
+	case *Func:
+		return &Func{Params: list(t.Params), Result: n.resolve(t.Result)}
+	case *Named:
+		return &Named{Name: t.Name, Args: list(t.Args), decl: t.decl}
+	case *Result:
+		return &Result{Value: n.resolve(t.Value), Error: n.resolve(t.Error)}
+	default:
+		return t
+	}
+}
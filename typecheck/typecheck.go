@@ -0,0 +1,610 @@
+// Package typecheck infers the types of lily programs and reports type
+// errors before the programs run.
+//
+// Typing is gradual. Variables, parameters and function results may be
+// annotated with a type:
+//
+//	let n: int = 1;
+//	let greet = fn(name: string, times: int): [string] { ... };
+//
+// The types are int, bool, string, nil and any, [T] for arrays of T,
+// fn(T, U): R for functions and the names of the structs and enums of the
+// program. Where there is no annotation, the type is inferred: a variable
+// that is never assigned after its declaration has the type of its
+// initializer and a function returns the type of its body. Everything else,
+// such as unannotated parameters, variables assigned elsewhere and the
+// results of builtins, has the type any, which is consistent with every
+// type and turns the checks off. A program is only rejected for operations
+// that fail for all values of the types involved, such as -true or "a" + 1,
+// and for values contradicting an annotation. Programs without annotations
+// that run without type errors are therefore accepted.
+//
+// Alternatively, [Infer] infers the principal type of every expression by
+// unification, without any, and rejects programs that use a value with
+// two different types:
+//
+//	let id = fn(x) { x };             // fn('a): 'a
+//	let add = fn(a, b) { a + b };     // fn('a, 'a): 'a where 'a: int | string
+//	let n = id(1) + add(2, 3);        // int
+//
+// Annotations are not enforced at run time.
+package typecheck
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/resolver"
+	"github.com/tombuente/lily/token"
+)
+
+type Info struct {
+	// Types maps every expression checked to its type.
+	Types map[ast.Expr]Type
+	// Defs maps the identifiers declaring variables to their types.
+	Defs map[*ast.Ident]Type
+}
+
+type Error struct {
+	Pos token.Pos
+	Msg string
+	// Related is the position of the other side of a conflict found by
+	// [Infer], such as the parameter an argument does not match. It is the
+	// zero Pos if there is none.
+	Related token.Pos
+}
+
+func (x *Error) Error() string {
+	return x.Msg
+}
+
+// ErrorList is returned by [Check] and holds all errors found in a program.
+type ErrorList []*Error
+
+func (x ErrorList) Error() string {
+	msgs := make([]string, len(x))
+	for i, err := range x {
+		msgs[i] = err.Msg
+	}
+	return strings.Join(msgs, "\n")
+}
+
+type checker struct {
+	info     *Info
+	resolved *resolver.Info
+	errs     ErrorList
+
+	assigned map[*ast.Ident]bool    // declarations of variables that are assigned
+	named    map[string]Type        // the structs and enums of the program by name
+	structs  map[*ast.Ident]*Struct // by the name of their declaration
+
+	fn *function // the function being checked, nil at the top level
+}
+
+// function is a function being checked.
+type function struct {
+	result  Type   // annotated result type, nil if there is none
+	returns []Type // types of the values returned by return statements
+}
+
+// Check checks the types of prog, which info is the result of resolving.
+// If prog has type errors, Check returns an [ErrorList] along with the info
+// gathered anyway.
+func Check(prog *ast.Program, info *resolver.Info) (*Info, error) {
+	c := &checker{
+		info: &Info{
+			Types: make(map[ast.Expr]Type),
+			Defs:  make(map[*ast.Ident]Type),
+		},
+		resolved: info,
+		assigned: make(map[*ast.Ident]bool),
+		named:    make(map[string]Type),
+		structs:  make(map[*ast.Ident]*Struct),
+	}
+	c.declareTypes(prog)
+	c.stmts(prog.Stmts)
+
+	if len(c.errs) > 0 {
+		return c.info, c.errs
+	}
+	return c.info, nil
+}
+
+// declareTypes collects the structs, enums and methods of prog, which may be
+// used before they are declared, and the variables that are assigned.
+func (c *checker) declareTypes(prog *ast.Program) {
+	ast.Inspect(prog, func(node ast.Node) bool {
+		switch node := node.(type) {
+		case *ast.StructStmt:
+			s := &Struct{Name: node.Name.Value, Methods: make(map[string]*Func)}
+			for _, field := range node.Fields {
+				s.Fields = append(s.Fields, field.Value)
+			}
+			c.named[s.Name] = s
+			c.structs[node.Name] = s
+		case *ast.EnumStmt:
+			c.named[node.Name.Value] = &Enum{Name: node.Name.Value}
+		case *ast.Assignment:
+			if decl := c.resolved.Decls[node.Ident]; decl != nil {
+				c.assigned[decl] = true
+			}
+		}
+		return true
+	})
+
+	// Methods need the types of their parameters.
+	ast.Inspect(prog, func(node ast.Node) bool {
+		if node, ok := node.(*ast.MethodStmt); ok {
+			if s := c.structs[c.resolved.Decls[node.Type]]; s != nil {
+				s.Methods[node.Name.Value] = c.signature(node.Function)
+			}
+		}
+		return true
+	})
+}
+
+func (c *checker) stmts(stmts []ast.Stmt) Type {
+	var typ Type = Any
+	for _, stmt := range stmts {
+		typ = c.stmt(stmt)
+	}
+	return typ
+}
+
+// stmt checks stmt and returns the type of its value.
+func (c *checker) stmt(stmt ast.Stmt) Type {
+	switch stmt := stmt.(type) {
+	case *ast.LetStmt:
+		var typ Type
+		if stmt.Type != nil {
+			typ = c.typeExpr(stmt.Type)
+			if actual, ok := c.expect(stmt.Expr, typ); !ok {
+				c.errorf(stmt.Expr.Pos(), "cannot use '%v' as '%v' in let statement", actual, typ)
+			}
+		} else {
+			typ = c.expr(stmt.Expr)
+		}
+		if stmt.Pattern != nil {
+			c.bind(stmt.Pattern, typ, stmt.Type != nil)
+		} else {
+			c.define(stmt.Ident, typ, stmt.Type != nil)
+		}
+		return Nil
+	case *ast.ReturnStmt:
+		switch {
+		case c.fn == nil:
+			c.expr(stmt.Expr)
+		case c.fn.result != nil:
+			if actual, ok := c.expect(stmt.Expr, c.fn.result); !ok {
+				c.errorf(stmt.Expr.Pos(), "cannot return '%v' from function returning '%v'", actual, c.fn.result)
+			}
+		default:
+			c.fn.returns = append(c.fn.returns, c.expr(stmt.Expr))
+		}
+		return Any
+	case *ast.ThrowStmt:
+		// Errors are of type any.
+		if typ := c.expr(stmt.Expr); !consistent(typ, String) {
+			c.errorf(stmt.Expr.Pos(), "can only throw strings and errors, got '%v'", typ)
+		}
+		return Any
+	case *ast.EnumStmt:
+		enum := c.named[stmt.Name.Value]
+		for _, variant := range stmt.Variants {
+			if variant.Fields == nil {
+				c.define(variant.Name, enum, true)
+				continue
+			}
+			params := make([]Type, len(variant.Fields))
+			for i := range params {
+				params[i] = Any
+			}
+			c.define(variant.Name, &Func{Params: params, Result: enum}, true)
+		}
+	case *ast.ImportStmt:
+		c.define(stmt.Name, Any, true)
+	case *ast.ExportStmt:
+		return c.stmt(stmt.Stmt)
+	case *ast.MethodStmt:
+		var recv Type = Any
+		if s := c.structs[c.resolved.Decls[stmt.Type]]; s != nil {
+			recv = s
+		}
+		c.define(stmt.Receiver, recv, true)
+		c.function(stmt.Function)
+	case *ast.ExprStmt:
+		return c.expr(stmt.Expr)
+	case *ast.BlockStmt:
+		return c.stmts(stmt.Stmts)
+	}
+	return Any
+}
+
+// define sets the type of the variable declared by ident. Unless the type is
+// annotated, variables that are assigned elsewhere are of type any.
+func (c *checker) define(ident *ast.Ident, typ Type, annotated bool) {
+	if !annotated && c.assigned[ident] {
+		typ = Any
+	}
+	c.info.Defs[ident] = typ
+}
+
+// bind defines the variables bound by pattern to a value of type typ.
+func (c *checker) bind(pattern ast.Pattern, typ Type, annotated bool) {
+	switch p := pattern.(type) {
+	case *ast.IdentPattern:
+		if c.resolved.Variants[p.Ident] == nil {
+			c.define(p.Ident, typ, annotated)
+		}
+	case *ast.ArrayPattern:
+		var elem Type = Any
+		if array, ok := typ.(*Array); ok {
+			elem = array.Elem
+		}
+		for _, e := range p.Elems {
+			c.bind(e, elem, annotated)
+		}
+	case *ast.ConstructorPattern:
+		for _, arg := range p.Args {
+			c.bind(arg, Any, false)
+		}
+	case *ast.ObjectPattern:
+		for _, field := range p.Fields {
+			c.bind(field.Pattern, Any, false)
+		}
+	}
+}
+
+// expect checks expr and reports whether its type is consistent with typ.
+func (c *checker) expect(expr ast.Expr, typ Type) (Type, bool) {
+	actual := c.expr(expr)
+	return actual, consistent(actual, typ)
+}
+
+// expr checks expr and returns its type.
+func (c *checker) expr(expr ast.Expr) Type {
+	typ := c.exprType(expr)
+	c.info.Types[expr] = typ
+	return typ
+}
+
+func (c *checker) exprType(expr ast.Expr) Type {
+	switch e := expr.(type) {
+	case *ast.Int:
+		return Int
+	case *ast.Bool:
+		return Bool
+	case *ast.String:
+		return String
+	case *ast.Ident:
+		if typ, ok := c.info.Defs[c.resolved.Decls[e]]; ok {
+			return typ
+		}
+		return Any
+	case *ast.UnaryOp:
+		return c.unary(e)
+	case *ast.BinaryOp:
+		return c.binary(e)
+	case *ast.If:
+		if typ := c.expr(e.Condition); !consistent(typ, Bool) {
+			c.errorf(e.Condition.Pos(), "if condition must evaluate to bool: '%v'", typ)
+		}
+		cons := c.stmt(e.Consequence)
+		if e.Alternative == nil {
+			return join(cons, Nil)
+		}
+		return join(cons, c.stmt(e.Alternative))
+	case *ast.Function:
+		return c.function(e)
+	case *ast.Call:
+		return c.call(e)
+	case *ast.Assignment:
+		if decl := c.resolved.Decls[e.Ident]; decl != nil {
+			if typ, ok := c.info.Defs[decl]; ok {
+				if actual, ok := c.expect(e.Expr, typ); !ok {
+					c.errorf(e.Expr.Pos(), "cannot assign '%v' to '%v' of type '%v'", actual, e.Ident.Value, typ)
+				}
+				return Nil
+			}
+		}
+		c.expr(e.Expr)
+		return Nil
+	case *ast.Selector:
+		return c.selector(e)
+	case *ast.Propagate:
+		c.expr(e.Expr)
+		return Any
+	case *ast.FieldAssignment:
+		c.expr(e.Expr)
+		switch typ := c.expr(e.Target.Expr).(type) {
+		case *Struct:
+			if !contains(typ.Fields, e.Target.Field.Value) {
+				c.errorf(e.Target.Field.Pos(), "'%v' has no field '%v'", typ, e.Target.Field.Value)
+			}
+		case Basic, *Array, *Func:
+			if typ != Any {
+				c.errorf(e.Target.Field.Pos(), "cannot assign to field '%v' of '%v'", e.Target.Field.Value, typ)
+			}
+		}
+		return Nil
+	case *ast.IndexAssignment:
+		elem := c.index(e.Target)
+		if actual, ok := c.expect(e.Expr, elem); !ok {
+			c.errorf(e.Expr.Pos(), "cannot use '%v' as element of '[%v]'", actual, elem)
+		}
+		return Nil
+	case *ast.StructLit:
+		return c.structLit(e)
+	case *ast.ArrayLit:
+		if len(e.Elems) == 0 {
+			return &Array{Elem: Any}
+		}
+		elem := c.expr(e.Elems[0])
+		for _, el := range e.Elems[1:] {
+			elem = join(elem, c.expr(el))
+		}
+		return &Array{Elem: elem}
+	case *ast.Index:
+		return c.index(e)
+	case *ast.Try:
+		typ := c.stmt(e.Body)
+		if e.Catch != nil {
+			c.define(e.Param, Any, true)
+			typ = join(typ, c.stmt(e.Catch))
+		}
+		if e.Finally != nil {
+			c.stmt(e.Finally)
+		}
+		return typ
+	case *ast.Match:
+		subject := c.expr(e.Subject)
+		var typ Type
+		for i, arm := range e.Arms {
+			c.bind(arm.Pattern, subject, false)
+			if body := c.stmt(arm.Body); i == 0 {
+				typ = body
+			} else {
+				typ = join(typ, body)
+			}
+		}
+		if typ == nil {
+			return Any
+		}
+		return typ
+	}
+	return Any
+}
+
+func (c *checker) unary(e *ast.UnaryOp) Type {
+	operand := c.expr(e.Rhs)
+	var typ Type = Int
+	if e.Op == "!" {
+		typ = Bool
+	}
+	if !consistent(operand, typ) {
+		c.errorf(e.Pos(), "bad operand type for unary %v: '%v'", e.Op, operand)
+	}
+	return typ
+}
+
+// binary checks a binary operation. Both operands must be ints, bools
+// compared with == or !=, or strings added with +.
+func (c *checker) binary(e *ast.BinaryOp) Type {
+	left, right := c.expr(e.Left), c.expr(e.Right)
+
+	// The operands are of the type of the other one if they are of type
+	// any and it is not.
+	operand := left
+	if operand == Any {
+		operand = right
+	}
+	if !consistent(left, right) {
+		operand = nil
+	}
+
+	switch e.Op {
+	case "+":
+		if operand == Int || operand == String || operand == Any {
+			return operand
+		}
+	case "-", "*", "/":
+		if operand == Int || operand == Any {
+			return Int
+		}
+	case "<", ">":
+		if operand == Int || operand == Any {
+			return Bool
+		}
+	case "==", "!=":
+		if operand == Int || operand == Bool || operand == Any {
+			return Bool
+		}
+	default:
+		return Any
+	}
+	c.errorf(e.Pos(), "unsupported operand type(s) for '%v': '%v' '%v'", e.Op, left, right)
+	return Any
+}
+
+// function checks fn and returns its type. The result type of a function
+// that is not annotated is the type of its body.
+func (c *checker) function(fn *ast.Function) Type {
+	typ := c.signature(fn)
+	for i, param := range fn.Params {
+		annotated := i < len(fn.ParamTypes) && fn.ParamTypes[i] != nil
+		c.bind(param, typ.Params[i], annotated)
+	}
+
+	outer := c.fn
+	c.fn = &function{}
+	if fn.Result != nil {
+		c.fn.result = typ.Result
+	}
+	body := c.stmts(fn.Body.Stmts)
+	var last ast.Stmt
+	if n := len(fn.Body.Stmts); n > 0 {
+		last = fn.Body.Stmts[n-1]
+	}
+	if fn.Result != nil {
+		if stmt, ok := last.(*ast.ExprStmt); ok && !consistent(body, typ.Result) {
+			c.errorf(stmt.Pos(), "cannot return '%v' from function returning '%v'", body, typ.Result)
+		}
+	} else {
+		results := c.fn.returns
+		if _, ok := last.(*ast.ReturnStmt); !ok {
+			results = append(results, body)
+		}
+		typ.Result = results[0]
+		for _, result := range results[1:] {
+			typ.Result = join(typ.Result, result)
+		}
+	}
+	c.fn = outer
+	return typ
+}
+
+// signature returns the type of fn as given by its annotations.
+func (c *checker) signature(fn *ast.Function) *Func {
+	typ := &Func{Params: make([]Type, len(fn.Params)), Result: Any}
+	for i := range fn.Params {
+		typ.Params[i] = Any
+		if i < len(fn.ParamTypes) && fn.ParamTypes[i] != nil {
+			typ.Params[i] = c.typeExpr(fn.ParamTypes[i])
+		}
+	}
+	if fn.Result != nil {
+		typ.Result = c.typeExpr(fn.Result)
+	}
+	return typ
+}
+
+func (c *checker) call(e *ast.Call) Type {
+	callee := c.expr(e.Lhs)
+	fn, ok := callee.(*Func)
+	if !ok {
+		if callee != Any {
+			c.errorf(e.Lhs.Pos(), "'%v' is not callable", callee)
+		}
+		for _, arg := range e.Args {
+			c.expr(arg)
+		}
+		return Any
+	}
+
+	if len(e.Args) != len(fn.Params) {
+		c.errorf(e.Pos(), "function takes %v argument(s), got %v", len(fn.Params), len(e.Args))
+		for _, arg := range e.Args {
+			c.expr(arg)
+		}
+		return fn.Result
+	}
+	for i, arg := range e.Args {
+		if actual, ok := c.expect(arg, fn.Params[i]); !ok {
+			c.errorf(arg.Pos(), "cannot use '%v' as '%v' in argument %v", actual, fn.Params[i], i+1)
+		}
+	}
+	return fn.Result
+}
+
+func (c *checker) selector(e *ast.Selector) Type {
+	name := e.Field.Value
+	switch typ := c.expr(e.Expr).(type) {
+	case *Struct:
+		if method, ok := typ.Methods[name]; ok {
+			return method
+		}
+		if !contains(typ.Fields, name) {
+			c.errorf(e.Field.Pos(), "'%v' has no field '%v'", typ, name)
+		}
+	case Basic, *Array, *Func:
+		if typ != Any {
+			c.errorf(e.Field.Pos(), "'%v' has no field '%v'", typ, name)
+		}
+	}
+	return Any
+}
+
+// index checks an index expression and returns the type of the element.
+func (c *checker) index(e *ast.Index) Type {
+	var elem Type = Any
+	switch typ := c.expr(e.Expr).(type) {
+	case *Array:
+		elem = typ.Elem
+	default:
+		if typ != Any {
+			c.errorf(e.Expr.Pos(), "'%v' is not indexable", typ)
+		}
+	}
+	if typ := c.expr(e.Index); !consistent(typ, Int) {
+		c.errorf(e.Index.Pos(), "array index must be int, got '%v'", typ)
+	}
+	return elem
+}
+
+func (c *checker) structLit(e *ast.StructLit) Type {
+	s := c.structs[c.resolved.Decls[e.Type]]
+	given := make(map[string]bool)
+	for _, field := range e.Fields {
+		c.expr(field.Value)
+		if s == nil {
+			continue
+		}
+		switch {
+		case !contains(s.Fields, field.Name.Value):
+			c.errorf(field.Name.Pos(), "'%v' has no field '%v'", s, field.Name.Value)
+		case given[field.Name.Value]:
+			c.errorf(field.Name.Pos(), "field '%v' given twice", field.Name.Value)
+		}
+		given[field.Name.Value] = true
+	}
+	if s == nil {
+		return Any
+	}
+	for _, field := range s.Fields {
+		if !given[field] {
+			c.errorf(e.Pos(), "missing field '%v' in '%v' literal", field, s)
+		}
+	}
+	return s
+}
+
+// typeExpr returns the type an annotation stands for.
+func (c *checker) typeExpr(typ ast.TypeExpr) Type {
+	switch t := typ.(type) {
+	case *ast.NamedType:
+		switch name := Basic(t.Name.Value); name {
+		case Any, Int, Bool, String, Nil:
+			return name
+		}
+		if named, ok := c.named[t.Name.Value]; ok {
+			return named
+		}
+		c.errorf(t.Pos(), "unknown type '%v'", t.Name.Value)
+	case *ast.ArrayType:
+		return &Array{Elem: c.typeExpr(t.Elem)}
+	case *ast.FuncType:
+		fn := &Func{Params: make([]Type, len(t.Params)), Result: Any}
+		for i, param := range t.Params {
+			fn.Params[i] = c.typeExpr(param)
+		}
+		if t.Result != nil {
+			fn.Result = c.typeExpr(t.Result)
+		}
+		return fn
+	}
+	return Any
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *checker) errorf(pos token.Pos, format string, args ...any) {
+	c.errs = append(c.errs, &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
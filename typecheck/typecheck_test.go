@@ -0,0 +1,368 @@
+package typecheck
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+	"github.com/tombuente/lily/resolver"
+	"github.com/tombuente/lily/token"
+)
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected []string
+	}{
+		{src: "-true", expected: []string{"1:1: bad operand type for unary -: 'bool'"}},
+		{src: "!1", expected: []string{"1:1: bad operand type for unary !: 'int'"}},
+		{src: `"a" + 1`, expected: []string{"1:1: unsupported operand type(s) for '+': 'string' 'int'"}},
+		{src: `true + true; "a" == "a"; [1] == [1]`, expected: []string{
+			"1:1: unsupported operand type(s) for '+': 'bool' 'bool'",
+			"1:14: unsupported operand type(s) for '==': 'string' 'string'",
+			"1:26: unsupported operand type(s) for '==': '[int]' '[int]'",
+		}},
+		{src: `let a = 1; let s = "x"; a - s`, expected: []string{"1:25: unsupported operand type(s) for '-': 'int' 'string'"}},
+		{src: "if 1 { 2 }", expected: []string{"1:4: if condition must evaluate to bool: 'int'"}},
+		{src: "let x: int = true", expected: []string{"1:14: cannot use 'bool' as 'int' in let statement"}},
+		{src: "let x: int = 1; x = \"a\"", expected: []string{"1:21: cannot assign 'string' to 'x' of type 'int'"}},
+		{src: `let xs: [int] = ["a"]`, expected: []string{"1:17: cannot use '[string]' as '[int]' in let statement"}},
+		{src: "let f = fn(a: int, b: string) { a }; f(\"a\", 1); f(1)", expected: []string{
+			"1:40: cannot use 'string' as 'int' in argument 1",
+			"1:45: cannot use 'int' as 'string' in argument 2",
+			"1:49: function takes 2 argument(s), got 1",
+		}},
+		{src: "let f = fn(): int { if true { return \"a\" }; true }", expected: []string{
+			"1:38: cannot return 'string' from function returning 'int'",
+			"1:45: cannot return 'bool' from function returning 'int'",
+		}},
+		{src: "let f = fn(n) { n }; f(1) + 1; let g = fn() { \"a\" }; g() + 1", expected: []string{
+			"1:54: unsupported operand type(s) for '+': 'string' 'int'",
+		}},
+		{src: "let n = 1; n(); n.x; n[0]; [1][true]", expected: []string{
+			"1:12: 'int' is not callable",
+			"1:19: 'int' has no field 'x'",
+			"1:22: 'int' is not indexable",
+			"1:32: array index must be int, got 'bool'",
+		}},
+		{src: "struct P { x }; fn (p P) m() { 1 }; let p = P{x: 1}; p.m() + 1; p.y; P{y: 1}; P{x: 1, x: 2}; p.z = 1", expected: []string{
+			"1:67: 'P' has no field 'y'",
+			"1:72: 'P' has no field 'y'",
+			"1:70: missing field 'x' in 'P' literal",
+			"1:87: field 'x' given twice",
+			"1:96: 'P' has no field 'z'",
+		}},
+		{src: "struct P { x }; let f = fn(p: P): int { p }; f(1)", expected: []string{
+			"1:41: cannot return 'P' from function returning 'int'",
+			"1:48: cannot use 'int' as 'P' in argument 1",
+		}},
+		{src: "enum E { A, B(v) }; let e: E = A; B(1, 2); let n: int = B(1)", expected: []string{
+			"1:35: function takes 1 argument(s), got 2",
+			"1:57: cannot use 'E' as 'int' in let statement",
+		}},
+		{src: "let g: fn(int): int = fn(a, b) { a }", expected: []string{
+			"1:23: cannot use 'fn(any, any): any' as 'fn(int): int' in let statement",
+		}},
+		{src: "throw 1", expected: []string{"1:7: can only throw strings and errors, got 'int'"}},
+		{src: "let x: Q = 1", expected: []string{"1:8: unknown type 'Q'"}},
+		{src: "let [a, b]: [int] = [1, 2]; a + \"s\"", expected: []string{
+			"1:29: unsupported operand type(s) for '+': 'int' 'string'",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := check(t, tt.src)
+			var errs ErrorList
+			if !errors.As(err, &errs) {
+				t.Fatalf("want errors, got=%v", err)
+			}
+			var actual []string
+			for _, err := range errs {
+				actual = append(actual, fmt.Sprintf("%v: %v", err.Pos, err.Msg))
+			}
+			if !slices.Equal(actual, tt.expected) {
+				t.Fatalf("want=%q,\ngot=%q", tt.expected, actual)
+			}
+		})
+	}
+}
+
+// TestGradual checks that programs without type errors at run time are
+// accepted, whether they are annotated or not.
+func TestGradual(t *testing.T) {
+	tests := []string{
+		`let x = 1; x = "a"; x + "b"`,
+		`let f = fn(a) { a + 1 }; f(1) + f(2)`,
+		`let id = fn(a) { a }; id(1) + 1; id("a") + "b"`,
+		`let xs = []; len(xs) + 1`,
+		`let f = fn(n) { if n < 2 { return n }; f(n - 1) + f(n - 2) }; f(10)`,
+		`let g = fn() { h() + 1 }; let h = fn() { 1 }; g()`,
+		`let f: fn(int): int = fn(a) { a }; f(1)`,
+		`let v: any = 1; v = "a"`,
+		`struct P { x }; fn (p P) add(q: P): P { P{x: p.x + q.x} }; P{x: 1}.add(P{x: 2}).x`,
+		`enum Opt { Some(v), None }; match Some(1) { Some(v) => v, None => 0 }`,
+		`try { throw "x" } catch (e) { e.message + "!" }`,
+		`import "lib" as m; m.f(1) + 1`,
+		`let f = fn(x: int): int { if x > 0 { return x }; -x }; f(-1)`,
+		`let s = if true { 1 } { "a" }; s`,
+	}
+
+	for _, src := range tests {
+		t.Run(src, func(t *testing.T) {
+			if _, err := check(t, src); err != nil {
+				t.Fatalf("Failed to check: %v", err)
+			}
+		})
+	}
+}
+
+func TestTypes(t *testing.T) {
+	src := `struct P { x };
+let a = 1;
+let b = [true];
+let c = fn(n: int, m) { if n > 0 { return "pos" }; "neg" };
+let d = c(1, 2);
+let e = P{x: a};
+let f = fn(p: P): fn(): P { fn() { p } };
+let g = 1; g = "a";
+let [h, i] = b;`
+	info, err := check(t, src)
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+
+	var actual []string
+	for ident, typ := range info.Defs {
+		actual = append(actual, fmt.Sprintf("%v: %v", ident.Value, typ))
+	}
+	slices.Sort(actual)
+
+	expected := []string{
+		"a: int",
+		"b: [bool]",
+		"c: fn(int, any): string",
+		"d: string",
+		"e: P",
+		"f: fn(P): fn(): P",
+		"g: any",
+		"h: bool",
+		"i: bool",
+		"m: any",
+		"n: int",
+		"p: P",
+	}
+	if !slices.Equal(actual, expected) {
+		t.Fatalf("want=%q,\ngot=%q", expected, actual)
+	}
+}
+
+func check(t *testing.T, src string) (*Info, error) {
+	t.Helper()
+	prog := parse(t, src)
+	info, err := resolver.Resolve(prog, []string{"len"})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	return Check(prog, info)
+}
+
+func parse(t *testing.T, src string) *ast.Program {
+	t.Helper()
+	prog, err := parser.New(lexer.New(src)).Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse program: %v", err)
+	}
+	return prog
+}
+
+func TestInfer(t *testing.T) {
+	src := `let id = fn(x) { x };
+let one = id(1);
+let str = id("s");
+let add = fn(a, b) { a + b };
+let eq = fn(c, d) { c == d };
+let compose = fn(f, g) { fn(y) { f(g(y)) } };
+let size = fn(s) { len(s) };
+let even = fn(n) { if n == 0 { return true }; odd(n - 1) };
+let odd = fn(m) { if m == 0 { return false }; even(m - 1) };
+struct P { px, py };
+fn (p P) sum() { p.px + p.py };
+let pt = P{px: 1, py: 2};
+let total = pt.sum();
+let getY = fn(v) { v.py };
+enum Opt { Some(w), None };
+let unwrap = fn(o, z) { match o { Some(w) => w, None => z } };
+let none = None;
+let parse = fn(t) { if len(t) == 0 { return err("empty") }; ok(len(t)) };
+let next = fn(u) { let k = parse(u)?; ok(k + 1) };
+let msg = try { throw "x" } catch (e) { e.message };
+let xs = [];
+struct Dog { name, age };
+struct Cat { name };
+let nameOf = fn(q) { q.name };
+let dog = nameOf(Dog{name: "rex", age: 3});
+let cat = nameOf(Cat{name: 1});`
+	info, err := infer(t, src)
+	if err != nil {
+		t.Fatalf("Failed to infer: %v", err)
+	}
+
+	var actual []string
+	for ident, typ := range info.Defs {
+		actual = append(actual, fmt.Sprintf("%v: %v", ident.Value, typ))
+	}
+	slices.Sort(actual)
+
+	expected := []string{
+		"None: Opt('a)",
+		"Some: fn('a): Opt('a)",
+		"a: 'a where 'a: int | string",
+		"add: fn('a, 'a): 'a where 'a: int | string",
+		"b: 'a where 'a: int | string",
+		"c: 'a where 'a: int | bool",
+		"cat: int",
+		"compose: fn(fn('a): 'b, fn('c): 'a): fn('c): 'b",
+		"d: 'a where 'a: int | bool",
+		"dog: string",
+		"e: error",
+		"eq: fn('a, 'a): bool where 'a: int | bool",
+		"even: fn(int): bool",
+		"f: fn('a): 'b",
+		"g: fn('a): 'b",
+		"getY: fn(P('a, 'b)): 'b",
+		"id: fn('a): 'a",
+		"k: int",
+		"m: int",
+		"msg: string",
+		"n: int",
+		"nameOf: fn('a): 'b",
+		"next: fn('a): result(int, string) where 'a: string | array",
+		"none: Opt('a)",
+		"o: Opt('a)",
+		"odd: fn(int): bool",
+		"one: int",
+		"p: P('a, 'a) where 'a: int | string",
+		"parse: fn('a): result(int, string) where 'a: string | array",
+		"pt: P(int, int)",
+		"q: 'a",
+		"s: 'a where 'a: string | array",
+		"size: fn('a): int where 'a: string | array",
+		"str: string",
+		"sum: fn(P('a, 'a)): 'a where 'a: int | string",
+		"t: 'a where 'a: string | array",
+		"total: int",
+		"u: 'a where 'a: string | array",
+		"unwrap: fn(Opt('a), 'a): 'a",
+		"v: P('a, 'b)",
+		"w: 'a",
+		"x: 'a",
+		"xs: ['a]",
+		"y: 'a",
+		"z: 'a",
+	}
+	if !slices.Equal(actual, expected) {
+		t.Fatalf("want=%q,\ngot=%q", expected, actual)
+	}
+}
+
+func TestInferErrors(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected []string
+	}{
+		{src: `"a" + 1`, expected: []string{"1:1: unsupported operand type(s) for '+': 'string' 'int' (1:7)"}},
+		{src: "-true; !1", expected: []string{
+			"1:1: bad operand type for unary -: 'bool'",
+			"1:8: bad operand type for unary !: 'int'",
+		}},
+		{src: "let f = fn(x) { x + 1 };\nf(\"a\")", expected: []string{"2:3: cannot use 'string' as 'int' in argument 1 (1:12)"}},
+		{src: "let x = 1;\nx = \"a\"", expected: []string{"2:5: cannot assign 'string' to 'x' of type 'int' (1:5)"}},
+		{src: "let x: int = true", expected: []string{"1:14: cannot use 'bool' as 'int' in let statement (1:8)"}},
+		{src: `let f = fn(n) { if n > 0 { return 1 }; "a" }`, expected: []string{
+			"1:40: cannot return 'string' from function returning 'int' (1:35)",
+		}},
+		{src: `if true { 1 } { "a" }; [1, "a"]; match 1 { 1 => true, _ => 2 }`, expected: []string{
+			"1:15: cannot use 'string' as 'int' in else branch (1:9)",
+			"1:28: cannot use 'string' as 'int' in array element (1:25)",
+			"1:60: cannot use 'int' as 'bool' in match arm (1:49)",
+		}},
+		{src: "let f = fn(x) { x(x) }; let r = fn() { r }", expected: []string{
+			"1:17: the call needs an infinite type",
+			"1:33: 'r' needs an infinite type",
+		}},
+		{src: "let n = 1; n(); n.x; n[0]; [1][true]", expected: []string{
+			"1:12: 'int' is not callable",
+			"1:19: 'int' has no field 'x'",
+			"1:22: 'int' is not indexable",
+			"1:32: array index must be int, got 'bool'",
+		}},
+		{src: "struct P { x };\nlet p = P{x: 1};\np.x = \"a\"; P{y: 1}", expected: []string{
+			"3:7: cannot assign 'string' to field 'x' of type 'int' (2:14)",
+			"3:14: 'P' has no field 'y' (1:8)",
+			"3:12: missing field 'x' in 'P' literal (1:12)",
+		}},
+		{src: "let f = fn(a, b) { a };\nf(1)", expected: []string{"2:1: function takes 2 argument(s), got 1 (1:12)"}},
+		{src: `let g = fn() { h(1) + h("a") }; let h = fn(x) { x }`, expected: []string{
+			"1:25: cannot use 'string' as 'int' in argument 1 (1:44)",
+		}},
+		{src: "let f = fn(x) { x.name };\nf(1)", expected: []string{"2:3: 'int' has no field 'name' (1:19)"}},
+		{src: "struct P { name };\nstruct Q { name };\nlet f = fn(x) { x.name + 1 };\nf(Q{name: 1}); f(P{name: \"a\"})", expected: []string{
+			"3:19: field 'name' is of type 'string' but used as 'int' (4:18)",
+		}},
+		{src: "throw 1", expected: []string{"1:7: can only throw strings and errors, got 'int'"}},
+		{src: "let x = 1; x?", expected: []string{"1:12: cannot propagate the error of 'int', which is not a result"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := infer(t, tt.src)
+			var errs ErrorList
+			if !errors.As(err, &errs) {
+				t.Fatalf("want errors, got=%v", err)
+			}
+			var actual []string
+			for _, err := range errs {
+				msg := fmt.Sprintf("%v: %v", err.Pos, err.Msg)
+				if err.Related != (token.Pos{}) {
+					msg += fmt.Sprintf(" (%v)", err.Related)
+				}
+				actual = append(actual, msg)
+			}
+			if !slices.Equal(actual, tt.expected) {
+				t.Fatalf("want=%q,\ngot=%q", tt.expected, actual)
+			}
+		})
+	}
+}
+
+// TestInferAnnotations checks that annotations constrain the inferred types.
+func TestInferAnnotations(t *testing.T) {
+	info, err := infer(t, `struct P { x }; let f = fn(a: int, b): [P] { [P{x: b}] }; let v: any = 1; v = "a"`)
+	if err != nil {
+		t.Fatalf("Failed to infer: %v", err)
+	}
+	for ident, typ := range info.Defs {
+		if ident.Value == "f" {
+			if expected := "fn(int, 'a): [P('a)]"; typ.String() != expected {
+				t.Fatalf("want=%v, got=%v", expected, typ)
+			}
+			return
+		}
+	}
+	t.Fatalf("no type for f")
+}
+
+func infer(t *testing.T, src string) (*Info, error) {
+	t.Helper()
+	prog := parse(t, src)
+	info, err := resolver.Resolve(prog, []string{"len", "ok", "err"})
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	return Infer(prog, info)
+}
@@ -0,0 +1,256 @@
+package typecheck
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/token"
+)
+
+// Type is the static type of a value.
+type Type interface {
+	String() string
+	typ()
+}
+
+// Basic is a type without structure.
+type Basic string
+
+const (
+	// Any is the type of values whose type is not known statically. It is
+	// consistent with every type.
+	Any    Basic = "any"
+	Int    Basic = "int"
+	Bool   Basic = "bool"
+	String Basic = "string"
+	Nil    Basic = "nil"
+)
+
+// Array is the type of arrays whose elements are of type Elem.
+type Array struct {
+	Elem Type
+}
+
+// Func is the type of functions, methods and enum variants with fields.
+type Func struct {
+	Params []Type
+	Result Type
+}
+
+// Struct is the type of the instances of a struct declared by the program.
+type Struct struct {
+	Name    string
+	Fields  []string
+	Methods map[string]*Func // without the receiver
+}
+
+// Enum is the type of the variants of an enum declared by the program.
+type Enum struct {
+	Name string
+}
+
+// Var is a type variable in the types inferred by [Infer]. It stands for
+// any type, or only for the types of its kinds if they are restricted: the
+// operands of + are ints or strings, the ones of == ints or bools and the
+// argument of len is a string or an array. Polymorphic types hold
+// variables, like fn('a): 'a, the type of fn(x) { x }.
+type Var struct {
+	Name string
+
+	kinds kinds // 0 for any type
+
+	// The fields below are used during inference.
+	inst  Type      // the type the variable is bound to, nil if unbound
+	level int       // depth of the let that created it, see [inferer.generalize]
+	pos   token.Pos // position of the expression that bound it
+
+	// fields are the fields selected from values of the variable before
+	// their type was known, which the type it is bound to must have.
+	fields []*fieldUse
+}
+
+// fieldUse is the selection of a field from a value of unknown type.
+type fieldUse struct {
+	name    *ast.Ident
+	typ     Type // type the field is used as
+	methods bool // methods are selected, too
+}
+
+// Named is the type of a struct or an enum declared by the program, as
+// inferred by [Infer]. Its arguments are the types of the fields of the
+// struct, or of the fields of all variants of the enum, in the order of
+// their declaration: an instance of struct P { x, y } holding an int and a
+// string is of type P(int, string).
+type Named struct {
+	Name string
+	Args []Type
+
+	decl *ast.Ident // name of the declaration, nil for the type of errors
+}
+
+// Result is the type of the results created by the builtins ok and err, as
+// inferred by [Infer].
+type Result struct {
+	Value Type
+	Error Type
+}
+
+// kinds is a set of kinds of types a [Var] may stand for.
+type kinds uint8
+
+const (
+	intKind kinds = 1 << iota
+	boolKind
+	stringKind
+	arrayKind
+)
+
+func (x kinds) String() string {
+	var names []string
+	for i, name := range []string{"int", "bool", "string", "array"} {
+		if x&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, " | ")
+}
+
+func (x Basic) typ()   {}
+func (x *Array) typ()  {}
+func (x *Func) typ()   {}
+func (x *Struct) typ() {}
+func (x *Enum) typ()   {}
+func (x *Var) typ()    {}
+func (x *Named) typ()  {}
+func (x *Result) typ() {}
+
+func (x Basic) String() string   { return typeString(x) }
+func (x *Array) String() string  { return typeString(x) }
+func (x *Func) String() string   { return typeString(x) }
+func (x *Struct) String() string { return typeString(x) }
+func (x *Enum) String() string   { return typeString(x) }
+func (x *Var) String() string    { return typeString(x) }
+func (x *Named) String() string  { return typeString(x) }
+func (x *Result) String() string { return typeString(x) }
+
+// typeString formats typ, followed by the kinds of its restricted type
+// variables: fn('a, 'a): 'a where 'a: int | string.
+func typeString(typ Type) string {
+	var b strings.Builder
+	var restricted []*Var
+	writeType(&b, typ, &restricted)
+	for i, v := range restricted {
+		if i == 0 {
+			b.WriteString(" where ")
+		} else {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%v: %v", v.Name, v.kinds)
+	}
+	return b.String()
+}
+
+func writeType(b *strings.Builder, typ Type, restricted *[]*Var) {
+	list := func(types ...Type) {
+		for i, t := range types {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeType(b, t, restricted)
+		}
+	}
+	switch t := typ.(type) {
+	case Basic:
+		b.WriteString(string(t))
+	case *Array:
+		b.WriteString("[")
+		writeType(b, t.Elem, restricted)
+		b.WriteString("]")
+	case *Func:
+		b.WriteString("fn(")
+		list(t.Params...)
+		b.WriteString("): ")
+		writeType(b, t.Result, restricted)
+	case *Struct:
+		b.WriteString(t.Name)
+	case *Enum:
+		b.WriteString(t.Name)
+	case *Var:
+		if t.inst != nil {
+			writeType(b, t.inst, restricted)
+			return
+		}
+		if t.kinds != 0 && !slices.Contains(*restricted, t) {
+			*restricted = append(*restricted, t)
+		}
+		b.WriteString(t.Name)
+	case *Named:
+		b.WriteString(t.Name)
+		if len(t.Args) > 0 {
+			b.WriteString("(")
+			list(t.Args...)
+			b.WriteString(")")
+		}
+	case *Result:
+		b.WriteString("result(")
+		list(t.Value, t.Error)
+		b.WriteString(")")
+	}
+}
+
+// consistent reports whether a value of type a may be used where a value of
+// type b is expected. [Any] is consistent with every type, otherwise the
+// types must be the same.
+func consistent(a, b Type) bool {
+	if a == Any || b == Any {
+		return true
+	}
+	switch a := a.(type) {
+	case *Array:
+		b, ok := b.(*Array)
+		return ok && consistent(a.Elem, b.Elem)
+	case *Func:
+		b, ok := b.(*Func)
+		if !ok || len(a.Params) != len(b.Params) {
+			return false
+		}
+		for i := range a.Params {
+			if !consistent(a.Params[i], b.Params[i]) {
+				return false
+			}
+		}
+		return consistent(a.Result, b.Result)
+	}
+	return a == b
+}
+
+// identical reports whether a and b are the same type.
+func identical(a, b Type) bool {
+	switch a := a.(type) {
+	case *Array:
+		b, ok := b.(*Array)
+		return ok && identical(a.Elem, b.Elem)
+	case *Func:
+		b, ok := b.(*Func)
+		if !ok || len(a.Params) != len(b.Params) {
+			return false
+		}
+		for i := range a.Params {
+			if !identical(a.Params[i], b.Params[i]) {
+				return false
+			}
+		}
+		return identical(a.Result, b.Result)
+	}
+	return a == b
+}
+
+// join returns the type of a value that is of type a or of type b.
+func join(a, b Type) Type {
+	if identical(a, b) {
+		return a
+	}
+	return Any
+}
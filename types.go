@@ -0,0 +1,88 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/tombuente/lily/ast"
+	"github.com/tombuente/lily/eval"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+	"github.com/tombuente/lily/resolver"
+	"github.com/tombuente/lily/token"
+	"github.com/tombuente/lily/typecheck"
+)
+
+// runTypes prints the inferred types of the names declared by the file in
+// args, or standard input if there is none, and the type errors found.
+func runTypes(args []string) error {
+	flags := flag.NewFlagSet("types", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: lily types [file]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var name string
+	var src []byte
+	var err error
+	switch flags.NArg() {
+	case 0:
+		name = "<standard input>"
+		src, err = io.ReadAll(os.Stdin)
+	case 1:
+		name = flags.Arg(0)
+		src, err = os.ReadFile(name)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		return err
+	}
+	return printTypes(os.Stdout, os.Stderr, name, string(src))
+}
+
+// printTypes writes the types of the names declared by src, read from
+// name, to out in the order of their declaration and its type errors to
+// errOut.
+func printTypes(out, errOut io.Writer, name, src string) error {
+	prog, err := parser.New(lexer.New(src)).Parse()
+	if err != nil {
+		return fmt.Errorf("%v: %w", name, err)
+	}
+	info, err := resolver.Resolve(prog, eval.New().Builtins())
+	if err != nil {
+		return fmt.Errorf("%v: %w", name, err)
+	}
+	types, err := typecheck.Infer(prog, info)
+
+	decls := make([]*ast.Ident, 0, len(types.Defs))
+	for ident := range types.Defs {
+		decls = append(decls, ident)
+	}
+	slices.SortFunc(decls, func(a, b *ast.Ident) int {
+		return cmp.Or(cmp.Compare(a.Pos().Line, b.Pos().Line), cmp.Compare(a.Pos().Column, b.Pos().Column))
+	})
+	for _, ident := range decls {
+		fmt.Fprintf(out, "%v:%v: %v: %v\n", name, ident.Pos(), ident.Value, types.Defs[ident])
+	}
+
+	var errs typecheck.ErrorList
+	if !errors.As(err, &errs) {
+		return nil
+	}
+	for _, err := range errs {
+		fmt.Fprintf(errOut, "%v:%v: %v", name, err.Pos, err.Msg)
+		if err.Related != (token.Pos{}) {
+			fmt.Fprintf(errOut, " (see %v)", err.Related)
+		}
+		fmt.Fprintln(errOut)
+	}
+	return errFindings
+}
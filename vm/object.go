@@ -0,0 +1,102 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/tombuente/lily/compiler"
+)
+
+type object interface {
+	Info() string
+}
+
+type builtinFunc func(args ...object) (object, error)
+
+type intObject struct {
+	value int64
+}
+
+type boolObject struct {
+	value bool
+}
+
+type stringObject struct {
+	value string
+}
+
+type closureObject struct {
+	fn       *compiler.Function
+	upvalues []*upvalue
+}
+
+// upvalue is a variable captured by a closure. While the variable's frame is
+// alive it refers to the stack slot, afterwards it holds the value itself.
+type upvalue struct {
+	name   string
+	slot   int
+	open   bool
+	closed object
+	next   *upvalue // next open upvalue, ordered by descending slot
+}
+
+type builtinFunctionObject struct {
+	fn builtinFunc
+}
+
+type nilObject struct{}
+
+type internalError struct {
+	msg string
+}
+
+type typeError struct {
+	msg string
+}
+
+type nameError struct {
+	msg string
+}
+
+type zeroDivisionError struct {
+	msg string
+}
+
+func (x *intObject) Info() string {
+	return "int"
+}
+
+func (x *boolObject) Info() string {
+	return "bool"
+}
+
+func (x *stringObject) Info() string {
+	return "string"
+}
+
+func (x *closureObject) Info() string {
+	return "function"
+}
+
+func (x *builtinFunctionObject) Info() string {
+	return "buildin function"
+}
+
+func (x *nilObject) Info() string {
+	return "nil"
+}
+
+func (x *internalError) Error() string {
+	return fmt.Sprintf("%v", x.msg)
+}
+
+func (x *typeError) Error() string {
+	return fmt.Sprintf("%v", x.msg)
+}
+
+func (x *nameError) Error() string {
+	return fmt.Sprintf("%v", x.msg)
+}
+
+func (x *zeroDivisionError) Error() string {
+	return fmt.Sprintf("%v", x.msg)
+}
@@ -0,0 +1,536 @@
+package vm
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/tombuente/lily/compiler"
+)
+
+const (
+	initialStackSize = 1024
+	maxFrames        = 1 << 20
+)
+
+var (
+	nilInstance   = &nilObject{}
+	trueInstance  = &boolObject{value: true}
+	falseInstance = &boolObject{value: false}
+)
+
+type frame struct {
+	cl   *closureObject
+	ip   int
+	base int // stack index of the first argument
+}
+
+type VM struct {
+	constants    []object
+	globals      []object
+	globalNames  []string
+	builtins     []*builtinFunctionObject // nil for builtins unknown to the VM
+	builtinNames []string
+
+	stack []object
+	sp    int // next free slot
+
+	frames       []frame
+	openUpvalues *upvalue
+}
+
+func New(bc *compiler.Bytecode) *VM {
+	constants := make([]object, len(bc.Constants))
+	for i, c := range bc.Constants {
+		switch c := c.(type) {
+		case compiler.Int:
+			constants[i] = &intObject{value: int64(c)}
+		case compiler.String:
+			constants[i] = &stringObject{value: string(c)}
+		case *compiler.Function:
+			constants[i] = &closureObject{fn: c}
+		}
+	}
+
+	builtins := make([]*builtinFunctionObject, len(bc.Builtins))
+	for i, name := range bc.Builtins {
+		builtins[i] = builtin[name]
+	}
+
+	vm := &VM{
+		constants:    constants,
+		globals:      make([]object, len(bc.Globals)),
+		globalNames:  bc.Globals,
+		builtins:     builtins,
+		builtinNames: bc.Builtins,
+		stack:        make([]object, initialStackSize),
+	}
+	vm.frames = append(vm.frames, frame{cl: &closureObject{fn: bc.Main}})
+	return vm
+}
+
+// Builtins returns the names of the builtins provided by the VM, to be passed
+// to [compiler.Compile].
+func Builtins() []string {
+	return slices.Collect(maps.Keys(builtin))
+}
+
+// Run executes bc and returns the value of the program.
+func Run(bc *compiler.Bytecode) (object, error) {
+	return New(bc).Run()
+}
+
+func (vm *VM) Run() (object, error) {
+	// The instruction pointer and the stack live in locals while a frame is
+	// running. The instruction pointer is written back to the frame and the
+	// stack pointer to the VM on calls and returns.
+	//
+	// Jumps only go forward, so a frame runs each of its instructions at
+	// most once and pushes at most one value per instruction. Frames get
+	// that much room on the stack when they start, and instructions push
+	// without checking for it.
+	fr := &vm.frames[len(vm.frames)-1]
+	ins := fr.cl.fn.Instructions
+	ip := fr.ip
+	vm.stack = grow(vm.stack, vm.sp+len(ins))
+	stack, sp := vm.stack, vm.sp
+
+	for {
+		op := compiler.Opcode(ins[ip])
+		ip++
+
+		switch op {
+		case compiler.OpConstant:
+			idx := compiler.ReadUint16(ins[ip:])
+			ip += 2
+			stack[sp] = vm.constants[idx]
+			sp++
+		case compiler.OpNil:
+			stack[sp] = nilInstance
+			sp++
+		case compiler.OpTrue:
+			stack[sp] = trueInstance
+			sp++
+		case compiler.OpFalse:
+			stack[sp] = falseInstance
+			sp++
+		case compiler.OpPop:
+			sp--
+
+		case compiler.OpAdd, compiler.OpSub, compiler.OpLess:
+			// Counting and recursion on ints skip binaryOp.
+			left, leftOk := stack[sp-2].(*intObject)
+			right, rightOk := stack[sp-1].(*intObject)
+			var res object
+			switch {
+			case !leftOk || !rightOk:
+				var err error
+				if res, err = binaryOp(op, stack[sp-2], stack[sp-1]); err != nil {
+					return nil, err
+				}
+			case op == compiler.OpAdd:
+				res = newInt(left.value + right.value)
+			case op == compiler.OpSub:
+				res = newInt(left.value - right.value)
+			default:
+				res = boolInstance(left.value < right.value)
+			}
+			sp--
+			stack[sp-1] = res
+		case compiler.OpAddConstant, compiler.OpSubConstant, compiler.OpLessConstant:
+			right := vm.constants[compiler.ReadUint16(ins[ip:])]
+			ip += 2
+			leftInt, leftOk := stack[sp-1].(*intObject)
+			rightInt, rightOk := right.(*intObject)
+			var res object
+			switch {
+			case !leftOk || !rightOk:
+				var err error
+				if res, err = binaryOp(plainOps[op], stack[sp-1], right); err != nil {
+					return nil, err
+				}
+			case op == compiler.OpAddConstant:
+				res = newInt(leftInt.value + rightInt.value)
+			case op == compiler.OpSubConstant:
+				res = newInt(leftInt.value - rightInt.value)
+			case compiler.Opcode(ins[ip]) == compiler.OpJumpIfFalse:
+				// Branch right away instead of pushing the condition.
+				if leftInt.value < rightInt.value {
+					ip += 3
+				} else {
+					ip = int(compiler.ReadUint16(ins[ip+1:]))
+				}
+				sp--
+				continue
+			default:
+				res = boolInstance(leftInt.value < rightInt.value)
+			}
+			stack[sp-1] = res
+		case compiler.OpMul, compiler.OpDiv, compiler.OpEQ, compiler.OpNotEQ, compiler.OpGreater:
+			res, err := binaryOp(op, stack[sp-2], stack[sp-1])
+			if err != nil {
+				return nil, err
+			}
+			sp--
+			stack[sp-1] = res
+		case compiler.OpMinus:
+			obj := stack[sp-1]
+			intObj, ok := obj.(*intObject)
+			if !ok {
+				return nil, &typeError{msg: fmt.Sprintf("bad operand type for unary -: '%v'", obj.Info())}
+			}
+			stack[sp-1] = newInt(-intObj.value)
+		case compiler.OpBang:
+			switch obj := stack[sp-1]; obj {
+			case trueInstance:
+				stack[sp-1] = falseInstance
+			case falseInstance:
+				stack[sp-1] = trueInstance
+			default:
+				return nil, &typeError{msg: fmt.Sprintf("bad operand type for unary !: '%v'", obj.Info())}
+			}
+
+		case compiler.OpJump:
+			ip = int(compiler.ReadUint16(ins[ip:]))
+		case compiler.OpJumpIfFalse:
+			sp--
+			switch obj := stack[sp]; obj {
+			case falseInstance:
+				ip = int(compiler.ReadUint16(ins[ip:]))
+			case trueInstance:
+				ip += 2
+			default:
+				return nil, &typeError{msg: fmt.Sprintf("if condition must evaluate to bool: '%v'", obj.Info())}
+			}
+
+		case compiler.OpGetGlobal:
+			idx := compiler.ReadUint16(ins[ip:])
+			ip += 2
+			obj := vm.globals[idx]
+			if obj == nil {
+				return nil, &nameError{msg: fmt.Sprintf("name '%v' not defined", vm.globalNames[idx])}
+			}
+			stack[sp] = obj
+			sp++
+		case compiler.OpSetGlobal:
+			idx := compiler.ReadUint16(ins[ip:])
+			ip += 2
+			if vm.globals[idx] == nil {
+				return nil, &nameError{msg: fmt.Sprintf("'%v' is not defined", vm.globalNames[idx])}
+			}
+			sp--
+			vm.globals[idx] = stack[sp]
+		case compiler.OpDefineGlobal:
+			idx := compiler.ReadUint16(ins[ip:])
+			ip += 2
+			sp--
+			vm.globals[idx] = stack[sp]
+
+		case compiler.OpGetLocal:
+			idx := int(ins[ip])
+			ip++
+			obj := stack[fr.base+idx]
+			if obj == nil {
+				return nil, &nameError{msg: fmt.Sprintf("name '%v' not defined", fr.cl.fn.Locals[idx])}
+			}
+			stack[sp] = obj
+			sp++
+		case compiler.OpSetLocal:
+			idx := int(ins[ip])
+			ip++
+			if stack[fr.base+idx] == nil {
+				return nil, &nameError{msg: fmt.Sprintf("'%v' is not defined", fr.cl.fn.Locals[idx])}
+			}
+			sp--
+			stack[fr.base+idx] = stack[sp]
+		case compiler.OpDefineLocal:
+			idx := int(ins[ip])
+			ip++
+			sp--
+			stack[fr.base+idx] = stack[sp]
+
+		case compiler.OpGetUpvalue:
+			up := fr.cl.upvalues[ins[ip]]
+			ip++
+			obj := getUpvalue(stack, up)
+			if obj == nil {
+				return nil, &nameError{msg: fmt.Sprintf("name '%v' not defined", up.name)}
+			}
+			stack[sp] = obj
+			sp++
+		case compiler.OpSetUpvalue:
+			up := fr.cl.upvalues[ins[ip]]
+			ip++
+			if getUpvalue(stack, up) == nil {
+				return nil, &nameError{msg: fmt.Sprintf("'%v' is not defined", up.name)}
+			}
+			sp--
+			if up.open {
+				stack[up.slot] = stack[sp]
+			} else {
+				up.closed = stack[sp]
+			}
+
+		case compiler.OpGetBuiltin:
+			idx := int(ins[ip])
+			ip++
+			b := vm.builtins[idx]
+			if b == nil {
+				return nil, &nameError{msg: fmt.Sprintf("builtin '%v' not available", vm.builtinNames[idx])}
+			}
+			stack[sp] = b
+			sp++
+
+		case compiler.OpClosure:
+			idx := compiler.ReadUint16(ins[ip:])
+			n := int(ins[ip+2])
+			ip += 3
+
+			fn := vm.constants[idx].(*closureObject).fn
+			cl := &closureObject{fn: fn, upvalues: make([]*upvalue, n)}
+			for i := range n {
+				local, index := ins[ip] == 1, int(ins[ip+1])
+				ip += 2
+				if local {
+					cl.upvalues[i] = vm.captureUpvalue(fr.base+index, fr.cl.fn.Locals[index])
+				} else {
+					cl.upvalues[i] = fr.cl.upvalues[index]
+				}
+			}
+			stack[sp] = cl
+			sp++
+
+		case compiler.OpCall, compiler.OpTailCall:
+			argc := int(ins[ip])
+			ip++
+			fr.ip = ip
+			if cl, ok := stack[sp-1-argc].(*closureObject); ok && op == compiler.OpCall && argc == cl.fn.NumParams && len(vm.frames) < maxFrames {
+				// The common case of call, entering a closure, is done
+				// here. Everything else, errors included, is left to it.
+				fn := cl.fn
+				base := sp - argc
+				top := base + len(fn.Locals)
+				if len(stack) < top+len(fn.Instructions) {
+					vm.stack = grow(stack, top+len(fn.Instructions))
+					stack = vm.stack
+				}
+				for ; sp < top; sp++ {
+					stack[sp] = nil
+				}
+				vm.frames = append(vm.frames, frame{cl: cl, base: base})
+				fr = &vm.frames[len(vm.frames)-1]
+				ins = fn.Instructions
+				ip = 0
+				continue
+			}
+			vm.stack, vm.sp = stack, sp
+			var err error
+			if op == compiler.OpCall {
+				err = vm.call(argc)
+			} else {
+				err = vm.tailCall(argc)
+			}
+			if err != nil {
+				return nil, err
+			}
+			stack, sp = vm.stack, vm.sp
+			fr = &vm.frames[len(vm.frames)-1]
+			ins = fr.cl.fn.Instructions
+			ip = fr.ip
+
+		case compiler.OpReturn:
+			res := stack[sp-1]
+			if vm.openUpvalues != nil {
+				vm.closeUpvalues(fr.base)
+			}
+			if len(vm.frames) == 1 {
+				vm.sp = sp - 1
+				return res, nil
+			}
+
+			sp = fr.base // drop arguments, locals and the callee, then push res
+			stack[sp-1] = res
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			fr = &vm.frames[len(vm.frames)-1]
+			ins = fr.cl.fn.Instructions
+			ip = fr.ip
+
+		default:
+			return nil, &internalError{msg: fmt.Sprintf("unknown opcode %v", op)}
+		}
+	}
+}
+
+func (vm *VM) call(argc int) error {
+	callee := vm.stack[vm.sp-1-argc]
+	switch callee := callee.(type) {
+	case *closureObject:
+		fn := callee.fn
+		if argc != fn.NumParams {
+			return &typeError{msg: fmt.Sprintf("'%v' takes %v argument(s), got %v", fn.Name, fn.NumParams, argc)}
+		}
+		if len(vm.frames) == maxFrames {
+			return &internalError{msg: "maximum call depth exceeded"}
+		}
+
+		base := vm.sp - argc
+		top := base + len(fn.Locals)
+		vm.stack = grow(vm.stack, top+len(fn.Instructions))
+		clear(vm.stack[vm.sp:top])
+		vm.sp = top
+		vm.frames = append(vm.frames, frame{cl: callee, base: base})
+		return nil
+	case *builtinFunctionObject:
+		args := make([]object, argc)
+		copy(args, vm.stack[vm.sp-argc:vm.sp])
+		res, err := callee.fn(args...)
+		if err != nil {
+			return err
+		}
+		vm.sp -= argc
+		vm.stack[vm.sp-1] = res
+		return nil
+	}
+	return &typeError{msg: fmt.Sprintf("'%v' is not callable", callee.Info())}
+}
+
+// tailCall calls a closure in place of the running frame. Other callables
+// are called as usual.
+func (vm *VM) tailCall(argc int) error {
+	if _, ok := vm.stack[vm.sp-1-argc].(*closureObject); !ok {
+		return vm.call(argc)
+	}
+
+	fr := &vm.frames[len(vm.frames)-1]
+	vm.closeUpvalues(fr.base)
+	copy(vm.stack[fr.base-1:], vm.stack[vm.sp-1-argc:vm.sp])
+	vm.sp = fr.base + argc
+	vm.frames = vm.frames[:len(vm.frames)-1]
+	return vm.call(argc)
+}
+
+func (vm *VM) captureUpvalue(slot int, name string) *upvalue {
+	var prev *upvalue
+	up := vm.openUpvalues
+	for up != nil && up.slot > slot {
+		prev = up
+		up = up.next
+	}
+	if up != nil && up.slot == slot {
+		return up
+	}
+
+	created := &upvalue{slot: slot, open: true, name: name, next: up}
+	if prev == nil {
+		vm.openUpvalues = created
+	} else {
+		prev.next = created
+	}
+	return created
+}
+
+// closeUpvalues moves all captured variables at or above slot off the stack.
+func (vm *VM) closeUpvalues(slot int) {
+	for vm.openUpvalues != nil && vm.openUpvalues.slot >= slot {
+		up := vm.openUpvalues
+		up.closed = vm.stack[up.slot]
+		up.open = false
+		vm.openUpvalues = up.next
+	}
+}
+
+func getUpvalue(stack []object, up *upvalue) object {
+	if up.open {
+		return stack[up.slot]
+	}
+	return up.closed
+}
+
+// grow returns stack or a copy of it that can hold at least size objects.
+func grow(stack []object, size int) []object {
+	if size <= len(stack) {
+		return stack
+	}
+	grown := make([]object, max(size, 2*len(stack)))
+	copy(grown, stack)
+	return grown
+}
+
+// plainOps maps the binary operations with a constant operand to the ones
+// without.
+var plainOps = map[compiler.Opcode]compiler.Opcode{
+	compiler.OpAddConstant:  compiler.OpAdd,
+	compiler.OpSubConstant:  compiler.OpSub,
+	compiler.OpLessConstant: compiler.OpLess,
+}
+
+func binaryOp(op compiler.Opcode, left, right object) (object, error) {
+	leftInt, leftOk := left.(*intObject)
+	rightInt, rightOk := right.(*intObject)
+	if leftOk && rightOk {
+		switch op {
+		case compiler.OpAdd:
+			return newInt(leftInt.value + rightInt.value), nil
+		case compiler.OpSub:
+			return newInt(leftInt.value - rightInt.value), nil
+		case compiler.OpMul:
+			return newInt(leftInt.value * rightInt.value), nil
+		case compiler.OpDiv:
+			if rightInt.value == 0 {
+				return nil, &zeroDivisionError{msg: "division by zero"}
+			}
+			return newInt(leftInt.value / rightInt.value), nil
+		case compiler.OpLess:
+			return boolInstance(leftInt.value < rightInt.value), nil
+		case compiler.OpGreater:
+			return boolInstance(leftInt.value > rightInt.value), nil
+		case compiler.OpEQ:
+			return boolInstance(leftInt.value == rightInt.value), nil
+		case compiler.OpNotEQ:
+			return boolInstance(leftInt.value != rightInt.value), nil
+		}
+	}
+
+	leftBool, leftOk := left.(*boolObject)
+	rightBool, rightOk := right.(*boolObject)
+	if leftOk && rightOk {
+		switch op {
+		case compiler.OpEQ:
+			return boolInstance(leftBool.value == rightBool.value), nil
+		case compiler.OpNotEQ:
+			return boolInstance(leftBool.value != rightBool.value), nil
+		}
+	}
+
+	leftString, leftOk := left.(*stringObject)
+	rightString, rightOk := right.(*stringObject)
+	if leftOk && rightOk && op == compiler.OpAdd {
+		return &stringObject{value: leftString.value + rightString.value}, nil
+	}
+
+	return nil, &typeError{msg: fmt.Sprintf("unsupported operand type(s) for '%v': '%v' '%v'", compiler.BinaryOperator(op), left.Info(), right.Info())}
+}
+
+// smallInts caches the integers most programs count with so that arithmetic
+// on them does not allocate.
+var smallInts = func() [1024]intObject {
+	var ints [1024]intObject
+	for i := range ints {
+		ints[i].value = int64(i)
+	}
+	return ints
+}()
+
+func newInt(val int64) *intObject {
+	if 0 <= val && val < int64(len(smallInts)) {
+		return &smallInts[val]
+	}
+	return &intObject{value: val}
+}
+
+func boolInstance(val bool) object {
+	if val {
+		return trueInstance
+	}
+	return falseInstance
+}
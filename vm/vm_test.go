@@ -0,0 +1,326 @@
+package vm
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/tombuente/lily/compiler"
+	"github.com/tombuente/lily/lexer"
+	"github.com/tombuente/lily/parser"
+	"github.com/tombuente/lily/resolver"
+)
+
+type vmTest struct {
+	name     string
+	src      string
+	expected object
+}
+
+type errorTest struct {
+	name string
+	src  string
+}
+
+// The cases mirror the eval package so that both backends are held to the
+// same results.
+func TestRun(t *testing.T) {
+	tests := []vmTest{
+		{src: "1", expected: &intObject{value: 1}},
+		{src: "-1", expected: &intObject{value: -1}},
+		{src: "1 + 1", expected: &intObject{value: 2}},
+		{src: "1 - 1", expected: &intObject{value: 0}},
+		{src: "3 * 3", expected: &intObject{value: 9}},
+		{src: "9 / 3", expected: &intObject{value: 3}},
+		{src: "2 + 3 * 4", expected: &intObject{value: 14}},
+		{src: "(2 + 3) * 4", expected: &intObject{value: 20}},
+		{src: "2 > 1", expected: trueInstance},
+		{src: "1 > 1", expected: falseInstance},
+		{src: "1 < 2", expected: trueInstance},
+		{src: "1 < 1", expected: falseInstance},
+		{src: "1 == 1", expected: trueInstance},
+		{src: "1 == 2", expected: falseInstance},
+		{src: "1 != 2", expected: trueInstance},
+		{src: "1 != 1", expected: falseInstance},
+		{src: "true", expected: trueInstance},
+		{src: "false", expected: falseInstance},
+		{src: "!true", expected: falseInstance},
+		{src: "!false", expected: trueInstance},
+		{src: "!!true", expected: trueInstance},
+		{src: "true == true", expected: trueInstance},
+		{src: "if (true) { 10 }", expected: &intObject{value: 10}},
+		{src: "if (false) { 10 }", expected: nilInstance},
+		{src: "if (false) { 10 } { 20 }", expected: &intObject{value: 20}},
+		{src: "if (1 < 2) { 10 } { 20 }", expected: &intObject{value: 10}},
+		{src: "if (2 < 1) { 10 } { 20 }", expected: &intObject{value: 20}},
+		{src: "let n = 3; n - 1 < n + 1", expected: trueInstance},
+		{src: "1; return 2; 3;", expected: &intObject{value: 2}},
+		{
+			name: "return first return expr",
+			src: `
+				if (10 > 1) {
+					if (10 > 1) {
+						return 10;
+					}
+					return 1;
+				}`,
+			expected: &intObject{value: 10},
+		},
+		{src: "let x = 5; x;", expected: &intObject{value: 5}},
+		{src: "let add = fn(x, y) { x+y }; add(1, 2);", expected: &intObject{value: 3}},
+		{src: "let add = fn(x, y) { x+y }; add(3, add(1, 2));", expected: &intObject{value: 6}},
+		{
+			name: "env capture",
+			src: `
+				let outer = 5;
+				let funnyAdd = fn(x) {
+					return outer + x;
+				}
+				funnyAdd(5);`,
+			expected: &intObject{value: 10},
+		},
+		{
+			name: "assignment",
+			src:  "let x = 5; x = 10; x", expected: &intObject{value: 10},
+		},
+		{
+			name: "mutate captured env",
+			src: `
+				let outer = 5;
+				let mutate = fn() {
+					outer = 10;
+				};
+				let funnyAdd = fn(x) {
+					return outer + x;
+				}
+				mutate();
+				funnyAdd(5);`,
+			expected: &intObject{value: 15},
+		},
+		{
+			src:      `let x = "tom"; x`,
+			expected: &stringObject{value: "tom"},
+		},
+		{
+			name:     "string concatenation",
+			src:      `let x = "hello" + " " + "world"; x`,
+			expected: &stringObject{value: "hello world"},
+		},
+	}
+
+	test(t, tests)
+}
+
+func TestBuiltin(t *testing.T) {
+	tests := []vmTest{
+		{src: `len("123")`, expected: &intObject{value: 3}},
+		{name: "override len", src: `let len = fn(x) { 1 }; len("123")`, expected: &intObject{value: 1}},
+	}
+
+	test(t, tests)
+}
+
+func TestTypeError(t *testing.T) {
+	tests := []errorTest{
+		{src: "-true"},
+		{src: "!1"},
+		{src: "1 > true; 1"},
+		{src: `"a" - 1`},
+		{src: "if (true < 1) { 1 }"},
+		{name: "nested type error", src: "true == (1 > true); 1"},
+	}
+
+	testError[*typeError](t, tests)
+}
+
+func TestNameError(t *testing.T) {
+	tests := []errorTest{
+		{name: "test double declaration", src: "let x = 5; let x = 6;"},
+		{name: "x undefined", src: "x = 5;"},
+	}
+
+	testError[resolver.ErrorList](t, tests)
+}
+
+func test(t *testing.T, tests []vmTest) {
+	t.Helper()
+	for _, tt := range tests {
+		name := tt.name
+		if name == "" {
+			name = tt.src
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Helper()
+			res, err := runHelper(t, tt.src)
+			if err != nil {
+				t.Fatalf("Failed with error: %v", err)
+			}
+			if !reflect.DeepEqual(res, tt.expected) {
+				t.Fatalf("want=%v, got=%v", tt.expected, res)
+			}
+		})
+	}
+}
+
+func testError[T error](t *testing.T, tests []errorTest) {
+	t.Helper()
+	for _, tt := range tests {
+		name := tt.name
+		if name == "" {
+			name = tt.src
+		}
+		t.Run(name, func(t *testing.T) {
+			t.Helper()
+			_, err := runHelper(t, tt.src)
+			if err == nil {
+				t.Fatalf("Expected error")
+			}
+			var asErr T
+			if !errors.As(err, &asErr) {
+				t.Fatalf("want=%v, got=%v", asErr, err)
+			}
+		})
+	}
+}
+
+func TestZeroDivisionError(t *testing.T) {
+	testError[*zeroDivisionError](t, []errorTest{{src: "1 / 0"}, {src: "let f = fn(x) { 1 / x }; f(0)"}})
+}
+
+func TestClosures(t *testing.T) {
+	tests := []vmTest{
+		{
+			name: "counter",
+			src: `
+				let counter = fn() {
+					let n = 0;
+					fn() { n = n + 1; n }
+				};
+				let c = counter();
+				c(); c(); c();`,
+			expected: &intObject{value: 3},
+		},
+		{
+			name: "nested capture",
+			src: `
+				let a = fn(x) {
+					fn(y) {
+						fn(z) { x + y + z }
+					}
+				};
+				a(1)(2)(3);`,
+			expected: &intObject{value: 6},
+		},
+		{
+			name: "local recursion",
+			src: `
+				let f = fn() {
+					let fib = fn(n) { if (n < 2) { return n }; fib(n - 1) + fib(n - 2) };
+					fib(10)
+				};
+				f();`,
+			expected: &intObject{value: 55},
+		},
+		{
+			name: "shared capture",
+			src: `
+				let pair = fn() {
+					let n = 0;
+					let inc = fn() { n = n + 1 };
+					let get = fn() { n };
+					inc(); inc();
+					get()
+				};
+				pair();`,
+			expected: &intObject{value: 2},
+		},
+	}
+
+	test(t, tests)
+}
+
+func TestTailCall(t *testing.T) {
+	tests := []vmTest{
+		{
+			name: "countdown",
+			src: `
+				let countdown = fn(n) { if (n == 0) { return 0 }; countdown(n - 1) };
+				countdown(10000000);`,
+			expected: &intObject{value: 0},
+		},
+		{
+			name: "mutual recursion",
+			src: `
+				let even = fn(n) { if (n == 0) { true } { odd(n - 1) } };
+				let odd = fn(n) { if (n == 0) { return false }; return even(n - 1) };
+				even(2000001);`,
+			expected: falseInstance,
+		},
+		{
+			name:     "tail call to builtin",
+			src:      `let f = fn(s) { len(s) }; f("abc")`,
+			expected: &intObject{value: 3},
+		},
+		{
+			name: "closure over tail called frame",
+			src: `
+				let f = fn(n, g) { if (n == 0) { g() } { f(n - 1, fn() { n }) } };
+				f(3, fn() { 0 });`,
+			expected: &intObject{value: 1},
+		},
+	}
+
+	test(t, tests)
+}
+
+func TestArity(t *testing.T) {
+	tests := []errorTest{
+		{src: "let f = fn(x) { x }; f()"},
+		{src: "let f = fn(x) { x }; f(1, 2)"},
+	}
+
+	testError[*typeError](t, tests)
+}
+
+const fibSrc = `
+	let fib = fn(n) {
+		if (n < 2) { return n };
+		fib(n - 1) + fib(n - 2)
+	};
+	fib(20);`
+
+// BenchmarkFib measures the cost of calls, on the program of eval's
+// BenchmarkFib.
+func BenchmarkFib(b *testing.B) {
+	prog, err := parser.New(lexer.New(fibSrc)).Parse()
+	if err != nil {
+		b.Fatalf("Failed to parse program: %v", err)
+	}
+	bc, err := compiler.Compile(prog, Builtins())
+	if err != nil {
+		b.Fatalf("Failed to compile program: %v", err)
+	}
+
+	for b.Loop() {
+		if _, err := Run(bc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// runHelper parses, compiles and runs the given source code, returning the
+// result. It fails the test on parsing errors.
+func runHelper(t *testing.T, src string) (object, error) {
+	t.Helper()
+	l := lexer.New(src)
+	p := parser.New(l)
+	prog, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Failed to parse program: %v", err)
+	}
+	bc, err := compiler.Compile(prog, Builtins())
+	if err != nil {
+		return nil, err
+	}
+	return Run(bc)
+}